@@ -1,13 +1,22 @@
 package main
 
 import (
+	"github.com/clintharrison/go-kindle-pkg/pkg/cli/cat"
+	"github.com/clintharrison/go-kindle-pkg/pkg/cli/createdelta"
 	"github.com/clintharrison/go-kindle-pkg/pkg/cli/createkpkg"
+	"github.com/clintharrison/go-kindle-pkg/pkg/cli/diff"
+	"github.com/clintharrison/go-kindle-pkg/pkg/cli/exportzip"
 	"github.com/clintharrison/go-kindle-pkg/pkg/cli/extract"
+	"github.com/clintharrison/go-kindle-pkg/pkg/cli/importzip"
 	"github.com/clintharrison/go-kindle-pkg/pkg/cli/install"
 	"github.com/clintharrison/go-kindle-pkg/pkg/cli/launch"
+	"github.com/clintharrison/go-kindle-pkg/pkg/cli/lint"
 	"github.com/clintharrison/go-kindle-pkg/pkg/cli/list"
+	"github.com/clintharrison/go-kindle-pkg/pkg/cli/ls"
+	"github.com/clintharrison/go-kindle-pkg/pkg/cli/recovery"
 	"github.com/clintharrison/go-kindle-pkg/pkg/cli/reloadmenu"
 	"github.com/clintharrison/go-kindle-pkg/pkg/cli/resolve"
+	"github.com/clintharrison/go-kindle-pkg/pkg/cli/verify"
 	"github.com/clintharrison/go-kindle-pkg/pkg/version"
 	"github.com/spf13/cobra"
 )
@@ -20,6 +29,11 @@ func NewRootCmd() *cobra.Command {
 			HiddenDefaultCmd: true,
 		},
 		SilenceUsage: true,
+		PersistentPreRun: func(cmd *cobra.Command, _ []string) {
+			if cmd.Name() != "recover" {
+				recovery.WarnIfInterrupted(cmd)
+			}
+		},
 	}
 
 	cmd.PersistentFlags().String("install-dir", version.BaseDir()+"/pkgs", "Directory for unpacked apps and libraries")
@@ -28,14 +42,24 @@ func NewRootCmd() *cobra.Command {
 	cmd.PersistentFlags().StringArrayP("repo", "r", []string{},
 		"Repository URL(s) to use (can be specified multiple times)")
 
+	cmd.AddCommand(cat.NewCommand())
+	cmd.AddCommand(createdelta.NewCommand())
 	cmd.AddCommand(createkpkg.NewCommand())
+	cmd.AddCommand(diff.NewCommand())
+	cmd.AddCommand(exportzip.NewCommand())
 	cmd.AddCommand(extract.NewCommand())
+	cmd.AddCommand(importzip.NewCommand())
+	cmd.AddCommand(install.NewAutoremoveCommand())
 	cmd.AddCommand(install.NewInstallCommand())
 	cmd.AddCommand(install.NewUninstallCommand())
 	cmd.AddCommand(launch.NewCommand())
+	cmd.AddCommand(lint.NewCommand())
 	cmd.AddCommand(list.NewCommand())
+	cmd.AddCommand(ls.NewCommand())
+	cmd.AddCommand(recovery.NewCommand())
 	cmd.AddCommand(reloadmenu.NewCommand())
 	cmd.AddCommand(resolve.NewCommand())
+	cmd.AddCommand(verify.NewCommand())
 
 	return cmd
 }
@@ -3,6 +3,7 @@ module github.com/clintharrison/go-kindle-pkg
 go 1.24.6
 
 require (
+	github.com/klauspost/compress v1.18.0
 	github.com/lmittmann/tint v1.1.2
 	github.com/mattn/go-gtk v0.0.0-20240119050609-48574e312fac
 	github.com/pingcap/errors v0.11.4
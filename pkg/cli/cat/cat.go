@@ -0,0 +1,50 @@
+package cat
+
+import (
+	"io"
+
+	"github.com/clintharrison/go-kindle-pkg/pkg/cli/clicommon"
+	"github.com/clintharrison/go-kindle-pkg/pkg/kpkg"
+	"github.com/pingcap/errors"
+	"github.com/spf13/cobra"
+)
+
+func NewCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "cat [flags] example.kpkg path/in/package...",
+		Short: "Print files from a .kpkg file without extracting it",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := cmd.Context()
+			if len(args) < 2 {
+				_ = cmd.Usage()
+				_, _ = cmd.OutOrStderr().Write([]byte("\n"))
+				return errors.New("a .kpkg file and at least one path in it must be specified")
+			}
+			packagePath := args[0]
+
+			pkg, err := kpkg.Open(ctx, packagePath)
+			if err != nil {
+				return errors.Wrapf(err, "kpkg.Open(%q)", packagePath)
+			}
+			defer func() { _ = pkg.Close() }()
+			fsys, err := pkg.FS(ctx)
+			if err != nil {
+				return errors.Wrapf(err, "reading %q", packagePath)
+			}
+
+			for _, name := range args[1:] {
+				f, err := fsys.Open(clicommon.PackagePath(name))
+				if err != nil {
+					return errors.AddStack(err)
+				}
+				_, err = io.Copy(cmd.OutOrStdout(), f)
+				_ = f.Close()
+				if err != nil {
+					return errors.Wrapf(err, "reading %q", name)
+				}
+			}
+			return nil
+		},
+	}
+	return cmd
+}
@@ -0,0 +1,36 @@
+package cat_test
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/clintharrison/go-kindle-pkg/pkg/cli/cat"
+	"github.com/clintharrison/go-kindle-pkg/pkg/kpkg"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCatCmd(t *testing.T) {
+	t.Parallel()
+
+	const manifest = `{"id": "hello", "name": "Hello", "version": [1, 0, 0]}`
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "manifest.json"), []byte(manifest), 0o644))  //nolint:gosec
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "hello.sh"), []byte("echo hello\n"), 0o755)) //nolint:gosec
+	p := filepath.Join(t.TempDir(), "hello.kpkg")
+	require.NoError(t, kpkg.Build(t.Context(), dir, p, kpkg.WithZstdCompression))
+
+	cmd := cat.NewCommand()
+	out := new(bytes.Buffer)
+	cmd.SetOut(out)
+	cmd.SetArgs([]string{p, "./manifest.json", "hello.sh"})
+	require.NoError(t, cmd.Execute())
+	require.Equal(t, manifest+"echo hello\n", out.String())
+
+	cmd = cat.NewCommand()
+	cmd.SetOut(new(bytes.Buffer))
+	cmd.SetErr(new(bytes.Buffer))
+	cmd.SetArgs([]string{p, "missing.sh"})
+	require.Error(t, cmd.Execute())
+}
@@ -4,20 +4,34 @@ import (
 	"fmt"
 
 	"github.com/clintharrison/go-kindle-pkg/pkg/repository"
+	"github.com/clintharrison/go-kindle-pkg/pkg/repository/manifest"
 	"github.com/clintharrison/go-kindle-pkg/pkg/resolver"
+	"github.com/clintharrison/go-kindle-pkg/pkg/state"
 	"github.com/pingcap/errors"
 	"github.com/spf13/cobra"
 )
 
-func GetRepoFromArgs(cmd *cobra.Command) (*repository.MultiRepository, error) {
+// GetRepoFromArgs opens the repositories given with --repo. With withDeltaCache, packages are
+// downloaded through --download-dir, and kept there for later upgrades to download as deltas;
+// only commands that install packages should ask for it.
+func GetRepoFromArgs(cmd *cobra.Command, withDeltaCache bool) (*repository.MultiRepository, error) {
 	repoURLs, err := cmd.Flags().GetStringArray("repo")
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to get repo URLs")
 	}
 
+	var httpOpts []repository.HTTPOption
+	if withDeltaCache {
+		downloadDir, err := cmd.Flags().GetString("download-dir")
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to get download dir")
+		}
+		httpOpts = append(httpOpts, repository.WithDeltaCache(downloadDir, installedVersion))
+	}
+
 	var rs []repository.Repository
 	for _, url := range repoURLs {
-		r, err := repository.NewHTTPRepository(url)
+		r, err := repository.NewHTTPRepository(url, httpOpts...)
 		if err != nil {
 			fmt.Fprintf(cmd.OutOrStderr(), //nolint:errcheck
 				"ERROR: Unable to create repository for URL %s:\n%v\n",
@@ -30,8 +44,18 @@ func GetRepoFromArgs(cmd *cobra.Command) (*repository.MultiRepository, error) {
 	return repo, nil
 }
 
+// installedVersion looks up the installed version of a package, for a repository to download a
+// delta from it.
+func installedVersion(id string) (manifest.SemanticVersion, bool) {
+	installed, err := state.GetInstalledPackages()
+	if err != nil || len(installed[id]) == 0 {
+		return manifest.SemanticVersion{}, false //nolint:exhaustruct
+	}
+	return installed[id][0].Version, true
+}
+
 func GetInitializedResolver(cmd *cobra.Command) (*resolver.Resolver, error) {
-	repo, err := GetRepoFromArgs(cmd)
+	repo, err := GetRepoFromArgs(cmd, false)
 	if err != nil {
 		return nil, err
 	}
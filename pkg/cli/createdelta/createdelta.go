@@ -0,0 +1,124 @@
+package createdelta
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/clintharrison/go-kindle-pkg/pkg/kpkg"
+	"github.com/clintharrison/go-kindle-pkg/pkg/repository/manifest"
+	"github.com/pingcap/errors"
+	"github.com/spf13/cobra"
+)
+
+func NewCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "create-delta [flags] old.kpkg new.kpkg",
+		Short: "Create a delta that updates old.kpkg to new.kpkg",
+		Long: `Create a delta that updates old.kpkg to new.kpkg, for a repository to publish alongside
+new.kpkg. Clients with the old version installed download the delta instead, and fall back to
+new.kpkg if the result doesn't match it exactly.
+
+The entry to add to the new artifact's "deltas" in repository.json is printed, with the delta's
+file name as its URL: replace it with the URL the delta is uploaded to. It includes the digest of
+new.kpkg's payload, which clients check the rebuilt package against.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := cmd.Context()
+			if len(args) != 2 {
+				_ = cmd.Usage()
+				_, _ = cmd.OutOrStderr().Write([]byte("\n"))
+				return errors.Errorf("exactly two .kpkg files must be specified, got %d", len(args))
+			}
+			oldPath, newPath := args[0], args[1]
+
+			output, err := cmd.Flags().GetString("output")
+			if err != nil {
+				return errors.AddStack(err)
+			}
+
+			old, err := kpkg.Open(ctx, oldPath)
+			if err != nil {
+				return errors.Wrapf(err, "kpkg.Open(%q)", oldPath)
+			}
+			oldVersion := old.Manifest.Version
+			_ = old.Close()
+			// clients check what they rebuild against the digest in the repository entry
+			newPayloadSHA256, err := payloadSHA256(cmd, newPath)
+			if err != nil {
+				return err
+			}
+
+			if output == "" {
+				output = strings.TrimSuffix(newPath, filepath.Ext(newPath)) +
+					"_from_" + oldVersion.String() + kpkg.DeltaSuffix
+			}
+
+			err = writeDelta(cmd, oldPath, newPath, output)
+			if err != nil {
+				return err
+			}
+
+			oldInfo, err := os.Stat(oldPath)
+			if err != nil {
+				return errors.AddStack(err)
+			}
+			newInfo, err := os.Stat(newPath)
+			if err != nil {
+				return errors.AddStack(err)
+			}
+			deltaInfo, err := os.Stat(output)
+			if err != nil {
+				return errors.AddStack(err)
+			}
+
+			out := cmd.OutOrStdout()
+			fmt.Fprintf(out, "Created %s (%d bytes; %s is %d bytes, %s is %d bytes)\n", //nolint:errcheck
+				output, deltaInfo.Size(), oldPath, oldInfo.Size(), newPath, newInfo.Size())
+			entry, err := json.Marshal(&manifest.Delta{
+				From: oldVersion, URL: filepath.Base(output), PayloadSHA256: newPayloadSHA256,
+			})
+			if err != nil {
+				return errors.AddStack(err)
+			}
+			fmt.Fprintf(out, "\nRepository entry:\n%s\n", entry) //nolint:errcheck
+			return nil
+		},
+	}
+
+	cmd.Flags().StringP("output", "o", "",
+		"Output delta file (default: the new package's path with _from_<old version>"+kpkg.DeltaSuffix+")")
+
+	return cmd
+}
+
+func payloadSHA256(cmd *cobra.Command, p string) (string, error) {
+	k, err := kpkg.Open(cmd.Context(), p)
+	if err != nil {
+		return "", errors.Wrapf(err, "kpkg.Open(%q)", p)
+	}
+	defer k.Close() //nolint:errcheck
+	_, sum, err := k.Digests(cmd.Context())
+	if err != nil {
+		return "", errors.Wrapf(err, "hashing %q", p)
+	}
+	return sum, nil
+}
+
+func writeDelta(cmd *cobra.Command, oldPath, newPath, output string) error {
+	f, err := os.Create(output)
+	if err != nil {
+		return errors.Wrapf(err, "os.Create(%q)", output)
+	}
+	err = kpkg.CreateDelta(cmd.Context(), oldPath, newPath, f)
+	cerr := f.Close()
+	if err == nil {
+		err = cerr
+	}
+	if err != nil {
+		_ = os.Remove(output)
+		return errors.Wrapf(err, "creating delta from %q to %q", oldPath, newPath)
+	}
+	return nil
+}
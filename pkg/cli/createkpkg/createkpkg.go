@@ -1,12 +1,17 @@
 package createkpkg
 
 import (
+	"encoding/json"
 	"fmt"
 	"os"
 	"path"
 	"path/filepath"
+	"slices"
+	"strings"
 
 	"github.com/clintharrison/go-kindle-pkg/pkg/kpkg"
+	"github.com/clintharrison/go-kindle-pkg/pkg/repository/manifest"
+	"github.com/clintharrison/go-kindle-pkg/pkg/resolver"
 	"github.com/pingcap/errors"
 	"github.com/spf13/cobra"
 )
@@ -15,6 +20,14 @@ func NewCommand() *cobra.Command {
 	cmd := &cobra.Command{
 		Use:   "create-kpkg [flags] <input-directory>",
 		Short: "Create a .kpkg file",
+		Long: "Create a .kpkg file from a directory containing a manifest.json.\n\n" +
+			"If the directory also has a " + kpkg.BuildSpecFileName + ", it can map in files from elsewhere, " +
+			"exclude paths by glob and override modes, e.g.:\n\n" +
+			"  {\"files\": [{\"src\": \"../build/bin\", \"dest\": \"bin\"}],\n" +
+			"   \"exclude\": [\".git\", \"*~\"],\n" +
+			"   \"modes\": [{\"pattern\": \"bin/*\", \"mode\": \"0755\"}]}\n\n" +
+			"ELF binaries in the package are checked against the manifest's supported_arch (armel or armhf), " +
+			"which is filled in from them if it's empty.",
 		RunE: func(cmd *cobra.Command, args []string) error {
 			output, err := cmd.Flags().GetString("output")
 			if err != nil {
@@ -48,10 +61,230 @@ func NewCommand() *cobra.Command {
 				output = base + ".kpkg"
 			}
 
-			return kpkg.Build(cmd.Context(), inputDir, output)
+			compression, err := cmd.Flags().GetString("compression")
+			if err != nil {
+				return errors.AddStack(err)
+			}
+			c, err := kpkg.ParseCompression(compression)
+			if err != nil {
+				return errors.Annotate(err, "invalid compression flag")
+			}
+			level, err := cmd.Flags().GetInt("compression-level")
+			if err != nil {
+				return errors.AddStack(err)
+			}
+
+			buildOpts := []kpkg.BuildOption{kpkg.WithCompression(c), kpkg.WithCompressionLevel(level)}
+			m, err := manifestFromFlags(cmd, inputDir)
+			if err != nil {
+				return err
+			}
+			if m != nil {
+				buildOpts = append(buildOpts, kpkg.WithManifest(m))
+			}
+			skipArchCheck, err := cmd.Flags().GetBool("skip-arch-check")
+			if err != nil {
+				return errors.AddStack(err)
+			}
+			if skipArchCheck {
+				buildOpts = append(buildOpts, kpkg.WithSkipArchCheck())
+			}
+			err = kpkg.Build(cmd.Context(), inputDir, output, buildOpts...)
+			if err != nil {
+				return errors.Wrapf(err, "kpkg.Build(%q)", inputDir)
+			}
+
+			err = checkReproducible(cmd, inputDir, output, buildOpts)
+			if err != nil {
+				return err
+			}
+
+			signKey, err := cmd.Flags().GetString("sign-key")
+			if err != nil {
+				return errors.AddStack(err)
+			}
+			if signKey == "" {
+				return nil
+			}
+			priv, err := kpkg.LoadPrivateKey(signKey)
+			if err != nil {
+				return errors.Wrap(err, "failed to load signing key")
+			}
+			sig, err := kpkg.SignFile(cmd.Context(), output, priv)
+			if err != nil {
+				return errors.Wrapf(err, "failed to sign %q", output)
+			}
+			_, _ = fmt.Fprintf(cmd.OutOrStdout(), "Signed %s with key %s\n", output, sig.KeyID)
+			return nil
 		},
 	}
 	cmd.Flags().StringP("output", "o", "", "Output .kpkg file path")
+	cmd.Flags().StringP("compression", "c", string(kpkg.CompressionNone),
+		fmt.Sprintf("Payload compression, one of %v", kpkg.Compressions()))
+	cmd.Flags().Int("compression-level", 0,
+		"Compression level: 1-9 for gzip, 1-22 for zstd (default is the codec's default)")
+	cmd.Flags().String("manifest-template", "",
+		"manifest.json to start from, instead of the one in the input directory")
+	cmd.Flags().String("id", "", "Set the manifest's package ID")
+	cmd.Flags().String("name", "", "Set the manifest's name (defaults to the ID)")
+	cmd.Flags().String("author", "", "Set the manifest's author")
+	cmd.Flags().String("description", "", "Set the manifest's description")
+	cmd.Flags().String("version", "", "Set the manifest's version, e.g. 1.2.3 or v1.2.3")
+	cmd.Flags().StringArray("depends", nil,
+		"Add or replace a dependency, e.g. 'kterm>=2.6' or 'koreader>=1.0,<2' (repeatable)")
+	cmd.Flags().StringSlice("arch", nil, "Set the manifest's supported architectures, e.g. armhf")
+	cmd.Flags().Bool("skip-arch-check", false,
+		"Don't check ELF binaries against supported_arch, or fill it in from them")
+	cmd.Flags().Bool("check-reproducible", false,
+		"Build the package a second time and fail if the two builds differ")
+	cmd.Flags().String("against", "",
+		"With --check-reproducible, compare with this existing .kpkg instead of building twice")
+	cmd.Flags().String("sign-key", "",
+		"PEM ed25519 private key file to write a detached .sig with (see \"openssl genpkey -algorithm ed25519\")")
 
 	return cmd
 }
+
+// checkReproducible compares the package just built with a second build, or with an existing
+// artifact, and reports the first entry that differs.
+func checkReproducible(cmd *cobra.Command, inputDir, output string, buildOpts []kpkg.BuildOption) error {
+	check, err := cmd.Flags().GetBool("check-reproducible")
+	if err != nil {
+		return errors.AddStack(err)
+	}
+	against, err := cmd.Flags().GetString("against")
+	if err != nil {
+		return errors.AddStack(err)
+	}
+	if against != "" && !check {
+		return errors.New("--against requires --check-reproducible")
+	}
+	if !check {
+		return nil
+	}
+
+	if against == "" {
+		tmpDir, err := os.MkdirTemp("", "kpkg-reproducible-")
+		if err != nil {
+			return errors.AddStack(err)
+		}
+		defer func() { _ = os.RemoveAll(tmpDir) }()
+		against = filepath.Join(tmpDir, filepath.Base(output))
+		err = kpkg.Build(cmd.Context(), inputDir, against, buildOpts...)
+		if err != nil {
+			return errors.Wrapf(err, "kpkg.Build(%q) again", inputDir)
+		}
+	}
+
+	diff, err := kpkg.CompareArchives(cmd.Context(), output, against)
+	if err != nil {
+		return errors.Wrap(err, "comparing builds")
+	}
+	if diff != nil {
+		fmt.Fprintf(cmd.OutOrStderr(), "%s is not reproducible: first difference at %s\n", output, diff) //nolint:errcheck
+		return errors.Errorf("%s differs from %s", output, against)
+	}
+	fmt.Fprintf(cmd.OutOrStdout(), "%s is reproducible\n", output) //nolint:errcheck
+	return nil
+}
+
+var manifestFlags = []string{ //nolint:gochecknoglobals
+	"manifest-template", "id", "name", "author", "description", "version", "depends", "arch",
+}
+
+// manifestFromFlags builds the manifest from --manifest-template (or the input directory's
+// manifest.json) patched with the other manifest flags. It returns nil if none of them were given,
+// so the input directory's manifest.json is packed as it is.
+func manifestFromFlags(cmd *cobra.Command, inputDir string) (*manifest.Manifest, error) {
+	if !slices.ContainsFunc(manifestFlags, cmd.Flags().Changed) {
+		return nil, nil //nolint:nilnil
+	}
+	flags := cmd.Flags()
+
+	m := &manifest.Manifest{} //nolint:exhaustruct
+	templatePath, err := flags.GetString("manifest-template")
+	if err != nil {
+		return nil, errors.AddStack(err)
+	}
+	if templatePath == "" {
+		templatePath = filepath.Join(inputDir, "manifest.json")
+	}
+	data, err := os.ReadFile(templatePath)
+	switch {
+	case err == nil:
+		err = json.Unmarshal(data, m)
+		if err != nil {
+			return nil, errors.Wrapf(err, "json.Unmarshal() to manifest.Manifest from %q", templatePath)
+		}
+	case os.IsNotExist(err) && !flags.Changed("manifest-template"):
+		// everything comes from flags
+	default:
+		return nil, errors.Wrapf(err, "os.ReadFile(%q)", templatePath)
+	}
+
+	for flag, field := range map[string]*string{
+		"id": &m.ID, "name": &m.Name, "author": &m.Author, "description": &m.Description,
+	} {
+		if flags.Changed(flag) {
+			*field, err = flags.GetString(flag)
+			if err != nil {
+				return nil, errors.AddStack(err)
+			}
+		}
+	}
+	if m.Name == "" {
+		m.Name = m.ID
+	}
+	if flags.Changed("version") {
+		v, err := flags.GetString("version")
+		if err != nil {
+			return nil, errors.AddStack(err)
+		}
+		sv, err := parseExactVersion(strings.TrimPrefix(v, "v"))
+		if err != nil {
+			return nil, errors.Annotate(err, "invalid version flag")
+		}
+		m.Version = *sv
+	}
+	if flags.Changed("arch") {
+		m.SupportedArch, err = flags.GetStringSlice("arch")
+		if err != nil {
+			return nil, errors.AddStack(err)
+		}
+	}
+	depends, err := flags.GetStringArray("depends")
+	if err != nil {
+		return nil, errors.AddStack(err)
+	}
+	for _, d := range depends {
+		c, err := resolver.ParseConstraint(d)
+		if err != nil {
+			return nil, errors.Annotate(err, "invalid depends flag")
+		}
+		if m.Dependencies == nil {
+			m.Dependencies = map[string]manifest.Dependency{}
+		}
+		m.Dependencies[string(c.ID)] = manifest.Dependency{
+			ID:           string(c.ID),
+			RepositoryID: (*string)(c.RepositoryID),
+			Min:          c.Min,
+			Max:          c.Max,
+		}
+	}
+
+	err = m.Validate()
+	if err != nil {
+		return nil, errors.AddStack(err)
+	}
+	return m, nil
+}
+
+// parseExactVersion is resolver.ParseVersion, but refuses components past the patch version
+// rather than ignoring them, so a tag like "1.2.3.4" isn't packaged as 1.2.3.
+func parseExactVersion(v string) (*manifest.SemanticVersion, error) {
+	if strings.Count(v, ".") > 2 {
+		return nil, errors.Errorf("version %q has more than three components", v)
+	}
+	sv, err := resolver.ParseVersion(v)
+	return sv, errors.AddStack(err)
+}
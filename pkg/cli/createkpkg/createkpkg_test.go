@@ -0,0 +1,165 @@
+package createkpkg_test
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/clintharrison/go-kindle-pkg/pkg/cli/createkpkg"
+	"github.com/clintharrison/go-kindle-pkg/pkg/kpkg"
+	"github.com/stretchr/testify/require"
+)
+
+const pfetchDir = "testdata/pfetch-kpkg"
+
+func TestCreateKpkgCmd_Compression(t *testing.T) {
+	t.Parallel()
+
+	var listings []string
+	for _, c := range kpkg.Compressions() {
+		output := filepath.Join(t.TempDir(), "pfetch.kpkg")
+		cmd := createkpkg.NewCommand()
+		out := new(bytes.Buffer)
+		cmd.SetOut(out)
+		cmd.SetErr(out)
+		cmd.SetArgs([]string{"--compression", string(c), "--output", output, pfetchDir})
+		require.NoError(t, cmd.Execute(), "compression %s", c)
+
+		k, err := kpkg.Open(t.Context(), output)
+		require.NoError(t, err, "compression %s", c)
+		require.Equal(t, "pfetch", k.Manifest.ID)
+		listing := new(bytes.Buffer)
+		require.NoError(t, k.ExtractAll(t.Context(), t.TempDir(), true, listing))
+		require.NoError(t, k.Close())
+		listings = append(listings, listing.String())
+	}
+	// the codec makes no difference to what's inside
+	for _, l := range listings[1:] {
+		require.Equal(t, listings[0], l)
+	}
+}
+
+func TestCreateKpkgCmd_BadCompression(t *testing.T) {
+	t.Parallel()
+
+	for _, args := range [][]string{
+		{"--compression", "lz4"},
+		{"--compression", "xz", "--compression-level", "9"},
+		{"--compression", "gzip", "--compression-level", "23"},
+	} {
+		cmd := createkpkg.NewCommand()
+		cmd.SetOut(new(bytes.Buffer))
+		cmd.SetErr(new(bytes.Buffer))
+		cmd.SetArgs(append(args, "--output", filepath.Join(t.TempDir(), "pfetch.kpkg"), pfetchDir))
+		require.Error(t, cmd.Execute(), "args %v", args)
+	}
+}
+
+// BenchmarkDecode compares how long each codec takes to read the whole pfetch package,
+// and how big it is: go test -bench Decode ./pkg/cli/createkpkg
+func BenchmarkDecode(b *testing.B) {
+	for _, c := range kpkg.Compressions() {
+		b.Run(string(c), func(b *testing.B) {
+			output := filepath.Join(b.TempDir(), "pfetch.kpkg")
+			require.NoError(b, kpkg.Build(b.Context(), pfetchDir, output, kpkg.WithCompression(c)))
+			fi, err := os.Stat(output)
+			require.NoError(b, err)
+
+			b.ResetTimer()
+			for b.Loop() {
+				k, err := kpkg.Open(b.Context(), output)
+				require.NoError(b, err)
+				_, _, err = k.Digests(b.Context())
+				require.NoError(b, err)
+				require.NoError(b, k.Close())
+			}
+			b.ReportMetric(float64(fi.Size()), "bytes")
+		})
+	}
+}
+
+func TestCreateKpkgCmd_CheckReproducible(t *testing.T) {
+	t.Parallel()
+
+	output := filepath.Join(t.TempDir(), "pfetch.kpkg")
+	cmd := createkpkg.NewCommand()
+	out := new(bytes.Buffer)
+	cmd.SetOut(out)
+	cmd.SetErr(out)
+	cmd.SetArgs([]string{"--check-reproducible", "--output", output, pfetchDir})
+	require.NoError(t, cmd.Execute())
+	require.Contains(t, out.String(), "is reproducible")
+
+	// an artifact built with other settings is reported, down to the entry
+	other := filepath.Join(t.TempDir(), "other.kpkg")
+	require.NoError(t, kpkg.Build(t.Context(), pfetchDir, other, kpkg.WithModTime(time.Unix(0, 0))))
+	cmd = createkpkg.NewCommand()
+	out = new(bytes.Buffer)
+	cmd.SetOut(out)
+	cmd.SetErr(out)
+	cmd.SetArgs([]string{"--check-reproducible", "--against", other, "--output", output, pfetchDir})
+	require.Error(t, cmd.Execute())
+	require.Contains(t, out.String(), "first difference at ./: mtime")
+}
+
+func TestCreateKpkgCmd_ManifestFlags(t *testing.T) {
+	t.Parallel()
+
+	output := filepath.Join(t.TempDir(), "pfetch.kpkg")
+	cmd := createkpkg.NewCommand()
+	out := new(bytes.Buffer)
+	cmd.SetOut(out)
+	cmd.SetErr(out)
+	cmd.SetArgs([]string{
+		"--version", "v0.7.1", "--depends", "kterm>=2.6", "--depends", "koreader>=1.0,<2", "--arch", "armel,armhf",
+		"--output", output, pfetchDir,
+	})
+	require.NoError(t, cmd.Execute())
+
+	k, err := kpkg.Open(t.Context(), output)
+	require.NoError(t, err)
+	defer k.Close()
+	m := k.Manifest
+	// the rest comes from the directory's manifest.json
+	require.Equal(t, "pfetch", m.ID)
+	require.Equal(t, "dylanaraps, packaged by clint32", m.Author)
+	require.Equal(t, "0.7.1", m.Version.String())
+	require.Equal(t, []string{"armel", "armhf"}, m.SupportedArch)
+	require.Equal(t, "2.6.0", m.Dependencies["kterm"].Min.String())
+	require.Nil(t, m.Dependencies["kterm"].Max)
+	require.Equal(t, "2.0.0", m.Dependencies["koreader"].Max.String())
+}
+
+func TestCreateKpkgCmd_ManifestFromFlagsOnly(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "launch.sh"), []byte("#!/bin/sh\n"), 0o755)) //nolint:gosec
+	output := filepath.Join(t.TempDir(), "hello.kpkg")
+
+	cmd := createkpkg.NewCommand()
+	cmd.SetOut(new(bytes.Buffer))
+	cmd.SetErr(new(bytes.Buffer))
+	cmd.SetArgs([]string{"--id", "hello", "--output", output, dir})
+	require.NoError(t, cmd.Execute())
+	k, err := kpkg.Open(t.Context(), output)
+	require.NoError(t, err)
+	defer k.Close()
+	require.Equal(t, "hello", k.Manifest.Name)
+
+	for _, args := range [][]string{
+		{"--name", "No ID"},
+		{"--id", "Hello"},
+		{"--id", "hello", "--version", "1.2.3.4"},
+		{"--id", "hello", "--depends", "kterm>>2"},
+		{"--id", "hello", "--manifest-template", filepath.Join(dir, "missing.json")},
+	} {
+		cmd := createkpkg.NewCommand()
+		cmd.SetOut(new(bytes.Buffer))
+		cmd.SetErr(new(bytes.Buffer))
+		cmd.SetArgs(append(args, "--output", output, dir))
+		require.Error(t, cmd.Execute(), "args %v", args)
+	}
+}
@@ -0,0 +1,79 @@
+package diff
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/clintharrison/go-kindle-pkg/pkg/kpkg"
+	"github.com/pingcap/errors"
+	"github.com/spf13/cobra"
+)
+
+func NewCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "diff [flags] old.kpkg new.kpkg",
+		Short: "Show what changed between two .kpkg files",
+		Long: `Show what changed between two .kpkg files: manifest fields, then each entry that was
+added (+), removed (-) or modified (~), with its attributes as extract --test lists them.
+With --text, modified text files are shown as unified diffs.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := cmd.Context()
+			if len(args) != 2 {
+				_ = cmd.Usage()
+				_, _ = cmd.OutOrStderr().Write([]byte("\n"))
+				return errors.Errorf("exactly two .kpkg files must be specified, got %d", len(args))
+			}
+			text, err := cmd.Flags().GetBool("text")
+			if err != nil {
+				return errors.AddStack(err)
+			}
+
+			a, err := kpkg.Open(ctx, args[0])
+			if err != nil {
+				return errors.Wrapf(err, "kpkg.Open(%q)", args[0])
+			}
+			defer func() { _ = a.Close() }()
+			b, err := kpkg.Open(ctx, args[1])
+			if err != nil {
+				return errors.Wrapf(err, "kpkg.Open(%q)", args[1])
+			}
+			defer func() { _ = b.Close() }()
+
+			var opts []kpkg.DiffOption
+			if text {
+				opts = append(opts, kpkg.WithTextDiffs())
+			}
+			d, err := kpkg.Diff(ctx, a, b, opts...)
+			if err != nil {
+				return errors.Wrapf(err, "comparing %q and %q", args[0], args[1])
+			}
+
+			out := cmd.OutOrStdout()
+			if d.Empty() {
+				fmt.Fprintln(out, "No differences") //nolint:errcheck
+				return nil
+			}
+			for _, m := range d.Manifest {
+				fmt.Fprintf(out, "manifest: %s\n", m) //nolint:errcheck
+			}
+			for _, e := range d.Entries {
+				switch e.Kind {
+				case kpkg.EntryAdded:
+					fmt.Fprintf(out, "+ %s%s\n", e.Path, e.Attrs) //nolint:errcheck
+				case kpkg.EntryRemoved:
+					fmt.Fprintf(out, "- %s%s\n", e.Path, e.Attrs) //nolint:errcheck
+				case kpkg.EntryModified:
+					fmt.Fprintf(out, "~ %s: %s\n", e.Path, strings.Join(e.Details, ", ")) //nolint:errcheck
+				}
+			}
+			for _, e := range d.Entries {
+				if e.TextDiff != "" {
+					fmt.Fprintf(out, "\n%s", e.TextDiff) //nolint:errcheck
+				}
+			}
+			return nil
+		},
+	}
+	cmd.Flags().Bool("text", false, "Show unified diffs of modified text files")
+	return cmd
+}
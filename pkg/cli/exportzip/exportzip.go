@@ -0,0 +1,78 @@
+package exportzip
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/clintharrison/go-kindle-pkg/pkg/kpkg"
+	"github.com/clintharrison/go-kindle-pkg/pkg/kual"
+	"github.com/pingcap/errors"
+	"github.com/spf13/cobra"
+)
+
+func NewCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "export-zip [flags] package.kpkg",
+		Short: "Convert a .kpkg file into a zip for installing by hand, without kpmgo",
+		Long: `Convert a .kpkg file into a zip that can be copied onto a Kindle connected over USB.
+
+The zip holds a KUAL extension in extensions/kpm-<id>/ that runs the package's install.sh,
+uninstall.sh and launch.sh, with the same environment kpmgo gives them. Installing it moves the
+package into kpm/pkgs/<id>/, where kpmgo would have installed it. Multi-architecture packages need
+--arch. Dependencies aren't included.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := cmd.Context()
+			if len(args) != 1 {
+				_ = cmd.Usage()
+				_, _ = cmd.OutOrStderr().Write([]byte("\n"))
+				return errors.Errorf("exactly one .kpkg file must be specified, got %d", len(args))
+			}
+			kpkgPath := args[0]
+
+			output, err := cmd.Flags().GetString("output")
+			if err != nil {
+				return errors.AddStack(err)
+			}
+			if output == "" {
+				output = strings.TrimSuffix(filepath.Base(kpkgPath), filepath.Ext(kpkgPath)) + ".zip"
+			}
+			var opts []kual.ExportOption
+			arch, err := cmd.Flags().GetString("arch")
+			if err != nil {
+				return errors.AddStack(err)
+			}
+			if arch != "" {
+				opts = append(opts, kual.WithArch(arch))
+			}
+
+			k, err := kpkg.Open(ctx, kpkgPath)
+			if err != nil {
+				return errors.Wrapf(err, "kpkg.Open(%q)", kpkgPath)
+			}
+			defer func() { _ = k.Close() }()
+
+			f, err := os.Create(output)
+			if err != nil {
+				return errors.Wrapf(err, "os.Create(%q)", output)
+			}
+			err = kual.ExportZip(ctx, k, f, opts...)
+			if cerr := f.Close(); err == nil {
+				err = errors.AddStack(cerr)
+			}
+			if err != nil {
+				_ = os.Remove(output)
+				return errors.Annotatef(err, "exporting %q", kpkgPath)
+			}
+			fmt.Fprintf(cmd.OutOrStdout(), "Exported %s version %s to %s\n", //nolint:errcheck
+				k.Manifest.ID, k.Manifest.Version.String(), output)
+			return nil
+		},
+	}
+
+	cmd.Flags().StringP("output", "o", "", "Output .zip file path (default: the package's name with .zip)")
+	cmd.Flags().String("arch", "", "Architecture to export a multi-architecture package for, e.g. armhf")
+
+	return cmd
+}
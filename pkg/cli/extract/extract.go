@@ -1,7 +1,12 @@
 package extract
 
 import (
+	"bytes"
+	"fmt"
+	"os"
+
 	"github.com/clintharrison/go-kindle-pkg/pkg/kpkg"
+	"github.com/clintharrison/go-kindle-pkg/pkg/mtree"
 	"github.com/pingcap/errors"
 	"github.com/spf13/cobra"
 )
@@ -10,6 +15,11 @@ func NewCommand() *cobra.Command {
 	cmd := &cobra.Command{
 		Use:   "extract [flags] example.kpkg",
 		Short: "Extract a .kpkg file",
+		Long: `Extract a .kpkg file.
+
+With --test, the entries are listed instead of extracted, one per line, or as an mtree(5)
+specification with --format mtree. With --verify-against, the package, or a directory it was
+extracted to, is compared with such a specification, and any differences are reported.`,
 		RunE: func(cmd *cobra.Command, _ []string) error {
 			ctx := cmd.Context()
 
@@ -22,6 +32,15 @@ func NewCommand() *cobra.Command {
 			}
 			packagePath := rest[0]
 
+			format, err := cmd.Flags().GetString("format")
+			if err != nil {
+				return errors.AddStack(err)
+			}
+			verifyAgainst, err := cmd.Flags().GetString("verify-against")
+			if err != nil {
+				return errors.AddStack(err)
+			}
+
 			output, err := cmd.Flags().GetString("output")
 			if err != nil {
 				return errors.AddStack(err)
@@ -32,6 +51,29 @@ func NewCommand() *cobra.Command {
 				return errors.AddStack(err)
 			}
 
+			arch, err := cmd.Flags().GetString("arch")
+			if err != nil {
+				return errors.AddStack(err)
+			}
+			include, err := cmd.Flags().GetStringArray("include")
+			if err != nil {
+				return errors.AddStack(err)
+			}
+			exclude, err := cmd.Flags().GetStringArray("exclude")
+			if err != nil {
+				return errors.AddStack(err)
+			}
+			extractOpts := []kpkg.ExtractOption{
+				kpkg.WithInclude(include...), kpkg.WithExclude(exclude...), kpkg.WithListFormat(kpkg.ListFormat(format)),
+			}
+			if arch != "" {
+				extractOpts = append(extractOpts, kpkg.WithArch(arch))
+			}
+
+			if verifyAgainst != "" {
+				return verify(cmd, packagePath, verifyAgainst, output, extractOpts)
+			}
+
 			// the real work
 			pkg, err := kpkg.Open(ctx, packagePath)
 			if err != nil {
@@ -40,7 +82,7 @@ func NewCommand() *cobra.Command {
 			// package must remain open until after extraction
 			defer func() { _ = pkg.Close() }()
 
-			return pkg.ExtractAll(ctx, output, test, cmd.OutOrStdout())
+			return pkg.ExtractAll(ctx, output, test, cmd.OutOrStdout(), extractOpts...)
 		},
 	}
 
@@ -48,5 +90,70 @@ func NewCommand() *cobra.Command {
 
 	cmd.Flags().StringP("output", "o", "./extracted", "Output directory for extracted files")
 
+	cmd.Flags().String("format", string(kpkg.ListAttrs),
+		"Format of the --test listing: attrs for one line per entry, or mtree for an mtree(5) specification")
+	cmd.Flags().String("verify-against", "",
+		"Compare the package, or a directory it was extracted to, with this mtree(5) specification instead of extracting")
+
+	cmd.Flags().StringArray("include", nil,
+		"Only extract paths matching this glob, or in a directory that does, e.g. '*.sh' or 'koreader/reader.lua' "+
+			"(may be repeated)")
+	cmd.Flags().StringArray("exclude", nil,
+		"Don't extract paths matching this glob, or in a directory that does (may be repeated)")
+
+	cmd.Flags().String("arch", "",
+		"Extract as installed on this architecture, merging a multi-arch package's common/ and arch/<arch>/ trees")
+
 	return cmd
 }
+
+// verify compares a package, or a directory it was extracted to, with an mtree specification.
+// Each difference is printed, and makes the command fail.
+func verify(cmd *cobra.Command, target, specPath, output string, extractOpts []kpkg.ExtractOption) error {
+	f, err := os.Open(specPath)
+	if err != nil {
+		return errors.AddStack(err)
+	}
+	defer f.Close()
+	spec, err := mtree.Parse(f)
+	if err != nil {
+		return errors.Annotatef(err, "parsing %q", specPath)
+	}
+
+	var actual []mtree.Entry
+	fi, err := os.Stat(target)
+	if err != nil {
+		return errors.AddStack(err)
+	}
+	if fi.IsDir() {
+		actual, err = mtree.FromDir(target)
+		if err != nil {
+			return err
+		}
+	} else {
+		pkg, err := kpkg.Open(cmd.Context(), target)
+		if err != nil {
+			return errors.Wrapf(err, "kpkg.Open(%q)", target)
+		}
+		defer func() { _ = pkg.Close() }()
+		listing := &bytes.Buffer{}
+		extractOpts = append(extractOpts, kpkg.WithListFormat(kpkg.ListMtree))
+		err = pkg.ExtractAll(cmd.Context(), output, true, listing, extractOpts...)
+		if err != nil {
+			return err
+		}
+		actual, err = mtree.Parse(listing)
+		if err != nil {
+			return err
+		}
+	}
+
+	diffs := mtree.Compare(spec, actual)
+	for _, d := range diffs {
+		fmt.Fprintln(cmd.OutOrStdout(), d) //nolint:errcheck
+	}
+	if len(diffs) > 0 {
+		return errors.Errorf("%q differs from %q in %d places", target, specPath, len(diffs))
+	}
+	return nil
+}
@@ -3,8 +3,11 @@ package extract_test
 import (
 	"bytes"
 	_ "embed"
+	"io/fs"
 	"os"
 	"path"
+	"path/filepath"
+	"slices"
 	"strings"
 	"testing"
 
@@ -121,3 +124,112 @@ func TestExtractCmd_ExtractArchive(t *testing.T) {
 
 	// TODO: check file contents, modes (exec bit!), links, ownership(?)
 }
+
+func TestExtractCmd_IncludeExclude(t *testing.T) {
+	t.Parallel()
+
+	koreaderPath := path.Join(t.TempDir(), "koreader_1.2.0_armhf.kpkg")
+	require.NoError(t, os.WriteFile(koreaderPath, exampleKpkg, 0o644)) //nolint:gosec
+
+	for _, tc := range []struct {
+		args []string
+		want []string
+	}{
+		{[]string{"--include", "*.sh"}, []string{".", "launch.sh", "install.sh", "uninstall.sh"}},
+		{[]string{"--include", "*.sh", "--exclude", "uninstall.sh"}, []string{".", "launch.sh", "install.sh"}},
+		{[]string{"--include", "app"}, []string{".", "app/", "app/some-bin", "app/legacy-some-bin"}},
+		{[]string{"--include", "app/some-bin"}, []string{".", "app/some-bin"}},
+		{[]string{"--exclude", "app", "--exclude", "*.json"}, []string{".", "launch.sh", "install.sh", "uninstall.sh"}},
+	} {
+		// the listing and the extraction agree on what's selected
+		cmd := extract.NewCommand()
+		out := new(bytes.Buffer)
+		cmd.SetOut(out)
+		cmd.SetErr(out)
+		cmd.SetArgs(append([]string{"--test", koreaderPath}, tc.args...))
+		require.NoError(t, cmd.Execute(), "args %v", tc.args)
+		var listed []string
+		for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+			listed = append(listed, strings.Fields(line)[0])
+		}
+		require.Equal(t, tc.want, listed, "args %v", tc.args)
+
+		output := t.TempDir()
+		cmd = extract.NewCommand()
+		cmd.SetOut(new(bytes.Buffer))
+		cmd.SetErr(new(bytes.Buffer))
+		cmd.SetArgs(append([]string{"--output", output, koreaderPath}, tc.args...))
+		require.NoError(t, cmd.Execute(), "args %v", tc.args)
+		extracted := []string{"."}
+		require.NoError(t, filepath.WalkDir(output, func(p string, d fs.DirEntry, err error) error {
+			if err != nil || p == output {
+				return err
+			}
+			rel, err := filepath.Rel(output, p)
+			if d.IsDir() {
+				rel += "/"
+			}
+			// parent directories are created for included files, but aren't entries themselves
+			if !d.IsDir() || slices.Contains(tc.want, rel) {
+				extracted = append(extracted, rel)
+			}
+			return err
+		}))
+		require.ElementsMatch(t, tc.want, extracted, "args %v", tc.args)
+	}
+
+	cmd := extract.NewCommand()
+	cmd.SetOut(new(bytes.Buffer))
+	cmd.SetErr(new(bytes.Buffer))
+	cmd.SetArgs([]string{"--test", "--include", "[", koreaderPath})
+	require.Error(t, cmd.Execute())
+}
+
+func TestExtractCmd_Mtree(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	koreaderPath := filepath.Join(dir, "koreader_1.2.0_armhf.kpkg")
+	require.NoError(t, os.WriteFile(koreaderPath, exampleKpkg, 0o644)) //nolint:gosec
+	run := func(args ...string) (string, error) {
+		cmd := extract.NewCommand()
+		out := new(bytes.Buffer)
+		cmd.SetOut(out)
+		cmd.SetErr(new(bytes.Buffer))
+		cmd.SilenceUsage = true
+		cmd.SetArgs(args)
+		err := cmd.Execute()
+		return out.String(), err
+	}
+
+	spec, err := run("--test", "--format", "mtree", koreaderPath)
+	require.NoError(t, err)
+	lines := strings.Split(spec, "\n")
+	require.Equal(t, "#mtree v2.0", lines[0])
+	require.Equal(t, "/set type=file uid=0 gid=0 mode=0644", lines[1])
+	require.Equal(t, ". type=dir mode=0755 uid=1000 gid=100", lines[2])
+	require.Contains(t, spec, "./app/legacy-some-bin type=link mode=0777 uid=1000 gid=100 link=some-bin\n")
+	require.Regexp(t, `\n\./launch\.sh mode=0755 size=67 uid=1000 gid=100 sha256digest=[0-9a-f]{64}\n`, spec)
+	specPath := filepath.Join(dir, "koreader.mtree")
+	require.NoError(t, os.WriteFile(specPath, []byte(spec), 0o644)) //nolint:gosec
+
+	// the package and what it extracts to both match their specification
+	out, err := run("--verify-against", specPath, koreaderPath)
+	require.NoError(t, err, out)
+	output := filepath.Join(dir, "extracted")
+	_, err = run("--output", output, koreaderPath)
+	require.NoError(t, err)
+	out, err = run("--verify-against", specPath, output)
+	require.NoError(t, err, out)
+
+	require.NoError(t, os.WriteFile(filepath.Join(output, "launch.sh"), []byte("changed"), 0o755)) //nolint:gosec
+	require.NoError(t, os.Remove(filepath.Join(output, "uninstall.sh")))
+	require.NoError(t, os.Mkdir(filepath.Join(output, "extra"), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(output, "extra", "file"), nil, 0o644)) //nolint:gosec
+	out, err = run("--verify-against", specPath, output)
+	require.Error(t, err)
+	require.Regexp(t, `^extra: extra
+modified: launch.sh \(size 7, expected 67, sha256digest [0-9a-f]{64}, expected [0-9a-f]{64}\)
+missing: uninstall.sh
+$`, out)
+}
@@ -0,0 +1,106 @@
+package importzip
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/clintharrison/go-kindle-pkg/pkg/kpkg"
+	"github.com/clintharrison/go-kindle-pkg/pkg/kual"
+	"github.com/clintharrison/go-kindle-pkg/pkg/resolver"
+	"github.com/pingcap/errors"
+	"github.com/spf13/cobra"
+)
+
+func NewCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "import-zip [flags] extension.zip",
+		Short: "Convert a KUAL extension zip into a .kpkg file",
+		Long: `Convert a zip with a KUAL extension, at extensions/<name>/, into a .kpkg file.
+
+The manifest is generated from the extension's config.xml: the package ID from <id> (or <name>),
+made to fit package ID rules, and the version from <version>. The package's install.sh copies
+the extension into the userstore's extensions directory, and its uninstall.sh removes it.
+Anything in the zip outside the extension directory is left out.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if len(args) != 1 {
+				_ = cmd.Usage()
+				_, _ = cmd.OutOrStderr().Write([]byte("\n"))
+				return errors.Errorf("exactly one .zip file must be specified, got %d", len(args))
+			}
+			zipPath := args[0]
+
+			output, err := cmd.Flags().GetString("output")
+			if err != nil {
+				return errors.AddStack(err)
+			}
+			if output == "" {
+				output = strings.TrimSuffix(filepath.Base(zipPath), filepath.Ext(zipPath)) + ".kpkg"
+			}
+
+			var opts []kual.ImportOption
+			id, err := cmd.Flags().GetString("id")
+			if err != nil {
+				return errors.AddStack(err)
+			}
+			if id != "" {
+				opts = append(opts, kual.WithID(id))
+			}
+			v, err := cmd.Flags().GetString("version")
+			if err != nil {
+				return errors.AddStack(err)
+			}
+			if v != "" {
+				sv, err := resolver.ParseVersion(strings.TrimPrefix(v, "v"))
+				if err != nil {
+					return errors.Annotate(err, "invalid version flag")
+				}
+				opts = append(opts, kual.WithVersion(*sv))
+			}
+			extension, err := cmd.Flags().GetString("extension")
+			if err != nil {
+				return errors.AddStack(err)
+			}
+			if extension != "" {
+				opts = append(opts, kual.WithExtension(extension))
+			}
+
+			compression, err := cmd.Flags().GetString("compression")
+			if err != nil {
+				return errors.AddStack(err)
+			}
+			c, err := kpkg.ParseCompression(compression)
+			if err != nil {
+				return errors.Annotate(err, "invalid compression flag")
+			}
+			buildOpts := []kpkg.BuildOption{kpkg.WithCompression(c)}
+			skipArchCheck, err := cmd.Flags().GetBool("skip-arch-check")
+			if err != nil {
+				return errors.AddStack(err)
+			}
+			if skipArchCheck {
+				buildOpts = append(buildOpts, kpkg.WithSkipArchCheck())
+			}
+			opts = append(opts, kual.WithBuildOptions(buildOpts...))
+
+			m, err := kual.ImportZip(cmd.Context(), zipPath, output, opts...)
+			if err != nil {
+				return err //nolint:wrapcheck
+			}
+			fmt.Fprintf(cmd.OutOrStdout(), "Imported %s version %s to %s\n", //nolint:errcheck
+				m.ID, m.Version.String(), output)
+			return nil
+		},
+	}
+
+	cmd.Flags().StringP("output", "o", "", "Output .kpkg file path (default: the zip's name with .kpkg)")
+	cmd.Flags().String("id", "", "Package ID, instead of one derived from config.xml")
+	cmd.Flags().String("version", "", "Package version, e.g. 1.2.3, instead of config.xml's")
+	cmd.Flags().String("extension", "", "Which extension to import, by directory name, if the zip has several")
+	cmd.Flags().StringP("compression", "c", string(kpkg.CompressionNone),
+		fmt.Sprintf("Payload compression, one of %v", kpkg.Compressions()))
+	cmd.Flags().Bool("skip-arch-check", false,
+		"Don't check ELF binaries against each other, or fill in supported_arch from them")
+
+	return cmd
+}
@@ -0,0 +1,79 @@
+package install
+
+import (
+	"fmt"
+
+	"github.com/clintharrison/go-kindle-pkg/pkg/repository"
+	"github.com/clintharrison/go-kindle-pkg/pkg/resolver"
+	"github.com/clintharrison/go-kindle-pkg/pkg/state"
+	"github.com/clintharrison/go-kindle-pkg/pkg/version"
+	"github.com/pingcap/errors"
+	"github.com/spf13/cobra"
+)
+
+func NewAutoremoveCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "autoremove [flags]",
+		Short: "Uninstall dependencies that are no longer needed",
+		Long: `Uninstall packages that were only installed as dependencies of other packages, once
+nothing that was asked for with install needs them any more.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			dryRun, err := cmd.Flags().GetBool("dry-run")
+			if err != nil {
+				return errors.Wrap(err, "failed to get dry-run flag")
+			}
+			if len(args) > 0 {
+				_ = cmd.Usage()
+				_, _ = cmd.OutOrStderr().Write([]byte("\n"))
+				return errors.Errorf("unexpected arguments: %v", args)
+			}
+
+			rm, err := unneededAfter(nil, nil)
+			if err != nil {
+				return err
+			}
+			if len(rm) == 0 {
+				fmt.Fprintln(cmd.OutOrStdout(), "No packages to remove") //nolint:errcheck
+				return nil
+			}
+			fmt.Fprintf(cmd.OutOrStdout(), "\033[1mPackages to be removed:\033[0m\n") //nolint:errcheck
+			rmRPs := make([]*repository.RepoPackage, 0, len(rm))
+			for _, art := range rm {
+				fmt.Fprintf(cmd.OutOrStdout(), "  - %s\n", art) //nolint:errcheck
+				rmRPs = append(rmRPs, &repository.RepoPackage{
+					ID:            string(art.ID),
+					RepositoryID:  string(art.RepositoryID),
+					Version:       art.Version,
+					SupportedArch: art.SupportedArch,
+					Dependencies:  nil,
+				})
+			}
+
+			fmt.Fprint(cmd.OutOrStdout(), "\n\033[1mPerforming package changes...\033[0m\n") //nolint:errcheck
+			// nothing is installed, so there's nothing to download from
+			err = performPackageChanges(cmd.Context(), repository.NewMultiRepository(), nil, rmRPs,
+				worldChanges{request: nil, forget: nil}, dryRun, nil, version.DeviceArch())
+			if err != nil {
+				fmt.Fprintf(cmd.OutOrStdout(), "\033[1mPackages were not removed successfully!\033[0m\n\n") //nolint:errcheck
+				return errors.Wrap(err, "failed to remove packages")
+			}
+			return nil
+		},
+	}
+	cmd.Flags().BoolP("dry-run", "n", false, "Perform a trial run with no changes made")
+	return cmd
+}
+
+// unneededAfter returns the installed packages that nothing in the world set needs, once the
+// packages in removing are gone and the IDs in forgetting are out of the world set.
+func unneededAfter(removing []*resolver.VersionedPackage, forgetting []string) ([]*resolver.VersionedPackage, error) {
+	db, err := state.LoadDB(version.BaseDir())
+	if err != nil {
+		return nil, errors.Annotate(err, "loading the installed-package database")
+	}
+	ids := make([]string, 0, len(removing))
+	for _, vp := range removing {
+		ids = append(ids, string(vp.ID))
+	}
+	return db.Unneeded(ids, forgetting)
+}
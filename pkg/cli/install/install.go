@@ -3,20 +3,20 @@ package install
 import (
 	"context"
 	"fmt"
-	"io"
-	"io/fs"
 	"log/slog"
 	"os"
-	"os/exec"
 	"path/filepath"
+	"slices"
 	"strings"
 
 	"github.com/clintharrison/go-kindle-pkg/pkg/cli/clicommon"
+	"github.com/clintharrison/go-kindle-pkg/pkg/cli/reloadmenu"
 	"github.com/clintharrison/go-kindle-pkg/pkg/kpkg"
 	"github.com/clintharrison/go-kindle-pkg/pkg/repository"
 	"github.com/clintharrison/go-kindle-pkg/pkg/repository/manifest"
 	"github.com/clintharrison/go-kindle-pkg/pkg/resolver"
 	"github.com/clintharrison/go-kindle-pkg/pkg/state"
+	"github.com/clintharrison/go-kindle-pkg/pkg/transaction"
 	"github.com/clintharrison/go-kindle-pkg/pkg/version"
 	"github.com/pingcap/errors"
 	"github.com/spf13/cobra"
@@ -61,6 +61,10 @@ func NewUninstallCommand() *cobra.Command {
 			if err != nil {
 				return errors.Wrap(err, "failed to get dry-run flag")
 			}
+			autoremove, err := cmd.Flags().GetBool("autoremove")
+			if err != nil {
+				return errors.Wrap(err, "failed to get autoremove flag")
+			}
 
 			if len(args) < 1 {
 				_ = cmd.Usage()
@@ -78,7 +82,7 @@ func NewUninstallCommand() *cobra.Command {
 				return fmt.Errorf("package %q is not installed", packageID)
 			}
 
-			multirepo, err := clicommon.GetRepoFromArgs(cmd)
+			multirepo, err := clicommon.GetRepoFromArgs(cmd, false)
 			if err != nil {
 				return errors.Wrap(err, "failed to initialize repository")
 			}
@@ -179,6 +183,21 @@ func NewUninstallCommand() *cobra.Command {
 			slog.Debug("resolved packages", "result", result)
 
 			add, rm := resolver.DiffInstallations(resolverInstalled, result)
+			rm = resolver.RemovalOrder(rm)
+
+			// the packages named are no longer wanted, even if they're kept as dependencies
+			world := worldChanges{request: nil, forget: nil}
+			for _, c := range cliConstraints {
+				world.forget = append(world.forget, string(c.ID))
+			}
+			if autoremove {
+				extra, err := unneededAfter(rm, world.forget)
+				if err != nil {
+					return err
+				}
+				rm = resolver.RemovalOrder(append(rm, extra...))
+			}
+
 			if len(rm) > 0 {
 				fmt.Fprintf(cmd.OutOrStdout(), "\033[1mPackages to be removed:\033[0m\n") //nolint:errcheck
 				for _, art := range rm {
@@ -225,8 +244,13 @@ func NewUninstallCommand() *cobra.Command {
 				rmRPs = append(rmRPs, rp)
 			}
 
+			openOpts, err := packageTrustOptions(false)
+			if err != nil {
+				return err
+			}
+
 			fmt.Fprint(cmd.OutOrStdout(), "\n\033[1mPerforming package changes...\033[0m\n") //nolint:errcheck
-			err = performPackageChanges(ctx, multirepo, addRPs, rmRPs, dryRun)
+			err = performPackageChanges(ctx, multirepo, addRPs, rmRPs, world, dryRun, openOpts, version.DeviceArch())
 			if err != nil {
 				fmt.Fprintf(cmd.OutOrStdout(), "\033[1mPackages were not installed successfully!\033[0m\n\n") //nolint:errcheck
 				return errors.Wrap(err, "failed to install packages")
@@ -235,12 +259,13 @@ func NewUninstallCommand() *cobra.Command {
 		},
 	}
 	cmd.Flags().BoolP("dry-run", "n", false, "Perform a trial run with no changes made")
+	cmd.Flags().Bool("autoremove", false, "Also uninstall dependencies that are no longer needed")
 	return cmd
 }
 
 func NewInstallCommand() *cobra.Command {
 	cmd := &cobra.Command{
-		Use:   "install [flags] example.kpkg",
+		Use:   "install [flags] example.kpkg | -",
 		Short: "Extract and install a .kpkg file",
 		RunE: func(cmd *cobra.Command, args []string) error {
 			ctx := cmd.Context()
@@ -249,7 +274,7 @@ func NewInstallCommand() *cobra.Command {
 			if err != nil {
 				return errors.Wrap(err, "failed to get dry-run flag")
 			}
-			multirepo, err := clicommon.GetRepoFromArgs(cmd)
+			multirepo, err := clicommon.GetRepoFromArgs(cmd, true)
 			if err != nil {
 				return errors.Wrap(err, "failed to initialize repository")
 			}
@@ -276,6 +301,29 @@ func NewInstallCommand() *cobra.Command {
 				return errors.Wrap(err, "failed to parse file arguments")
 			}
 
+			allowUnsigned, err := cmd.Flags().GetBool("allow-unsigned")
+			if err != nil {
+				return errors.Wrap(err, "failed to get allow-unsigned flag")
+			}
+			openOpts, err := packageTrustOptions(allowUnsigned)
+			if err != nil {
+				return err
+			}
+
+			// "-" reads a package from stdin, which can only be read once: open it up front and
+			// hand the open package to the installer through its own repository
+			var streamed []*kpkg.KPKG
+			if i := slices.Index(fileArgs, "-"); i >= 0 {
+				fileArgs = slices.Delete(fileArgs, i, i+1)
+				k, err := openStdinPackage(cmd, openOpts)
+				if err != nil {
+					return err
+				}
+				defer k.Close() //nolint:errcheck
+				multirepo.AddRepository(repository.NewStreamRepository(k))
+				streamed = append(streamed, k)
+			}
+
 			// Create a local file repository for the .kpkg files specified on the command line
 			// and any extracted (installed, usually) packages
 			dirs := make([]string, 0, len(installedDirs)+len(fileArgs))
@@ -285,7 +333,7 @@ func NewInstallCommand() *cobra.Command {
 
 			// read metadata from .kpkg files to generate constraints and artifacts
 			// used for resolution
-			fileConstraints, err := processKPKGArgs(ctx, fileArgs)
+			fileConstraints, fileIDs, err := processKPKGArgs(ctx, fileArgs, streamed...)
 			if err != nil {
 				return err
 			}
@@ -312,9 +360,42 @@ func NewInstallCommand() *cobra.Command {
 				return errors.Wrap(err, "failed to parse package constraints from args")
 			}
 
+			// the packages asked for join the world set, unlike their dependencies. Package files are
+			// recorded by ID alone, so they can be upgraded from a repository later
+			world := worldChanges{request: nil, forget: nil}
+			for _, id := range fileIDs {
+				world.request = append(world.request, state.Constraint{ID: id, Min: nil, Max: nil})
+			}
+			for _, c := range constraints {
+				world.request = append(world.request, state.Constraint{ID: string(c.ID), Min: c.Min, Max: c.Max})
+			}
 			constraints = append(fileConstraints, constraints...)
 
-			result, err := res.Resolve(constraints)
+			// installing is additive: everything already installed stays, at the same version
+			// unless the new packages need it upgraded
+			resolverInstalled := repoInstalledMapToResolverVPkgMap(installed)
+			constraints, preferred := resolver.RetainInstalled(resolverInstalled, constraints)
+
+			// and the packages asked for before stay within the versions they were asked for at,
+			// unless they're being asked for again
+			db, err := state.LoadDB(version.BaseDir())
+			if err != nil {
+				return errors.Annotate(err, "loading the installed-package database")
+			}
+			requested := make([]string, 0, len(world.request))
+			for _, c := range world.request {
+				requested = append(requested, c.ID)
+			}
+			constraints = append(constraints, db.WorldConstraints(requested)...)
+
+			arch, err := cmd.Flags().GetString("arch")
+			if err != nil {
+				return errors.Wrap(err, "failed to get arch flag")
+			}
+			if arch == "" {
+				arch = version.DeviceArch()
+			}
+			result, err := res.Resolve(constraints, resolver.WithPreferredVersions(preferred), resolver.WithArch(arch))
 			if err != nil {
 				fmt.Fprintf(cmd.OutOrStderr(), "ERROR: Unable to resolve packages:\n%v\n", err) //nolint:errcheck
 				return errors.Wrap(err, "failed to resolve packages")
@@ -322,8 +403,8 @@ func NewInstallCommand() *cobra.Command {
 
 			slog.Debug("resolved packages", "result", result)
 
-			resolverInstalled := repoInstalledMapToResolverVPkgMap(installed)
 			add, rm := resolver.DiffInstallations(resolverInstalled, result)
+			rm = resolver.RemovalOrder(rm)
 			if len(rm) > 0 {
 				fmt.Fprintf(cmd.OutOrStdout(), "\033[1mPackages to be removed:\033[0m\n") //nolint:errcheck
 				for _, art := range rm {
@@ -371,7 +452,7 @@ func NewInstallCommand() *cobra.Command {
 			}
 
 			fmt.Fprint(cmd.OutOrStdout(), "\n\033[1mPerforming package changes...\033[0m\n") //nolint:errcheck
-			err = performPackageChanges(ctx, multirepo, addRPs, rmRPs, dryRun)
+			err = performPackageChanges(ctx, multirepo, addRPs, rmRPs, world, dryRun, openOpts, arch)
 			if err != nil {
 				fmt.Fprintf(cmd.OutOrStdout(), "\033[1mPackages were not installed successfully!\033[0m\n\n") //nolint:errcheck
 				return errors.Wrap(err, "failed to install packages")
@@ -380,254 +461,217 @@ func NewInstallCommand() *cobra.Command {
 		},
 	}
 	cmd.Flags().BoolP("dry-run", "n", false, "Perform a trial run with no changes made")
+	cmd.Flags().Bool("allow-unsigned", false,
+		"Install packages that are unsigned or signed by a key not in "+kpkg.TrustedKeysDir())
+	cmd.Flags().String("signature", "", "Detached signature for a package read from stdin with \"-\"")
+	cmd.Flags().String("arch", "", "Install packages for this architecture (armel or armhf) instead of the device's")
 	return cmd
 }
 
-func performPackageChanges(
-	ctx context.Context, repo repository.Repository, add, rm []*repository.RepoPackage, dryRun bool,
-) error {
-	slog.Debug("performPackageChanges()", "repo", repo.ID(), "add", len(add), "remove", len(rm), "dryRun", dryRun)
-	if len(rm) > 0 {
-		for _, rp := range rm {
-			err := removePackage(ctx, rp, dryRun)
-			if err != nil {
-				return err
-			}
-		}
+// openStdinPackage opens the package piped to `install -`, reading only as far as its manifest.
+func openStdinPackage(cmd *cobra.Command, openOpts []kpkg.OpenOption) (*kpkg.KPKG, error) {
+	sigPath, err := cmd.Flags().GetString("signature")
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get signature flag")
 	}
-	if len(add) > 0 {
-		for _, rp := range add {
-			err := addPackage(ctx, repo, rp, dryRun)
-			if err != nil {
-				return err
-			}
-			fmt.Printf("\033[1m%s:\033[0m installed successfully\n", rp.ID)
+	if sigPath != "" {
+		sig, err := kpkg.ReadSignatureFile(sigPath)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to read signature")
 		}
+		openOpts = append(slices.Clip(openOpts), kpkg.WithSignature(sig))
 	}
-	if dryRun {
-		fmt.Println("\n\033[1mDry run finished! No changes were made.\033[0m")
-		return nil
+	k, err := kpkg.OpenStream(cmd.Context(), cmd.InOrStdin(), openOpts...)
+	if err != nil {
+		return nil, errors.Wrap(err, "kpkg.OpenStream(stdin)")
 	}
-	return nil
+	return k, nil
 }
 
-func removePackage(ctx context.Context, rp *repository.RepoPackage, dryRun bool) error {
-	// TODO: rewrite this to duplicate less with addPackage
-	var err error
-	pkgDirName := rp.ID
-	baseDir := version.BaseDir()
-	pkgsDir := filepath.Join(baseDir, "pkgs")
-	destDir := filepath.Join(pkgsDir, pkgDirName)
-	uninstallerPath := filepath.Join(destDir, "uninstall.sh")
-
-	fmt.Printf("Running uninstall script for %s (version %s)\n", rp.ID, rp.Version.String())
-
-	cmd := exec.CommandContext(ctx, "/bin/sh", "-l", uninstallerPath)
-	cmd.Dir = destDir
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	if dryRun {
-		fmt.Printf(" - [dry-run] /bin/sh -l %q\n", uninstallerPath)
-		err = nil
-	} else {
-		err = cmd.Run()
-	}
+// packageTrustOptions loads the trusted publisher keys that packages are verified against before installing.
+func packageTrustOptions(allowUnsigned bool) ([]kpkg.OpenOption, error) {
+	keyring, err := kpkg.LoadKeyring(kpkg.TrustedKeysDir())
 	if err != nil {
-		return fmt.Errorf("failed to remove package dir %q: %w", destDir, err)
-	}
-	if dryRun {
-		fmt.Printf(" - [dry-run] Removed package directory %q\n", destDir)
-	} else {
-		err = os.RemoveAll(destDir)
-		if err != nil {
-			return fmt.Errorf("failed to remove package dir %q: %w", destDir, err)
-		}
+		return nil, errors.Wrap(err, "failed to load trusted keys")
 	}
-	return nil
+	slog.Debug("loaded trusted keys", "count", keyring.Len(), "allow_unsigned", allowUnsigned)
+	return []kpkg.OpenOption{kpkg.WithKeyring(keyring), kpkg.WithAllowUnsigned(allowUnsigned)}, nil
 }
 
-// this is all begging to be refactored elsewhere
+// worldChanges are the changes to the world set, the packages that were asked for.
+type worldChanges struct {
+	request []state.Constraint
+	forget  []string
+}
 
-func downloadAndUnpack(
-	ctx context.Context, repo repository.Repository, rp *repository.RepoPackage, destDir string, dryRun bool,
+// performPackageChanges removes rm and installs add, and updates the world set.
+func performPackageChanges(
+	ctx context.Context, repo repository.Repository, add, rm []*repository.RepoPackage, world worldChanges,
+	dryRun bool, openOpts []kpkg.OpenOption, arch string,
 ) error {
+	slog.Debug("performPackageChanges()", "repo", repo.ID(), "add", len(add), "remove", len(rm), "dryRun", dryRun)
 	if dryRun {
-		fmt.Printf(" - [dry-run] Downloading and unpacking package %s to %s\n", rp, destDir)
+		for _, rp := range rm {
+			destDir := filepath.Join(version.BaseDir(), "pkgs", rp.ID)
+			fmt.Printf(" - [dry-run] /bin/sh -l %q\n", filepath.Join(destDir, "uninstall.sh"))
+			fmt.Printf(" - [dry-run] Removed package directory %q\n", destDir)
+		}
+		for _, rp := range add {
+			destDir := filepath.Join(version.BaseDir(), "pkgs", rp.ID)
+			fmt.Printf(" - [dry-run] Downloading and unpacking package %s to %s\n", rp, destDir)
+			fmt.Printf(" - [dry-run] /bin/sh -l %q\n", filepath.Join(destDir, "install.sh"))
+		}
+		fmt.Println("\n\033[1mDry run finished! No changes were made.\033[0m")
 		return nil
 	}
 
-	err := os.MkdirAll(destDir, 0o755) //nolint:gosec
+	// everything is downloaded and unpacked before anything installed is touched, and if any
+	// script fails, the installed packages are put back as they were
+	tx, err := transaction.New(transaction.WithMenu(reloadmenu.Regenerate))
 	if err != nil {
-		return errors.AddStack(err)
+		return errors.Annotate(err, "starting transaction")
 	}
-
-	tmpFile, err := os.CreateTemp("", "*.kpkg")
-	if err != nil {
-		return errors.Wrapf(err, "os.CreateTemp()")
+	defer tx.Close() //nolint:errcheck
+	for _, rp := range rm {
+		err := tx.Remove(rp.ID)
+		if err != nil {
+			return errors.AddStack(err)
+		}
 	}
-	defer func() {
-		_ = os.RemoveAll(tmpFile.Name())
-	}()
-
-	kpkgPath := tmpFile.Name()
-	slog.Debug("downloadPackage()", "kpkgPath", kpkgPath)
-	err = repo.DownloadPackage(ctx, rp, kpkgPath, dryRun)
-	if err != nil {
-		return errors.Wrapf(err, "repo.DownloadPackage(%q)", kpkgPath)
+	for _, rp := range add {
+		err := tx.Add(rp.ID, func(dir string) (*state.Origin, error) {
+			sum, err := downloadAndUnpack(ctx, repo, rp, dir, openOpts, arch)
+			if err != nil {
+				return nil, err
+			}
+			return &state.Origin{RepositoryID: rp.RepositoryID, SHA256: sum}, nil
+		})
+		if err != nil {
+			return errors.Wrapf(err, "failed to stage package %s", rp)
+		}
 	}
-
-	if dryRun {
-		fmt.Printf(" - [dry-run] Unpacked package %s to %s\n", rp, destDir)
-		return nil
+	for _, c := range world.request {
+		tx.Request(c)
 	}
-	kpkgFile, err := kpkg.Open(ctx, kpkgPath)
-	if err != nil {
-		return errors.Wrapf(err, "kpkg.Open(%q)", kpkgPath)
+	for _, id := range world.forget {
+		tx.Forget(id)
 	}
-	defer func() { _ = kpkgFile.Close() }()
-
-	tmpDir, err := os.MkdirTemp("", "kpm-extract-"+kpkgFile.Manifest.ID)
+	err = tx.Commit(ctx)
 	if err != nil {
-		return errors.Wrapf(err, "os.MkdirTemp()")
+		return errors.AddStack(err)
 	}
-	defer func() {
-		_ = os.RemoveAll(tmpDir)
-	}()
-	slog.Debug("extracting KPKG", "kpkg", kpkgPath, "destDir", tmpDir, "package", kpkgFile.Manifest)
+	for _, rp := range add {
+		fmt.Printf("\033[1m%s:\033[0m installed successfully\n", rp.ID)
+	}
+	return nil
+}
+
+// this is all begging to be refactored elsewhere
 
-	err = kpkgFile.ExtractAll(ctx, tmpDir, false, os.Stdout)
+func downloadAndUnpack(
+	ctx context.Context, repo repository.Repository, rp *repository.RepoPackage, destDir string,
+	openOpts []kpkg.OpenOption, arch string,
+) (string, error) {
+	// the package is extracted as it is downloaded, rather than going through a copy in /tmp
+	kpkgFile, err := repo.OpenPackage(ctx, rp, openOpts...)
 	if err != nil {
-		return errors.Wrapf(err, "kpkg.ExtractAll(%q, %q)", rp, tmpDir)
+		return "", errors.Wrapf(err, "repo.OpenPackage(%s)", rp)
 	}
-	err = copyDirSafe(tmpDir, destDir)
+	defer func() { _ = kpkgFile.Close() }()
+
+	// refuse packages that say they're too big up front; ExtractAll enforces the same limits on
+	// what's actually in them
+	err = kpkgFile.CheckLimits()
 	if err != nil {
-		return errors.Wrapf(err, "copyDirSafe(%q, %q)", tmpDir, destDir)
+		fmt.Printf(" - Refusing to install %s: %v\n", rp, err)
+		return "", errors.Wrapf(err, "checking limits for %s", rp)
 	}
 
-	return nil
-}
+	slog.Debug("extracting KPKG", "kpkg", rp, "destDir", destDir, "package", kpkgFile.Manifest, "arch", arch)
 
-func copyDirSafe(srcDir, destDir string) error {
-	srcFS := os.DirFS(srcDir)
-	err := fs.WalkDir(srcFS, ".", func(srcPath string, d fs.DirEntry, err error) error {
+	// only the common tree and this device's tree of a multi-arch package are installed, and
+	// pkgs/ is on /mnt/us, which can't hold symlinks
+	extractOpts := []kpkg.ExtractOption{kpkg.WithoutSymlinks()}
+	if arch != "" {
+		extractOpts = append(extractOpts, kpkg.WithArch(arch))
+	} else {
+		archs, err := kpkgFile.Archs()
 		if err != nil {
-			return errors.AddStack(err)
+			return "", errors.Wrapf(err, "reading %s", rp)
 		}
-		destPath := filepath.Join(destDir, srcPath)
-		slog.Debug("copyDirSafe()", "srcPath", srcPath, "destPath", destPath)
-
-		//nolint:exhaustive
-		switch d.Type() & fs.ModeType {
-		case fs.ModeSymlink:
-			slog.Warn("link copying is not supported on /mnt/us, skipping", "path", srcPath)
-			return nil
-		case fs.ModeDir:
-			err := os.MkdirAll(destPath, 0o755) //nolint:gosec
-			if err != nil {
-				return errors.Wrapf(err, "os.MkdirAll(%q)", destPath)
-			}
-			return nil
-		case 0: // regular file
-			srcFile, err := os.Open(filepath.Join(srcDir, srcPath))
-			if err != nil {
-				return errors.Wrapf(err, "os.Open(%q)", srcPath)
-			}
-			defer srcFile.Close()
-
-			destFile, err := os.Create(destPath)
-			if err != nil {
-				return errors.Wrapf(err, "os.Create(%q)", destPath)
-			}
-			defer destFile.Close()
-
-			_, err = io.Copy(destFile, srcFile)
-			if err != nil {
-				return errors.Wrapf(err, "io.Copy(%q, %q)", srcPath, destPath)
-			}
-		default:
-			slog.Warn("unsupported file type, skipping", "path", srcPath, "type", d.Type())
+		if len(archs) > 0 {
+			return "", errors.Errorf("%s has files for each of %v, but the device architecture is unknown; use --arch",
+				rp, archs)
 		}
-		return nil
-	})
-	return errors.AddStack(err)
-}
-
-func addPackage(ctx context.Context, repo repository.Repository, rp *repository.RepoPackage, dryRun bool) error {
-	baseDir := version.BaseDir()
-	// TODO: is this desirable? It means you can't assume you're in /mnt/us/kpm/pkgs/$name/, which
-	// could be useful if absolute paths are needed somewhere.
-	// pkgDirName := fmt.Sprintf("%s-%d.%d.%d", rp.ID, rp.Version.Major, rp.Version.Minor, rp.Version.Patch)
-	pkgDirName := rp.ID
-	pkgsDir := filepath.Join(baseDir, "pkgs")
-	destDir := filepath.Join(pkgsDir, pkgDirName)
-
-	slog.Debug("downloadAndUnpack()", "rp", rp, "destDir", destDir, "dryRun", dryRun)
-	err := downloadAndUnpack(ctx, repo, rp, destDir, dryRun)
-	if err != nil {
-		return errors.Wrapf(err, "failed to stage package %s", rp)
 	}
 
-	installerPath := destDir + "/install.sh"
-	_, err = os.Stat(installerPath)
-	if os.IsNotExist(err) {
-		slog.Debug("no install script for package %q", "path", rp.ID)
-		return nil
-	}
-	// TODO: add test for this behavior
-	err = os.Chmod(installerPath, 0o755) //nolint:gosec
+	// destDir is in the transaction's staging directory, next to pkgs/, so nothing is written
+	// twice or to the small tmpfs /tmp. Packages are only verified once ExtractAll has read all
+	// of them, and the transaction throws the staging directory away if it fails.
+	err = kpkgFile.ExtractAll(ctx, destDir, false, os.Stdout, extractOpts...)
 	if err != nil {
-		return fmt.Errorf("failed to make installer %q executable: %w", installerPath, err)
+		if ue, ok := kpkg.AsUnsafeEntryError(err); ok {
+			fmt.Printf(" - Refusing to install %s: archive entry %q: %s\n", rp, ue.Name, ue.Reason)
+		} else if errors.Cause(err) == kpkg.ErrLimitExceeded { //nolint:errorlint // pingcap/errors has no Is()
+			fmt.Printf(" - Refusing to install %s: %v\n", rp, err)
+		}
+		return "", errors.Wrapf(err, "kpkg.ExtractAll(%q, %q)", rp, destDir)
 	}
-
-	fmt.Printf("Running install script for %s (version %s)\n", rp.ID, rp.Version.String())
-
-	cmd := exec.CommandContext(ctx, "/bin/sh", "-l", installerPath)
-	cmd.Env = append(cmd.Env, os.Environ()...)
-	cmd.Env = append(cmd.Env, "KPM_INSTALL_DIR="+destDir)
-	cmd.Env = append(cmd.Env, "KPM_BASE_DIR="+baseDir)
-	cmd.Env = append(cmd.Env, "KPM_USERSTORE_DIR="+version.UserstoreDir())
-	cmd.Dir = destDir
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	if dryRun {
-		fmt.Printf(" - [dry-run] /bin/sh -l %q\n", installerPath)
-	} else {
-		err = cmd.Run()
+	if v := kpkgFile.Verification; v != nil {
+		fmt.Printf(" - Verified signature by %s (key %s)\n", v.Signer, v.KeyID)
 	}
+
+	// the digest of what was installed, for the installed-package database
+	sum, err := kpkgFile.PayloadSHA256(ctx)
 	if err != nil {
-		return fmt.Errorf("failed to install package %q: %w", installerPath, err)
+		return "", errors.Wrapf(err, "hashing %s", rp)
 	}
-	return nil
+	return sum, nil
 }
 
-func processKPKGArgs(ctx context.Context, fileArgs []string) ([]*resolver.Constraint, error) {
+// processKPKGArgs returns the constraints for installing the package files and their dependencies,
+// and the files' package IDs.
+func processKPKGArgs(
+	ctx context.Context, fileArgs []string, streamed ...*kpkg.KPKG,
+) ([]*resolver.Constraint, []string, error) {
 	var manifests []*manifest.Manifest
+	for _, k := range streamed {
+		manifests = append(manifests, k.Manifest)
+	}
 	for _, f := range fileArgs {
 		kpkg, err := kpkg.Open(ctx, f)
 		if err != nil {
-			return nil, errors.Wrapf(err, "kpkg.OpenKPKGFile(%q)", f)
+			return nil, nil, errors.Wrapf(err, "kpkg.OpenKPKGFile(%q)", f)
 		}
 		defer kpkg.Close() //nolint:errcheck
 		pkgManifest := kpkg.Manifest
 		if pkgManifest == nil {
-			return nil, fmt.Errorf("kpkg %q has no manifest", f)
+			return nil, nil, fmt.Errorf("kpkg %q has no manifest", f)
 		}
 		manifests = append(manifests, pkgManifest)
 	}
 
 	constraints, err := constraintsFromKPKGFiles(manifests)
 	if err != nil {
-		return nil, errors.Wrap(err, "failed to generate constraints from .kpkg files")
+		return nil, nil, errors.Wrap(err, "failed to generate constraints from .kpkg files")
 	}
 
-	return constraints, nil
+	ids := make([]string, 0, len(manifests))
+	for _, m := range manifests {
+		ids = append(ids, m.ID)
+	}
+	return constraints, ids, nil
 }
 
-// findFileArgs separates .kpkg file arguments from version constraint (foo=1.2.3) arguments.
+// findFileArgs separates .kpkg file arguments (or "-" for stdin) from version constraint (foo=1.2.3) arguments.
 func findFileArgs(args []string) ([]string, []string, error) {
 	var fileArgs []string
 	var rest []string
 	for _, arg := range args {
+		if arg == "-" {
+			fileArgs = append(fileArgs, arg)
+			continue
+		}
 		fi, _ := os.Stat(arg)
 		exists := fi != nil && fi.Mode().IsRegular()
 
@@ -0,0 +1,110 @@
+package lint
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/clintharrison/go-kindle-pkg/pkg/kpkg"
+	pkglint "github.com/clintharrison/go-kindle-pkg/pkg/lint"
+	"github.com/pingcap/errors"
+	"github.com/spf13/cobra"
+)
+
+// report is the --json output for one package.
+type report struct {
+	Target   string            `json:"target"`
+	Findings []pkglint.Finding `json:"findings"`
+}
+
+func NewCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "lint [flags] (package-dir | example.kpkg)...",
+		Short: "Check package directories or .kpkg files for packaging mistakes",
+		Long: `Check package directories or .kpkg files for packaging mistakes: invalid manifests, missing or
+non-POSIX install and uninstall scripts, CRLF line endings, undeclared dependencies in launch.sh,
+binaries that aren't executable, names that can't be stored on FAT, and suspicious paths.
+
+A directory is checked as create-kpkg would pack it. Each finding has a rule ID and a severity,
+and the command fails if any finding is an error. Use --list-rules to see them all.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			asJSON, err := cmd.Flags().GetBool("json")
+			if err != nil {
+				return errors.AddStack(err)
+			}
+			listRules, err := cmd.Flags().GetBool("list-rules")
+			if err != nil {
+				return errors.AddStack(err)
+			}
+			out := cmd.OutOrStdout()
+
+			if listRules {
+				if asJSON {
+					return errors.AddStack(json.NewEncoder(out).Encode(pkglint.Rules()))
+				}
+				for _, r := range pkglint.Rules() {
+					fmt.Fprintf(out, "%-26s %-8s %s\n", r.ID, r.Severity, r.Summary) //nolint:errcheck
+				}
+				return nil
+			}
+			if len(args) == 0 {
+				_ = cmd.Usage()
+				_, _ = cmd.OutOrStderr().Write([]byte("\n"))
+				return errors.New("at least one package directory or .kpkg file must be specified")
+			}
+
+			reports := make([]report, 0, len(args))
+			failed := 0
+			for _, target := range args {
+				findings, err := lintTarget(cmd, target)
+				if err != nil {
+					return err
+				}
+				if pkglint.HasErrors(findings) {
+					failed++
+				}
+				reports = append(reports, report{Target: target, Findings: findings})
+			}
+
+			if asJSON {
+				enc := json.NewEncoder(out)
+				enc.SetIndent("", "  ")
+				err = enc.Encode(reports)
+				if err != nil {
+					return errors.AddStack(err)
+				}
+			} else {
+				for _, r := range reports {
+					for _, f := range r.Findings {
+						fmt.Fprintf(out, "%s: %s\n", r.Target, f) //nolint:errcheck
+					}
+				}
+			}
+			if failed > 0 {
+				return errors.Errorf("%d of %d packages have errors", failed, len(args))
+			}
+			return nil
+		},
+	}
+
+	cmd.Flags().Bool("json", false, "Print the findings as JSON")
+	cmd.Flags().Bool("list-rules", false, "List the rules, with their IDs and severities, instead of checking anything")
+
+	return cmd
+}
+
+func lintTarget(cmd *cobra.Command, target string) ([]pkglint.Finding, error) {
+	fi, err := os.Stat(target)
+	if err != nil {
+		return nil, errors.AddStack(err)
+	}
+	if fi.IsDir() {
+		return pkglint.Dir(cmd.Context(), target) //nolint:wrapcheck
+	}
+	k, err := kpkg.Open(cmd.Context(), target)
+	if err != nil {
+		return nil, errors.Wrapf(err, "kpkg.Open(%q)", target)
+	}
+	defer func() { _ = k.Close() }()
+	return pkglint.Package(cmd.Context(), k) //nolint:wrapcheck
+}
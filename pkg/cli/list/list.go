@@ -16,7 +16,7 @@ func NewCommand() *cobra.Command {
 		Use:   "list [flags]",
 		Short: "List available packages",
 		RunE: func(cmd *cobra.Command, _ []string) error {
-			repo, err := clicommon.GetRepoFromArgs(cmd)
+			repo, err := clicommon.GetRepoFromArgs(cmd, false)
 			if err != nil {
 				return errors.Wrap(err, "failed to initialize package repository")
 			}
@@ -0,0 +1,78 @@
+package ls
+
+import (
+	"fmt"
+	"io/fs"
+
+	"github.com/clintharrison/go-kindle-pkg/pkg/cli/clicommon"
+	"github.com/clintharrison/go-kindle-pkg/pkg/kpkg"
+	"github.com/pingcap/errors"
+	"github.com/spf13/cobra"
+)
+
+func NewCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "ls [flags] example.kpkg [path/in/package]",
+		Short: "List the files in a .kpkg file without extracting it",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := cmd.Context()
+			if len(args) < 1 || len(args) > 2 {
+				_ = cmd.Usage()
+				_, _ = cmd.OutOrStderr().Write([]byte("\n"))
+				return errors.Errorf("exactly one .kpkg file must be specified, got %d", len(args))
+			}
+			packagePath := args[0]
+			root := "."
+			if len(args) == 2 {
+				root = clicommon.PackagePath(args[1])
+			}
+			long, err := cmd.Flags().GetBool("long")
+			if err != nil {
+				return errors.AddStack(err)
+			}
+
+			pkg, err := kpkg.Open(ctx, packagePath)
+			if err != nil {
+				return errors.Wrapf(err, "kpkg.Open(%q)", packagePath)
+			}
+			defer func() { _ = pkg.Close() }()
+			fsys, err := pkg.FS(ctx)
+			if err != nil {
+				return errors.Wrapf(err, "reading %q", packagePath)
+			}
+
+			out := cmd.OutOrStdout()
+			err = fs.WalkDir(fsys, root, func(name string, d fs.DirEntry, err error) error {
+				if err != nil {
+					return err
+				}
+				if name == "." {
+					return nil
+				}
+				if d.IsDir() {
+					name += "/"
+				}
+				if !long {
+					fmt.Fprintln(out, name) //nolint:errcheck
+					return nil
+				}
+				info, err := d.Info()
+				if err != nil {
+					return errors.AddStack(err)
+				}
+				if d.Type()&fs.ModeSymlink != 0 {
+					target, err := fsys.ReadLink(name)
+					if err != nil {
+						return err
+					}
+					name += " -> " + target
+				}
+				fmt.Fprintf(out, "%s %10d %s\n", info.Mode(), info.Size(), name) //nolint:errcheck
+				return nil
+			})
+			return errors.Wrapf(err, "listing %q", root)
+		},
+	}
+	cmd.Flags().BoolP("long", "l", false, "Show modes, sizes and link targets")
+	return cmd
+}
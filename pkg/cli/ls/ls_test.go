@@ -0,0 +1,42 @@
+package ls_test
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/clintharrison/go-kindle-pkg/pkg/cli/ls"
+	"github.com/clintharrison/go-kindle-pkg/pkg/kpkg"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLsCmd(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "bin"), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "manifest.json"), //nolint:gosec
+		[]byte(`{"id": "hello", "name": "Hello", "version": [1, 0, 0]}`), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "bin/hello"), []byte("#!/bin/sh\n"), 0o755)) //nolint:gosec
+	require.NoError(t, os.Symlink("hello", filepath.Join(dir, "bin/hi")))
+	p := filepath.Join(t.TempDir(), "hello.kpkg")
+	require.NoError(t, kpkg.Build(t.Context(), dir, p, kpkg.WithXZCompression))
+
+	cmd := ls.NewCommand()
+	out := new(bytes.Buffer)
+	cmd.SetOut(out)
+	cmd.SetArgs([]string{p})
+	require.NoError(t, cmd.Execute())
+	require.Equal(t, "bin/\nbin/hello\nbin/hi\ncontents.json\nmanifest.json\n", out.String())
+
+	cmd = ls.NewCommand()
+	out = new(bytes.Buffer)
+	cmd.SetOut(out)
+	cmd.SetArgs([]string{"-l", p, "./bin"})
+	require.NoError(t, cmd.Execute())
+	require.Equal(t, `drwxr-xr-x          0 bin/
+-rwxr-xr-x         10 bin/hello
+Lrwxrwxrwx          0 bin/hi -> hello
+`, out.String())
+}
@@ -0,0 +1,98 @@
+package recovery
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/clintharrison/go-kindle-pkg/pkg/cli/reloadmenu"
+	"github.com/clintharrison/go-kindle-pkg/pkg/transaction"
+	"github.com/clintharrison/go-kindle-pkg/pkg/version"
+	"github.com/pingcap/errors"
+	"github.com/spf13/cobra"
+)
+
+func NewCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "recover [flags]",
+		Short: "Finish or undo an install or uninstall that was interrupted",
+		Long: `Finish or undo an install or uninstall that was interrupted, e.g. by the Kindle
+going to sleep or running out of battery, using the journal it left in the base directory.
+
+By default, changes are rolled forward if every package had been downloaded and the
+installed packages had started changing, and rolled back otherwise.`,
+		RunE: func(cmd *cobra.Command, _ []string) error {
+			ctx := cmd.Context()
+			forward, err := cmd.Flags().GetBool("forward")
+			if err != nil {
+				return errors.AddStack(err)
+			}
+			back, err := cmd.Flags().GetBool("back")
+			if err != nil {
+				return errors.AddStack(err)
+			}
+
+			opts := []transaction.Option{
+				transaction.WithOutput(cmd.OutOrStdout()), transaction.WithMenu(reloadmenu.Regenerate),
+			}
+			s, err := transaction.Interrupted(opts...)
+			if errors.Cause(err) == transaction.ErrRunning { //nolint:errorlint // pingcap/errors has no Is()
+				return errors.Annotate(err, "not recovering")
+			}
+			if err != nil {
+				return errors.Annotate(err, "reading the journal")
+			}
+			out := cmd.OutOrStdout()
+			if s == nil {
+				fmt.Fprintln(out, "Nothing to recover") //nolint:errcheck
+				return nil
+			}
+			printStatus(cmd, s)
+			if !forward && !back {
+				forward = s.CanRollForward()
+			}
+			err = transaction.Recover(ctx, forward, opts...)
+			if err != nil {
+				return errors.Annotate(err, "recovering")
+			}
+			fmt.Fprintln(out, "\033[1mRecovered successfully\033[0m") //nolint:errcheck
+			return nil
+		},
+	}
+	cmd.Flags().Bool("forward", false, "Finish the changes")
+	cmd.Flags().Bool("back", false, "Undo the changes")
+	cmd.MarkFlagsMutuallyExclusive("forward", "back")
+	return cmd
+}
+
+func printStatus(cmd *cobra.Command, s *transaction.Status) {
+	out := cmd.OutOrStdout()
+	switch {
+	case s.RollingBack:
+		fmt.Fprintln(out, "An interrupted transaction was being rolled back") //nolint:errcheck
+	case s.Committed:
+		fmt.Fprintln(out, "An interrupted transaction had changed every package") //nolint:errcheck
+	case s.Committing:
+		fmt.Fprintln(out, "An interrupted transaction was changing packages") //nolint:errcheck
+	default:
+		fmt.Fprintln(out, "An interrupted transaction was downloading packages") //nolint:errcheck
+	}
+	if len(s.Remove) > 0 {
+		fmt.Fprintf(out, "  removing: %s\n", strings.Join(s.Remove, ", ")) //nolint:errcheck
+	}
+	if len(s.Add) > 0 {
+		fmt.Fprintf(out, "  installing: %s\n", strings.Join(s.Add, ", ")) //nolint:errcheck
+	}
+	if s.Last != nil {
+		fmt.Fprintf(out, "  last step: %s %s\n", s.Last.Op, s.Last.ID) //nolint:errcheck
+	}
+}
+
+// WarnIfInterrupted tells the user to run recover if a transaction was interrupted.
+func WarnIfInterrupted(cmd *cobra.Command) {
+	s, err := transaction.Interrupted()
+	if err != nil || s == nil {
+		return
+	}
+	fmt.Fprintf(cmd.ErrOrStderr(), //nolint:errcheck
+		"WARNING: a package transaction was interrupted; run `%s recover` to finish or undo it\n", version.CLIName)
+}
@@ -37,17 +37,10 @@ func NewCommand() *cobra.Command {
 				return errors.AddStack(err)
 			}
 			if write {
-				menuPath := filepath.Join(version.UserstoreDir(), "extensions", "kpmgo", "menu.json")
-				f, err := os.Create(menuPath)
+				err := writeMenu(menuJSON)
 				if err != nil {
-					return errors.Wrapf(err, "os.Create(%q)", menuPath)
+					return err
 				}
-				defer f.Close()
-				_, err = f.Write(menuJSON)
-				if err != nil {
-					return errors.Wrapf(err, "writing regenerated menu.json to %q", menuPath)
-				}
-				slog.Info("regenerated menu.json written", "path", menuPath)
 			} else {
 				_, err = cmd.OutOrStdout().Write(menuJSON)
 				if err != nil {
@@ -61,6 +54,46 @@ func NewCommand() *cobra.Command {
 	return cmd
 }
 
+// MenuPath is the kpmgo extension's menu.json.
+func MenuPath() string {
+	return filepath.Join(version.UserstoreDir(), "extensions", "kpmgo", "menu.json")
+}
+
+// Regenerate rewrites the kpmgo extension's menu.json for the installed packages, if the
+// extension is there.
+func Regenerate() error {
+	_, err := os.Stat(filepath.Dir(MenuPath()))
+	if os.IsNotExist(err) {
+		slog.Debug("kpmgo extension isn't installed, not regenerating its menu", "path", MenuPath())
+		return nil
+	}
+	installedPkgs, err := state.GetInstalledPackages()
+	if err != nil {
+		return errors.AddStack(err)
+	}
+	menuJSON, err := json.MarshalIndent(generateMenuJSON(installedPkgs), "", "  ")
+	if err != nil {
+		return errors.AddStack(err)
+	}
+	return writeMenu(menuJSON)
+}
+
+// writeMenu replaces menu.json by renaming, so KUAL never sees half of one.
+func writeMenu(menuJSON []byte) error {
+	menuPath := MenuPath()
+	tmpPath := menuPath + ".tmp"
+	err := os.WriteFile(tmpPath, menuJSON, 0o644) //nolint:gosec
+	if err != nil {
+		return errors.Wrapf(err, "writing regenerated menu.json to %q", tmpPath)
+	}
+	err = os.Rename(tmpPath, menuPath)
+	if err != nil {
+		return errors.Wrapf(err, "os.Rename(%q, %q)", tmpPath, menuPath)
+	}
+	slog.Info("regenerated menu.json written", "path", menuPath)
+	return nil
+}
+
 type KUALMenu struct {
 	Items []*KUALMenuItem `json:"items"`
 }
@@ -0,0 +1,136 @@
+package verify
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/clintharrison/go-kindle-pkg/pkg/kpkg"
+	"github.com/clintharrison/go-kindle-pkg/pkg/state"
+	"github.com/clintharrison/go-kindle-pkg/pkg/version"
+	"github.com/pingcap/errors"
+	"github.com/spf13/cobra"
+)
+
+func NewCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "verify [flags] [example.kpkg | package-id]...",
+		Short: "Verify .kpkg signatures, or the files of installed packages",
+		Long: "Verify the detached signature of .kpkg files, and check the files of installed packages\n" +
+			"against the contents list they were built with. With no arguments, every installed package is checked.",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if len(args) == 0 {
+				installed, err := state.GetInstalledPackages()
+				if err != nil {
+					return errors.Wrap(err, "failed to get installed packages")
+				}
+				for id := range installed {
+					args = append(args, id)
+				}
+				slices.Sort(args)
+			}
+
+			keysDir, err := cmd.Flags().GetString("keys")
+			if err != nil {
+				return errors.AddStack(err)
+			}
+			keyring, err := kpkg.LoadKeyring(keysDir)
+			if err != nil {
+				return errors.Wrap(err, "failed to load trusted keys")
+			}
+
+			failed := 0
+			for _, arg := range args {
+				var ok bool
+				if isPackageFile(arg) {
+					ok, err = verifyPackage(cmd, keyring, arg)
+				} else {
+					ok, err = verifyInstalled(cmd, arg)
+				}
+				if err != nil {
+					return err
+				}
+				if !ok {
+					failed++
+				}
+			}
+			if failed > 0 {
+				return errors.Errorf("%d of %d package(s) failed verification", failed, len(args))
+			}
+			return nil
+		},
+	}
+	cmd.Flags().String("keys", kpkg.TrustedKeysDir(), "Directory of trusted publisher keys (*.pem)")
+	return cmd
+}
+
+func verifyPackage(cmd *cobra.Command, keyring *kpkg.Keyring, packagePath string) (bool, error) {
+	out := cmd.OutOrStdout()
+
+	sig, err := kpkg.ReadSignatureFile(packagePath + kpkg.SignatureSuffix)
+	if err != nil {
+		fmt.Fprintf(out, "%s: FAIL unsigned (%v)\n", packagePath, errors.Cause(err)) //nolint:errcheck
+		return false, nil
+	}
+
+	pkg, err := kpkg.Open(cmd.Context(), packagePath)
+	if err != nil {
+		return false, errors.Wrapf(err, "kpkg.Open(%q)", packagePath)
+	}
+	defer pkg.Close()
+
+	signer := "<untrusted>"
+	if k := keyring.Lookup(sig.KeyID); k != nil {
+		signer = k.Name
+	}
+	v, err := pkg.Verify(cmd.Context(), sig, keyring)
+	if err != nil {
+		fmt.Fprintf(out, "%s: FAIL signer=%s key_id=%s: %v\n", packagePath, signer, sig.KeyID, err) //nolint:errcheck
+		return false, nil
+	}
+	fmt.Fprintf(out, "%s: OK signer=%s key_id=%s payload_sha256=%s\n", //nolint:errcheck
+		packagePath, v.Signer, v.KeyID, v.PayloadSHA256)
+	return true, nil
+}
+
+// isPackageFile tells .kpkg file arguments apart from installed package IDs.
+func isPackageFile(arg string) bool {
+	if strings.HasSuffix(arg, ".kpkg") {
+		return true
+	}
+	fi, err := os.Stat(arg)
+	return err == nil && fi.Mode().IsRegular()
+}
+
+func verifyInstalled(cmd *cobra.Command, packageID string) (bool, error) {
+	out := cmd.OutOrStdout()
+	pkgDir := filepath.Join(version.BaseDir(), "pkgs", packageID)
+	_, err := os.Stat(pkgDir)
+	if err != nil {
+		return false, errors.Errorf("package %q is not installed", packageID)
+	}
+
+	contents, err := kpkg.ReadContentsFile(filepath.Join(pkgDir, kpkg.ContentsFileName))
+	if err != nil {
+		if os.IsNotExist(errors.Cause(err)) {
+			fmt.Fprintf(out, "%s: SKIP package was built without a contents list\n", packageID) //nolint:errcheck
+			return true, nil
+		}
+		return false, err
+	}
+	ds, err := kpkg.VerifyDir(pkgDir, contents)
+	if err != nil {
+		return false, errors.Wrapf(err, "verifying %q", pkgDir)
+	}
+	if len(ds) == 0 {
+		fmt.Fprintf(out, "%s: OK %d entries\n", packageID, len(contents.Files)) //nolint:errcheck
+		return true, nil
+	}
+	fmt.Fprintf(out, "%s: FAIL %d discrepancies\n", packageID, len(ds)) //nolint:errcheck
+	for _, d := range ds {
+		fmt.Fprintf(out, "  %s\n", d) //nolint:errcheck
+	}
+	return false, nil
+}
@@ -0,0 +1,181 @@
+package kpkg
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/pingcap/errors"
+)
+
+// Architectures that Kindle packages are built for.
+const (
+	// ArchArmel is soft-float ARM, for firmware before 5.16.3.
+	ArchArmel = "armel"
+	// ArchArmhf is hard-float ARM, for firmware 5.16.3 and later.
+	ArchArmhf = "armhf"
+)
+
+const (
+	efARMABIFloatSoft = 0x200
+	efARMABIFloatHard = 0x400
+)
+
+// DetectELFArch works out the architecture an ELF binary runs on. For 32-bit ARM that includes the
+// float ABI: the dynamic loader a binary asks for settles it, and for shared libraries, which
+// don't ask for one, the EABI flags do. Static executables need no loader and run on either
+// firmware whatever their flags say, so they return "".
+// Anything else is named after its machine, e.g. "arm64" or "amd64", so it doesn't match any Kindle.
+func DetectELFArch(r io.ReaderAt) (string, error) {
+	f, err := elf.NewFile(r)
+	if err != nil {
+		return "", errors.Wrap(err, "elf.NewFile()")
+	}
+	defer f.Close()
+
+	switch f.Machine { //nolint:exhaustive
+	case elf.EM_ARM:
+	case elf.EM_AARCH64:
+		return "arm64", nil
+	case elf.EM_X86_64:
+		return "amd64", nil
+	case elf.EM_386:
+		return "386", nil
+	default:
+		return strings.ToLower(strings.TrimPrefix(f.Machine.String(), "EM_")), nil
+	}
+
+	dynamic := false
+	for _, p := range f.Progs {
+		if p.Type != elf.PT_INTERP {
+			continue
+		}
+		dynamic = true
+		interp, err := io.ReadAll(p.Open())
+		if err != nil {
+			return "", errors.Wrap(err, "reading PT_INTERP")
+		}
+		switch s := string(bytes.TrimRight(interp, "\x00")); {
+		case strings.Contains(s, "ld-linux-armhf"):
+			return ArchArmhf, nil
+		case strings.HasSuffix(s, "/ld-linux.so.3"):
+			return ArchArmel, nil
+		}
+	}
+
+	if !dynamic && f.Type != elf.ET_DYN {
+		return "", nil
+	}
+	flags, err := elfFlags(r, f)
+	if err != nil {
+		return "", err
+	}
+	switch {
+	case flags&efARMABIFloatHard != 0:
+		return ArchArmhf, nil
+	case flags&efARMABIFloatSoft != 0:
+		return ArchArmel, nil
+	default:
+		return "", nil
+	}
+}
+
+// elfFlags reads e_flags, which debug/elf doesn't expose.
+func elfFlags(r io.ReaderAt, f *elf.File) (uint32, error) {
+	off := int64(36)
+	if f.Class == elf.ELFCLASS64 {
+		off = 48
+	}
+	var buf [4]byte
+	_, err := r.ReadAt(buf[:], off)
+	if err != nil {
+		return 0, errors.Wrap(err, "reading e_flags")
+	}
+	if f.ByteOrder == binary.BigEndian {
+		return binary.BigEndian.Uint32(buf[:]), nil
+	}
+	return binary.LittleEndian.Uint32(buf[:]), nil
+}
+
+// DetectFileArch is DetectELFArch for the file at path, which may not be an ELF file at all.
+func DetectFileArch(path string) (string, bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", false, errors.Wrapf(err, "os.Open(%q)", path)
+	}
+	defer f.Close()
+
+	magic := make([]byte, len(elf.ELFMAG))
+	_, err = f.ReadAt(magic, 0)
+	if err != nil || string(magic) != elf.ELFMAG {
+		return "", false, nil //nolint:nilerr // too short to be ELF
+	}
+	arch, err := DetectELFArch(f)
+	if err != nil {
+		return "", true, errors.Annotatef(err, "in %q", path)
+	}
+	return arch, true, nil
+}
+
+// ArchMismatchError is returned by Build when a package's binaries don't agree with its supported_arch.
+type ArchMismatchError struct {
+	Declared []string
+	// Binaries maps each package path to the architecture detected for it.
+	Binaries map[string]string
+}
+
+func (e *ArchMismatchError) Error() string {
+	paths := make([]string, 0, len(e.Binaries))
+	for p := range e.Binaries {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	found := make([]string, 0, len(paths))
+	for _, p := range paths {
+		found = append(found, fmt.Sprintf("%s is %s", p, e.Binaries[p]))
+	}
+	if len(e.Declared) == 0 {
+		return "package has binaries for more than one architecture: " + strings.Join(found, ", ")
+	}
+	return fmt.Sprintf("manifest supported_arch is %v, but %s", e.Declared, strings.Join(found, ", "))
+}
+
+// AsArchMismatchError returns the *ArchMismatchError at the root of err, if there is one.
+func AsArchMismatchError(err error) (*ArchMismatchError, bool) {
+	ae, ok := errors.Cause(err).(*ArchMismatchError) //nolint:errorlint // pingcap/errors has no As()
+	return ae, ok
+}
+
+// checkBinaryArch works out the architecture of the package from the binaries in it. Binaries
+// that run anywhere are ignored; the rest must agree with each other and with declared, if it's set.
+func checkBinaryArch(declared []string, binaries map[string]string) (string, error) {
+	var archs []string
+	constrained := map[string]string{}
+	for p, arch := range binaries {
+		if arch == "" {
+			continue
+		}
+		constrained[p] = arch
+		if !slices.Contains(archs, arch) {
+			archs = append(archs, arch)
+		}
+	}
+	if len(archs) == 0 {
+		return "", nil
+	}
+	if len(archs) > 1 {
+		return "", errors.AddStack(&ArchMismatchError{Declared: nil, Binaries: constrained})
+	}
+	for _, d := range declared {
+		if d != archs[0] {
+			return "", errors.AddStack(&ArchMismatchError{Declared: declared, Binaries: constrained})
+		}
+	}
+	return archs[0], nil
+}
@@ -0,0 +1,185 @@
+package kpkg_test
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"path/filepath"
+	"testing"
+
+	"github.com/clintharrison/go-kindle-pkg/pkg/kpkg"
+	"github.com/clintharrison/go-kindle-pkg/pkg/repository/manifest"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeELF returns the headers of a little-endian 32-bit ELF file, with a PT_INTERP if interp is set.
+func fakeELF(t *testing.T, typ elf.Type, machine elf.Machine, flags uint32, interp string) string {
+	t.Helper()
+	hdr := elf.Header32{ //nolint:exhaustruct
+		Type:      uint16(typ),
+		Machine:   uint16(machine),
+		Version:   uint32(elf.EV_CURRENT),
+		Flags:     flags,
+		Ehsize:    52,
+		Phentsize: 32,
+		Shentsize: 40,
+	}
+	copy(hdr.Ident[:], elf.ELFMAG)
+	hdr.Ident[elf.EI_CLASS] = byte(elf.ELFCLASS32)
+	hdr.Ident[elf.EI_DATA] = byte(elf.ELFDATA2LSB)
+	hdr.Ident[elf.EI_VERSION] = byte(elf.EV_CURRENT)
+	var progs []elf.Prog32
+	if interp != "" {
+		hdr.Phoff = 52
+		hdr.Phnum = 1
+		progs = append(progs, elf.Prog32{ //nolint:exhaustruct
+			Type:   uint32(elf.PT_INTERP),
+			Off:    52 + 32,
+			Filesz: uint32(len(interp) + 1), //nolint:gosec
+			Memsz:  uint32(len(interp) + 1), //nolint:gosec
+			Flags:  uint32(elf.PF_R),
+			Align:  1,
+		})
+	}
+
+	buf := &bytes.Buffer{}
+	require.NoError(t, binary.Write(buf, binary.LittleEndian, hdr))
+	require.NoError(t, binary.Write(buf, binary.LittleEndian, progs))
+	if interp != "" {
+		buf.WriteString(interp + "\x00")
+	}
+	return buf.String()
+}
+
+func TestDetectELFArch(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		name    string
+		typ     elf.Type
+		machine elf.Machine
+		flags   uint32
+		interp  string
+		want    string
+	}{
+		{"armhf loader", elf.ET_EXEC, elf.EM_ARM, 0x05000000, "/lib/ld-linux-armhf.so.3", kpkg.ArchArmhf},
+		{"armel loader", elf.ET_EXEC, elf.EM_ARM, 0x05000000, "/lib/ld-linux.so.3", kpkg.ArchArmel},
+		{"loader wins over flags", elf.ET_EXEC, elf.EM_ARM, 0x05000400, "/lib/ld-linux.so.3", kpkg.ArchArmel},
+		{"hard float library", elf.ET_DYN, elf.EM_ARM, 0x05000400, "", kpkg.ArchArmhf},
+		{"soft float library", elf.ET_DYN, elf.EM_ARM, 0x05000200, "", kpkg.ArchArmel},
+		{"unspecified float ABI", elf.ET_DYN, elf.EM_ARM, 0x05000000, "", ""},
+		{"static soft float", elf.ET_EXEC, elf.EM_ARM, 0x05000200, "", ""},
+		{"static hard float", elf.ET_EXEC, elf.EM_ARM, 0x05000400, "", ""},
+		{"aarch64", elf.ET_EXEC, elf.EM_AARCH64, 0, "", "arm64"},
+		{"x86-64", elf.ET_EXEC, elf.EM_X86_64, 0, "/lib64/ld-linux-x86-64.so.2", "amd64"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			arch, err := kpkg.DetectELFArch(bytes.NewReader([]byte(fakeELF(t, tc.typ, tc.machine, tc.flags, tc.interp))))
+			require.NoError(t, err)
+			require.Equal(t, tc.want, arch)
+		})
+	}
+
+	_, err := kpkg.DetectELFArch(bytes.NewReader([]byte("#!/bin/sh\n")))
+	require.Error(t, err)
+}
+
+func TestBuild_ArchCheck(t *testing.T) {
+	t.Parallel()
+	ctx := t.Context()
+	armhf := fakeELF(t, elf.ET_EXEC, elf.EM_ARM, 0x05000400, "/lib/ld-linux-armhf.so.3")
+	armel := fakeELF(t, elf.ET_EXEC, elf.EM_ARM, 0x05000200, "/lib/ld-linux.so.3")
+	static := fakeELF(t, elf.ET_EXEC, elf.EM_ARM, 0x05000000, "")
+	// what the usual soft-float and softfp Kindle toolchains build with -static
+	staticSoft := fakeELF(t, elf.ET_EXEC, elf.EM_ARM, 0x05000200, "")
+	libSoft := fakeELF(t, elf.ET_DYN, elf.EM_ARM, 0x05000200, "")
+
+	t.Run("fills in supported_arch", func(t *testing.T) {
+		t.Parallel()
+		p := buildPackage(t, map[string]string{
+			"manifest.json": testManifest,
+			"bin/tool":      armhf,
+			"bin/static":    static,
+			"bin/script":    "#!/bin/sh\n",
+		})
+		k, err := kpkg.Open(ctx, p)
+		require.NoError(t, err)
+		defer k.Close()
+		require.Equal(t, []string{kpkg.ArchArmhf}, k.Manifest.SupportedArch)
+	})
+
+	t.Run("matches supported_arch", func(t *testing.T) {
+		t.Parallel()
+		p := buildPackage(t, map[string]string{
+			"manifest.json": `{"id": "signed", "name": "Signed", "version": [1, 0, 0], "supported_arch": ["armel"]}`,
+			"bin/tool":      armel,
+		})
+		k, err := kpkg.Open(ctx, p)
+		require.NoError(t, err)
+		defer k.Close()
+		require.Equal(t, []string{kpkg.ArchArmel}, k.Manifest.SupportedArch)
+	})
+
+	for name, supported := range map[string][]string{
+		"static binary for both":  {kpkg.ArchArmel, kpkg.ArchArmhf},
+		"static binary for armhf": {kpkg.ArchArmhf},
+	} {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			m := &manifest.Manifest{ID: "signed", Name: "Signed", SupportedArch: supported} //nolint:exhaustruct
+			p := buildPackage(t, map[string]string{"bin/static": staticSoft}, kpkg.WithManifest(m))
+			k, err := kpkg.Open(ctx, p)
+			require.NoError(t, err)
+			defer k.Close()
+			require.Equal(t, supported, k.Manifest.SupportedArch)
+		})
+	}
+
+	t.Run("static binary beside armhf ones", func(t *testing.T) {
+		t.Parallel()
+		p := buildPackage(t, map[string]string{
+			"manifest.json": testManifest,
+			"bin/tool":      armhf,
+			"bin/helper":    staticSoft,
+		})
+		k, err := kpkg.Open(ctx, p)
+		require.NoError(t, err)
+		defer k.Close()
+		require.Equal(t, []string{kpkg.ArchArmhf}, k.Manifest.SupportedArch)
+	})
+
+	for name, files := range map[string]map[string]string{
+		"contradicts supported_arch": {
+			"manifest.json": `{"id": "signed", "name": "Signed", "version": [1, 0, 0], "supported_arch": ["armel"]}`,
+			"bin/tool":      armhf,
+		},
+		"claims both": {
+			"manifest.json": `{"id": "signed", "name": "Signed", "version": [1, 0, 0], "supported_arch": ["armel", "armhf"]}`,
+			"bin/tool":      armhf,
+		},
+		"mixed binaries": {
+			"manifest.json": testManifest,
+			"bin/tool":      armhf,
+			"lib/libold.so": libSoft,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			dest := filepath.Join(t.TempDir(), "test.kpkg")
+			err := kpkg.Build(ctx, writePackageDir(t, files), dest)
+			_, ok := kpkg.AsArchMismatchError(err)
+			require.True(t, ok, "expected an ArchMismatchError, got %v", err)
+
+			// unless the check is skipped
+			require.NoError(t, kpkg.Build(ctx, writePackageDir(t, files), dest, kpkg.WithSkipArchCheck()))
+		})
+	}
+
+	t.Run("WithManifest is not modified", func(t *testing.T) {
+		t.Parallel()
+		m := &manifest.Manifest{ID: "signed", Name: "Signed"} //nolint:exhaustruct
+		buildPackage(t, map[string]string{"bin/tool": armel}, kpkg.WithManifest(m))
+		require.Empty(t, m.SupportedArch)
+	})
+}
@@ -3,30 +3,94 @@ package kpkg
 import (
 	"archive/tar"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"io"
 	"io/fs"
+	"log/slog"
+	"maps"
 	"os"
+	"path"
 	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
 	"time"
 
+	"github.com/clintharrison/go-kindle-pkg/pkg/repository/manifest"
 	"github.com/pingcap/errors"
-	"github.com/ulikunitz/xz"
 )
 
+// normalizedModTime is used for every entry so builds don't depend on when files were touched,
+// unless SOURCE_DATE_EPOCH or WithModTime ask for a different time.
+var normalizedModTime = time.Date(2000, time.January, 1, 0, 0, 0, 0, time.UTC) //nolint:gochecknoglobals
+
 type BuildOption func(*options) error
 
 type options struct {
-	compressor func(io.WriteCloser) (io.WriteCloser, error)
+	compression Compression
+	level       int
+	modTime     time.Time
+	manifest    *manifest.Manifest
+	// skipArchCheck packs binaries without checking them against supported_arch
+	skipArchCheck bool
 }
 
-func WithXZCompression(opts *options) error {
-	opts.compressor = func(w io.WriteCloser) (io.WriteCloser, error) {
-		return xz.NewWriter(w)
+// WithManifest packs m as the manifest.json, instead of the one in the package directory.
+func WithManifest(m *manifest.Manifest) BuildOption {
+	return func(opts *options) error {
+		opts.manifest = m
+		return nil
+	}
+}
+
+// WithSkipArchCheck packs ELF binaries without checking that they match the manifest's
+// supported_arch, or filling it in when it's empty.
+func WithSkipArchCheck() BuildOption {
+	return func(opts *options) error {
+		opts.skipArchCheck = true
+		return nil
 	}
-	return nil
 }
 
+// WithModTime sets the modification time recorded for every entry.
+func WithModTime(t time.Time) BuildOption {
+	return func(opts *options) error {
+		opts.modTime = t.UTC()
+		return nil
+	}
+}
+
+// sourceDateEpoch returns the time in $SOURCE_DATE_EPOCH, or normalizedModTime if it isn't set.
+// See https://reproducible-builds.org/specs/source-date-epoch/
+func sourceDateEpoch() (time.Time, error) {
+	v := os.Getenv("SOURCE_DATE_EPOCH")
+	if v == "" {
+		return normalizedModTime, nil
+	}
+	secs, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || secs < 0 {
+		return time.Time{}, errors.Errorf("invalid SOURCE_DATE_EPOCH %q", v)
+	}
+	return time.Unix(secs, 0).UTC(), nil
+}
+
+// Build packages the directory at rootPath into dest, along with anything its BuildSpecFileName
+// maps in from elsewhere.
+//
+// The output is reproducible: it depends only on the names, types, contents and executable bits
+// of the files, and on the options, so the same tree builds to the same bytes on any machine.
+//   - Entries are written as "./", manifest.json, contents.json, and then everything else in the
+//     depth-first, lexical order that filepath.WalkDir would visit them in.
+//   - Headers are GNU format, with uid/gid 0, no user or group names, no access or change times,
+//     and the modification time from WithModTime, SOURCE_DATE_EPOCH or 2000-01-01 UTC, in that order.
+//   - Modes are normalized like git does: 0755 for directories and executables, 0644 for other
+//     files and 0777 for symlinks, and then the build spec's overrides are applied.
+//   - Unless WithSkipArchCheck is given, the ELF binaries must all be for one architecture, which
+//     must match supported_arch. If supported_arch is empty, it is filled in.
+//   - Every compressor setting is fixed, though a different Go or codec library version may
+//     still compress differently.
 func Build(_ context.Context, rootPath string, dest string, optFuncs ...BuildOption) error {
 	opts := &options{} //nolint:exhaustruct
 	for _, o := range optFuncs {
@@ -35,45 +99,147 @@ func Build(_ context.Context, rootPath string, dest string, optFuncs ...BuildOpt
 			return errors.Wrap(err, "applying build option")
 		}
 	}
+	if opts.modTime.IsZero() {
+		var err error
+		opts.modTime, err = sourceDateEpoch()
+		if err != nil {
+			return err
+		}
+	}
+
+	// Files are hashed while collecting them, so that contents.json can be written at the start
+	// of the archive along with manifest.json, rather than after everything it describes.
+	spec, err := readBuildSpec(rootPath)
+	if err != nil {
+		return err
+	}
+	c := &entryCollector{
+		spec:     spec,
+		specPath: filepath.Join(rootPath, BuildSpecFileName),
+		modTime:  opts.modTime,
+		entries:  map[string]*buildEntry{},
+	}
+	// TODO: Refactor this once Go 1.25 is available, to use tar.NewWriter.AddFS directly?
+	// I'm not sure how to mask the uid/timestamps though...
+	err = c.addTree(rootPath, ".")
+	if err != nil {
+		return errors.Wrap(err, "walking root fs")
+	}
+	for _, f := range spec.Files {
+		src := f.Src
+		if !filepath.IsAbs(src) {
+			src = filepath.Join(rootPath, src)
+		}
+		err = c.addTree(src, f.Dest)
+		if err != nil {
+			return errors.Wrapf(err, "adding %q as %q", f.Src, f.Dest)
+		}
+	}
+	manifestEntry, m, err := c.addManifest(opts.manifest)
+	if err != nil {
+		return err
+	}
+	if !opts.skipArchCheck {
+		manifestEntry, err = c.checkArch(manifestEntry, m)
+		if err != nil {
+			return err
+		}
+	}
+	entries := c.sorted()
+
+	contents := &Contents{Version: contentsVersion, Files: make([]ContentsEntry, 0, len(entries))}
+	for _, be := range entries {
+		ce := newContentsEntry(be.header)
+		ce.SHA256 = be.sha256
+		contents.Files = append(contents.Files, ce)
+	}
+
 	df, err := os.Create(dest)
 	if err != nil {
 		return errors.Wrapf(err, "opening destination file %q", dest)
 	}
 	defer df.Close()
 
-	var compressw io.WriteCloser
-	if opts.compressor != nil {
-		compressw, err = opts.compressor(df)
-		if err != nil {
-			return errors.Wrap(err, "creating compressor")
-		}
-		defer compressw.Close() //nolint:errcheck
-	} else {
-		compressw = df
+	compressw, err := newCompressor(df, opts.compression, opts.level)
+	if err != nil {
+		return errors.Wrap(err, "creating compressor")
 	}
+	defer compressw.Close() //nolint:errcheck
 
 	tw := tar.NewWriter(compressw)
 	defer tw.Close() //nolint:errcheck
 
-	manifestPath := filepath.Join(rootPath, "manifest.json")
-	_, err = os.Stat(manifestPath)
+	// The root directory comes first, then the metadata files, then everything else in order.
+	// Readers rely on this to find the metadata without decompressing the whole package.
+	rest := slices.DeleteFunc(slices.Clone(entries), func(be *buildEntry) bool { return be == manifestEntry })
+	if rest[0].header.Name == "./" {
+		err = writeBuildEntry(tw, rest[0])
+		if err != nil {
+			return err
+		}
+		rest = rest[1:]
+	}
+	err = writeBuildEntry(tw, manifestEntry)
 	if err != nil {
-		if os.IsNotExist(err) {
-			// TODO: create the manifest.json
-			return errors.New("manifest.json must be present in the package directory")
+		return err
+	}
+	err = writeContents(tw, contents, opts.modTime)
+	if err != nil {
+		return errors.Wrap(err, "writing contents file")
+	}
+	for _, be := range rest {
+		err = writeBuildEntry(tw, be)
+		if err != nil {
+			return err
 		}
-		return errors.Wrap(err, "os.Stat(\"manifest.json\")")
 	}
+	return nil
+}
 
-	// TODO: Refactor this once Go 1.25 is available, to use tar.NewWriter.AddFS directly?
-	// I'm not sure how to mask the uid/timestamps though...
-	err = filepath.WalkDir(rootPath, func(name string, d fs.DirEntry, err error) error {
+// entryCollector gathers the package's entries, keyed by their path in the package.
+type entryCollector struct {
+	spec *BuildSpec
+	// specPath is where spec was read from, so that it isn't packed itself
+	specPath string
+	modTime  time.Time
+	entries  map[string]*buildEntry
+}
+
+// addTree adds the file or directory tree at src to the package at dest.
+func (c *entryCollector) addTree(src, dest string) error {
+	return filepath.WalkDir(src, func(name string, d fs.DirEntry, err error) error { //nolint:wrapcheck
 		if err != nil {
 			return err
 		}
-		if name == "." {
+		rel, err := filepath.Rel(src, name)
+		if err != nil {
+			return errors.AddStack(err)
+		}
+		pkgPath := path.Join(dest, filepath.ToSlash(rel))
+		if pkgPath == BuildSpecFileName && name == c.specPath {
+			slog.Debug("skipping the build spec", "path", name)
+			return nil
+		}
+		if pkgPath != "." && c.spec.excluded(pkgPath) {
+			slog.Debug("excluding", "path", pkgPath)
+			if d.IsDir() {
+				return fs.SkipDir
+			}
 			return nil
 		}
+		if pkgPath == ContentsFileName || pkgPath == BuildSpecFileName {
+			// contents.json is generated, and any other kpkg-build.json would be taken for the
+			// package's own spec if it were rebuilt from an extracted copy
+			return errors.Errorf("%q would be packed as %s, which is reserved; exclude it or move it", name, pkgPath)
+		}
+		if existing, ok := c.entries[pkgPath]; ok {
+			// a mapping may put files into a directory that already exists, but can't replace anything
+			if d.IsDir() && existing.header.Typeflag == tar.TypeDir {
+				return nil
+			}
+			return errors.Errorf("%q is already in the package", pkgPath)
+		}
+
 		info, err := d.Info()
 		if err != nil {
 			return errors.AddStack(err)
@@ -92,42 +258,205 @@ func Build(_ context.Context, rootPath string, dest string, optFuncs ...BuildOpt
 		if err != nil {
 			return errors.AddStack(err)
 		}
+		h = normalizeHeader(h, info, pkgPath, c.modTime)
+		c.spec.overrideMode(h, pkgPath)
 
-		h, err = normalizeHeader(h, info, rootPath, name)
+		be := &buildEntry{header: h, src: "", sha256: "", data: nil}
+		if d.Type().IsRegular() {
+			be.src = name
+			be.sha256, err = fileSHA256(name)
+			if err != nil {
+				return err
+			}
+		}
+		c.entries[pkgPath] = be
+		return c.addParents(pkgPath)
+	})
+}
+
+// addManifest adds m as manifest.json, replacing any from the package directory, or if m is nil
+// checks the one from the package directory. Either way, it must be a valid manifest.
+func (c *entryCollector) addManifest(m *manifest.Manifest) (*buildEntry, *manifest.Manifest, error) {
+	if m == nil {
+		be, ok := c.entries["manifest.json"]
+		if !ok {
+			return nil, nil, errors.New("manifest.json must be present in the package directory")
+		}
+		if be.src == "" {
+			return nil, nil, errors.New("manifest.json must be a regular file")
+		}
+		data, err := os.ReadFile(be.src)
 		if err != nil {
-			return errors.Wrap(err, "normalizing tar header")
+			return nil, nil, errors.Wrapf(err, "os.ReadFile(%q)", be.src)
 		}
-		err = tw.WriteHeader(h)
+		m = &manifest.Manifest{} //nolint:exhaustruct
+		err = json.Unmarshal(data, m)
 		if err != nil {
-			return errors.AddStack(err)
+			return nil, nil, errors.Wrapf(err, "json.Unmarshal() to manifest.Manifest from %q", be.src)
 		}
-		if !d.Type().IsRegular() {
-			return nil
+		return be, m, errors.AddStack(m.Validate())
+	}
+
+	err := m.Validate()
+	if err != nil {
+		return nil, nil, errors.AddStack(err)
+	}
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return nil, nil, errors.AddStack(err)
+	}
+	data = append(data, '\n')
+	sum := sha256.Sum256(data)
+	be := &buildEntry{
+		header: &tar.Header{ //nolint:exhaustruct
+			Typeflag: tar.TypeReg,
+			Name:     "./manifest.json",
+			Mode:     0o644,
+			Size:     int64(len(data)),
+			ModTime:  c.modTime,
+			Format:   tar.FormatGNU,
+		},
+		src:    "",
+		sha256: hex.EncodeToString(sum[:]),
+		data:   data,
+	}
+	c.entries["manifest.json"] = be
+	return be, m, nil
+}
+
+// checkArch checks the package's ELF binaries and arch trees against m's supported_arch, and
+// returns the manifest entry to pack: a new one with supported_arch filled in, if m didn't declare any.
+func (c *entryCollector) checkArch(manifestEntry *buildEntry, m *manifest.Manifest) (*buildEntry, error) {
+	binaries := map[string]string{}
+	for pkgPath, be := range c.entries {
+		if be.src == "" {
+			continue
 		}
-		f, err := os.Open(name)
+		arch, isELF, err := DetectFileArch(be.src)
 		if err != nil {
-			return errors.AddStack(err)
+			return nil, err
 		}
-		defer f.Close()
-		_, err = io.Copy(tw, f)
-		return errors.AddStack(err)
-	})
+		if isELF {
+			binaries[pkgPath] = arch
+		}
+	}
+	var supported []string
+	archs, err := c.archDirs()
 	if err != nil {
-		return errors.Wrap(err, "walking root fs")
+		return nil, err
+	}
+	if archs != nil {
+		supported, err = checkMultiArch(m, archs, binaries)
+	} else {
+		var arch string
+		arch, err = checkBinaryArch(m.SupportedArch, binaries)
+		if arch != "" {
+			supported = []string{arch}
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(supported) == 0 || len(m.SupportedArch) > 0 {
+		return manifestEntry, nil
+	}
+
+	slog.Info("setting supported_arch from the package's binaries", "arch", supported)
+	filled := *m
+	filled.SupportedArch = supported
+	be, _, err := c.addManifest(&filled)
+	return be, err
+}
+
+// addParents adds any directories above pkgPath that no source provided, as for a mapping
+// to "opt/tool/bin" in a package without an opt/ directory.
+func (c *entryCollector) addParents(pkgPath string) error {
+	for dir := path.Dir(pkgPath); dir != "."; dir = path.Dir(dir) {
+		if existing, ok := c.entries[dir]; ok {
+			if existing.header.Typeflag != tar.TypeDir {
+				return errors.Errorf("%q is in the package, but %q is not a directory", pkgPath, dir)
+			}
+			return nil
+		}
+		h := &tar.Header{ //nolint:exhaustruct
+			Typeflag: tar.TypeDir,
+			Name:     "./" + dir + "/",
+			Mode:     0o755,
+			ModTime:  c.modTime,
+			Format:   tar.FormatGNU,
+		}
+		c.spec.overrideMode(h, dir)
+		c.entries[dir] = &buildEntry{header: h, src: "", sha256: "", data: nil}
 	}
 	return nil
 }
 
-func normalizeHeader(h *tar.Header, d fs.FileInfo, rootPath, name string) (*tar.Header, error) {
-	// Make path relative to rootPath
-	relPath, err := filepath.Rel(rootPath, name)
+// sorted returns the entries in the order filepath.WalkDir would visit them, had they all come
+// from one directory: depth-first, and lexical within each directory.
+func (c *entryCollector) sorted() []*buildEntry {
+	paths := slices.Collect(maps.Keys(c.entries))
+	slices.SortFunc(paths, func(a, b string) int {
+		return slices.Compare(pathComponents(a), pathComponents(b))
+	})
+	entries := make([]*buildEntry, 0, len(paths))
+	for _, p := range paths {
+		entries = append(entries, c.entries[p])
+	}
+	return entries
+}
+
+func pathComponents(p string) []string {
+	if p == "." {
+		return nil
+	}
+	return strings.Split(p, "/")
+}
+
+type buildEntry struct {
+	header *tar.Header
+	// src and sha256 are only set for regular files
+	src    string
+	sha256 string
+	// data is the contents of a generated file, which has no src
+	data []byte
+}
+
+func writeBuildEntry(tw *tar.Writer, be *buildEntry) error {
+	err := tw.WriteHeader(be.header)
 	if err != nil {
-		return nil, errors.AddStack(err)
+		return errors.AddStack(err)
+	}
+	if be.data != nil {
+		_, err = tw.Write(be.data)
+		return errors.AddStack(err)
+	}
+	if be.src == "" {
+		return nil
+	}
+	f, err := os.Open(be.src)
+	if err != nil {
+		return errors.AddStack(err)
+	}
+	defer f.Close()
+	hasher := sha256.New()
+	_, err = io.Copy(io.MultiWriter(tw, hasher), f)
+	if err != nil {
+		return errors.AddStack(err)
 	}
-	if relPath == "." {
+	// contents.json has already been written, so it had better still be right
+	if sum := hex.EncodeToString(hasher.Sum(nil)); sum != be.sha256 {
+		return errors.Errorf("%q changed while the package was being built", be.src)
+	}
+	return nil
+}
+
+// normalizeHeader strips everything host-specific from h, and names it for pkgPath
+// (a slash-separated path in the package, or "." for the root).
+func normalizeHeader(h *tar.Header, d fs.FileInfo, pkgPath string, modTime time.Time) *tar.Header {
+	if pkgPath == "." {
 		h.Name = "./"
 	} else {
-		h.Name = "./" + relPath
+		h.Name = "./" + pkgPath
 	}
 
 	// Normalize metadata; no need to leak host info
@@ -135,10 +464,26 @@ func normalizeHeader(h *tar.Header, d fs.FileInfo, rootPath, name string) (*tar.
 	h.Gid = 0
 	h.Uname = ""
 	h.Gname = ""
-	h.Mode &= 0o777
-	h.ModTime = time.Date(2000, time.January, 1, 0, 0, 0, 0, time.UTC)
+	h.ModTime = modTime
+	// tar.FileInfoHeader fills these in from stat(2), and the GNU format records them
+	h.AccessTime = time.Time{}
+	h.ChangeTime = time.Time{}
+	h.Devmajor = 0
+	h.Devminor = 0
+	h.Xattrs = nil //nolint:staticcheck
+	h.PAXRecords = nil
 	h.Format = tar.FormatGNU
 
+	// the umask of whoever checked the files out shouldn't matter
+	switch {
+	case d.Mode()&fs.ModeSymlink != 0:
+		h.Mode = 0o777
+	case d.IsDir() || d.Mode()&0o100 != 0:
+		h.Mode = 0o755
+	default:
+		h.Mode = 0o644
+	}
+
 	// Only regular files have size
 	if d.Mode().IsRegular() {
 		h.Size = d.Size()
@@ -147,5 +492,5 @@ func normalizeHeader(h *tar.Header, d fs.FileInfo, rootPath, name string) (*tar.
 		h.Name = strings.TrimSuffix(h.Name, "/") + "/"
 	}
 
-	return h, nil
+	return h
 }
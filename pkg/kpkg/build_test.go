@@ -0,0 +1,208 @@
+package kpkg_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/clintharrison/go-kindle-pkg/pkg/kpkg"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBuild_MetadataFirst(t *testing.T) {
+	t.Parallel()
+	ctx := t.Context()
+
+	p := buildPackage(t, map[string]string{
+		"manifest.json": testManifest,
+		"bin/tool":      "#!/bin/sh\n",
+		"lib/libfoo.so": "elf",
+	}, kpkg.WithXZCompression)
+	k, err := kpkg.Open(ctx, p)
+	require.NoError(t, err)
+	defer k.Close()
+	require.Equal(t, "signed", k.Manifest.ID)
+	require.NotNil(t, k.Contents)
+	require.Len(t, k.Contents.Files, 6)
+
+	out := &bytes.Buffer{}
+	require.NoError(t, k.ExtractAll(ctx, t.TempDir(), true, out))
+	var names []string
+	for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		names = append(names, strings.Fields(line)[0])
+	}
+	require.Equal(t, []string{
+		".", "manifest.json", "contents.json", "bin/", "bin/tool", "lib/", "lib/libfoo.so",
+	}, names)
+}
+
+func TestBuild_Reproducible(t *testing.T) {
+	t.Parallel()
+	ctx := t.Context()
+	files := map[string]string{
+		"manifest.json": testManifest,
+		"bin/tool":      "#!/bin/sh\n",
+		"share/a.txt":   "a",
+	}
+
+	for _, c := range kpkg.Compressions() {
+		t.Run(string(c), func(t *testing.T) {
+			t.Parallel()
+			// the same tree, checked out at a different time with a different umask
+			dirA, dirB := writePackageDir(t, files), writePackageDir(t, files)
+			require.NoError(t, os.Chmod(filepath.Join(dirA, "bin/tool"), 0o755))
+			require.NoError(t, os.Chmod(filepath.Join(dirB, "bin/tool"), 0o775))
+			require.NoError(t, os.Chmod(filepath.Join(dirB, "share/a.txt"), 0o664))
+			require.NoError(t, os.Chtimes(filepath.Join(dirB, "share/a.txt"), time.Now(), time.Unix(1, 0)))
+
+			a := filepath.Join(t.TempDir(), "a.kpkg")
+			b := filepath.Join(t.TempDir(), "b.kpkg")
+			require.NoError(t, kpkg.Build(ctx, dirA, a, kpkg.WithCompression(c)))
+			require.NoError(t, kpkg.Build(ctx, dirB, b, kpkg.WithCompression(c)))
+			diff, err := kpkg.CompareArchives(ctx, a, b)
+			require.NoError(t, err)
+			require.Nil(t, diff)
+		})
+	}
+}
+
+//nolint:paralleltest // uses t.Setenv
+func TestBuild_SourceDateEpoch(t *testing.T) {
+	t.Setenv("SOURCE_DATE_EPOCH", "1700000000")
+	// uncompressed, so the tar can be read directly
+	p := buildPackage(t, map[string]string{"manifest.json": testManifest, "bin/tool": "#!/bin/sh\n"})
+	f, err := os.Open(p)
+	require.NoError(t, err)
+	defer f.Close()
+	tr := tar.NewReader(f)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		require.Equal(t, time.Unix(1700000000, 0).UTC(), h.ModTime.UTC(), h.Name)
+	}
+
+	t.Setenv("SOURCE_DATE_EPOCH", "yesterday")
+	err = kpkg.Build(t.Context(), writePackageDir(t, map[string]string{"manifest.json": testManifest}),
+		filepath.Join(t.TempDir(), "bad.kpkg"))
+	require.Error(t, err)
+}
+
+func TestCompareArchives(t *testing.T) {
+	t.Parallel()
+	ctx := t.Context()
+
+	a := buildPackage(t, map[string]string{"manifest.json": testManifest, "bin/tool": "one"})
+	b := buildPackage(t, map[string]string{"manifest.json": testManifest, "bin/tool": "two"})
+	diff, err := kpkg.CompareArchives(ctx, a, b)
+	require.NoError(t, err)
+	// contents.json comes first, and its digest of bin/tool differs too
+	require.Equal(t, "./contents.json", diff.Entry)
+
+	c := buildPackage(t, map[string]string{"manifest.json": testManifest, "bin/tool": "one"}, kpkg.WithZstdCompression)
+	diff, err = kpkg.CompareArchives(ctx, a, c)
+	require.NoError(t, err)
+	require.NotNil(t, diff)
+	require.Empty(t, diff.Entry)
+}
+
+func TestBuild_Spec(t *testing.T) {
+	t.Parallel()
+	ctx := t.Context()
+
+	elsewhere := writePackageDir(t, map[string]string{"lib/libfoo.so": "elf", "README": "hi"})
+	dir := writePackageDir(t, map[string]string{
+		"manifest.json": testManifest,
+		"bin/tool":      "#!/bin/sh\n",
+		"bin/tool~":     "#!/bin/sh\n",
+		".git/config":   "[core]\n",
+		kpkg.BuildSpecFileName: `{
+			"files": [
+				{"src": "` + filepath.Join(elsewhere, "lib") + `", "dest": "opt/foo/lib"},
+				{"src": "` + filepath.Join(elsewhere, "README") + `", "dest": "README.txt"}
+			],
+			"exclude": [".git", "*~"],
+			"modes": [{"pattern": "bin/*", "mode": "0755"}, {"pattern": "opt/**/*.so", "mode": "0555"}]
+		}`,
+	})
+	p := filepath.Join(t.TempDir(), "spec.kpkg")
+	require.NoError(t, kpkg.Build(ctx, dir, p))
+
+	k, err := kpkg.Open(ctx, p)
+	require.NoError(t, err)
+	defer k.Close()
+	out := &bytes.Buffer{}
+	require.NoError(t, k.ExtractAll(ctx, t.TempDir(), true, out))
+	require.Equal(t, strings.Join([]string{
+		". type=dir mode=755 size=0 uid=0 gid=0",
+		"manifest.json type=file mode=644 size=56 uid=0 gid=0",
+		"contents.json type=file mode=644 size=1180 uid=0 gid=0",
+		"README.txt type=file mode=644 size=2 uid=0 gid=0",
+		"bin/ type=dir mode=755 size=0 uid=0 gid=0",
+		"bin/tool type=file mode=755 size=10 uid=0 gid=0",
+		"opt/ type=dir mode=755 size=0 uid=0 gid=0",
+		"opt/foo/ type=dir mode=755 size=0 uid=0 gid=0",
+		"opt/foo/lib/ type=dir mode=755 size=0 uid=0 gid=0",
+		"opt/foo/lib/libfoo.so type=file mode=555 size=3 uid=0 gid=0",
+	}, "\n")+"\n", out.String())
+}
+
+func TestBuild_BadSpec(t *testing.T) {
+	t.Parallel()
+
+	for _, spec := range []string{
+		`{"files": [{"src": "x", "dest": "../outside"}]}`,
+		`{"exclude": ["[oops"]}`,
+		`{"modes": [{"pattern": "bin/*", "mode": "rwx"}]}`,
+		`{"files": [{"src": "bin/tool", "dest": "manifest.json"}]}`,
+	} {
+		dir := writePackageDir(t, map[string]string{
+			"manifest.json": testManifest, "bin/tool": "", kpkg.BuildSpecFileName: spec,
+		})
+		require.Error(t, kpkg.Build(t.Context(), dir, filepath.Join(t.TempDir(), "bad.kpkg")), spec)
+	}
+}
+
+func TestBuild_ReservedNames(t *testing.T) {
+	t.Parallel()
+	elsewhere := writePackageDir(t, map[string]string{kpkg.BuildSpecFileName: `{}`})
+
+	for name, files := range map[string]map[string]string{
+		"stale contents.json": {
+			"manifest.json":       testManifest,
+			kpkg.ContentsFileName: `{"version": 1, "files": []}`,
+		},
+		"spec mapped in from elsewhere": {
+			"manifest.json": testManifest,
+			kpkg.BuildSpecFileName: `{"files": [{"src": "` + filepath.Join(elsewhere, kpkg.BuildSpecFileName) +
+				`", "dest": "` + kpkg.BuildSpecFileName + `"}]}`,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			dir := writePackageDir(t, files)
+			err := kpkg.Build(t.Context(), dir, filepath.Join(t.TempDir(), "reserved.kpkg"))
+			require.ErrorContains(t, err, "which is reserved")
+		})
+	}
+
+	// a stale contents.json can be left out, and a fresh one is generated
+	dir := writePackageDir(t, map[string]string{
+		"manifest.json":        testManifest,
+		kpkg.ContentsFileName:  `{"version": 1, "files": []}`,
+		kpkg.BuildSpecFileName: `{"exclude": ["` + kpkg.ContentsFileName + `"]}`,
+	})
+	p := filepath.Join(t.TempDir(), "excluded.kpkg")
+	require.NoError(t, kpkg.Build(t.Context(), dir, p))
+	k, err := kpkg.Open(t.Context(), p)
+	require.NoError(t, err)
+	defer k.Close()
+	require.Len(t, k.Contents.Files, 2)
+}
@@ -0,0 +1,115 @@
+package kpkg
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/pingcap/errors"
+)
+
+// BuildSpecFileName is an optional file next to manifest.json that tells Build what else to
+// pack, what to leave out, and which modes to set. It is not packed itself.
+//
+//	{
+//	  "files": [{"src": "../build/koreader", "dest": "koreader"}],
+//	  "exclude": [".git", "*~", "docs/**/*.md"],
+//	  "modes": [{"pattern": "bin/*", "mode": "0755"}]
+//	}
+const BuildSpecFileName = "kpkg-build.json"
+
+type BuildSpec struct {
+	// Files are packed in addition to the package directory.
+	Files []FileMapping `json:"files,omitempty"`
+	// Exclude lists globs of package paths to leave out, see matchGlob.
+	// An excluded directory is left out with everything in it.
+	Exclude []string `json:"exclude,omitempty"`
+	// Modes override the normalized modes of matching entries; the last match wins.
+	Modes []ModeOverride `json:"modes,omitempty"`
+}
+
+type FileMapping struct {
+	// Src is a file or directory, relative to the package directory unless it's absolute.
+	Src string `json:"src"`
+	// Dest is where Src goes in the package.
+	Dest string `json:"dest"`
+}
+
+type ModeOverride struct {
+	Pattern string `json:"pattern"`
+	// Mode is in octal, e.g. "0755"
+	Mode string `json:"mode"`
+
+	mode int64
+}
+
+// readBuildSpec reads the spec in rootPath, or returns an empty one if there isn't one.
+func readBuildSpec(rootPath string) (*BuildSpec, error) {
+	spec := &BuildSpec{Files: nil, Exclude: nil, Modes: nil}
+	specPath := filepath.Join(rootPath, BuildSpecFileName)
+	data, err := os.ReadFile(specPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return spec, nil
+		}
+		return nil, errors.Wrapf(err, "os.ReadFile(%q)", specPath)
+	}
+	err = json.Unmarshal(data, spec)
+	if err != nil {
+		return nil, errors.Wrapf(err, "json.Unmarshal() to kpkg.BuildSpec from %q", specPath)
+	}
+	err = spec.validate()
+	if err != nil {
+		return nil, errors.Annotatef(err, "in %q", specPath)
+	}
+	return spec, nil
+}
+
+func (s *BuildSpec) validate() error {
+	for i, f := range s.Files {
+		if f.Src == "" {
+			return errors.Errorf("files[%d] has no src", i)
+		}
+		dest := path.Clean(strings.TrimPrefix(f.Dest, "./"))
+		if f.Dest == "" || path.IsAbs(dest) || isOutside(dest) {
+			return errors.Errorf("files[%d] has an invalid dest %q", i, f.Dest)
+		}
+		s.Files[i].Dest = dest
+	}
+	for _, pattern := range s.Exclude {
+		if !validGlob(pattern) {
+			return errors.Errorf("invalid exclude pattern %q", pattern)
+		}
+	}
+	for i, mo := range s.Modes {
+		if !validGlob(mo.Pattern) {
+			return errors.Errorf("invalid mode pattern %q", mo.Pattern)
+		}
+		mode, err := strconv.ParseInt(mo.Mode, 8, 32)
+		if err != nil || mode < 0 || mode > 0o777 {
+			return errors.Errorf("invalid mode %q for %q", mo.Mode, mo.Pattern)
+		}
+		s.Modes[i].mode = mode
+	}
+	return nil
+}
+
+func (s *BuildSpec) excluded(pkgPath string) bool {
+	return matchAnyGlob(s.Exclude, pkgPath)
+}
+
+// overrideMode applies the spec's mode overrides to anything but a symlink, whose mode means nothing.
+func (s *BuildSpec) overrideMode(h *tar.Header, pkgPath string) {
+	if h.Typeflag == tar.TypeSymlink {
+		return
+	}
+	for _, mo := range s.Modes {
+		if matchGlob(mo.Pattern, pkgPath) {
+			h.Mode = mo.mode
+		}
+	}
+}
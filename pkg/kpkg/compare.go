@@ -0,0 +1,136 @@
+package kpkg
+
+import (
+	"archive/tar"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/pingcap/errors"
+)
+
+// ArchiveDifference is the first difference found between two packages.
+type ArchiveDifference struct {
+	// Entry is the name of the first entry that differs. It is empty when every entry matches,
+	// and the packages only differ in how they were compressed.
+	Entry  string
+	Detail string
+}
+
+func (d *ArchiveDifference) String() string {
+	if d.Entry == "" {
+		return d.Detail
+	}
+	return fmt.Sprintf("%s: %s", d.Entry, d.Detail)
+}
+
+// CompareArchives compares two packages entry by entry, in archive order, and returns the first
+// difference between them, or nil if the files are identical.
+func CompareArchives(ctx context.Context, pathA, pathB string) (*ArchiveDifference, error) {
+	sumA, err := fileSHA256(pathA)
+	if err != nil {
+		return nil, err
+	}
+	sumB, err := fileSHA256(pathB)
+	if err != nil {
+		return nil, err
+	}
+	if sumA == sumB {
+		return nil, nil //nolint:nilnil
+	}
+
+	a, err := Open(ctx, pathA)
+	if err != nil {
+		return nil, errors.Wrapf(err, "kpkg.Open(%q)", pathA)
+	}
+	defer a.Close()
+	b, err := Open(ctx, pathB)
+	if err != nil {
+		return nil, errors.Wrapf(err, "kpkg.Open(%q)", pathB)
+	}
+	defer b.Close()
+
+	nextA, err := a.entries()
+	if err != nil {
+		return nil, err
+	}
+	nextB, err := b.entries()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		ha, ra, errA := nextA()
+		if errA != nil && errA != io.EOF {
+			return nil, errors.Wrapf(errA, "reading %q", pathA)
+		}
+		hb, rb, errB := nextB()
+		if errB != nil && errB != io.EOF {
+			return nil, errors.Wrapf(errB, "reading %q", pathB)
+		}
+		switch {
+		case errA == io.EOF && errB == io.EOF:
+			return &ArchiveDifference{
+				Entry:  "",
+				Detail: "every entry matches, but the compressed files differ",
+			}, nil
+		case errA == io.EOF:
+			return &ArchiveDifference{Entry: hb.Name, Detail: "only in " + pathB}, nil
+		case errB == io.EOF:
+			return &ArchiveDifference{Entry: ha.Name, Detail: "only in " + pathA}, nil
+		}
+
+		if detail := compareHeaders(ha, hb); detail != "" {
+			return &ArchiveDifference{Entry: ha.Name, Detail: detail}, nil
+		}
+		contentsA, err := readerSHA256(ra)
+		if err != nil {
+			return nil, errors.Wrapf(err, "reading %q from %q", ha.Name, pathA)
+		}
+		contentsB, err := readerSHA256(rb)
+		if err != nil {
+			return nil, errors.Wrapf(err, "reading %q from %q", hb.Name, pathB)
+		}
+		if contentsA != contentsB {
+			return &ArchiveDifference{
+				Entry:  ha.Name,
+				Detail: fmt.Sprintf("contents differ: sha256 %s vs %s", contentsA, contentsB),
+			}, nil
+		}
+	}
+}
+
+// compareHeaders describes how two headers differ, in every field a tar writer records.
+func compareHeaders(a, b *tar.Header) string {
+	var diffs []string
+	field := func(name string, va, vb any) {
+		if va != vb {
+			diffs = append(diffs, fmt.Sprintf("%s %v vs %v", name, va, vb))
+		}
+	}
+	field("name", a.Name, b.Name)
+	field("type", string(a.Typeflag), string(b.Typeflag))
+	field("link", a.Linkname, b.Linkname)
+	field("mode", fmt.Sprintf("%04o", a.Mode), fmt.Sprintf("%04o", b.Mode))
+	field("uid", a.Uid, b.Uid)
+	field("gid", a.Gid, b.Gid)
+	field("uname", a.Uname, b.Uname)
+	field("gname", a.Gname, b.Gname)
+	field("size", a.Size, b.Size)
+	field("mtime", a.ModTime.UTC(), b.ModTime.UTC())
+	field("atime", a.AccessTime.UTC(), b.AccessTime.UTC())
+	field("ctime", a.ChangeTime.UTC(), b.ChangeTime.UTC())
+	field("format", a.Format, b.Format)
+	return strings.Join(diffs, ", ")
+}
+
+func readerSHA256(r io.Reader) (string, error) {
+	h := sha256.New()
+	_, err := io.Copy(h, r)
+	if err != nil {
+		return "", errors.AddStack(err)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,226 @@
+package kpkg
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/pingcap/errors"
+)
+
+// ContentsFileName is the digest list that Build adds to every package. It is extracted with
+// the rest of the package, so an installed package keeps a copy to be verified against.
+const ContentsFileName = "contents.json"
+
+const contentsVersion = 1
+
+// Contents lists every entry in a package along with the digests of regular files.
+type Contents struct {
+	Version int             `json:"version"`
+	Files   []ContentsEntry `json:"files"`
+}
+
+type ContentsEntry struct {
+	// Path is relative to the package root, without a leading "./"
+	Path string `json:"path"`
+	// Type is one of "file", "dir" or "link", as in the mtree-like output of ExtractAll.
+	Type string `json:"type"`
+	// Mode is the octal permission bits, e.g. "0755"
+	Mode   string `json:"mode"`
+	Size   int64  `json:"size,omitempty"`
+	SHA256 string `json:"sha256,omitempty"`
+	Link   string `json:"link,omitempty"`
+}
+
+func newContentsEntry(h *tar.Header) ContentsEntry {
+	ce := ContentsEntry{
+		Path:   strings.TrimSuffix(strings.TrimPrefix(h.Name, "./"), "/"),
+		Type:   "file",
+		Mode:   fmt.Sprintf("%04o", h.Mode&0o7777),
+		Size:   h.Size,
+		SHA256: "",
+		Link:   "",
+	}
+	if ce.Path == "" {
+		ce.Path = "."
+	}
+	switch h.Typeflag {
+	case tar.TypeDir:
+		ce.Type = "dir"
+	case tar.TypeSymlink, tar.TypeLink:
+		ce.Type = "link"
+		ce.Link = h.Linkname
+	}
+	return ce
+}
+
+func marshalContents(contents *Contents) ([]byte, error) {
+	data, err := json.MarshalIndent(contents, "", "  ")
+	if err != nil {
+		return nil, errors.AddStack(err)
+	}
+	return append(data, '\n'), nil
+}
+
+func writeContents(tw *tar.Writer, contents *Contents, modTime time.Time) error {
+	data, err := marshalContents(contents)
+	if err != nil {
+		return err
+	}
+	err = tw.WriteHeader(&tar.Header{ //nolint:exhaustruct
+		Typeflag: tar.TypeReg,
+		Name:     "./" + ContentsFileName,
+		Mode:     0o644,
+		Size:     int64(len(data)),
+		ModTime:  modTime,
+		Format:   tar.FormatGNU,
+	})
+	if err != nil {
+		return errors.AddStack(err)
+	}
+	_, err = io.Copy(tw, bytes.NewReader(data))
+	return errors.AddStack(err)
+}
+
+// ReadContentsFile reads the contents list kept in an installed package directory.
+func ReadContentsFile(path string) (*Contents, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "os.ReadFile(%q)", path)
+	}
+	c, err := parseContents(data)
+	if err != nil {
+		return nil, errors.Annotatef(err, "in %q", path)
+	}
+	return c, nil
+}
+
+func parseContents(data []byte) (*Contents, error) {
+	var c Contents
+	err := json.Unmarshal(data, &c)
+	if err != nil {
+		return nil, errors.Wrap(err, "json.Unmarshal() to kpkg.Contents")
+	}
+	if c.Version != contentsVersion {
+		return nil, errors.Errorf("unsupported contents version %d", c.Version)
+	}
+	return &c, nil
+}
+
+type DiscrepancyKind string
+
+const (
+	Missing  DiscrepancyKind = "missing"
+	Modified DiscrepancyKind = "modified"
+	Extra    DiscrepancyKind = "extra"
+)
+
+type Discrepancy struct {
+	Path   string
+	Kind   DiscrepancyKind
+	Detail string
+}
+
+func (d Discrepancy) String() string {
+	if d.Detail == "" {
+		return fmt.Sprintf("%s: %s", d.Kind, d.Path)
+	}
+	return fmt.Sprintf("%s: %s (%s)", d.Kind, d.Path, d.Detail)
+}
+
+// VerifyDir compares an installed package directory against its contents list.
+//
+// Modes are not compared: packages are installed onto /mnt/us, which is FAT and can't keep them.
+// For the same reason, links are never installed, so they are not reported as missing.
+func VerifyDir(dir string, c *Contents) ([]Discrepancy, error) {
+	var ds []Discrepancy
+	known := make(map[string]bool, len(c.Files))
+	for _, ce := range c.Files {
+		known[ce.Path] = true
+		p := filepath.Join(dir, filepath.FromSlash(ce.Path))
+		fi, err := os.Lstat(p)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				return nil, errors.Wrapf(err, "os.Lstat(%q)", p)
+			}
+			if ce.Type != "link" {
+				ds = append(ds, Discrepancy{Path: ce.Path, Kind: Missing, Detail: ""})
+			}
+			continue
+		}
+		switch ce.Type {
+		case "dir":
+			if !fi.IsDir() {
+				ds = append(ds, Discrepancy{Path: ce.Path, Kind: Modified, Detail: "expected a directory"})
+			}
+		case "file":
+			if !fi.Mode().IsRegular() {
+				ds = append(ds, Discrepancy{Path: ce.Path, Kind: Modified, Detail: "expected a regular file"})
+				continue
+			}
+			if fi.Size() != ce.Size {
+				ds = append(ds, Discrepancy{
+					Path: ce.Path, Kind: Modified, Detail: fmt.Sprintf("size %d, expected %d", fi.Size(), ce.Size),
+				})
+				continue
+			}
+			sum, err := fileSHA256(p)
+			if err != nil {
+				return nil, err
+			}
+			if sum != ce.SHA256 {
+				ds = append(ds, Discrepancy{Path: ce.Path, Kind: Modified, Detail: "sha256 " + sum})
+			}
+		}
+	}
+
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return errors.AddStack(err)
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return errors.AddStack(err)
+		}
+		rel = filepath.ToSlash(rel)
+		if rel == "." || rel == ContentsFileName || known[rel] {
+			return nil
+		}
+		ds = append(ds, Discrepancy{Path: rel, Kind: Extra, Detail: ""})
+		if d.IsDir() {
+			// everything below an unexpected directory is unexpected too; once is enough
+			return fs.SkipDir
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "walking %q", dir)
+	}
+
+	slices.SortFunc(ds, func(a, b Discrepancy) int { return strings.Compare(a.Path, b.Path) })
+	return ds, nil
+}
+
+func fileSHA256(p string) (string, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return "", errors.Wrapf(err, "os.Open(%q)", p)
+	}
+	defer f.Close()
+	h := sha256.New()
+	_, err = io.Copy(h, f)
+	if err != nil {
+		return "", errors.Wrapf(err, "reading %q", p)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,61 @@
+package kpkg_test
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/clintharrison/go-kindle-pkg/pkg/kpkg"
+	"github.com/stretchr/testify/require"
+)
+
+func TestContentsVerifyDir(t *testing.T) {
+	t.Parallel()
+	ctx := t.Context()
+
+	p := buildPackage(t, map[string]string{
+		"manifest.json":  testManifest,
+		"install.sh":     "#!/bin/sh\n",
+		"bin/tool":       "#!/bin/sh\necho hi\n",
+		"share/data.txt": "data",
+	})
+	k, err := kpkg.Open(ctx, p)
+	require.NoError(t, err)
+	defer k.Close()
+
+	dir := t.TempDir()
+	require.NoError(t, k.ExtractAll(ctx, dir, false, io.Discard))
+
+	contents, err := kpkg.ReadContentsFile(filepath.Join(dir, kpkg.ContentsFileName))
+	require.NoError(t, err)
+	paths := make([]string, 0, len(contents.Files))
+	for _, ce := range contents.Files {
+		paths = append(paths, ce.Path)
+	}
+	require.ElementsMatch(t, []string{
+		".", "manifest.json", "install.sh", "bin", "bin/tool", "share", "share/data.txt",
+	}, paths)
+
+	ds, err := kpkg.VerifyDir(dir, contents)
+	require.NoError(t, err)
+	require.Empty(t, ds)
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "bin/tool"), []byte("#!/bin/sh\necho HI\n"), 0o755)) //nolint:gosec
+	require.NoError(t, os.Remove(filepath.Join(dir, "share/data.txt")))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "stray.txt"), nil, 0o644)) //nolint:gosec
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "cache/a"), 0o755))
+
+	ds, err = kpkg.VerifyDir(dir, contents)
+	require.NoError(t, err)
+	var got []string
+	for _, d := range ds {
+		got = append(got, string(d.Kind)+" "+d.Path)
+	}
+	require.Equal(t, []string{
+		"modified bin/tool",
+		"extra cache",
+		"missing share/data.txt",
+		"extra stray.txt",
+	}, got)
+}
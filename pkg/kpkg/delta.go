@@ -0,0 +1,387 @@
+package kpkg
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"hash/fnv"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/clintharrison/go-kindle-pkg/pkg/utilio"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pingcap/errors"
+)
+
+// DeltaSuffix is the file extension for deltas written by CreateDelta.
+const DeltaSuffix = ".kdelta"
+
+const (
+	deltaMagic   = "kpkg-delta\n"
+	deltaVersion = 1
+	// deltaBlockSize is the tar block size: entries start on block boundaries in both payloads,
+	// so unchanged files are found wherever they moved to without a rolling hash.
+	deltaBlockSize = 512
+)
+
+const (
+	deltaOpCopy   byte = 'C'
+	deltaOpInsert byte = 'I'
+	deltaOpEnd    byte = 'E'
+)
+
+// ErrDeltaMismatch is returned when a delta doesn't apply to the base it is given, or doesn't
+// reconstruct the package it was made for.
+var ErrDeltaMismatch = errors.New("delta does not match") //nolint:gochecknoglobals
+
+// deltaHeader is the JSON line after the magic at the start of a delta. The digests are of the
+// decompressed tar payloads, as in a Signature, so a reconstructed package can be checked against
+// the signature of the package it was made from.
+type deltaHeader struct {
+	Version             int    `json:"version"`
+	BasePayloadSHA256   string `json:"base_payload_sha256"`
+	TargetPayloadSHA256 string `json:"target_payload_sha256"`
+	TargetPayloadSize   int64  `json:"target_payload_size"`
+}
+
+// CreateDelta writes a delta that turns the payload of the package at basePath into that of the
+// package at targetPath. It is made of copies of byte ranges from the base, and zstd-compressed
+// data for whatever is new. Both payloads are read into memory, which is fine for a publisher but
+// not for a Kindle.
+func CreateDelta(ctx context.Context, basePath, targetPath string, w io.Writer) error {
+	base, err := readPayload(ctx, basePath)
+	if err != nil {
+		return err
+	}
+	target, err := readPayload(ctx, targetPath)
+	if err != nil {
+		return err
+	}
+	baseSum := sha256.Sum256(base)
+	targetSum := sha256.Sum256(target)
+
+	header, err := json.Marshal(deltaHeader{
+		Version:             deltaVersion,
+		BasePayloadSHA256:   hex.EncodeToString(baseSum[:]),
+		TargetPayloadSHA256: hex.EncodeToString(targetSum[:]),
+		TargetPayloadSize:   int64(len(target)),
+	})
+	if err != nil {
+		return errors.AddStack(err)
+	}
+	_, err = io.WriteString(w, deltaMagic+string(header)+"\n")
+	if err != nil {
+		return errors.AddStack(err)
+	}
+
+	zw, err := zstd.NewWriter(w, zstd.WithEncoderLevel(zstd.SpeedBestCompression))
+	if err != nil {
+		return errors.AddStack(err)
+	}
+	err = writeDeltaOps(ctx, zw, base, target)
+	if err != nil {
+		_ = zw.Close()
+		return err
+	}
+	return errors.AddStack(zw.Close())
+}
+
+// readPayload reads a package's whole decompressed tar payload.
+func readPayload(ctx context.Context, path string) ([]byte, error) {
+	k, err := Open(ctx, path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "kpkg.Open(%q)", path)
+	}
+	defer k.Close()
+	r, _, err := k.decompressor()
+	if err != nil {
+		return nil, err
+	}
+	data, err := io.ReadAll(utilio.NewContextReader(ctx, r))
+	if err != nil {
+		return nil, errors.Wrapf(err, "reading payload of %q", path)
+	}
+	return data, nil
+}
+
+func blockHash(b []byte) uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write(b)
+	return h.Sum64()
+}
+
+func writeDeltaOps(ctx context.Context, w io.Writer, base, target []byte) error {
+	// where each block-aligned block of the base starts, keeping the first of any duplicates
+	index := make(map[uint64]int, len(base)/deltaBlockSize)
+	for off := 0; off+deltaBlockSize <= len(base); off += deltaBlockSize {
+		h := blockHash(base[off : off+deltaBlockSize])
+		if _, ok := index[h]; !ok {
+			index[h] = off
+		}
+	}
+
+	bw := bufio.NewWriter(w)
+	var buf [2 * binary.MaxVarintLen64]byte
+	op := func(kind byte, a, b uint64, data []byte) error {
+		n := binary.PutUvarint(buf[:], a)
+		if kind == deltaOpCopy {
+			n += binary.PutUvarint(buf[n:], b)
+		}
+		_ = bw.WriteByte(kind)
+		_, _ = bw.Write(buf[:n])
+		_, err := bw.Write(data)
+		return errors.AddStack(err)
+	}
+
+	literal := 0 // start of target bytes not yet written
+	for pos := 0; pos+deltaBlockSize <= len(target); {
+		if pos%(1<<20) == 0 {
+			if err := ctx.Err(); err != nil {
+				return errors.AddStack(err)
+			}
+		}
+		block := target[pos : pos+deltaBlockSize]
+		off, ok := index[blockHash(block)]
+		if !ok || !bytes.Equal(base[off:off+deltaBlockSize], block) {
+			pos += deltaBlockSize
+			continue
+		}
+		n := deltaBlockSize
+		for off+n < len(base) && pos+n < len(target) && base[off+n] == target[pos+n] {
+			n++
+		}
+		if literal < pos {
+			err := op(deltaOpInsert, uint64(pos-literal), 0, target[literal:pos])
+			if err != nil {
+				return err
+			}
+		}
+		err := op(deltaOpCopy, uint64(off), uint64(n), nil)
+		if err != nil {
+			return err
+		}
+		literal = pos + n
+		// keep looking on block boundaries, where the next entry will start
+		pos = (literal + deltaBlockSize - 1) / deltaBlockSize * deltaBlockSize
+	}
+	if literal < len(target) {
+		err := op(deltaOpInsert, uint64(len(target)-literal), 0, target[literal:])
+		if err != nil {
+			return err
+		}
+	}
+	_ = bw.WriteByte(deltaOpEnd)
+	return errors.AddStack(bw.Flush())
+}
+
+// ApplyDelta reconstructs a package from the package at basePath and a delta made by CreateDelta,
+// writing it to targetPath. The result is an uncompressed package: a Kindle has more storage than
+// CPU to spare, and an uncompressed base makes applying the next delta cheaper.
+//
+// Both payloads are checked against the digests in the delta, and the reconstructed payload also
+// against targetSHA256, which must come from somewhere other than the delta, such as the
+// repository: otherwise a substituted delta would vouch for itself. ErrDeltaMismatch is returned
+// if any is wrong. Nothing is left at targetPath unless the package was reconstructed exactly.
+func ApplyDelta(ctx context.Context, basePath string, delta io.Reader, targetPath, targetSHA256 string) error {
+	if targetSHA256 == "" {
+		return errors.New("no digest to check the reconstructed package against")
+	}
+	br := bufio.NewReader(delta)
+	header, err := readDeltaHeader(br)
+	if err != nil {
+		return err
+	}
+
+	k, err := Open(ctx, basePath)
+	if err != nil {
+		return errors.Wrapf(err, "kpkg.Open(%q)", basePath)
+	}
+	defer k.Close()
+	// the delta is only checked once it's applied, so don't take its word for a size that would
+	// fill the storage first
+	if k.limits.MaxTotalSize > 0 && header.TargetPayloadSize > k.limits.MaxTotalSize {
+		return errors.Annotatef(ErrLimitExceeded, "reconstructed payload would be %d bytes, more than the %d allowed",
+			header.TargetPayloadSize, k.limits.MaxTotalSize)
+	}
+	base, cleanup, err := k.payloadReaderAt(ctx, filepath.Dir(targetPath), header.BasePayloadSHA256)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	partPath := targetPath + ".part"
+	f, err := os.Create(partPath)
+	if err != nil {
+		return errors.Wrapf(err, "os.Create(%q)", partPath)
+	}
+	ok := false
+	defer func() {
+		if !ok {
+			_ = f.Close()
+			_ = os.Remove(partPath)
+		}
+	}()
+
+	zr, err := newZstdReader(br, k.limits)
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+	targetHash := sha256.New()
+	bw := bufio.NewWriter(io.MultiWriter(f, targetHash))
+	n, err := applyDeltaOps(ctx, bufio.NewReader(zr), base, bw, header.TargetPayloadSize)
+	if err != nil {
+		return err
+	}
+	err = bw.Flush()
+	if err != nil {
+		return errors.Wrapf(err, "writing %q", partPath)
+	}
+	sum := hex.EncodeToString(targetHash.Sum(nil))
+	if n != header.TargetPayloadSize || sum != header.TargetPayloadSHA256 {
+		return errors.Annotatef(ErrDeltaMismatch,
+			"reconstructed payload is %d bytes with sha256 %s, expected %d bytes with %s",
+			n, sum, header.TargetPayloadSize, header.TargetPayloadSHA256)
+	}
+	if sum != targetSHA256 {
+		return errors.Annotatef(ErrDeltaMismatch, "reconstructed payload has sha256 %s, but the package's is %s",
+			sum, targetSHA256)
+	}
+
+	err = f.Close()
+	if err != nil {
+		return errors.Wrapf(err, "closing %q", partPath)
+	}
+	err = os.Rename(partPath, targetPath)
+	if err != nil {
+		return errors.Wrapf(err, "os.Rename(%q, %q)", partPath, targetPath)
+	}
+	ok = true
+	return nil
+}
+
+func readDeltaHeader(br *bufio.Reader) (*deltaHeader, error) {
+	magic := make([]byte, len(deltaMagic))
+	_, err := io.ReadFull(br, magic)
+	if err != nil || string(magic) != deltaMagic {
+		return nil, errors.New("not a kpkg delta")
+	}
+	line, err := br.ReadBytes('\n')
+	if err != nil {
+		return nil, errors.Wrap(err, "reading delta header")
+	}
+	var header deltaHeader
+	err = json.Unmarshal(line, &header)
+	if err != nil {
+		return nil, errors.Wrap(err, "json.Unmarshal() to kpkg.deltaHeader")
+	}
+	if header.Version != deltaVersion {
+		return nil, errors.Errorf("unsupported delta version %d", header.Version)
+	}
+	return &header, nil
+}
+
+// payloadReaderAt gives random access to the package's decompressed payload, after checking its
+// digest. An uncompressed package is read in place; anything else is decompressed to a temporary
+// file in tmpDir, which cleanup removes.
+func (k *KPKG) payloadReaderAt(ctx context.Context, tmpDir, wantSHA256 string) (io.ReaderAt, func(), error) {
+	if k.file == nil {
+		return nil, nil, errors.New("a delta can only be applied to a package opened from a file")
+	}
+	r, raw, err := k.decompressor()
+	if err != nil {
+		return nil, nil, err
+	}
+	h := sha256.New()
+	var ra io.ReaderAt
+	cleanup := func() {}
+	if raw {
+		_, err = io.Copy(h, utilio.NewContextReader(ctx, io.NewSectionReader(k.file, 0, 1<<62)))
+		ra = k.file
+	} else {
+		var tmp *os.File
+		tmp, err = os.CreateTemp(tmpDir, "kpkg-delta-base-")
+		if err != nil {
+			return nil, nil, errors.Wrapf(err, "os.CreateTemp(%q)", tmpDir)
+		}
+		cleanup = func() {
+			_ = tmp.Close()
+			_ = os.Remove(tmp.Name())
+		}
+		_, err = io.Copy(io.MultiWriter(tmp, h), utilio.NewContextReader(ctx, r))
+		ra = tmp
+	}
+	if err != nil {
+		cleanup()
+		return nil, nil, errors.Wrapf(err, "reading payload of %q", k.path)
+	}
+	if sum := hex.EncodeToString(h.Sum(nil)); sum != wantSHA256 {
+		cleanup()
+		return nil, nil, errors.Annotatef(ErrDeltaMismatch, "base payload sha256 is %s, expected %s", sum, wantSHA256)
+	}
+	return ra, cleanup, nil
+}
+
+// applyDeltaOps writes the target payload, stopping short of writing more than size bytes of it.
+func applyDeltaOps(ctx context.Context, r *bufio.Reader, base io.ReaderAt, w io.Writer, size int64) (int64, error) {
+	var written int64
+	tooBig := func(n uint64) error {
+		if n > uint64(size-written) { //nolint:gosec
+			return errors.Annotatef(ErrDeltaMismatch, "payload is more than the %d bytes expected", size)
+		}
+		return nil
+	}
+	for {
+		if err := ctx.Err(); err != nil {
+			return 0, errors.AddStack(err)
+		}
+		kind, err := r.ReadByte()
+		if err != nil {
+			return 0, errors.Wrap(err, "reading delta")
+		}
+		switch kind {
+		case deltaOpEnd:
+			return written, nil
+		case deltaOpCopy:
+			off, err := binary.ReadUvarint(r)
+			if err != nil {
+				return 0, errors.Wrap(err, "reading delta")
+			}
+			n, err := binary.ReadUvarint(r)
+			if err != nil {
+				return 0, errors.Wrap(err, "reading delta")
+			}
+			if err := tooBig(n); err != nil {
+				return 0, err
+			}
+			copied, err := io.Copy(w, io.NewSectionReader(base, int64(off), int64(n))) //nolint:gosec
+			if err != nil {
+				return 0, errors.Wrap(err, "copying from the base package")
+			}
+			if copied != int64(n) { //nolint:gosec
+				return 0, errors.Annotatef(ErrDeltaMismatch, "copy of %d bytes at %d is past the end of the base", n, off)
+			}
+			written += copied
+		case deltaOpInsert:
+			n, err := binary.ReadUvarint(r)
+			if err != nil {
+				return 0, errors.Wrap(err, "reading delta")
+			}
+			if err := tooBig(n); err != nil {
+				return 0, err
+			}
+			inserted, err := io.CopyN(w, r, int64(n)) //nolint:gosec
+			written += inserted
+			if err != nil {
+				return 0, errors.Wrap(err, "reading delta")
+			}
+		default:
+			return 0, errors.Errorf("unknown delta operation %q", kind)
+		}
+	}
+}
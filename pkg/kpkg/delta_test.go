@@ -0,0 +1,101 @@
+package kpkg_test
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/clintharrison/go-kindle-pkg/pkg/kpkg"
+	"github.com/pingcap/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDelta(t *testing.T) {
+	t.Parallel()
+	ctx := t.Context()
+
+	big := strings.Repeat("unchanged library code\n", 10000)
+	base := buildPackage(t, map[string]string{
+		"manifest.json": testManifest,
+		"lib/big.so":    big,
+		"lib/gone.so":   strings.Repeat("gone\n", 1000),
+		"install.sh":    "echo v1\n",
+	})
+	target := buildPackage(t, map[string]string{
+		"manifest.json": `{"id": "signed", "name": "Signed", "version": [1, 0, 1]}`,
+		"lib/big.so":    big,
+		"lib/new.so":    strings.Repeat("new\n", 1000),
+		"install.sh":    "echo v2\n",
+	}, kpkg.WithGzipCompression)
+
+	delta := &bytes.Buffer{}
+	require.NoError(t, kpkg.CreateDelta(ctx, base, target, delta))
+	require.Less(t, delta.Len(), 2048, "the unchanged library should be copied from the base")
+
+	digests := func(p string) [2]string {
+		k, err := kpkg.Open(ctx, p)
+		require.NoError(t, err)
+		defer k.Close()
+		m, payload, err := k.Digests(ctx)
+		require.NoError(t, err)
+		return [2]string{m, payload}
+	}
+	targetSum := digests(target)[1]
+
+	// the reconstructed package has the same payload, and so the same signature, as the target
+	out := filepath.Join(t.TempDir(), "reconstructed.kpkg")
+	require.NoError(t, kpkg.ApplyDelta(ctx, base, bytes.NewReader(delta.Bytes()), out, targetSum))
+	require.Equal(t, digests(target), digests(out))
+
+	// an uncompressed base is used in place, and gives the same result
+	again := filepath.Join(t.TempDir(), "again.kpkg")
+	require.NoError(t, kpkg.ApplyDelta(ctx, out, bytes.NewReader(mustDelta(t, out, target)), again, targetSum))
+	require.Equal(t, digests(target), digests(again))
+
+	// the wrong base is refused, and leaves nothing behind
+	wrong := filepath.Join(t.TempDir(), "wrong.kpkg")
+	err := kpkg.ApplyDelta(ctx, target, bytes.NewReader(delta.Bytes()), wrong, targetSum)
+	require.Equal(t, kpkg.ErrDeltaMismatch, errors.Cause(err), "got %v", err)
+	entries, err := os.ReadDir(filepath.Dir(wrong))
+	require.NoError(t, err)
+	require.Empty(t, entries)
+
+	// and so is a corrupted delta
+	corrupt := bytes.Clone(delta.Bytes())
+	corrupt[len(corrupt)-10] ^= 0xff
+	require.Error(t, kpkg.ApplyDelta(ctx, base, bytes.NewReader(corrupt), wrong, targetSum))
+	_, err = os.Stat(wrong)
+	require.True(t, os.IsNotExist(err))
+
+	// and so is a delta whose header vouches for some other package than the one expected
+	other := buildPackage(t, map[string]string{
+		"manifest.json": `{"id": "signed", "name": "Signed", "version": [6, 6, 6]}`,
+		"lib/big.so":    big,
+	})
+	err = kpkg.ApplyDelta(ctx, base, bytes.NewReader(mustDelta(t, base, other)), wrong, targetSum)
+	require.Equal(t, kpkg.ErrDeltaMismatch, errors.Cause(err), "got %v", err)
+	_, err = os.Stat(wrong)
+	require.True(t, os.IsNotExist(err))
+
+	// and so is a delta claiming a bigger package than could be installed, before anything is written
+	huge := regexp.MustCompile(`"target_payload_size":\d+`).ReplaceAll(delta.Bytes(),
+		[]byte(`"target_payload_size":2147483648`))
+	err = kpkg.ApplyDelta(ctx, base, bytes.NewReader(huge), wrong, targetSum)
+	require.Equal(t, kpkg.ErrLimitExceeded, errors.Cause(err), "got %v", err)
+	entries, err = os.ReadDir(filepath.Dir(wrong))
+	require.NoError(t, err)
+	require.Empty(t, entries)
+
+	// there's nothing to check the result against without the expected digest
+	require.Error(t, kpkg.ApplyDelta(ctx, base, bytes.NewReader(delta.Bytes()), wrong, ""))
+}
+
+func mustDelta(t *testing.T, base, target string) []byte {
+	t.Helper()
+	delta := &bytes.Buffer{}
+	require.NoError(t, kpkg.CreateDelta(t.Context(), base, target, delta))
+	return delta.Bytes()
+}
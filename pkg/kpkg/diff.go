@@ -0,0 +1,297 @@
+package kpkg
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"maps"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/clintharrison/go-kindle-pkg/pkg/repository/manifest"
+	"github.com/clintharrison/go-kindle-pkg/pkg/textdiff"
+	"github.com/pingcap/errors"
+)
+
+// maxTextDiffSize is the largest file Diff will show a text diff of, and so hold in memory.
+const maxTextDiffSize = 1 << 20
+
+// textDiffContext is how many unchanged lines are shown around each change in a text diff.
+const textDiffContext = 3
+
+// ChangeKind is how an entry differs between two packages.
+type ChangeKind string
+
+const (
+	EntryAdded    ChangeKind = "added"
+	EntryRemoved  ChangeKind = "removed"
+	EntryModified ChangeKind = "modified"
+)
+
+// EntryChange is an entry that differs between two packages.
+type EntryChange struct {
+	// Path is the entry's name relative to the package root, as listed by extract --test.
+	Path string
+	Kind ChangeKind
+	// Attrs are the mtree-like attributes of an added or removed entry, in the package that has it.
+	Attrs string
+	// Details describe each way a modified entry changed, like "size 100 -> 120 (+20)".
+	Details []string
+	// TextDiff is a unified diff of a modified text file, if Diff was asked for them.
+	TextDiff string
+}
+
+// PackageDiff is what changed from one package to another.
+type PackageDiff struct {
+	// Manifest describes each manifest field that changed, like "version 1.0.0 -> 1.1.0".
+	Manifest []string
+	// Entries are in the order the entries would be extracted: depth-first, and lexical within each
+	// directory. manifest.json and contents.json aren't included; their changes are covered by
+	// Manifest and the other entries.
+	Entries []EntryChange
+}
+
+// Empty is whether the packages have the same manifest and entries.
+func (d *PackageDiff) Empty() bool {
+	return len(d.Manifest) == 0 && len(d.Entries) == 0
+}
+
+type DiffOption func(*diffOptions)
+
+type diffOptions struct {
+	textDiffs bool
+}
+
+// WithTextDiffs makes Diff include a unified diff of each modified file that looks like text.
+func WithTextDiffs() DiffOption {
+	return func(o *diffOptions) {
+		o.textDiffs = true
+	}
+}
+
+// Diff compares two packages by their manifests and the attributes and contents of their entries,
+// regardless of the order they were archived in. Each package is read through once, so it can be
+// used with packages opened by OpenStream.
+func Diff(ctx context.Context, a, b *KPKG, optFuncs ...DiffOption) (*PackageDiff, error) {
+	opts := &diffOptions{} //nolint:exhaustruct
+	for _, o := range optFuncs {
+		o(opts)
+	}
+	entriesA, err := a.diffEntries(ctx, opts.textDiffs)
+	if err != nil {
+		return nil, errors.Annotate(err, "reading the first package")
+	}
+	entriesB, err := b.diffEntries(ctx, opts.textDiffs)
+	if err != nil {
+		return nil, errors.Annotate(err, "reading the second package")
+	}
+
+	d := &PackageDiff{Manifest: diffManifests(a.Manifest, b.Manifest), Entries: nil}
+	names := slices.Collect(maps.Keys(entriesA))
+	for name := range entriesB {
+		if _, ok := entriesA[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	slices.SortFunc(names, func(x, y string) int {
+		return slices.Compare(pathComponents(x), pathComponents(y))
+	})
+	for _, name := range names {
+		ea, inA := entriesA[name]
+		eb, inB := entriesB[name]
+		switch {
+		case !inA:
+			d.Entries = append(d.Entries, EntryChange{
+				Path: listName(name), Kind: EntryAdded, Attrs: formatAttrs(eb.attrs), Details: nil, TextDiff: "",
+			})
+		case !inB:
+			d.Entries = append(d.Entries, EntryChange{
+				Path: listName(name), Kind: EntryRemoved, Attrs: formatAttrs(ea.attrs), Details: nil, TextDiff: "",
+			})
+		default:
+			details := diffAttrs(ea, eb)
+			if len(details) == 0 {
+				continue
+			}
+			change := EntryChange{Path: listName(name), Kind: EntryModified, Attrs: "", Details: details, TextDiff: ""}
+			if ea.text != nil && eb.text != nil {
+				p := listName(name)
+				change.TextDiff = textdiff.Unified("a/"+p, "b/"+p, *ea.text, *eb.text, textDiffContext)
+			}
+			d.Entries = append(d.Entries, change)
+		}
+	}
+	return d, nil
+}
+
+type diffEntry struct {
+	attrs map[string]string
+	// sha256 is only set for regular files
+	sha256 string
+	// text is set for regular files that look like text, if text diffs were asked for
+	text *string
+}
+
+// diffEntries reads the package's entries through once, keyed by their cleaned names.
+func (k *KPKG) diffEntries(ctx context.Context, keepText bool) (map[string]*diffEntry, error) {
+	next, err := k.entries()
+	if err != nil {
+		return nil, err
+	}
+	entries := map[string]*diffEntry{}
+	lc := &limitChecker{limits: k.limits, entries: 0, total: 0}
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, errors.AddStack(err)
+		}
+		h, r, err := next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "tarReader.Next()")
+		}
+		err = lc.check(h)
+		if err != nil {
+			return nil, err
+		}
+		name := path.Clean(strings.TrimPrefix(h.Name, "/"))
+		if name == "manifest.json" || name == ContentsFileName {
+			continue
+		}
+		attrs, err := entryAttrs(h)
+		if err != nil {
+			return nil, err
+		}
+		e := &diffEntry{attrs: attrs, sha256: "", text: nil}
+		if h.Typeflag == tar.TypeReg {
+			e.sha256, e.text, err = readDiffContents(r, h.Size, keepText)
+			if err != nil {
+				return nil, errors.Wrapf(err, "reading %q", h.Name)
+			}
+		}
+		entries[name] = e
+	}
+
+	err = k.finishEntries()
+	if err != nil {
+		return nil, errors.Wrap(err, "verifying package")
+	}
+	return entries, nil
+}
+
+// readDiffContents hashes a file's contents, and keeps them as well if they are wanted and look
+// like text: valid UTF-8 with no NUL bytes, and small enough to diff.
+func readDiffContents(r io.Reader, size int64, keepText bool) (string, *string, error) {
+	if !keepText || size > maxTextDiffSize {
+		sum, err := readerSHA256(r)
+		return sum, nil, err
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return "", nil, errors.AddStack(err)
+	}
+	sum, err := readerSHA256(bytes.NewReader(data))
+	if err != nil {
+		return "", nil, err
+	}
+	if bytes.IndexByte(data, 0) >= 0 || !utf8.Valid(data) {
+		return sum, nil, nil
+	}
+	text := string(data)
+	return sum, &text, nil
+}
+
+func diffAttrs(a, b *diffEntry) []string {
+	var details []string
+	for _, k := range attrOrder {
+		va, vb := a.attrs[k], b.attrs[k]
+		if va == vb {
+			continue
+		}
+		switch k {
+		case "size":
+			sa, _ := strconv.ParseInt(va, 10, 64)
+			sb, _ := strconv.ParseInt(vb, 10, 64)
+			details = append(details, fmt.Sprintf("size %s -> %s (%+d)", va, vb, sb-sa))
+		case "link":
+			details = append(details, fmt.Sprintf("link target %q -> %q", va, vb))
+		default:
+			details = append(details, fmt.Sprintf("%s %s -> %s", k, va, vb))
+		}
+	}
+	if a.sha256 != "" && b.sha256 != "" && a.sha256 != b.sha256 && a.attrs["size"] == b.attrs["size"] {
+		details = append(details, "contents changed")
+	}
+	return details
+}
+
+// diffManifests describes the fields that changed between two manifests.
+func diffManifests(a, b *manifest.Manifest) []string {
+	if a == nil || b == nil {
+		return nil
+	}
+	var diffs []string
+	field := func(name, va, vb string) {
+		if va != vb {
+			diffs = append(diffs, fmt.Sprintf("%s %s -> %s", name, va, vb))
+		}
+	}
+	field("id", strconv.Quote(a.ID), strconv.Quote(b.ID))
+	field("name", strconv.Quote(a.Name), strconv.Quote(b.Name))
+	field("author", strconv.Quote(a.Author), strconv.Quote(b.Author))
+	field("description", strconv.Quote(a.Description), strconv.Quote(b.Description))
+	field("version", a.Version.String(), b.Version.String())
+	field("supported_arch", formatArchs(a.SupportedArch), formatArchs(b.SupportedArch))
+
+	ids := slices.Collect(maps.Keys(a.Dependencies))
+	for id := range b.Dependencies {
+		if _, ok := a.Dependencies[id]; !ok {
+			ids = append(ids, id)
+		}
+	}
+	slices.Sort(ids)
+	for _, id := range ids {
+		da, inA := a.Dependencies[id]
+		db, inB := b.Dependencies[id]
+		switch {
+		case !inA:
+			diffs = append(diffs, fmt.Sprintf("dependency %s added (%s)", id, formatDependency(db)))
+		case !inB:
+			diffs = append(diffs, fmt.Sprintf("dependency %s removed (was %s)", id, formatDependency(da)))
+		default:
+			field("dependency "+id, formatDependency(da), formatDependency(db))
+		}
+	}
+	return diffs
+}
+
+func formatArchs(archs []string) string {
+	if len(archs) == 0 {
+		return "(any)"
+	}
+	return "[" + strings.Join(archs, ", ") + "]"
+}
+
+// formatDependency formats a dependency's constraints, like ">=1.0.0,<2.0.0".
+func formatDependency(d manifest.Dependency) string {
+	var parts []string
+	if d.Min != nil {
+		parts = append(parts, ">="+d.Min.String())
+	}
+	if d.Max != nil {
+		parts = append(parts, "<"+d.Max.String())
+	}
+	if d.RepositoryID != nil {
+		parts = append(parts, "repository="+*d.RepositoryID)
+	}
+	if len(parts) == 0 {
+		return "any version"
+	}
+	return strings.Join(parts, ",")
+}
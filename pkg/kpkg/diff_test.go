@@ -0,0 +1,92 @@
+package kpkg_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/clintharrison/go-kindle-pkg/pkg/kpkg"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiff(t *testing.T) {
+	t.Parallel()
+	ctx := t.Context()
+
+	dirA := writePackageDir(t, map[string]string{
+		"manifest.json": `{"id": "signed", "name": "Signed", "version": [1, 0, 0],
+			"dependencies": {"libfoo": {"id": "libfoo", "min": [1, 0, 0]}}}`,
+		"install.sh":  "#!/bin/sh\necho installing\n",
+		"bin/tool":    "tool v1",
+		"removed.txt": "gone",
+		"same.txt":    "same",
+	})
+	require.NoError(t, os.Symlink("bin/tool", filepath.Join(dirA, "current")))
+	dirB := writePackageDir(t, map[string]string{
+		"manifest.json": `{"id": "signed", "name": "Signed", "version": [1, 1, 0], "supported_arch": ["armhf"],
+			"dependencies": {"libbar": {"id": "libbar"}, "libfoo": {"id": "libfoo", "min": [1, 2, 0]}}}`,
+		"install.sh": "#!/bin/sh\necho installing v2\n",
+		"bin/tool":   "tool v2",
+		"added.txt":  "new",
+		"same.txt":   "same",
+	})
+	require.NoError(t, os.Symlink("bin/other", filepath.Join(dirB, "current")))
+	require.NoError(t, os.Chmod(filepath.Join(dirB, "bin/tool"), 0o755))
+
+	a := filepath.Join(t.TempDir(), "a.kpkg")
+	require.NoError(t, kpkg.Build(ctx, dirA, a))
+	b := filepath.Join(t.TempDir(), "b.kpkg")
+	require.NoError(t, kpkg.Build(ctx, dirB, b, kpkg.WithGzipCompression, kpkg.WithSkipArchCheck()))
+
+	diff := func(opts ...kpkg.DiffOption) *kpkg.PackageDiff {
+		t.Helper()
+		ka, err := kpkg.Open(ctx, a)
+		require.NoError(t, err)
+		defer ka.Close()
+		kb, err := kpkg.Open(ctx, b)
+		require.NoError(t, err)
+		defer kb.Close()
+		d, err := kpkg.Diff(ctx, ka, kb, opts...)
+		require.NoError(t, err)
+		return d
+	}
+
+	d := diff()
+	require.Equal(t, []string{
+		"version 1.0.0 -> 1.1.0",
+		"supported_arch (any) -> [armhf]",
+		"dependency libbar added (any version)",
+		"dependency libfoo >=1.0.0 -> >=1.2.0",
+	}, d.Manifest)
+	//nolint:exhaustruct
+	require.Equal(t, []kpkg.EntryChange{
+		{Path: "added.txt", Kind: kpkg.EntryAdded, Attrs: " type=file mode=644 size=3 uid=0 gid=0"},
+		{Path: "bin/tool", Kind: kpkg.EntryModified, Details: []string{"mode 644 -> 755", "contents changed"}},
+		{Path: "current", Kind: kpkg.EntryModified, Details: []string{`link target "bin/tool" -> "bin/other"`}},
+		{Path: "install.sh", Kind: kpkg.EntryModified, Details: []string{"size 26 -> 29 (+3)"}},
+		{Path: "removed.txt", Kind: kpkg.EntryRemoved, Attrs: " type=file mode=644 size=4 uid=0 gid=0"},
+	}, d.Entries)
+
+	d = diff(kpkg.WithTextDiffs())
+	require.Equal(t, "install.sh", d.Entries[3].Path)
+	require.Equal(t, `--- a/install.sh
++++ b/install.sh
+@@ -1,2 +1,2 @@
+ #!/bin/sh
+-echo installing
++echo installing v2
+`, d.Entries[3].TextDiff)
+
+	// a package has no differences from itself, however it is compressed
+	c := filepath.Join(t.TempDir(), "c.kpkg")
+	require.NoError(t, kpkg.Build(ctx, dirA, c, kpkg.WithZstdCompression))
+	ka, err := kpkg.Open(ctx, a)
+	require.NoError(t, err)
+	defer ka.Close()
+	kc, err := kpkg.Open(ctx, c)
+	require.NoError(t, err)
+	defer kc.Close()
+	d, err = kpkg.Diff(ctx, ka, kc)
+	require.NoError(t, err)
+	require.True(t, d.Empty(), "%+v", d)
+}
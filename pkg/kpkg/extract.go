@@ -3,22 +3,115 @@ package kpkg
 import (
 	"archive/tar"
 	"context"
+	"crypto/sha256"
 	"fmt"
 	"io"
+	"io/fs"
 	"log/slog"
 	"os"
 	"path"
+	"path/filepath"
+	"slices"
 	"strconv"
 	"strings"
 
 	"github.com/pingcap/errors"
 )
 
-func (k *KPKG) ExtractAll(ctx context.Context, targetDir string, test bool, logw io.Writer) error {
+type ExtractOption func(*extractOptions)
+
+type extractOptions struct {
+	arch       string
+	include    []string
+	exclude    []string
+	listFormat ListFormat
+	noSymlinks bool
+}
+
+// WithInclude extracts only the entries that match one of the patterns, or are in a directory
+// that does. Patterns are globs like those in a BuildSpec: "*.sh" matches at any depth, and
+// "koreader/reader.lua" or "koreader/**/*.lua" match from the package root.
+func WithInclude(patterns ...string) ExtractOption {
+	return func(o *extractOptions) {
+		o.include = append(o.include, patterns...)
+	}
+}
+
+// WithExclude leaves out the entries that match one of the patterns, or are in a directory that
+// does. It takes precedence over WithInclude.
+func WithExclude(patterns ...string) ExtractOption {
+	return func(o *extractOptions) {
+		o.exclude = append(o.exclude, patterns...)
+	}
+}
+
+// WithoutSymlinks skips symlink entries, with a warning, for extracting to a filesystem that
+// can't hold them, like the FAT-formatted /mnt/us on a Kindle.
+func WithoutSymlinks() ExtractOption {
+	return func(o *extractOptions) {
+		o.noSymlinks = true
+	}
+}
+
+func (o *extractOptions) validate() error {
+	for _, pattern := range slices.Concat(o.include, o.exclude) {
+		if !validGlob(pattern) {
+			return errors.Errorf("invalid glob %q", pattern)
+		}
+	}
+	switch o.listFormat {
+	case "", ListAttrs, ListMtree:
+	default:
+		return errors.Errorf("unknown list format %q", o.listFormat)
+	}
+	return nil
+}
+
+// selected reports whether the include and exclude patterns let an entry through. The root is
+// always extracted, as the directory everything else goes in.
+func (o *extractOptions) selected(entry *tar.Header) bool {
+	name := path.Clean(entry.Name)
+	if name == "." {
+		return true
+	}
+	if matchAnyGlobOrParent(o.exclude, name) {
+		return false
+	}
+	return len(o.include) == 0 || matchAnyGlobOrParent(o.include, name)
+}
+
+// WithArch extracts the package for a device of the given architecture. A multi-architecture
+// package has its common/ and arch/<arch>/ trees merged, and the rest left out; any package that
+// doesn't support arch is refused with ErrUnsupportedArch. Without it, packages are extracted as they are.
+func WithArch(arch string) ExtractOption {
+	return func(o *extractOptions) {
+		o.arch = arch
+	}
+}
+
+func (k *KPKG) ExtractAll(
+	ctx context.Context, targetDir string, test bool, logw io.Writer, optFuncs ...ExtractOption,
+) error {
+	opts := &extractOptions{} //nolint:exhaustruct
+	for _, o := range optFuncs {
+		o(opts)
+	}
 	if targetDir == "" {
 		return errors.New("no target directory specified")
 	}
-	_, err := os.Stat(targetDir)
+	err := opts.validate()
+	if err != nil {
+		return err
+	}
+	var ae *archExtractor
+	if opts.arch != "" {
+		var err error
+		ae, err = k.archExtractor(opts.arch)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = os.Stat(targetDir)
 	if err != nil {
 		if test {
 			slog.Info("would create output directory", "path", targetDir)
@@ -29,13 +122,17 @@ func (k *KPKG) ExtractAll(ctx context.Context, targetDir string, test bool, logw
 			}
 		}
 	}
-	err = k.resetReader()
+	next, err := k.entries()
 	if err != nil {
-		return errors.Wrap(err, "kpkg.resetReader()")
+		return err
 	}
 
+	// in test mode, keep listing so every refused entry is flagged, but still fail at the end
+	var firstUnsafe error
+	lister := newEntryLister(logw, opts.listFormat)
+	lc := &limitChecker{limits: k.limits, entries: 0, total: 0}
 	for {
-		entry, err := k.tarReader.Next()
+		entry, r, err := next()
 		nm := "<nil>"
 		if entry != nil {
 			nm = entry.Name
@@ -48,20 +145,202 @@ func (k *KPKG) ExtractAll(ctx context.Context, targetDir string, test bool, logw
 			return errors.Wrap(err, "tarReader.Next()")
 		}
 		slog.Debug("extracting", "name", entry.Name, "type", entry.Typeflag, "size", entry.Size, "dest", targetDir)
-		if test {
-			err := logEntry(logw, entry)
+		err = lc.check(entry)
+		if err != nil {
+			return err
+		}
+		relPath, unsafeErr := checkEntry(entry)
+		if _, ok := archTree(relPath); ok && ae == nil && opts.arch != "" && k.Contents == nil {
+			// a streamed package without a contents.json can't be checked for payload trees up front
+			return errors.Errorf("%s has an %s/ tree but no %s, so it can't be extracted for %s",
+				k.Manifest.ID, ArchDir, ContentsFileName, opts.arch)
+		}
+		if ae != nil && unsafeErr == nil {
+			var ok bool
+			entry, r, ok, err = ae.mapEntry(entry, r)
 			if err != nil {
 				return err
 			}
-		} else {
-			err := extractEntry(ctx, k.tarReader, entry, targetDir)
+			if !ok {
+				continue
+			}
+			relPath, unsafeErr = checkEntry(entry)
+		}
+		// the same entries are listed in test mode as would be extracted
+		if !opts.selected(entry) {
+			slog.Debug("not selected", "name", entry.Name)
+			continue
+		}
+		if test {
+			err := lister.list(entry, r)
 			if err != nil {
 				return err
 			}
+			if unsafeErr != nil {
+				lister.refused(unsafeErr)
+				if firstUnsafe == nil {
+					firstUnsafe = unsafeErr
+				}
+			}
+			continue
+		}
+		if unsafeErr != nil {
+			return unsafeErr
+		}
+		if opts.noSymlinks && entry.Typeflag == tar.TypeSymlink {
+			slog.Warn("symlinks are not supported here, skipping", "path", entry.Name, "target", entry.Linkname)
+			continue
+		}
+		err = extractEntry(ctx, r, entry, targetDir, relPath)
+		if err != nil {
+			return err
 		}
 	}
 
-	return nil
+	if test {
+		err := lister.finish()
+		if err != nil {
+			return err
+		}
+	}
+	err = k.finishEntries()
+	if err != nil {
+		return errors.Wrap(err, "verifying package")
+	}
+	return firstUnsafe
+}
+
+// entries returns an iterator over the archive's entries and their contents, from the start.
+func (k *KPKG) entries() (func() (*tar.Header, io.Reader, error), error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.stream == nil {
+		r, err := k.payloadReader()
+		if err != nil {
+			return nil, err
+		}
+		// a package that must be verified is hashed as it's read, for finishEntries to check
+		k.payload, k.payloadHash = r, nil
+		if k.keyring != nil {
+			k.payloadHash = sha256.New()
+			k.payload = io.TeeReader(r, k.payloadHash)
+		}
+		k.tarReader = tar.NewReader(k.payload)
+		return func() (*tar.Header, io.Reader, error) {
+			entry, err := k.tarReader.Next()
+			return entry, k.tarReader, err //nolint:wrapcheck
+		}, nil
+	}
+
+	if k.stream.consumed {
+		return nil, errors.New("package stream has already been read")
+	}
+	k.stream.consumed = true
+	return func() (*tar.Header, io.Reader, error) {
+		return k.stream.nextEntry(k.tarReader)
+	}, nil
+}
+
+// UnsafeEntryError is returned for an archive entry that would be written outside the target directory.
+type UnsafeEntryError struct {
+	Name     string
+	Linkname string
+	Reason   string
+}
+
+func (e *UnsafeEntryError) Error() string {
+	if e.Linkname != "" {
+		return fmt.Sprintf("unsafe archive entry %q -> %q: %s", e.Name, e.Linkname, e.Reason)
+	}
+	return fmt.Sprintf("unsafe archive entry %q: %s", e.Name, e.Reason)
+}
+
+// AsUnsafeEntryError returns the *UnsafeEntryError at the root of err, if there is one.
+func AsUnsafeEntryError(err error) (*UnsafeEntryError, bool) {
+	ue, ok := errors.Cause(err).(*UnsafeEntryError) //nolint:errorlint // pingcap/errors has no As()
+	return ue, ok
+}
+
+func isOutside(rel string) bool {
+	return rel == ".." || strings.HasPrefix(rel, "../")
+}
+
+// checkEntry validates an entry's name and link target without touching the filesystem,
+// returning its path relative to the target directory ("." for the root).
+func checkEntry(entry *tar.Header) (string, error) {
+	unsafe := func(reason string) error {
+		return errors.AddStack(&UnsafeEntryError{Name: entry.Name, Linkname: entry.Linkname, Reason: reason})
+	}
+	if path.IsAbs(entry.Name) {
+		return "", unsafe("absolute path")
+	}
+	rel := path.Clean(entry.Name)
+	if isOutside(rel) {
+		return "", unsafe("path escapes the target directory")
+	}
+
+	switch entry.Typeflag {
+	case tar.TypeSymlink:
+		if path.IsAbs(entry.Linkname) {
+			return "", unsafe("absolute link target")
+		}
+		if isOutside(path.Join(path.Dir(rel), entry.Linkname)) {
+			return "", unsafe("link target escapes the target directory")
+		}
+		// path.Join cleans "s/.." away, but the system follows s first, so if it's a link (or
+		// becomes one later in the archive) the target can end up anywhere
+		if ascendsAfterDescending(entry.Linkname) {
+			return "", unsafe("link target has \"..\" after a directory that may be a link")
+		}
+	case tar.TypeLink:
+		// hard link names are archive paths, not relative to the link's directory
+		if path.IsAbs(entry.Linkname) {
+			return "", unsafe("absolute link target")
+		}
+		if isOutside(path.Clean(entry.Linkname)) {
+			return "", unsafe("link target escapes the target directory")
+		}
+	}
+	return rel, nil
+}
+
+// ascendsAfterDescending reports whether a link target has a ".." component after a named one,
+// as in "s/../../etc". Leading ".." components only climb out of the link's own directory, which
+// is real by the time the link is made, so they resolve the same way lexically and on disk.
+func ascendsAfterDescending(linkname string) bool {
+	descended := false
+	for _, c := range strings.Split(linkname, "/") {
+		switch c {
+		case "", ".":
+		case "..":
+			if descended {
+				return true
+			}
+		default:
+			descended = true
+		}
+	}
+	return false
+}
+
+// checkResolvedParent makes sure that, with symlinks extracted so far resolved, fullPath's
+// directory is still inside targetDir. checkEntry alone can't see through links like "d -> .".
+func checkResolvedParent(entry *tar.Header, targetDir, fullPath string) (string, error) {
+	realTarget, err := filepath.EvalSymlinks(targetDir)
+	if err != nil {
+		return "", errors.Wrapf(err, "filepath.EvalSymlinks(%q)", targetDir)
+	}
+	realParent, err := filepath.EvalSymlinks(filepath.Dir(fullPath))
+	if err != nil {
+		return "", errors.Wrapf(err, "filepath.EvalSymlinks(%q)", filepath.Dir(fullPath))
+	}
+	rel, err := filepath.Rel(realTarget, realParent)
+	if err != nil || isOutside(filepath.ToSlash(rel)) {
+		return "", errors.AddStack(&UnsafeEntryError{
+			Name: entry.Name, Linkname: entry.Linkname, Reason: "parent directory resolves outside the target directory",
+		})
+	}
+	return realParent, nil
 }
 
 // attrOrder matches the order from mtree output, which is slightly nicer to read than random.
@@ -70,8 +349,17 @@ var attrOrder = []string{ //nolint:gochecknoglobals
 }
 
 func logEntry(logw io.Writer, entry *tar.Header) error {
-	// TODO: normalize name, don't allow path traversal upwards?
-	n := strings.TrimPrefix(entry.Name, "./")
+	attrs, err := entryAttrs(entry)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(logw, "%s%s\n", listName(entry.Name), formatAttrs(attrs)) //nolint:errcheck
+	return nil
+}
+
+// listName is an entry name as it is listed, relative to the package root.
+func listName(name string) string {
+	n := strings.TrimPrefix(name, "./")
 	// replace whitespace with octal escapes.
 	// this should maybe replace more than that, but for now this will do?
 	for _, r := range []rune{'\t', '\n', '\v', '\f', '\r'} {
@@ -80,8 +368,11 @@ func logEntry(logw io.Writer, entry *tar.Header) error {
 	if n == "" {
 		n = "."
 	}
-	logw.Write([]byte(n)) //nolint:errcheck
+	return n
+}
 
+// entryAttrs returns the mtree-like attributes of an entry, keyed by the names in attrOrder.
+func entryAttrs(entry *tar.Header) (map[string]string, error) {
 	attrs := make(map[string]string)
 	attrs["size"] = strconv.FormatInt(entry.Size, 10)
 	attrs["mode"] = fmt.Sprintf("%o", entry.Mode)
@@ -106,22 +397,47 @@ func logEntry(logw io.Writer, entry *tar.Header) error {
 		attrs["type"] = "fifo"
 	default:
 		slog.Error("UNSUPPORTED", "name", entry.Name, "type", entry.Typeflag)
-		return fmt.Errorf("unsupported entry type: %v", entry.Typeflag)
+		return nil, fmt.Errorf("unsupported entry type: %v", entry.Typeflag)
 	}
+	return attrs, nil
+}
 
+// formatAttrs formats attrs in attrOrder, each preceded by a space.
+func formatAttrs(attrs map[string]string) string {
+	sb := &strings.Builder{}
 	for _, k := range attrOrder {
 		v, ok := attrs[k]
 		if ok {
-			fmt.Fprintf(logw, " %s=%s", k, v) //nolint:errcheck
+			fmt.Fprintf(sb, " %s=%s", k, v)
 		}
 	}
-	logw.Write([]byte("\n")) //nolint:errcheck
-	return nil
+	return sb.String()
 }
 
-func extractEntry(_ context.Context, r io.Reader, entry *tar.Header, targetDir string) error {
-	path := strings.TrimPrefix(path.Clean(entry.Name), "./")
-	fullPath := targetDir + "/" + path
+func extractEntry(_ context.Context, r io.Reader, entry *tar.Header, targetDir, relPath string) error {
+	fullPath := filepath.Join(targetDir, filepath.FromSlash(relPath))
+	if relPath == "." {
+		// the root entry; targetDir has already been created
+		return nil
+	}
+
+	if entry.Typeflag != tar.TypeDir {
+		err := os.MkdirAll(filepath.Dir(fullPath), 0o755) //nolint:gosec
+		if err != nil {
+			return errors.Wrapf(err, "os.MkdirAll(%q)", filepath.Dir(fullPath))
+		}
+	}
+	realParent, err := checkResolvedParent(entry, targetDir, fullPath)
+	if err != nil {
+		return err
+	}
+	// never write through a link that an earlier entry left at this path
+	if fi, err := os.Lstat(fullPath); err == nil && fi.Mode()&fs.ModeSymlink != 0 {
+		err := os.Remove(fullPath)
+		if err != nil {
+			return errors.Wrapf(err, "os.Remove(%q)", fullPath)
+		}
+	}
 
 	switch entry.Typeflag {
 	case tar.TypeDir:
@@ -142,15 +458,31 @@ func extractEntry(_ context.Context, r io.Reader, entry *tar.Header, targetDir s
 		}
 		return nil
 	case tar.TypeSymlink:
-		err := os.Symlink(entry.Linkname, fullPath)
+		// checkEntry refused targets with ".." past their first named component, so joining the
+		// rest to the real parent lexically is where the system will resolve the link too
+		realTarget, err := filepath.EvalSymlinks(targetDir)
+		if err != nil {
+			return errors.Wrapf(err, "filepath.EvalSymlinks(%q)", targetDir)
+		}
+		rel, err := filepath.Rel(realTarget, filepath.Join(realParent, filepath.FromSlash(entry.Linkname)))
+		if err != nil || isOutside(filepath.ToSlash(rel)) {
+			return errors.AddStack(&UnsafeEntryError{
+				Name: entry.Name, Linkname: entry.Linkname, Reason: "link target resolves outside the target directory",
+			})
+		}
+		err = os.Symlink(entry.Linkname, fullPath)
 		if err != nil {
 			return errors.Wrapf(err, "os.Symlink(%q, %q)", entry.Linkname, fullPath)
 		}
 		return nil
 	case tar.TypeLink:
-		err := os.Link(entry.Linkname, fullPath)
+		linkPath := filepath.Join(targetDir, filepath.FromSlash(path.Clean(entry.Linkname)))
+		if _, err := checkResolvedParent(entry, targetDir, linkPath); err != nil {
+			return err
+		}
+		err := os.Link(linkPath, fullPath)
 		if err != nil {
-			return errors.Wrapf(err, "os.Link(%q, %q)", entry.Linkname, fullPath)
+			return errors.Wrapf(err, "os.Link(%q, %q)", linkPath, fullPath)
 		}
 		return nil
 	default:
@@ -0,0 +1,175 @@
+package kpkg_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/clintharrison/go-kindle-pkg/pkg/kpkg"
+	"github.com/stretchr/testify/require"
+)
+
+// writeRawTar writes an uncompressed archive with a manifest.json followed by the given entries,
+// for archives that Build would never produce.
+func writeRawTar(t *testing.T, entries ...*tar.Header) string {
+	t.Helper()
+	buf := &bytes.Buffer{}
+	tw := tar.NewWriter(buf)
+	require.NoError(t, tw.WriteHeader(&tar.Header{ //nolint:exhaustruct
+		Typeflag: tar.TypeReg, Name: "./manifest.json", Mode: 0o644, Size: int64(len(testManifest)),
+	}))
+	_, err := tw.Write([]byte(testManifest))
+	require.NoError(t, err)
+	for _, h := range entries {
+		require.NoError(t, tw.WriteHeader(h))
+		if h.Size > 0 {
+			_, err := tw.Write(bytes.Repeat([]byte("x"), int(h.Size)))
+			require.NoError(t, err)
+		}
+	}
+	require.NoError(t, tw.Close())
+
+	p := filepath.Join(t.TempDir(), "raw.kpkg")
+	require.NoError(t, os.WriteFile(p, buf.Bytes(), 0o644)) //nolint:gosec
+	return p
+}
+
+//nolint:exhaustruct
+func TestExtractAll_RejectsUnsafeEntries(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name    string
+		entries []*tar.Header
+		refused string
+		// only detectable once earlier entries exist on disk, so --test can't flag it
+		onlyOnDisk bool
+	}{
+		{
+			name:    "parent traversal",
+			entries: []*tar.Header{{Typeflag: tar.TypeReg, Name: "./../../evil", Mode: 0o644, Size: 1}},
+			refused: "./../../evil",
+		},
+		{
+			name:    "absolute path",
+			entries: []*tar.Header{{Typeflag: tar.TypeReg, Name: "/tmp/evil", Mode: 0o644, Size: 1}},
+			refused: "/tmp/evil",
+		},
+		{
+			name:    "absolute symlink",
+			entries: []*tar.Header{{Typeflag: tar.TypeSymlink, Name: "./etc", Linkname: "/etc", Mode: 0o777}},
+			refused: "./etc",
+		},
+		{
+			name:    "escaping symlink",
+			entries: []*tar.Header{{Typeflag: tar.TypeSymlink, Name: "./a/up", Linkname: "../..", Mode: 0o777}},
+			refused: "./a/up",
+		},
+		{
+			name:    "escaping hardlink",
+			entries: []*tar.Header{{Typeflag: tar.TypeLink, Name: "./passwd", Linkname: "../../etc/passwd"}},
+			refused: "./passwd",
+		},
+		{
+			name: "symlink escaping through another symlink",
+			entries: []*tar.Header{
+				{Typeflag: tar.TypeSymlink, Name: "./d", Linkname: ".", Mode: 0o777},
+				{Typeflag: tar.TypeSymlink, Name: "./d/up", Linkname: "..", Mode: 0o777},
+			},
+			refused:    "./d/up",
+			onlyOnDisk: true,
+		},
+		{
+			name: "symlink escaping through a link its target passes through",
+			entries: []*tar.Header{
+				{Typeflag: tar.TypeSymlink, Name: "./p/q/s", Linkname: "../..", Mode: 0o777},
+				{Typeflag: tar.TypeSymlink, Name: "./t", Linkname: "p/q/s/../../etc", Mode: 0o777},
+			},
+			refused: "./t",
+		},
+		{
+			name: "symlink escaping through a link that comes later",
+			entries: []*tar.Header{
+				{Typeflag: tar.TypeSymlink, Name: "./t", Linkname: "p/q/s/../../etc", Mode: 0o777},
+				{Typeflag: tar.TypeSymlink, Name: "./p/q/s", Linkname: "../..", Mode: 0o777},
+			},
+			refused: "./t",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			ctx := t.Context()
+			k, err := kpkg.Open(ctx, writeRawTar(t, tt.entries...))
+			require.NoError(t, err)
+			defer k.Close()
+
+			target := filepath.Join(t.TempDir(), "sub", "target")
+			err = k.ExtractAll(ctx, target, false, nil)
+			require.Error(t, err)
+			ue, ok := kpkg.AsUnsafeEntryError(err)
+			require.True(t, ok, "expected an UnsafeEntryError, got %v", err)
+			require.Equal(t, tt.refused, ue.Name)
+
+			// --test flags the same entry
+			out := &bytes.Buffer{}
+			err = k.ExtractAll(ctx, target, true, out)
+			if tt.onlyOnDisk {
+				require.NoError(t, err)
+				return
+			}
+			ue, ok = kpkg.AsUnsafeEntryError(err)
+			require.True(t, ok, "expected an UnsafeEntryError, got %v", err)
+			require.Equal(t, tt.refused, ue.Name)
+			require.Contains(t, out.String(), "# refused: ")
+		})
+	}
+}
+
+//nolint:exhaustruct
+func TestExtractAll_HardlinkRelativeToTarget(t *testing.T) {
+	t.Parallel()
+	ctx := t.Context()
+	k, err := kpkg.Open(ctx, writeRawTar(t,
+		&tar.Header{Typeflag: tar.TypeDir, Name: "./app/", Mode: 0o755},
+		&tar.Header{Typeflag: tar.TypeReg, Name: "./app/some-bin", Mode: 0o755, Size: 3},
+		&tar.Header{Typeflag: tar.TypeLink, Name: "./app/same-bin", Linkname: "./app/some-bin"},
+	))
+	require.NoError(t, err)
+	defer k.Close()
+
+	target := t.TempDir()
+	require.NoError(t, k.ExtractAll(ctx, target, false, nil))
+	data, err := os.ReadFile(filepath.Join(target, "app", "same-bin"))
+	require.NoError(t, err)
+	require.Equal(t, "xxx", string(data))
+}
+
+//nolint:exhaustruct
+func TestExtractAll_WithoutSymlinks(t *testing.T) {
+	t.Parallel()
+	ctx := t.Context()
+	k, err := kpkg.Open(ctx, writeRawTar(t,
+		&tar.Header{Typeflag: tar.TypeReg, Name: "./bin", Mode: 0o755, Size: 3},
+		&tar.Header{Typeflag: tar.TypeSymlink, Name: "./link", Linkname: "bin", Mode: 0o777},
+		// and unsafe links are still refused, rather than skipped
+		&tar.Header{Typeflag: tar.TypeSymlink, Name: "./etc", Linkname: "/etc", Mode: 0o777},
+	))
+	require.NoError(t, err)
+	defer k.Close()
+
+	target := t.TempDir()
+	err = k.ExtractAll(ctx, target, false, nil, kpkg.WithoutSymlinks())
+	ue, ok := kpkg.AsUnsafeEntryError(err)
+	require.True(t, ok, "expected an UnsafeEntryError, got %v", err)
+	require.Equal(t, "./etc", ue.Name)
+	_, err = os.Lstat(filepath.Join(target, "link"))
+	require.ErrorIs(t, err, fs.ErrNotExist)
+	data, err := os.ReadFile(filepath.Join(target, "bin"))
+	require.NoError(t, err)
+	require.Equal(t, "xxx", string(data))
+}
@@ -0,0 +1,347 @@
+package kpkg
+
+import (
+	"archive/tar"
+	"bufio"
+	"context"
+	"io"
+	"io/fs"
+	"math"
+	"path"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/pingcap/errors"
+)
+
+// maxSymlinks is how many links FS follows resolving one name, as for Linux's ELOOP.
+const maxSymlinks = 40
+
+// FS is a read-only view of a package's files, as fs.FS. It is indexed in one pass over the
+// archive; reading a file from a compressed package decompresses it again from the start, up to
+// the file. Symlinks are followed within the package, and links out of it don't exist.
+type FS struct {
+	k       *KPKG
+	raw     bool
+	entries map[string]*fsEntry
+}
+
+var (
+	_ fs.ReadDirFS  = (*FS)(nil)
+	_ fs.StatFS     = (*FS)(nil)
+	_ fs.ReadFileFS = (*FS)(nil)
+)
+
+type fsEntry struct {
+	header *tar.Header
+	// offset is where the file's data starts in the uncompressed tar stream
+	offset   int64
+	children []string
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n += int64(n)
+	return n, err //nolint:wrapcheck
+}
+
+// FS indexes the package and returns a view of its files. Packages opened with OpenStream
+// can't be read more than once, and so have no FS.
+func (k *KPKG) FS(ctx context.Context) (*FS, error) {
+	if k.stream != nil || k.file == nil {
+		return nil, errors.New("only packages opened from a file can be read as an fs.FS")
+	}
+	dr, raw, err := k.decompressor()
+	if err != nil {
+		return nil, err
+	}
+	cr := &countingReader{r: dr, n: 0}
+	tr := tar.NewReader(cr)
+
+	fsys := &FS{k: k, raw: raw, entries: map[string]*fsEntry{}}
+	fsys.entries["."] = &fsEntry{header: dirHeader("."), offset: 0, children: nil}
+	var hardLinks []string
+	lc := &limitChecker{limits: k.limits, entries: 0, total: 0}
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, errors.AddStack(err)
+		}
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "tarReader.Next()")
+		}
+		err = lc.check(h)
+		if err != nil {
+			return nil, err
+		}
+		name := path.Clean(strings.TrimPrefix(h.Name, "/"))
+		if isOutside(name) {
+			continue
+		}
+		if h.Typeflag == tar.TypeLink {
+			hardLinks = append(hardLinks, name)
+		}
+		fsys.add(name, &fsEntry{header: h, offset: cr.n, children: nil})
+	}
+
+	// a hard link is read as the file it links to
+	for _, name := range hardLinks {
+		e := fsys.entries[name]
+		target, ok := fsys.entries[path.Clean(e.header.Linkname)]
+		if !ok || target.header.Typeflag != tar.TypeReg {
+			delete(fsys.entries, name)
+			continue
+		}
+		h := *target.header
+		h.Name = e.header.Name
+		e.header = &h
+		e.offset = target.offset
+	}
+	for _, e := range fsys.entries {
+		slices.Sort(e.children)
+	}
+	return fsys, nil
+}
+
+// decompressor returns the package's uncompressed tar stream from the start, independently of
+// any other reader, and whether the package is uncompressed.
+func (k *KPKG) decompressor() (io.Reader, bool, error) {
+	br := bufio.NewReader(io.NewSectionReader(k.file, 0, math.MaxInt64))
+	dr, err := sniffDecompressor(br, k.limits)
+	if err != nil {
+		return nil, false, err
+	}
+	return dr, dr == io.Reader(br), nil
+}
+
+// add indexes e at name, along with any parent directories the archive doesn't have entries for.
+// A later entry for the same name replaces an earlier one, as it would when extracting.
+func (fsys *FS) add(name string, e *fsEntry) {
+	if existing, ok := fsys.entries[name]; ok {
+		e.children = existing.children
+		fsys.entries[name] = e
+		return
+	}
+	fsys.entries[name] = e
+	for name != "." {
+		parent := path.Dir(name)
+		pe, ok := fsys.entries[parent]
+		if !ok {
+			pe = &fsEntry{header: dirHeader(parent), offset: 0, children: nil}
+			fsys.entries[parent] = pe
+		}
+		pe.children = append(pe.children, path.Base(name))
+		if ok {
+			return
+		}
+		name = parent
+	}
+}
+
+func dirHeader(name string) *tar.Header {
+	return &tar.Header{ //nolint:exhaustruct
+		Typeflag: tar.TypeDir,
+		Name:     name + "/",
+		Mode:     0o755,
+		ModTime:  time.Time{},
+	}
+}
+
+// resolve finds the entry for name, following symlinks in every element but the last, and in the
+// last too if followLast is set.
+func (fsys *FS) resolve(op, name string, followLast bool) (*fsEntry, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	notExist := &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+	p := name
+	for links := 0; ; {
+		var elems []string
+		if p != "." {
+			elems = strings.Split(p, "/")
+		}
+		cur := "."
+		restarted := false
+		for i, elem := range elems {
+			next := path.Join(cur, elem)
+			e, ok := fsys.entries[next]
+			if !ok {
+				return nil, notExist
+			}
+			last := i == len(elems)-1
+			if e.header.Typeflag == tar.TypeSymlink && (!last || followLast) {
+				links++
+				if links > maxSymlinks || path.IsAbs(e.header.Linkname) {
+					return nil, notExist
+				}
+				target := path.Join(path.Dir(next), e.header.Linkname)
+				if isOutside(target) {
+					return nil, notExist
+				}
+				p = path.Join(append([]string{target}, elems[i+1:]...)...)
+				restarted = true
+				break
+			}
+			if !last && e.header.Typeflag != tar.TypeDir {
+				return nil, notExist
+			}
+			cur = next
+		}
+		if !restarted {
+			return fsys.entries[cur], nil
+		}
+	}
+}
+
+// Open opens the named file, following symlinks.
+func (fsys *FS) Open(name string) (fs.File, error) {
+	e, err := fsys.resolve("open", name, true)
+	if err != nil {
+		return nil, err
+	}
+	return &fsFile{fsys: fsys, e: e, name: path.Base(name), r: nil, dirPos: 0}, nil
+}
+
+// Stat returns information about the named file, following symlinks.
+func (fsys *FS) Stat(name string) (fs.FileInfo, error) {
+	e, err := fsys.resolve("stat", name, true)
+	if err != nil {
+		return nil, err
+	}
+	return fileInfo{e.header.FileInfo(), path.Base(name)}, nil
+}
+
+// Lstat returns information about the named file, without following a symlink at the end of it.
+func (fsys *FS) Lstat(name string) (fs.FileInfo, error) {
+	e, err := fsys.resolve("lstat", name, false)
+	if err != nil {
+		return nil, err
+	}
+	return fileInfo{e.header.FileInfo(), path.Base(name)}, nil
+}
+
+// ReadLink returns the target of the named symlink.
+func (fsys *FS) ReadLink(name string) (string, error) {
+	e, err := fsys.resolve("readlink", name, false)
+	if err != nil {
+		return "", err
+	}
+	if e.header.Typeflag != tar.TypeSymlink {
+		return "", &fs.PathError{Op: "readlink", Path: name, Err: fs.ErrInvalid}
+	}
+	return e.header.Linkname, nil
+}
+
+// ReadDir returns the entries of the named directory, sorted by name.
+func (fsys *FS) ReadDir(name string) ([]fs.DirEntry, error) {
+	e, err := fsys.resolve("readdir", name, true)
+	if err != nil {
+		return nil, err
+	}
+	if e.header.Typeflag != tar.TypeDir {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: errors.New("not a directory")}
+	}
+	return fsys.dirEntries(e), nil
+}
+
+func (fsys *FS) dirEntries(e *fsEntry) []fs.DirEntry {
+	dir := path.Clean(strings.TrimPrefix(e.header.Name, "/"))
+	des := make([]fs.DirEntry, 0, len(e.children))
+	for _, child := range e.children {
+		ce := fsys.entries[path.Join(dir, child)]
+		des = append(des, fs.FileInfoToDirEntry(fileInfo{ce.header.FileInfo(), child}))
+	}
+	return des
+}
+
+// ReadFile returns the contents of the named file.
+func (fsys *FS) ReadFile(name string) ([]byte, error) {
+	f, err := fsys.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return nil, &fs.PathError{Op: "read", Path: name, Err: err}
+	}
+	return data, nil
+}
+
+// contents returns a reader for a regular file's data.
+func (fsys *FS) contents(e *fsEntry) (io.Reader, error) {
+	if fsys.raw {
+		return io.NewSectionReader(fsys.k.file, e.offset, e.header.Size), nil
+	}
+	dr, _, err := fsys.k.decompressor()
+	if err != nil {
+		return nil, err
+	}
+	_, err = io.CopyN(io.Discard, dr, e.offset)
+	if err != nil {
+		return nil, errors.Wrapf(err, "seeking to %q", e.header.Name)
+	}
+	return io.LimitReader(dr, e.header.Size), nil
+}
+
+// fileInfo names an entry for the path it was looked up by, which may be a link to it.
+type fileInfo struct {
+	fs.FileInfo
+	name string
+}
+
+func (fi fileInfo) Name() string { return fi.name }
+
+type fsFile struct {
+	fsys   *FS
+	e      *fsEntry
+	name   string
+	r      io.Reader
+	dirPos int
+}
+
+func (f *fsFile) Stat() (fs.FileInfo, error) {
+	return fileInfo{f.e.header.FileInfo(), f.name}, nil
+}
+
+func (f *fsFile) Read(p []byte) (int, error) {
+	if f.e.header.Typeflag == tar.TypeDir {
+		return 0, &fs.PathError{Op: "read", Path: f.name, Err: errors.New("is a directory")}
+	}
+	if f.r == nil {
+		r, err := f.fsys.contents(f.e)
+		if err != nil {
+			return 0, &fs.PathError{Op: "read", Path: f.name, Err: err}
+		}
+		f.r = r
+	}
+	return f.r.Read(p) //nolint:wrapcheck
+}
+
+func (f *fsFile) Close() error { return nil }
+
+// ReadDir makes directories fs.ReadDirFile.
+func (f *fsFile) ReadDir(n int) ([]fs.DirEntry, error) {
+	if f.e.header.Typeflag != tar.TypeDir {
+		return nil, &fs.PathError{Op: "readdir", Path: f.name, Err: errors.New("not a directory")}
+	}
+	des := f.fsys.dirEntries(f.e)[f.dirPos:]
+	if n > 0 {
+		if len(des) == 0 {
+			return nil, io.EOF
+		}
+		des = des[:min(n, len(des))]
+	}
+	f.dirPos += len(des)
+	return des, nil
+}
@@ -0,0 +1,77 @@
+package kpkg_test
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+
+	"github.com/clintharrison/go-kindle-pkg/pkg/kpkg"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFS(t *testing.T) {
+	t.Parallel()
+	files := map[string]string{
+		"manifest.json":   testManifest,
+		"bin/tool":        "#!/bin/sh\necho tool\n",
+		"share/doc/a.txt": "a",
+		"share/doc/b.txt": "b",
+	}
+
+	for _, c := range kpkg.Compressions() {
+		t.Run(string(c), func(t *testing.T) {
+			t.Parallel()
+			ctx := t.Context()
+			dir := writePackageDir(t, files)
+			require.NoError(t, os.Symlink("doc/a.txt", filepath.Join(dir, "share/a-link")))
+			dest := filepath.Join(t.TempDir(), "test.kpkg")
+			require.NoError(t, kpkg.Build(ctx, dir, dest, kpkg.WithCompression(c)))
+
+			k, err := kpkg.Open(ctx, dest)
+			require.NoError(t, err)
+			defer k.Close()
+			fsys, err := k.FS(ctx)
+			require.NoError(t, err)
+
+			require.NoError(t, fstest.TestFS(fsys,
+				"manifest.json", "contents.json", "bin/tool", "share/doc/a.txt", "share/doc/b.txt", "share/a-link"))
+
+			data, err := fs.ReadFile(fsys, "bin/tool")
+			require.NoError(t, err)
+			require.Equal(t, files["bin/tool"], string(data))
+			data, err = fs.ReadFile(fsys, "share/a-link")
+			require.NoError(t, err)
+			require.Equal(t, "a", string(data))
+
+			var walked []string
+			require.NoError(t, fs.WalkDir(fsys, "share", func(p string, _ fs.DirEntry, err error) error {
+				walked = append(walked, p)
+				return err
+			}))
+			require.Equal(t, []string{"share", "share/a-link", "share/doc", "share/doc/a.txt", "share/doc/b.txt"}, walked)
+		})
+	}
+}
+
+func TestFS_LinkOutside(t *testing.T) {
+	t.Parallel()
+	ctx := t.Context()
+	dir := writePackageDir(t, map[string]string{"manifest.json": testManifest})
+	require.NoError(t, os.Symlink("../../../etc/passwd", filepath.Join(dir, "escape")))
+	dest := filepath.Join(t.TempDir(), "test.kpkg")
+	require.NoError(t, kpkg.Build(ctx, dir, dest))
+	k, err := kpkg.Open(ctx, dest)
+	require.NoError(t, err)
+	defer k.Close()
+	fsys, err := k.FS(ctx)
+	require.NoError(t, err)
+
+	// links can't reach outside the package, but are still there to be read
+	_, err = fsys.Open("escape")
+	require.ErrorIs(t, err, fs.ErrNotExist)
+	target, err := fsys.ReadLink("escape")
+	require.NoError(t, err)
+	require.Equal(t, "../../../etc/passwd", target)
+}
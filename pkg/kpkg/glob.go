@@ -0,0 +1,77 @@
+package kpkg
+
+import (
+	"path"
+	"strings"
+)
+
+// matchGlob matches a slash-separated package path against a pattern, like a .gitignore line:
+//   - a pattern without a slash matches the last element of the path, at any depth ("*.swp")
+//   - otherwise it matches the whole path, element by element ("bin/*"), where "**" matches any
+//     number of elements, including none ("docs/**/*.md")
+//
+// Elements are matched with path.Match. A leading "./" or "/" is ignored.
+func matchGlob(pattern, name string) bool {
+	pattern = strings.TrimPrefix(strings.TrimPrefix(pattern, "./"), "/")
+	name = strings.TrimPrefix(name, "./")
+	if !strings.Contains(pattern, "/") {
+		ok, _ := path.Match(pattern, path.Base(name))
+		return ok
+	}
+	return matchElements(strings.Split(pattern, "/"), strings.Split(name, "/"))
+}
+
+// matchAnyGlob reports whether name matches any of the patterns.
+func matchAnyGlob(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if matchGlob(pattern, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchAnyGlobOrParent reports whether name, or a directory it's in, matches any of the patterns.
+func matchAnyGlobOrParent(patterns []string, name string) bool {
+	for p := path.Clean(strings.TrimPrefix(name, "./")); p != "." && p != "/"; p = path.Dir(p) {
+		if matchAnyGlob(patterns, p) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchElements(pattern, name []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := 0; i <= len(name); i++ {
+				if matchElements(pattern[1:], name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(name) == 0 {
+			return false
+		}
+		ok, _ := path.Match(pattern[0], name[0])
+		if !ok {
+			return false
+		}
+		pattern, name = pattern[1:], name[1:]
+	}
+	return len(name) == 0
+}
+
+func validGlob(pattern string) bool {
+	if pattern == "" {
+		return false
+	}
+	for _, elem := range strings.Split(pattern, "/") {
+		_, err := path.Match(elem, "")
+		if err != nil {
+			return false
+		}
+	}
+	return true
+}
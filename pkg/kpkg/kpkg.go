@@ -2,34 +2,93 @@ package kpkg
 
 import (
 	"archive/tar"
-	"compress/gzip"
+	"bufio"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"hash"
 	"io"
 	"log/slog"
 	"os"
+	"slices"
 	"strings"
 	"sync"
 
 	"github.com/clintharrison/go-kindle-pkg/pkg/repository/manifest"
 	"github.com/pingcap/errors"
-	"github.com/ulikunitz/xz"
 )
 
 type KPKG struct {
 	mu sync.Mutex
 
 	Manifest *manifest.Manifest
+	// Contents is the package's contents.json, if it has one with the rest of the metadata.
+	Contents *Contents
+	// Verification is the result of checking the detached signature, if Open was asked to. The
+	// payload is verified as ExtractAll reads it, so it's only set once ExtractAll succeeds.
+	Verification *Verification
 
 	path      string
 	file      *os.File
 	tarReader *tar.Reader
+	// stream is only set for packages opened with OpenStream, which can be read just once.
+	stream *streamState
+	limits Limits
+
+	// keyring and signature are set when the package must be verified as it is read
+	keyring     *Keyring
+	signature   *Signature
+	manifestSum string
+	// payload is the decompressed payload ExtractAll is reading from a file, which is also fed into
+	// payloadHash when the package must be verified
+	payload     io.Reader
+	payloadHash hash.Hash
 
 	closerFuncs []func() error
 }
 
-func Open(ctx context.Context, path string) (*KPKG, error) {
+type OpenOption func(*openOptions)
+
+type openOptions struct {
+	keyring       *Keyring
+	allowUnsigned bool
+	signaturePath string
+	signature     *Signature
+	limits        *Limits
+}
+
+func (o *openOptions) packageLimits() Limits {
+	if o.limits == nil {
+		return DefaultLimits()
+	}
+	return *o.limits
+}
+
+// WithKeyring makes Open check that the package's detached signature was made by one of the given
+// trusted keys, and ExtractAll verify the package against it as it reads it, rather than reading
+// the package an extra time. Callers must extract to a staging directory and discard it if
+// ExtractAll fails.
+func WithKeyring(kr *Keyring) OpenOption {
+	return func(o *openOptions) {
+		o.keyring = kr
+	}
+}
+
+// WithAllowUnsigned lets a package without a detached signature be opened even when a keyring is given.
+// Packages that are signed are still verified, and a bad signature is always an error.
+func WithAllowUnsigned(allow bool) OpenOption {
+	return func(o *openOptions) {
+		o.allowUnsigned = allow
+	}
+}
+
+func Open(ctx context.Context, path string, optFuncs ...OpenOption) (*KPKG, error) {
+	opts := &openOptions{signaturePath: path + SignatureSuffix} //nolint:exhaustruct
+	for _, o := range optFuncs {
+		o(opts)
+	}
 	kpkg := &KPKG{} //nolint:exhaustruct // this is initialized as we go, to register closers
 
 	f, err := os.Open(path)
@@ -39,6 +98,7 @@ func Open(ctx context.Context, path string) (*KPKG, error) {
 	kpkg.RegisterCloser(f.Close)
 	kpkg.file = f
 	kpkg.path = path
+	kpkg.limits = opts.packageLimits()
 	err = kpkg.resetReader()
 	if err != nil {
 		cerr := kpkg.Close()
@@ -57,10 +117,66 @@ func Open(ctx context.Context, path string) (*KPKG, error) {
 		return nil, errors.Wrapf(err, "kpkg.ReadMetadata() for %q", path)
 	}
 
+	if opts.keyring != nil {
+		err = kpkg.checkTrustOnOpen(opts)
+		if err != nil {
+			cerr := kpkg.Close()
+			if cerr != nil {
+				slog.Error("checkTrustOnOpen()", "close_error", cerr, "verify_error", err)
+			}
+			return nil, errors.Wrapf(err, "verifying signature for %q", path)
+		}
+	}
+
 	return kpkg, nil
 }
 
+// checkTrustOnOpen finds the package's signature and checks that a trusted key made it. The
+// package itself is checked against it by ExtractAll.
+func (k *KPKG) checkTrustOnOpen(opts *openOptions) error {
+	sig := opts.signature
+	if sig == nil {
+		var err error
+		sig, err = ReadSignatureFile(opts.signaturePath)
+		if err != nil {
+			if os.IsNotExist(errors.Cause(err)) {
+				if opts.allowUnsigned {
+					slog.Warn("package is not signed, continuing anyway", "path", k.path)
+					return nil
+				}
+				return errors.Annotatef(ErrUnsigned, "no signature at %q", opts.signaturePath)
+			}
+			return err
+		}
+	}
+	return k.checkTrust(sig, opts)
+}
+
+// checkTrust checks what can be checked before reading the payload: that sig was made by a
+// trusted key. If it was, the package must match it when it's read.
+func (k *KPKG) checkTrust(sig *Signature, opts *openOptions) error {
+	_, err := checkSignature(sig, opts.keyring)
+	if err != nil {
+		// a key we don't know can't vouch for anything, so it's no better (or worse) than no signature
+		if errors.Cause(err) == ErrUntrustedKey && opts.allowUnsigned { //nolint:errorlint // pingcap/errors has no Is()
+			slog.Warn("package is signed by an untrusted key, continuing anyway", "path", k.path, "key_id", sig.KeyID)
+			return nil
+		}
+		return err
+	}
+	k.keyring = opts.keyring
+	k.signature = sig
+	return nil
+}
+
 func (k *KPKG) ReadMetadata(ctx context.Context) error {
+	if k.stream != nil {
+		if k.Manifest != nil {
+			return nil
+		}
+		return k.readStreamMetadata(ctx)
+	}
+
 	err := k.resetReader()
 	if err != nil {
 		return errors.Wrap(err, "kpkg.resetReader()")
@@ -73,35 +189,78 @@ func (k *KPKG) ReadMetadata(ctx context.Context) error {
 		return nil
 	}
 
+	return k.readMetadataPrefix(ctx, func() (*tar.Header, io.Reader, error) {
+		entry, err := k.tarReader.Next()
+		return entry, k.tarReader, err //nolint:wrapcheck
+	})
+}
+
+// metadataFiles are written by Build straight after the root directory entry, in this order,
+// so that reading them never means decompressing the rest of the package.
+var metadataFiles = []string{"manifest.json", ContentsFileName} //nolint:gochecknoglobals
+
+// readMetadataPrefix reads the metadata files at the start of the archive, stopping at the first
+// entry after them. Legacy archives with manifest.json further in are scanned until it turns up.
+func (k *KPKG) readMetadataPrefix(ctx context.Context, next func() (*tar.Header, io.Reader, error)) error {
+	firstOther := ""
+	lc := &limitChecker{limits: k.limits, entries: 0, total: 0}
 	for {
 		if ctx.Err() != nil {
 			return errors.AddStack(ctx.Err())
 		}
-		entry, err := k.tarReader.Next()
+		entry, r, err := next()
+		if err == io.EOF && k.Manifest != nil {
+			return nil
+		}
 		if err != nil {
 			return errors.Wrapf(err, "tarReader.Next()")
 		}
-		path := entry.Name
-		if path == "./" || path == "." {
+		err = lc.check(entry)
+		if err != nil {
+			return err
+		}
+		path := strings.TrimPrefix(entry.Name, "./")
+		if path == "" || path == "." {
 			continue
 		}
-		path = strings.TrimPrefix(path, "./")
-		if path == "manifest.json" {
-			if entry.Typeflag != tar.TypeReg {
-				return fmt.Errorf("manifest.json is not a regular file: %v", entry.Typeflag)
+		if !slices.Contains(metadataFiles, path) {
+			if k.Manifest != nil {
+				return nil
 			}
-			data := make([]byte, entry.Size)
-			_, err := io.ReadFull(k.tarReader, data)
-			if err != nil {
-				return errors.Wrapf(err, "io.ReadFull() for manifest.json")
+			if firstOther == "" {
+				firstOther = path
 			}
+			continue
+		}
+
+		if entry.Typeflag != tar.TypeReg {
+			return fmt.Errorf("%s is not a regular file: %v", path, entry.Typeflag)
+		}
+		data, err := io.ReadAll(r)
+		if err != nil {
+			return errors.Wrapf(err, "reading %s", path)
+		}
+		switch path {
+		case "manifest.json":
+			sum := sha256.Sum256(data)
+			k.manifestSum = hex.EncodeToString(sum[:])
 			var m manifest.Manifest
 			err = json.Unmarshal(data, &m)
 			if err != nil {
 				return errors.Wrapf(err, "json.Unmarshal() to manifest.Manifest")
 			}
 			k.Manifest = &m
-			return nil
+			if firstOther != "" {
+				slog.Warn("legacy package: manifest.json is not at the start of the archive, "+
+					"so everything before it had to be decompressed; rebuild it with create-kpkg",
+					"path", k.path, "first_entry", firstOther)
+			}
+		case ContentsFileName:
+			c, err := parseContents(data)
+			if err != nil {
+				return errors.Wrapf(err, "parsing %s", path)
+			}
+			k.Contents = c
 		}
 	}
 }
@@ -129,30 +288,28 @@ func (k *KPKG) resetReader() error {
 	k.mu.Lock()
 	defer k.mu.Unlock()
 
+	r, err := k.payloadReader()
+	if err != nil {
+		return err
+	}
+	k.tarReader = tar.NewReader(r)
+	slog.Debug("resetReader completed successfully")
+	return nil
+}
+
+// payloadReader rewinds the underlying file and returns a reader for the decompressed tar stream.
+func (k *KPKG) payloadReader() (io.Reader, error) {
+	if k.file == nil {
+		return nil, errors.New("package was opened as a stream and can't be read again")
+	}
 	_, err := k.file.Seek(0, 0)
 	if err != nil {
-		return errors.AddStack(err)
+		return nil, errors.AddStack(err)
 	}
 
-	var r io.Reader
-	r, err = xz.NewReader(k.file)
+	r, err := sniffDecompressor(bufio.NewReader(k.file), k.limits)
 	if err != nil {
-		slog.Debug("not xz compressed, trying gzip", "error", err)
-		_, err = k.file.Seek(0, 0)
-		if err != nil {
-			return errors.Wrapf(err, "k.file.Seek(0,0) for %q", k.path)
-		}
-		r, err = gzip.NewReader(k.file)
-		if err != nil {
-			slog.Debug("not gzip compressed, using raw file", "error", err)
-			_, err = k.file.Seek(0, 0)
-			if err != nil {
-				return errors.Wrapf(err, "k.file.Seek(0,0) for %q", k.path)
-			}
-			r = k.file
-		}
+		return nil, errors.Wrapf(err, "opening payload of %q", k.path)
 	}
-	k.tarReader = tar.NewReader(r)
-	slog.Debug("resetReader completed successfully")
-	return nil
+	return r, nil
 }
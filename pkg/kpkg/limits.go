@@ -0,0 +1,161 @@
+package kpkg
+
+import (
+	"archive/tar"
+	"io"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pingcap/errors"
+)
+
+// ErrLimitExceeded is returned when a package is bigger than the Limits it is read with allow.
+var ErrLimitExceeded = errors.New("package exceeds limits") //nolint:gochecknoglobals
+
+// Limits bound how much a package can make its reader decompress, hold in memory and write out,
+// so that a hostile or broken package fails cleanly instead of filling a Kindle's RAM or storage.
+// They are checked against each tar header as it is read, before the entry's data.
+// A zero field means no limit.
+type Limits struct {
+	// MaxTotalSize bounds the sum of all entries' sizes.
+	MaxTotalSize int64
+	// MaxEntrySize bounds the size of any one entry.
+	MaxEntrySize int64
+	// MaxEntries bounds the number of entries, including directories and links.
+	MaxEntries int
+	// MaxManifestSize bounds manifest.json, which is read into memory.
+	MaxManifestSize int64
+	// MaxContentsSize bounds contents.json, which is read into memory and grows with the entry count.
+	MaxContentsSize int64
+	// MaxPathLength bounds the length in bytes of entry names and link targets.
+	MaxPathLength int
+	// MaxWindowSize bounds the window a zstd-compressed package, or the dictionary an
+	// xz-compressed one, can make its decompressor allocate, which happens up front, before
+	// any entry can be checked.
+	MaxWindowSize int64
+}
+
+// DefaultLimits are sized for a Kindle: a few hundred MB of RAM, and a few GB of user storage.
+// The largest packages, like KOReader, are around a tenth of these.
+func DefaultLimits() Limits {
+	return Limits{
+		MaxTotalSize:    1 << 30,
+		MaxEntrySize:    512 << 20,
+		MaxEntries:      100_000,
+		MaxManifestSize: 256 << 10,
+		MaxContentsSize: 16 << 20,
+		MaxPathLength:   1024,
+		// zstd -19 uses 8MB and --ultra -22 128MB, xz -9 64MB; anything past this is for a bigger machine
+		MaxWindowSize: 64 << 20,
+	}
+}
+
+// WithLimits replaces DefaultLimits for reading the package.
+func WithLimits(l Limits) OpenOption {
+	return func(o *openOptions) {
+		o.limits = &l
+	}
+}
+
+// zstdOptions are the decoder options for reading a zstd stream within the limits. The decoded
+// size can't usefully be bounded below MaxTotalSize, but it also caps the window when streaming.
+func (l Limits) zstdOptions() []zstd.DOption {
+	// a single synchronous decoder starts no goroutines, so it doesn't need closing,
+	// and the Kindle only has one core to give it anyway
+	opts := []zstd.DOption{zstd.WithDecoderConcurrency(1), zstd.WithDecoderLowmem(true)}
+	if l.MaxWindowSize > 0 {
+		opts = append(opts, zstd.WithDecoderMaxWindow(uint64(l.MaxWindowSize)))
+	}
+	if l.MaxTotalSize > 0 {
+		opts = append(opts, zstd.WithDecoderMaxMemory(uint64(l.MaxTotalSize)))
+	}
+	return opts
+}
+
+// zstdReader is a zstd decoder that reports going over its limits as ErrLimitExceeded.
+type zstdReader struct {
+	*zstd.Decoder
+}
+
+func newZstdReader(r io.Reader, l Limits) (zstdReader, error) {
+	zr, err := zstd.NewReader(r, l.zstdOptions()...)
+	if err != nil {
+		return zstdReader{nil}, errors.AddStack(zstdLimitError(err))
+	}
+	return zstdReader{zr}, nil
+}
+
+func (z zstdReader) Read(p []byte) (int, error) {
+	n, err := z.Decoder.Read(p)
+	return n, zstdLimitError(err)
+}
+
+func zstdLimitError(err error) error {
+	//nolint:errorlint // the decoder returns these unwrapped
+	if err == zstd.ErrWindowSizeExceeded || err == zstd.ErrDecoderSizeExceeded {
+		return errors.Annotate(ErrLimitExceeded, err.Error())
+	}
+	// others, io.EOF included, are passed through as they are
+	return err
+}
+
+// limitChecker tracks an archive's running totals as its entries are read.
+type limitChecker struct {
+	limits  Limits
+	entries int
+	total   int64
+}
+
+func (lc *limitChecker) check(h *tar.Header) error {
+	exceeded := func(format string, args ...any) error {
+		return errors.Annotatef(ErrLimitExceeded, format, args...)
+	}
+	l := lc.limits
+	lc.entries++
+	if l.MaxEntries > 0 && lc.entries > l.MaxEntries {
+		return exceeded("more than %d entries", l.MaxEntries)
+	}
+	if l.MaxPathLength > 0 && (len(h.Name) > l.MaxPathLength || len(h.Linkname) > l.MaxPathLength) {
+		return exceeded("%.64q... is longer than %d bytes", h.Name, l.MaxPathLength)
+	}
+	if h.Size < 0 {
+		return errors.Errorf("%q has a negative size", h.Name)
+	}
+	if l.MaxEntrySize > 0 && h.Size > l.MaxEntrySize {
+		return exceeded("%q is %d bytes, more than the %d allowed for one entry", h.Name, h.Size, l.MaxEntrySize)
+	}
+	lc.total += h.Size
+	if l.MaxTotalSize > 0 && lc.total > l.MaxTotalSize {
+		return exceeded("more than %d bytes uncompressed, as of %q", l.MaxTotalSize, h.Name)
+	}
+
+	switch strings.TrimPrefix(h.Name, "./") {
+	case "manifest.json":
+		if l.MaxManifestSize > 0 && h.Size > l.MaxManifestSize {
+			return exceeded("manifest.json is %d bytes, more than the %d allowed", h.Size, l.MaxManifestSize)
+		}
+	case ContentsFileName:
+		if l.MaxContentsSize > 0 && h.Size > l.MaxContentsSize {
+			return exceeded("%s is %d bytes, more than the %d allowed", ContentsFileName, h.Size, l.MaxContentsSize)
+		}
+	}
+	return nil
+}
+
+// CheckLimits checks the package's contents.json against its limits, so that a package that
+// declares itself too big can be refused before anything is extracted. ExtractAll still checks
+// every entry as it goes, since contents.json could be lying.
+func (k *KPKG) CheckLimits() error {
+	if k.Contents == nil {
+		return nil
+	}
+	lc := &limitChecker{limits: k.limits, entries: 0, total: 0}
+	for _, ce := range k.Contents.Files {
+		h := &tar.Header{Name: ce.Path, Linkname: ce.Link, Size: ce.Size} //nolint:exhaustruct
+		err := lc.check(h)
+		if err != nil {
+			return errors.Annotatef(err, "according to %s", ContentsFileName)
+		}
+	}
+	return nil
+}
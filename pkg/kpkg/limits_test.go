@@ -0,0 +1,160 @@
+package kpkg_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/clintharrison/go-kindle-pkg/pkg/kpkg"
+	"github.com/pingcap/errors"
+	"github.com/stretchr/testify/require"
+	"github.com/ulikunitz/xz"
+	"github.com/ulikunitz/xz/lzma"
+)
+
+//nolint:exhaustruct
+func TestLimits(t *testing.T) {
+	t.Parallel()
+
+	built := buildPackage(t, map[string]string{
+		"manifest.json": testManifest,
+		"a.txt":         "a",
+		"b/c.txt":       strings.Repeat("c", 1000),
+		"b/d.txt":       strings.Repeat("d", 1000),
+	}, kpkg.WithGzipCompression)
+	zstdBuilt := buildPackage(t, map[string]string{
+		"manifest.json": testManifest,
+		"b/c.txt":       strings.Repeat("c", 4000),
+	}, kpkg.WithZstdCompression)
+	xzBuilt := buildPackage(t, map[string]string{
+		"manifest.json": testManifest,
+		"b/c.txt":       strings.Repeat("c", 4000),
+	}, kpkg.WithXZCompression)
+	// no contents.json to give it away, and the big entry is past the metadata
+	bomb := writeRawTar(t,
+		&tar.Header{Typeflag: tar.TypeDir, Name: "./a/", Mode: 0o755},
+		&tar.Header{Typeflag: tar.TypeReg, Name: "./a/bomb", Mode: 0o644, Size: 2 << 20},
+	)
+
+	for _, tc := range []struct {
+		name   string
+		path   string
+		limits kpkg.Limits
+	}{
+		{"entries", built, kpkg.Limits{MaxEntries: 5}},
+		{"entry size", built, kpkg.Limits{MaxEntrySize: 999}},
+		{"total size", built, kpkg.Limits{MaxTotalSize: 1500}},
+		{"manifest size", built, kpkg.Limits{MaxManifestSize: 10}},
+		{"contents size", built, kpkg.Limits{MaxContentsSize: 100}},
+		{"path length", built, kpkg.Limits{MaxPathLength: 8}},
+		{"zstd window", zstdBuilt, kpkg.Limits{MaxWindowSize: 1 << 10}},
+		{"xz dictionary", xzBuilt, kpkg.Limits{MaxWindowSize: 1 << 20}},
+		{"bomb", bomb, kpkg.Limits{MaxEntrySize: 1 << 20}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			ctx := t.Context()
+
+			// whichever of reading the metadata, checking contents.json or extracting notices first
+			err := func() error {
+				k, err := kpkg.Open(ctx, tc.path, kpkg.WithLimits(tc.limits))
+				if err != nil {
+					return err
+				}
+				defer k.Close()
+				err = k.CheckLimits()
+				if err != nil {
+					return err
+				}
+				return k.ExtractAll(ctx, t.TempDir(), false, &bytes.Buffer{})
+			}()
+			require.Equal(t, kpkg.ErrLimitExceeded, errors.Cause(err), "got %v", err)
+
+			// streams are held to the same limits
+			f, err := os.Open(tc.path)
+			require.NoError(t, err)
+			defer f.Close()
+			err = func() error {
+				k, err := kpkg.OpenStream(ctx, f, kpkg.WithLimits(tc.limits))
+				if err != nil {
+					return err
+				}
+				return k.ExtractAll(ctx, t.TempDir(), false, &bytes.Buffer{})
+			}()
+			require.Equal(t, kpkg.ErrLimitExceeded, errors.Cause(err), "got %v", err)
+		})
+	}
+
+	// and nothing here is anywhere near the defaults
+	for _, p := range []string{built, xzBuilt, bomb} {
+		k, err := kpkg.Open(t.Context(), p)
+		require.NoError(t, err)
+		require.NoError(t, k.CheckLimits())
+		require.NoError(t, k.ExtractAll(t.Context(), t.TempDir(), false, &bytes.Buffer{}))
+		require.NoError(t, k.Close())
+	}
+}
+
+func TestLimits_ExtractChecksContentsClaims(t *testing.T) {
+	t.Parallel()
+	ctx := t.Context()
+
+	// contents.json is only a claim: a package that lies in it is still stopped while extracting
+	p := buildPackage(t, map[string]string{
+		"manifest.json": testManifest, "a.txt": "a", "big.txt": strings.Repeat("x", 4096),
+	})
+	k, err := kpkg.Open(ctx, p, kpkg.WithLimits(kpkg.Limits{MaxEntrySize: 1024})) //nolint:exhaustruct
+	require.NoError(t, err)
+	defer k.Close()
+	for i := range k.Contents.Files {
+		k.Contents.Files[i].Size = 1
+	}
+	require.NoError(t, k.CheckLimits())
+	err = k.ExtractAll(ctx, t.TempDir(), false, &bytes.Buffer{})
+	require.Equal(t, kpkg.ErrLimitExceeded, errors.Cause(err), "got %v", err)
+}
+
+func TestLimits_XZDictionaryHeader(t *testing.T) {
+	t.Parallel()
+	ctx := t.Context()
+
+	// an xz package whose block header asks for a 1.5GB dictionary, which the decoder would
+	// allocate before reading anything else
+	data, err := os.ReadFile(buildPackage(t, map[string]string{
+		"manifest.json": testManifest,
+	}, kpkg.WithXZCompression))
+	require.NoError(t, err)
+	block := data[12:]
+	header := block[:(int(block[0])+1)*4]
+	i := bytes.Index(header, []byte{0x21, 0x01})
+	require.Positive(t, i, "no LZMA2 filter in %x", header)
+	header[i+2] = lzma.EncodeDictCap(3 << 29)
+	binary.LittleEndian.PutUint32(header[len(header)-4:], crc32.ChecksumIEEE(header[:len(header)-4]))
+
+	// and the same again behind an empty stream, so it's past the first stream's index
+	empty := &bytes.Buffer{}
+	zw, err := xz.NewWriter(empty)
+	require.NoError(t, err)
+	require.NoError(t, zw.Close())
+
+	for name, pkg := range map[string][]byte{
+		"first block":   data,
+		"second stream": append(empty.Bytes(), data...),
+	} {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			p := filepath.Join(t.TempDir(), "dict.kpkg")
+			require.NoError(t, os.WriteFile(p, pkg, 0o644)) //nolint:gosec
+
+			_, err := kpkg.Open(ctx, p)
+			require.Equal(t, kpkg.ErrLimitExceeded, errors.Cause(err), "got %v", err)
+			_, err = kpkg.OpenStream(ctx, bytes.NewReader(pkg))
+			require.Equal(t, kpkg.ErrLimitExceeded, errors.Cause(err), "got %v", err)
+		})
+	}
+}
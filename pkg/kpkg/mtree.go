@@ -0,0 +1,112 @@
+package kpkg
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/clintharrison/go-kindle-pkg/pkg/mtree"
+	"github.com/pingcap/errors"
+)
+
+// ListFormat is how ExtractAll lists entries in test mode.
+type ListFormat string
+
+const (
+	// ListAttrs lists each entry on one line with its mtree-like attributes. It is the default.
+	ListAttrs ListFormat = "attrs"
+	// ListMtree writes an mtree(5) specification, with the sha256 digest of every file.
+	ListMtree ListFormat = "mtree"
+)
+
+// WithListFormat sets how ExtractAll lists entries in test mode.
+func WithListFormat(f ListFormat) ExtractOption {
+	return func(o *extractOptions) {
+		o.listFormat = f
+	}
+}
+
+// entryLister lists entries for ExtractAll's test mode.
+type entryLister struct {
+	w  io.Writer
+	mw *mtree.Writer
+	// files has the keywords of each regular file listed as mtree, for hard links to them
+	files map[string]map[string]string
+}
+
+func newEntryLister(w io.Writer, format ListFormat) *entryLister {
+	l := &entryLister{w: w, mw: nil, files: nil}
+	if format == ListMtree {
+		l.mw = mtree.NewWriter(w)
+		l.files = map[string]map[string]string{}
+	}
+	return l
+}
+
+func (l *entryLister) list(entry *tar.Header, r io.Reader) error {
+	if l.mw == nil {
+		return logEntry(l.w, entry)
+	}
+	e, err := l.mtreeEntry(entry, r)
+	if err != nil {
+		return err
+	}
+	return l.mw.WriteEntry(e)
+}
+
+func (l *entryLister) refused(err error) {
+	if l.mw == nil {
+		fmt.Fprintf(l.w, "# refused: %v\n", err) //nolint:errcheck
+		return
+	}
+	_ = l.mw.WriteComment(fmt.Sprintf("refused: %v", err))
+}
+
+func (l *entryLister) finish() error {
+	if l.mw == nil {
+		return nil
+	}
+	return l.mw.Flush()
+}
+
+// mtreeEntry describes an entry as it will be extracted. A hard link is extracted as another name
+// for the file it links to, so it is listed as that file.
+func (l *entryLister) mtreeEntry(entry *tar.Header, r io.Reader) (mtree.Entry, error) {
+	p := path.Clean(strings.TrimPrefix(entry.Name, "/"))
+	kws := map[string]string{
+		"mode": fmt.Sprintf("%04o", entry.Mode&0o7777),
+		"uid":  strconv.Itoa(entry.Uid),
+		"gid":  strconv.Itoa(entry.Gid),
+	}
+	switch entry.Typeflag {
+	case tar.TypeReg:
+		sum, err := readerSHA256(r)
+		if err != nil {
+			return mtree.Entry{}, errors.Wrapf(err, "reading %q", entry.Name) //nolint:exhaustruct
+		}
+		kws["type"] = "file"
+		kws["size"] = strconv.FormatInt(entry.Size, 10)
+		kws["sha256digest"] = sum
+		l.files[p] = kws
+	case tar.TypeLink:
+		target, ok := l.files[path.Clean(entry.Linkname)]
+		if !ok {
+			return mtree.Entry{}, errors.Errorf("hard link %q to %q, which isn't a file before it", //nolint:exhaustruct
+				entry.Name, entry.Linkname)
+		}
+		kws = target
+	case tar.TypeSymlink:
+		kws["type"] = "link"
+		kws["link"] = entry.Linkname
+	default:
+		attrs, err := entryAttrs(entry)
+		if err != nil {
+			return mtree.Entry{}, err //nolint:exhaustruct
+		}
+		kws["type"] = attrs["type"]
+	}
+	return mtree.Entry{Path: p, Keywords: kws}, nil
+}
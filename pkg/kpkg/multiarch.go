@@ -0,0 +1,274 @@
+package kpkg
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/clintharrison/go-kindle-pkg/pkg/repository/manifest"
+	"github.com/pingcap/errors"
+)
+
+// A multi-architecture package keeps files that every device gets under CommonDir, and files for
+// just one architecture under ArchDir/<arch>, e.g. arch/armhf/bin/tool. When it is extracted for
+// a device, both trees are merged into the package directory, so that's where bin/tool ends up.
+// Relative symlinks are resolved against where files are installed, not where they're packed.
+const (
+	CommonDir = "common"
+	ArchDir   = "arch"
+)
+
+// ErrUnsupportedArch is returned when extracting a package for an architecture it doesn't support.
+var ErrUnsupportedArch = errors.New("package does not support this architecture") //nolint:gochecknoglobals
+
+// Archs returns the architectures a multi-architecture package has payload trees for, or nil
+// for an ordinary package. A package without a contents.json, because it predates them or was
+// put together by hand, is scanned for its trees instead; a streamed one can't be until it's
+// extracted, so ExtractAll refuses it then.
+func (k *KPKG) Archs() ([]string, error) {
+	var paths []string
+	if k.Contents != nil {
+		for _, ce := range k.Contents.Files {
+			paths = append(paths, ce.Path)
+		}
+	} else if k.stream == nil {
+		var err error
+		paths, err = k.entryPaths()
+		if err != nil {
+			return nil, err
+		}
+	}
+	var archs []string
+	for _, p := range paths {
+		arch, ok := archTree(p)
+		if ok && !slices.Contains(archs, arch) {
+			archs = append(archs, arch)
+		}
+	}
+	slices.Sort(archs)
+	return archs, nil
+}
+
+// archTree returns the architecture whose payload tree p is in, if it's in one.
+func archTree(p string) (string, bool) {
+	rest, ok := strings.CutPrefix(p, ArchDir+"/")
+	if !ok || rest == "" {
+		return "", false
+	}
+	arch, _, _ := strings.Cut(rest, "/")
+	return arch, true
+}
+
+// entryPaths lists the cleaned paths of every entry in the archive.
+func (k *KPKG) entryPaths() ([]string, error) {
+	err := k.resetReader()
+	if err != nil {
+		return nil, errors.Wrap(err, "kpkg.resetReader()")
+	}
+	var paths []string
+	lc := &limitChecker{limits: k.limits, entries: 0, total: 0}
+	for {
+		entry, err := k.tarReader.Next()
+		if err == io.EOF { //nolint:errorlint // io.EOF is never wrapped
+			return paths, nil
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "tarReader.Next()")
+		}
+		err = lc.check(entry)
+		if err != nil {
+			return nil, err
+		}
+		paths = append(paths, path.Clean(entry.Name))
+	}
+}
+
+// InstalledPath maps p, a path in a multi-architecture package, to where it is installed on an
+// arch device. It returns false for paths that aren't installed there.
+func InstalledPath(p, arch string) (string, bool) {
+	return archPath(p, arch)
+}
+
+func archPath(p, arch string) (string, bool) {
+	switch {
+	case p == "." || p == "manifest.json" || p == ContentsFileName:
+		return p, true
+	case p == CommonDir:
+		return ".", true
+	case strings.HasPrefix(p, CommonDir+"/"):
+		return strings.TrimPrefix(p, CommonDir+"/"), true
+	case p == ArchDir+"/"+arch:
+		return ".", true
+	case strings.HasPrefix(p, ArchDir+"/"+arch+"/"):
+		return strings.TrimPrefix(p, ArchDir+"/"+arch+"/"), true
+	default:
+		return "", false
+	}
+}
+
+// ForArch returns the contents list of a multi-architecture package as installed on an arch device.
+func (c *Contents) ForArch(arch string) *Contents {
+	mapped := &Contents{Version: c.Version, Files: make([]ContentsEntry, 0, len(c.Files))}
+	seen := map[string]bool{}
+	for _, ce := range c.Files {
+		p, ok := archPath(ce.Path, arch)
+		// common/ and arch/<arch>/ can both have a bin/, but it is only installed once
+		if !ok || seen[p] {
+			continue
+		}
+		seen[p] = true
+		ce.Path = p
+		mapped.Files = append(mapped.Files, ce)
+	}
+	return mapped
+}
+
+// archExtractor maps the entries of a multi-architecture package as ExtractAll reads them.
+type archExtractor struct {
+	arch string
+	// contents is the installed contents.json, if the package has one
+	contents []byte
+	seen     map[string]bool
+}
+
+// archExtractor checks that the package supports arch, and returns an extractor for its payload
+// trees, or nil if it is an ordinary package that is extracted as it is.
+func (k *KPKG) archExtractor(arch string) (*archExtractor, error) {
+	archs, err := k.Archs()
+	if err != nil {
+		return nil, err
+	}
+	if len(k.Manifest.SupportedArch) > 0 && !slices.Contains(k.Manifest.SupportedArch, arch) ||
+		len(archs) > 0 && !slices.Contains(archs, arch) {
+		return nil, errors.Annotatef(ErrUnsupportedArch, "%s supports %v, not %s",
+			k.Manifest.ID, k.Manifest.SupportedArch, arch)
+	}
+	if len(archs) == 0 {
+		return nil, nil //nolint:nilnil
+	}
+	var contents []byte
+	if k.Contents != nil {
+		contents, err = marshalContents(k.Contents.ForArch(arch))
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &archExtractor{arch: arch, contents: contents, seen: map[string]bool{}}, nil
+}
+
+// mapEntry returns entry as it's installed, or false if it isn't.
+func (ae *archExtractor) mapEntry(entry *tar.Header, r io.Reader) (*tar.Header, io.Reader, bool, error) {
+	p, ok := archPath(path.Clean(entry.Name), ae.arch)
+	if !ok || ae.seen[p] {
+		return nil, nil, false, nil
+	}
+	ae.seen[p] = true
+
+	h := *entry
+	switch {
+	case p == ".":
+		h.Name = "./"
+	case entry.Typeflag == tar.TypeDir:
+		h.Name = "./" + p + "/"
+	default:
+		h.Name = "./" + p
+	}
+	if entry.Typeflag == tar.TypeLink {
+		h.Linkname, ok = archPath(path.Clean(entry.Linkname), ae.arch)
+		if !ok {
+			return nil, nil, false, errors.Errorf("%q is a hard link to %q, which isn't installed for %s",
+				entry.Name, entry.Linkname, ae.arch)
+		}
+	}
+	if p == ContentsFileName && ae.contents != nil {
+		// the installed copy describes the installed files
+		h.Size = int64(len(ae.contents))
+		r = bytes.NewReader(ae.contents)
+	}
+	return &h, r, true, nil
+}
+
+// archDirs returns the architectures the package being built has payload trees for, or nil if it
+// doesn't use the multi-architecture layout, after checking that it uses it properly.
+func (c *entryCollector) archDirs() ([]string, error) {
+	if _, ok := c.entries[ArchDir]; !ok {
+		return nil, nil
+	}
+	var archs []string
+	for p, be := range c.entries {
+		top, rest, _ := strings.Cut(p, "/")
+		switch top {
+		case ".", "manifest.json", CommonDir:
+		case ArchDir:
+			if rest != "" && !strings.Contains(rest, "/") {
+				if be.header.Typeflag != tar.TypeDir {
+					return nil, errors.Errorf("%q must be a directory", p)
+				}
+				archs = append(archs, rest)
+			}
+		default:
+			return nil, errors.Errorf("packages with an %s/ directory may only have %s/ and %s/<arch>/ "+
+				"at the top level, not %q", ArchDir, CommonDir, ArchDir, p)
+		}
+		if be.header.Typeflag != tar.TypeDir && (p == CommonDir || p == ArchDir) {
+			return nil, errors.Errorf("%q must be a directory", p)
+		}
+	}
+	slices.Sort(archs)
+
+	// an arch tree may add to common/, but not replace anything in it
+	for _, arch := range archs {
+		for p, be := range c.entries {
+			if be.header.Typeflag == tar.TypeDir || !strings.HasPrefix(p, ArchDir+"/"+arch+"/") {
+				continue
+			}
+			common := CommonDir + "/" + strings.TrimPrefix(p, ArchDir+"/"+arch+"/")
+			if _, ok := c.entries[common]; ok {
+				return nil, errors.Errorf("%q and %q would both be installed at the same path", common, p)
+			}
+		}
+	}
+	return archs, nil
+}
+
+// checkMultiArch checks the binaries of a multi-architecture package: each arch tree's against
+// its arch, and common/'s against every arch in supported_arch, which defaults to the arch trees.
+func checkMultiArch(m *manifest.Manifest, archs []string, binaries map[string]string) ([]string, error) {
+	declared := m.SupportedArch
+	if len(declared) == 0 {
+		declared = archs
+	}
+	for _, arch := range archs {
+		if !slices.Contains(declared, arch) {
+			return nil, errors.Errorf("package has an %s/%s/ tree, but supported_arch is %v", ArchDir, arch, declared)
+		}
+	}
+
+	common := map[string]string{}
+	perArch := map[string]map[string]string{}
+	for p, arch := range binaries {
+		dir, _, _ := strings.Cut(strings.TrimPrefix(p, ArchDir+"/"), "/")
+		if !strings.HasPrefix(p, ArchDir+"/") {
+			common[p] = arch
+			continue
+		}
+		if perArch[dir] == nil {
+			perArch[dir] = map[string]string{}
+		}
+		perArch[dir][p] = arch
+	}
+	for arch, bins := range perArch {
+		_, err := checkBinaryArch([]string{arch}, bins)
+		if err != nil {
+			return nil, err
+		}
+	}
+	_, err := checkBinaryArch(declared, common)
+	if err != nil {
+		return nil, err
+	}
+	return declared, nil
+}
@@ -0,0 +1,138 @@
+package kpkg_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"debug/elf"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/clintharrison/go-kindle-pkg/pkg/kpkg"
+	"github.com/pingcap/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMultiArch(t *testing.T) {
+	t.Parallel()
+	ctx := t.Context()
+	armhf := fakeELF(t, elf.ET_EXEC, elf.EM_ARM, 0x05000400, "/lib/ld-linux-armhf.so.3")
+	armel := fakeELF(t, elf.ET_EXEC, elf.EM_ARM, 0x05000200, "/lib/ld-linux.so.3")
+
+	p := buildPackage(t, map[string]string{
+		"manifest.json":           testManifest,
+		"common/install.sh":       "#!/bin/sh\n",
+		"common/bin/wrapper.sh":   "#!/bin/sh\n",
+		"arch/armhf/bin/tool":     armhf,
+		"arch/armel/bin/tool":     armel,
+		"arch/armel/lib/compat.a": "only on armel",
+	}, kpkg.WithZstdCompression)
+	k, err := kpkg.Open(ctx, p)
+	require.NoError(t, err)
+	defer k.Close()
+	require.Equal(t, []string{kpkg.ArchArmel, kpkg.ArchArmhf}, k.Manifest.SupportedArch)
+	archs, err := k.Archs()
+	require.NoError(t, err)
+	require.Equal(t, []string{kpkg.ArchArmel, kpkg.ArchArmhf}, archs)
+
+	out := &bytes.Buffer{}
+	require.NoError(t, k.ExtractAll(ctx, t.TempDir(), true, out, kpkg.WithArch(kpkg.ArchArmhf)))
+	require.Equal(t, `. type=dir mode=755 size=0 uid=0 gid=0
+manifest.json type=file mode=644 size=194 uid=0 gid=0
+contents.json type=file mode=644 size=937 uid=0 gid=0
+bin/ type=dir mode=755 size=0 uid=0 gid=0
+bin/tool type=file mode=644 size=109 uid=0 gid=0
+bin/wrapper.sh type=file mode=644 size=10 uid=0 gid=0
+install.sh type=file mode=644 size=10 uid=0 gid=0
+`, out.String())
+
+	dir := t.TempDir()
+	require.NoError(t, k.ExtractAll(ctx, dir, false, &bytes.Buffer{}, kpkg.WithArch(kpkg.ArchArmel)))
+	tool, err := os.ReadFile(filepath.Join(dir, "bin/tool"))
+	require.NoError(t, err)
+	require.Equal(t, armel, string(tool))
+	require.FileExists(t, filepath.Join(dir, "lib/compat.a"))
+	// the installed contents.json describes what was installed
+	c, err := kpkg.ReadContentsFile(filepath.Join(dir, kpkg.ContentsFileName))
+	require.NoError(t, err)
+	ds, err := kpkg.VerifyDir(dir, c)
+	require.NoError(t, err)
+	require.Empty(t, ds)
+
+	err = k.ExtractAll(ctx, t.TempDir(), false, &bytes.Buffer{}, kpkg.WithArch("arm64"))
+	require.Equal(t, kpkg.ErrUnsupportedArch, errors.Cause(err))
+
+	// without an arch, the package is extracted as it is
+	raw := t.TempDir()
+	require.NoError(t, k.ExtractAll(ctx, raw, false, &bytes.Buffer{}))
+	require.FileExists(t, filepath.Join(raw, "arch/armhf/bin/tool"))
+}
+
+//nolint:exhaustruct
+func TestMultiArch_NoContents(t *testing.T) {
+	t.Parallel()
+	ctx := t.Context()
+	// put together by hand, so there's no contents.json and no entries for the arch/ directories
+	p := writeRawTar(t,
+		&tar.Header{Typeflag: tar.TypeDir, Name: "./common/", Mode: 0o755},
+		&tar.Header{Typeflag: tar.TypeReg, Name: "./common/install.sh", Mode: 0o755, Size: 3},
+		&tar.Header{Typeflag: tar.TypeReg, Name: "./arch/armhf/bin/tool", Mode: 0o755, Size: 4},
+		&tar.Header{Typeflag: tar.TypeReg, Name: "./arch/armel/bin/tool", Mode: 0o755, Size: 5},
+	)
+	k, err := kpkg.Open(ctx, p)
+	require.NoError(t, err)
+	defer k.Close()
+	require.Nil(t, k.Contents)
+	archs, err := k.Archs()
+	require.NoError(t, err)
+	require.Equal(t, []string{kpkg.ArchArmel, kpkg.ArchArmhf}, archs)
+
+	dir := t.TempDir()
+	require.NoError(t, k.ExtractAll(ctx, dir, false, &bytes.Buffer{}, kpkg.WithArch(kpkg.ArchArmhf)))
+	info, err := os.Stat(filepath.Join(dir, "bin/tool"))
+	require.NoError(t, err)
+	require.Equal(t, int64(4), info.Size())
+	require.FileExists(t, filepath.Join(dir, "install.sh"))
+	require.NoDirExists(t, filepath.Join(dir, "arch"))
+	err = k.ExtractAll(ctx, t.TempDir(), false, &bytes.Buffer{}, kpkg.WithArch("arm64"))
+	require.Equal(t, kpkg.ErrUnsupportedArch, errors.Cause(err))
+
+	// a stream can't be scanned ahead, so it's refused rather than extracted as it is
+	s, err := openStream(t, p)
+	require.NoError(t, err)
+	defer s.Close()
+	err = s.ExtractAll(ctx, t.TempDir(), false, &bytes.Buffer{}, kpkg.WithArch(kpkg.ArchArmhf))
+	require.ErrorContains(t, err, "no contents.json")
+}
+
+func TestMultiArch_BadLayout(t *testing.T) {
+	t.Parallel()
+
+	for name, files := range map[string]map[string]string{
+		"file outside the trees": {
+			"manifest.json":       testManifest,
+			"install.sh":          "#!/bin/sh\n",
+			"arch/armhf/bin/tool": "tool",
+		},
+		"arch tree replaces common": {
+			"manifest.json":       testManifest,
+			"common/bin/tool":     "tool",
+			"arch/armhf/bin/tool": "tool",
+		},
+		"arch tree not in supported_arch": {
+			"manifest.json":       `{"id": "signed", "name": "Signed", "version": [1, 0, 0], "supported_arch": ["armhf"]}`,
+			"arch/armhf/bin/tool": "tool",
+			"arch/armel/bin/tool": "tool",
+		},
+		"binary in the wrong tree": {
+			"manifest.json":       testManifest,
+			"arch/armel/bin/tool": fakeELF(t, elf.ET_EXEC, elf.EM_ARM, 0x05000400, "/lib/ld-linux-armhf.so.3"),
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			dest := filepath.Join(t.TempDir(), "test.kpkg")
+			require.Error(t, kpkg.Build(t.Context(), writePackageDir(t, files), dest))
+		})
+	}
+}
@@ -0,0 +1,373 @@
+package kpkg
+
+import (
+	"archive/tar"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"hash"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/clintharrison/go-kindle-pkg/pkg/utilio"
+	"github.com/clintharrison/go-kindle-pkg/pkg/version"
+	"github.com/pingcap/errors"
+)
+
+// SignatureSuffix is appended to a .kpkg path to find its detached signature.
+const SignatureSuffix = ".sig"
+
+const (
+	signatureVersion   = 1
+	signatureAlgorithm = "ed25519"
+	// signatureDomain is prepended to the signed message so a kpkg signature can't be replayed elsewhere.
+	signatureDomain = "kpkg-signature-v1\n"
+)
+
+var (
+	ErrUnsigned     = errors.New("package is not signed")
+	ErrUntrustedKey = errors.New("package is signed by an untrusted key")
+	ErrBadSignature = errors.New("package signature is invalid")
+)
+
+// Signature is the detached signature stored next to a package as <name>.kpkg.sig.
+//
+// It covers the manifest.json and a digest of the decompressed tar payload, so a package
+// can be recompressed (or reconstructed from a delta) without invalidating its signature.
+type Signature struct {
+	Version        int    `json:"version"`
+	Algorithm      string `json:"algorithm"`
+	KeyID          string `json:"key_id"`
+	ManifestSHA256 string `json:"manifest_sha256"`
+	PayloadSHA256  string `json:"payload_sha256"`
+	Signature      []byte `json:"signature"`
+}
+
+func (s *Signature) message() []byte {
+	return []byte(signatureDomain + s.ManifestSHA256 + "\n" + s.PayloadSHA256 + "\n")
+}
+
+// Verification describes a successfully verified signature.
+type Verification struct {
+	Signer         string
+	KeyID          string
+	ManifestSHA256 string
+	PayloadSHA256  string
+}
+
+// TrustedKey is a publisher key that packages may be signed with.
+type TrustedKey struct {
+	// Name is the human-readable signer, taken from the key's file name.
+	Name      string
+	KeyID     string
+	PublicKey ed25519.PublicKey
+}
+
+type Keyring struct {
+	keys map[string]*TrustedKey
+}
+
+func NewKeyring(keys ...*TrustedKey) *Keyring {
+	kr := &Keyring{keys: make(map[string]*TrustedKey, len(keys))}
+	for _, k := range keys {
+		kr.keys[k.KeyID] = k
+	}
+	return kr
+}
+
+// Lookup returns the trusted key with the given ID, or nil.
+func (kr *Keyring) Lookup(keyID string) *TrustedKey {
+	return kr.keys[keyID]
+}
+
+func (kr *Keyring) Len() int {
+	return len(kr.keys)
+}
+
+// TrustedKeysDir is where publisher keys are kept on the device, one PEM file per key.
+func TrustedKeysDir() string {
+	return filepath.Join(version.BaseDir(), "trusted-keys")
+}
+
+// LoadKeyring reads every *.pem public key in dir. A missing directory is an empty keyring.
+func LoadKeyring(dir string) (*Keyring, error) {
+	kr := NewKeyring()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			slog.Debug("no trusted keys directory", "dir", dir)
+			return kr, nil
+		}
+		return nil, errors.Wrapf(err, "os.ReadDir(%q)", dir)
+	}
+	for _, e := range entries {
+		if e.IsDir() || filepath.Ext(e.Name()) != ".pem" {
+			continue
+		}
+		p := filepath.Join(dir, e.Name())
+		data, err := os.ReadFile(p)
+		if err != nil {
+			return nil, errors.Wrapf(err, "os.ReadFile(%q)", p)
+		}
+		pub, err := ParsePublicKey(data)
+		if err != nil {
+			return nil, errors.Wrapf(err, "parsing trusted key %q", p)
+		}
+		k := &TrustedKey{
+			Name:      strings.TrimSuffix(e.Name(), ".pem"),
+			KeyID:     KeyID(pub),
+			PublicKey: pub,
+		}
+		kr.keys[k.KeyID] = k
+	}
+	return kr, nil
+}
+
+// KeyID is a short fingerprint of a public key: the first 8 bytes of its SHA-256, in hex.
+func KeyID(pub ed25519.PublicKey) string {
+	sum := sha256.Sum256(pub)
+	return hex.EncodeToString(sum[:8])
+}
+
+// ParsePublicKey parses a PEM "PUBLIC KEY" block, as written by `openssl pkey -pubout`.
+func ParsePublicKey(data []byte) (ed25519.PublicKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "PUBLIC KEY" {
+		return nil, errors.New("expected a PEM \"PUBLIC KEY\" block")
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, errors.AddStack(err)
+	}
+	pub, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return nil, errors.Errorf("expected an ed25519 public key, got %T", key)
+	}
+	return pub, nil
+}
+
+// LoadPrivateKey reads a PEM "PRIVATE KEY" file, as written by `openssl genpkey -algorithm ed25519`.
+func LoadPrivateKey(path string) (ed25519.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "os.ReadFile(%q)", path)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "PRIVATE KEY" {
+		return nil, errors.Errorf("%q: expected a PEM \"PRIVATE KEY\" block", path)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, errors.Wrapf(err, "parsing private key %q", path)
+	}
+	priv, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, errors.Errorf("%q: expected an ed25519 private key, got %T", path, key)
+	}
+	return priv, nil
+}
+
+func ReadSignatureFile(path string) (*Signature, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "os.ReadFile(%q)", path)
+	}
+	sig, err := ParseSignature(data)
+	if err != nil {
+		return nil, errors.Annotatef(err, "in %q", path)
+	}
+	return sig, nil
+}
+
+func ParseSignature(data []byte) (*Signature, error) {
+	var sig Signature
+	err := json.Unmarshal(data, &sig)
+	if err != nil {
+		return nil, errors.Wrap(err, "json.Unmarshal() to kpkg.Signature")
+	}
+	if sig.Version != signatureVersion || sig.Algorithm != signatureAlgorithm {
+		return nil, errors.Errorf("unsupported signature version %d/%q", sig.Version, sig.Algorithm)
+	}
+	return &sig, nil
+}
+
+// SignFile signs the package at path and writes the detached signature to path + SignatureSuffix.
+func SignFile(ctx context.Context, path string, priv ed25519.PrivateKey) (*Signature, error) {
+	k, err := Open(ctx, path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "kpkg.Open(%q)", path)
+	}
+	defer k.Close()
+
+	sig, err := k.Sign(ctx, priv)
+	if err != nil {
+		return nil, err
+	}
+	data, err := json.MarshalIndent(sig, "", "  ")
+	if err != nil {
+		return nil, errors.AddStack(err)
+	}
+	sigPath := path + SignatureSuffix
+	err = os.WriteFile(sigPath, data, 0o644) //nolint:gosec
+	if err != nil {
+		return nil, errors.Wrapf(err, "os.WriteFile(%q)", sigPath)
+	}
+	return sig, nil
+}
+
+func (k *KPKG) Sign(ctx context.Context, priv ed25519.PrivateKey) (*Signature, error) {
+	manifestSum, payloadSum, err := k.Digests(ctx)
+	if err != nil {
+		return nil, err
+	}
+	pub, ok := priv.Public().(ed25519.PublicKey)
+	if !ok {
+		return nil, errors.New("unable to derive ed25519 public key")
+	}
+	sig := &Signature{
+		Version:        signatureVersion,
+		Algorithm:      signatureAlgorithm,
+		KeyID:          KeyID(pub),
+		ManifestSHA256: manifestSum,
+		PayloadSHA256:  payloadSum,
+		Signature:      nil,
+	}
+	sig.Signature = ed25519.Sign(priv, sig.message())
+	return sig, nil
+}
+
+// Verify checks sig against the package contents and the trusted keys in kr.
+func (k *KPKG) Verify(ctx context.Context, sig *Signature, kr *Keyring) (*Verification, error) {
+	key, err := checkSignature(sig, kr)
+	if err != nil {
+		return nil, err
+	}
+	manifestSum, payloadSum, err := k.Digests(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return verifyDigests(key, sig, manifestSum, payloadSum)
+}
+
+// checkSignature checks that sig was made by a trusted key, without looking at the package itself.
+func checkSignature(sig *Signature, kr *Keyring) (*TrustedKey, error) {
+	key := kr.Lookup(sig.KeyID)
+	if key == nil {
+		return nil, errors.Annotatef(ErrUntrustedKey, "key ID %s", sig.KeyID)
+	}
+	if !ed25519.Verify(key.PublicKey, sig.message(), sig.Signature) {
+		return nil, errors.Annotatef(ErrBadSignature, "signature by %s (%s) does not verify", key.Name, key.KeyID)
+	}
+	return key, nil
+}
+
+// verifyDigests checks the package's actual digests against the ones that were signed.
+func verifyDigests(key *TrustedKey, sig *Signature, manifestSum, payloadSum string) (*Verification, error) {
+	if manifestSum != sig.ManifestSHA256 {
+		return nil, errors.Annotatef(ErrBadSignature, "manifest.json digest is %s, signed %s", manifestSum, sig.ManifestSHA256)
+	}
+	if payloadSum != sig.PayloadSHA256 {
+		return nil, errors.Annotatef(ErrBadSignature, "payload digest is %s, signed %s", payloadSum, sig.PayloadSHA256)
+	}
+	return &Verification{
+		Signer:         key.Name,
+		KeyID:          key.KeyID,
+		ManifestSHA256: manifestSum,
+		PayloadSHA256:  payloadSum,
+	}, nil
+}
+
+// finishEntries reads whatever is left of the payload after the entries and, if the package must
+// be verified, verifies it against its signature.
+func (k *KPKG) finishEntries() error {
+	payload, payloadHash := k.payload, k.payloadHash
+	if k.stream != nil {
+		payload, payloadHash = k.stream.payload, k.stream.payloadHash
+	}
+	if payloadHash == nil {
+		return nil
+	}
+	_, err := io.Copy(io.Discard, payload)
+	if err != nil {
+		return errors.Wrap(err, "hashing payload")
+	}
+	if k.keyring == nil {
+		return nil
+	}
+	key, err := checkSignature(k.signature, k.keyring)
+	if err != nil {
+		return err
+	}
+	v, err := verifyDigests(key, k.signature, k.manifestSum, hex.EncodeToString(payloadHash.Sum(nil)))
+	if err != nil {
+		return err
+	}
+	k.Verification = v
+	return nil
+}
+
+// Digests returns the SHA-256 of manifest.json and of the whole decompressed tar payload.
+func (k *KPKG) Digests(ctx context.Context) (string, string, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	r, err := k.payloadReader()
+	if err != nil {
+		return "", "", err
+	}
+	payloadHash := sha256.New()
+	tee := io.TeeReader(utilio.NewContextReader(ctx, r), payloadHash)
+
+	var manifestHash hash.Hash
+	tr := tar.NewReader(tee)
+	for {
+		entry, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", "", errors.Wrap(err, "tarReader.Next()")
+		}
+		if strings.TrimPrefix(entry.Name, "./") != "manifest.json" {
+			continue
+		}
+		manifestHash = sha256.New()
+		_, err = io.Copy(manifestHash, tr)
+		if err != nil {
+			return "", "", errors.Wrap(err, "hashing manifest.json")
+		}
+	}
+	// the tar reader stops at the end-of-archive marker; the rest is still part of the payload
+	_, err = io.Copy(io.Discard, tee)
+	if err != nil {
+		return "", "", errors.Wrap(err, "hashing payload")
+	}
+	if manifestHash == nil {
+		return "", "", errors.New("package has no manifest.json")
+	}
+	return hex.EncodeToString(manifestHash.Sum(nil)), hex.EncodeToString(payloadHash.Sum(nil)), nil
+}
+
+// PayloadSHA256 returns the SHA-256 of the decompressed tar payload, as Digests does, without
+// reading the package again if it was worked out when the signature was verified. A stream's
+// digest is only known once ExtractAll has read all of it.
+func (k *KPKG) PayloadSHA256(ctx context.Context) (string, error) {
+	if k.Verification != nil {
+		return k.Verification.PayloadSHA256, nil
+	}
+	if k.stream != nil {
+		if !k.stream.consumed {
+			return "", errors.New("the package stream hasn't been read yet")
+		}
+		return hex.EncodeToString(k.stream.payloadHash.Sum(nil)), nil
+	}
+	_, sum, err := k.Digests(ctx)
+	return sum, err
+}
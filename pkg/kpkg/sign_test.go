@@ -0,0 +1,117 @@
+package kpkg_test
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/clintharrison/go-kindle-pkg/pkg/kpkg"
+	"github.com/pingcap/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func writePackageDir(t *testing.T, files map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, contents := range files {
+		p := filepath.Join(dir, name)
+		require.NoError(t, os.MkdirAll(filepath.Dir(p), 0o755))
+		require.NoError(t, os.WriteFile(p, []byte(contents), 0o644)) //nolint:gosec
+	}
+	return dir
+}
+
+func buildPackage(t *testing.T, files map[string]string, opts ...kpkg.BuildOption) string {
+	t.Helper()
+	dest := filepath.Join(t.TempDir(), "test.kpkg")
+	require.NoError(t, kpkg.Build(t.Context(), writePackageDir(t, files), dest, opts...))
+	return dest
+}
+
+func genKey(t *testing.T, keysDir, name string) ed25519.PrivateKey {
+	t.Helper()
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	require.NoError(t, err)
+	data := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})             //nolint:exhaustruct
+	require.NoError(t, os.WriteFile(filepath.Join(keysDir, name+".pem"), data, 0o644)) //nolint:gosec
+	return priv
+}
+
+const testManifest = `{"id": "signed", "name": "Signed", "version": [1, 0, 0]}`
+
+func TestSignAndVerify(t *testing.T) {
+	t.Parallel()
+	ctx := t.Context()
+
+	trustedDir := t.TempDir()
+	trusted := genKey(t, trustedDir, "publisher")
+	untrusted := genKey(t, t.TempDir(), "stranger")
+	keyring, err := kpkg.LoadKeyring(trustedDir)
+	require.NoError(t, err)
+	require.Equal(t, 1, keyring.Len())
+
+	files := map[string]string{"manifest.json": testManifest, "install.sh": "#!/bin/sh\n"}
+
+	t.Run("trusted signature", func(t *testing.T) {
+		t.Parallel()
+		p := buildPackage(t, files)
+		sig, err := kpkg.SignFile(ctx, p, trusted)
+		require.NoError(t, err)
+
+		k, err := kpkg.Open(ctx, p, kpkg.WithKeyring(keyring))
+		require.NoError(t, err)
+		defer k.Close()
+		// the payload is only verified as it's extracted, so it isn't read twice
+		require.Nil(t, k.Verification)
+		require.NoError(t, k.ExtractAll(ctx, t.TempDir(), false, io.Discard))
+		require.NotNil(t, k.Verification)
+		require.Equal(t, "publisher", k.Verification.Signer)
+		require.Equal(t, sig.KeyID, k.Verification.KeyID)
+	})
+
+	t.Run("unsigned", func(t *testing.T) {
+		t.Parallel()
+		p := buildPackage(t, files)
+		_, err := kpkg.Open(ctx, p, kpkg.WithKeyring(keyring))
+		require.Error(t, err)
+		require.Equal(t, kpkg.ErrUnsigned, errors.Cause(err))
+
+		k, err := kpkg.Open(ctx, p, kpkg.WithKeyring(keyring), kpkg.WithAllowUnsigned(true))
+		require.NoError(t, err)
+		defer k.Close()
+		require.Nil(t, k.Verification)
+	})
+
+	t.Run("untrusted key", func(t *testing.T) {
+		t.Parallel()
+		p := buildPackage(t, files)
+		_, err := kpkg.SignFile(ctx, p, untrusted)
+		require.NoError(t, err)
+		_, err = kpkg.Open(ctx, p, kpkg.WithKeyring(keyring))
+		require.Equal(t, kpkg.ErrUntrustedKey, errors.Cause(err))
+	})
+
+	t.Run("payload changed after signing", func(t *testing.T) {
+		t.Parallel()
+		p := buildPackage(t, files)
+		_, err := kpkg.SignFile(ctx, p, trusted)
+		require.NoError(t, err)
+
+		other := buildPackage(t, map[string]string{"manifest.json": testManifest, "install.sh": "#!/bin/sh\nrm -rf /\n"})
+		require.NoError(t, os.Rename(other, p))
+
+		k, err := kpkg.Open(ctx, p, kpkg.WithKeyring(keyring), kpkg.WithAllowUnsigned(true))
+		require.NoError(t, err)
+		defer k.Close()
+		err = k.ExtractAll(ctx, t.TempDir(), false, io.Discard)
+		require.Equal(t, kpkg.ErrBadSignature, errors.Cause(err))
+		require.Nil(t, k.Verification)
+	})
+}
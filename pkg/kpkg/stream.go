@@ -0,0 +1,143 @@
+package kpkg
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"io"
+	"log/slog"
+	"slices"
+	"strings"
+
+	"github.com/clintharrison/go-kindle-pkg/pkg/utilio"
+	"github.com/pingcap/errors"
+)
+
+// maxBufferedBeforeManifest bounds how much of a stream is held in memory while looking for
+// manifest.json. Packages that put it first (as Build does) only buffer the metadata files
+// and the entry after them.
+const maxBufferedBeforeManifest = 4 << 20
+
+type streamState struct {
+	// payload is the decompressed tar stream, which is also fed into payloadHash as it is read
+	payload     io.Reader
+	payloadHash hash.Hash
+
+	// entries read while looking for manifest.json, replayed by ExtractAll
+	buffered     []bufferedEntry
+	bufferedSize int64
+	consumed     bool
+}
+
+type bufferedEntry struct {
+	header *tar.Header
+	data   []byte
+	// live is set for the entry after the metadata, whose data has not been read from the stream yet
+	live bool
+}
+
+// WithSignature provides the detached signature for a package opened with OpenStream, which has
+// no path to find a .sig file next to, or replaces the .sig file for one opened with Open.
+func WithSignature(sig *Signature) OpenOption {
+	return func(o *openOptions) {
+		o.signature = sig
+	}
+}
+
+// OpenStream opens a package from a reader that can't seek, such as an HTTP response or stdin.
+//
+// Only the head of the stream is read, up to and including manifest.json. ExtractAll reads the
+// rest, and so can only be called once. When a keyring is given, the payload digest can only be
+// checked after ExtractAll has seen the whole stream, so callers must extract to a staging directory
+// and discard it if ExtractAll fails.
+func OpenStream(ctx context.Context, r io.Reader, optFuncs ...OpenOption) (*KPKG, error) {
+	opts := &openOptions{} //nolint:exhaustruct
+	for _, o := range optFuncs {
+		o(opts)
+	}
+
+	payload, err := sniffDecompressor(bufio.NewReader(r), opts.packageLimits())
+	if err != nil {
+		return nil, err
+	}
+	ss := &streamState{ //nolint:exhaustruct
+		payloadHash: sha256.New(),
+	}
+	ss.payload = io.TeeReader(utilio.NewContextReader(ctx, payload), ss.payloadHash)
+
+	k := &KPKG{ //nolint:exhaustruct
+		path:      "<stream>",
+		tarReader: tar.NewReader(ss.payload),
+		stream:    ss,
+		limits:    opts.packageLimits(),
+	}
+	if opts.keyring != nil {
+		err := k.checkStreamTrust(opts)
+		if err != nil {
+			return nil, err
+		}
+	}
+	err = k.ReadMetadata(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "kpkg.ReadMetadata() for stream")
+	}
+	return k, nil
+}
+
+// checkStreamTrust checks that there is a signature for the stream, which has no .sig file to
+// find one in, and that it was made by a trusted key.
+func (k *KPKG) checkStreamTrust(opts *openOptions) error {
+	if opts.signature == nil {
+		if opts.allowUnsigned {
+			slog.Warn("package stream is not signed, continuing anyway")
+			return nil
+		}
+		return errors.Annotate(ErrUnsigned, "no signature for package stream")
+	}
+	return k.checkTrust(opts.signature, opts)
+}
+
+func (k *KPKG) readStreamMetadata(ctx context.Context) error {
+	ss := k.stream
+	err := k.readMetadataPrefix(ctx, func() (*tar.Header, io.Reader, error) {
+		entry, err := k.tarReader.Next()
+		if err != nil {
+			return nil, nil, err //nolint:wrapcheck
+		}
+		if k.Manifest != nil && !slices.Contains(metadataFiles, strings.TrimPrefix(entry.Name, "./")) {
+			// the first entry past the metadata: its data stays in the stream for ExtractAll
+			ss.buffered = append(ss.buffered, bufferedEntry{header: entry, data: nil, live: true})
+			return entry, k.tarReader, nil
+		}
+		if entry.Size > maxBufferedBeforeManifest-ss.bufferedSize {
+			return nil, nil, fmt.Errorf("%q is too large to buffer before manifest.json: "+
+				"streamed packages must have manifest.json near the start", entry.Name)
+		}
+		data, err := io.ReadAll(k.tarReader)
+		if err != nil {
+			return nil, nil, errors.Wrapf(err, "reading %q", entry.Name)
+		}
+		ss.buffered = append(ss.buffered, bufferedEntry{header: entry, data: data, live: false})
+		ss.bufferedSize += int64(len(data))
+		return entry, bytes.NewReader(data), nil
+	})
+	return err
+}
+
+// nextEntry returns the next entry from a stream, replaying anything read by ReadMetadata first.
+func (ss *streamState) nextEntry(tr *tar.Reader) (*tar.Header, io.Reader, error) {
+	if len(ss.buffered) > 0 {
+		be := ss.buffered[0]
+		ss.buffered = ss.buffered[1:]
+		if be.live {
+			return be.header, tr, nil
+		}
+		return be.header, bytes.NewReader(be.data), nil
+	}
+	entry, err := tr.Next()
+	return entry, tr, err //nolint:wrapcheck
+}
@@ -0,0 +1,157 @@
+package kpkg_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/clintharrison/go-kindle-pkg/pkg/kpkg"
+	"github.com/pingcap/errors"
+	"github.com/stretchr/testify/require"
+)
+
+// onlyReader hides everything but Read, so nothing can seek the package behind our back.
+type onlyReader struct{ r io.Reader }
+
+func (o onlyReader) Read(p []byte) (int, error) { return o.r.Read(p) }
+
+func openStream(t *testing.T, p string, opts ...kpkg.OpenOption) (*kpkg.KPKG, error) {
+	t.Helper()
+	f, err := os.Open(p)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = f.Close() })
+	return kpkg.OpenStream(t.Context(), onlyReader{f}, opts...)
+}
+
+func TestOpenStream(t *testing.T) {
+	t.Parallel()
+	ctx := t.Context()
+	files := map[string]string{
+		"manifest.json": testManifest,
+		"install.sh":    "#!/bin/sh\n",
+		"bin/tool":      "#!/bin/sh\necho hi\n",
+	}
+
+	for name, opts := range map[string][]kpkg.BuildOption{
+		"uncompressed": nil,
+		"gzip":         {kpkg.WithGzipCompression},
+		"xz":           {kpkg.WithXZCompression},
+		"zstd":         {kpkg.WithZstdCompression, kpkg.WithCompressionLevel(19)},
+	} {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			p := buildPackage(t, files, opts...)
+			k, err := openStream(t, p)
+			require.NoError(t, err)
+			defer k.Close()
+			require.Equal(t, "signed", k.Manifest.ID)
+
+			dir := t.TempDir()
+			require.NoError(t, k.ExtractAll(ctx, dir, false, io.Discard))
+			data, err := os.ReadFile(filepath.Join(dir, "bin", "tool"))
+			require.NoError(t, err)
+			require.Equal(t, files["bin/tool"], string(data))
+
+			// the stream is gone now
+			require.Error(t, k.ExtractAll(ctx, t.TempDir(), false, io.Discard))
+		})
+	}
+}
+
+func TestOpenStream_LargeFileAfterMetadata(t *testing.T) {
+	t.Parallel()
+	big := strings.Repeat("x", 5<<20)
+	p := buildPackage(t, map[string]string{"manifest.json": testManifest, "big.bin": big})
+
+	// nothing past the metadata is buffered, however big it is
+	k, err := openStream(t, p)
+	require.NoError(t, err)
+	defer k.Close()
+	dir := t.TempDir()
+	require.NoError(t, k.ExtractAll(t.Context(), dir, false, io.Discard))
+	data, err := os.ReadFile(filepath.Join(dir, "big.bin"))
+	require.NoError(t, err)
+	require.Len(t, data, len(big))
+}
+
+//nolint:exhaustruct
+func TestOpenStream_ManifestNotFirst(t *testing.T) {
+	t.Parallel()
+	ctx := t.Context()
+
+	buf := &bytes.Buffer{}
+	tw := tar.NewWriter(buf)
+	for _, e := range [][2]string{{"./data.txt", "data"}, {"./manifest.json", testManifest}} {
+		require.NoError(t, tw.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeReg, Name: e[0], Mode: 0o644, Size: int64(len(e[1])),
+		}))
+		_, err := tw.Write([]byte(e[1]))
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Close())
+
+	k, err := kpkg.OpenStream(ctx, onlyReader{buf})
+	require.NoError(t, err)
+	defer k.Close()
+	require.Equal(t, "signed", k.Manifest.ID)
+
+	// entries read while looking for the manifest are still extracted
+	dir := t.TempDir()
+	require.NoError(t, k.ExtractAll(ctx, dir, false, io.Discard))
+	data, err := os.ReadFile(filepath.Join(dir, "data.txt"))
+	require.NoError(t, err)
+	require.Equal(t, "data", string(data))
+}
+
+func TestOpenStream_Signature(t *testing.T) {
+	t.Parallel()
+	ctx := t.Context()
+
+	trustedDir := t.TempDir()
+	trusted := genKey(t, trustedDir, "publisher")
+	keyring, err := kpkg.LoadKeyring(trustedDir)
+	require.NoError(t, err)
+	files := map[string]string{"manifest.json": testManifest, "install.sh": "#!/bin/sh\n"}
+
+	t.Run("trusted signature", func(t *testing.T) {
+		t.Parallel()
+		p := buildPackage(t, files)
+		sig, err := kpkg.SignFile(ctx, p, trusted)
+		require.NoError(t, err)
+
+		k, err := openStream(t, p, kpkg.WithKeyring(keyring), kpkg.WithSignature(sig))
+		require.NoError(t, err)
+		defer k.Close()
+		// only known once the whole payload has been read
+		require.Nil(t, k.Verification)
+		require.NoError(t, k.ExtractAll(ctx, t.TempDir(), false, io.Discard))
+		require.NotNil(t, k.Verification)
+		require.Equal(t, "publisher", k.Verification.Signer)
+	})
+
+	t.Run("unsigned", func(t *testing.T) {
+		t.Parallel()
+		p := buildPackage(t, files)
+		_, err := openStream(t, p, kpkg.WithKeyring(keyring))
+		require.Equal(t, kpkg.ErrUnsigned, errors.Cause(err))
+	})
+
+	t.Run("payload changed after signing", func(t *testing.T) {
+		t.Parallel()
+		p := buildPackage(t, files)
+		sig, err := kpkg.SignFile(ctx, p, trusted)
+		require.NoError(t, err)
+		other := buildPackage(t, map[string]string{"manifest.json": testManifest, "install.sh": "#!/bin/sh\nrm -rf /\n"})
+
+		k, err := openStream(t, other, kpkg.WithKeyring(keyring), kpkg.WithSignature(sig))
+		require.NoError(t, err)
+		defer k.Close()
+		err = k.ExtractAll(ctx, t.TempDir(), false, io.Discard)
+		require.Equal(t, kpkg.ErrBadSignature, errors.Cause(err))
+		require.Nil(t, k.Verification)
+	})
+}
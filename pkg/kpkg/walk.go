@@ -0,0 +1,105 @@
+package kpkg
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pingcap/errors"
+)
+
+// WalkFunc is called for each entry of a package, with its contents if it's a regular file.
+type WalkFunc func(h *tar.Header, r io.Reader) error
+
+// WalkBuildDir calls fn for each entry that Build would pack from the package directory at
+// rootPath, following its kpkg-build.json, in the order they would be packed. Nothing is checked
+// beyond what's needed to collect them: the manifest may be missing or invalid, and binaries for
+// any architecture. contents.json is not generated.
+func WalkBuildDir(ctx context.Context, rootPath string, fn WalkFunc) error {
+	spec, err := readBuildSpec(rootPath)
+	if err != nil {
+		return err
+	}
+	c := &entryCollector{
+		spec:     spec,
+		specPath: filepath.Join(rootPath, BuildSpecFileName),
+		modTime:  time.Time{},
+		entries:  map[string]*buildEntry{},
+	}
+	err = c.addTree(rootPath, ".")
+	if err != nil {
+		return errors.Wrap(err, "walking root fs")
+	}
+	for _, f := range spec.Files {
+		src := f.Src
+		if !filepath.IsAbs(src) {
+			src = filepath.Join(rootPath, src)
+		}
+		err = c.addTree(src, f.Dest)
+		if err != nil {
+			return errors.Wrapf(err, "adding %q as %q", f.Src, f.Dest)
+		}
+	}
+	for _, be := range c.sorted() {
+		if err := ctx.Err(); err != nil {
+			return errors.AddStack(err)
+		}
+		err := walkBuildEntry(be, fn)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func walkBuildEntry(be *buildEntry, fn WalkFunc) error {
+	if be.src == "" {
+		return fn(be.header, bytes.NewReader(be.data))
+	}
+	f, err := os.Open(be.src)
+	if err != nil {
+		return errors.AddStack(err)
+	}
+	defer f.Close()
+	return fn(be.header, f)
+}
+
+// Walk calls fn for each entry in the archive as it is stored, including any that ExtractAll
+// would refuse to write.
+func (k *KPKG) Walk(ctx context.Context, fn WalkFunc) error {
+	next, err := k.entries()
+	if err != nil {
+		return err
+	}
+	lc := &limitChecker{limits: k.limits, entries: 0, total: 0}
+	for {
+		if err := ctx.Err(); err != nil {
+			return errors.AddStack(err)
+		}
+		h, r, err := next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return errors.Wrap(err, "tarReader.Next()")
+		}
+		err = lc.check(h)
+		if err != nil {
+			return err
+		}
+		err = fn(h, r)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// CheckEntry returns the *UnsafeEntryError that ExtractAll would refuse the entry with, if any.
+func CheckEntry(h *tar.Header) error {
+	_, err := checkEntry(h)
+	return err
+}
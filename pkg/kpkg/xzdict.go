@@ -0,0 +1,296 @@
+package kpkg
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+
+	"github.com/pingcap/errors"
+	"github.com/ulikunitz/xz/lzma"
+)
+
+// xz's LZMA2 decoder allocates the dictionary its block header asks for, up to 4GB, before
+// decoding anything, and the xz package has no way to cap it. xzDictChecker sits in front of the
+// decoder and walks the container format as it passes through, checking each block header's
+// dictionary size against MaxWindowSize before the decoder gets to see it.
+// See https://tukaani.org/xz/xz-file-format.txt for the layout.
+
+const (
+	xzStreamHeaderSize = 12
+	xzLZMA2FilterID    = 0x21
+)
+
+type xzState int
+
+const (
+	xzStreamHeader xzState = iota
+	xzBlockOrIndex
+	xzChunk
+	xzBlockEnd
+	xzIndexRecords
+	xzIndexEnd
+	xzStreamPadding
+)
+
+type xzDictChecker struct {
+	r       *bufio.Reader
+	maxDict int64
+
+	state     xzState
+	checkSize int
+	// blockSize is the size of the current block so far, for its padding
+	blockSize int64
+	// indexSize is the size of the current index so far, for its padding
+	indexSize int64
+	// records is how many index record fields are left to pass through
+	records uint64
+
+	buf     []byte
+	pending []byte
+	err     error
+}
+
+// newXZDictChecker checks the first block header before returning, so that a package asking for
+// too big a dictionary is refused when it's opened.
+func newXZDictChecker(r *bufio.Reader, maxDict int64) (*xzDictChecker, error) {
+	c := &xzDictChecker{r: r, maxDict: maxDict, state: xzStreamHeader} //nolint:exhaustruct
+	for c.err == nil && c.state != xzChunk {
+		c.err = c.next()
+	}
+	if c.err != nil && c.err != io.EOF { //nolint:errorlint // io.EOF is never wrapped
+		return nil, c.err
+	}
+	c.pending = c.buf
+	return c, nil
+}
+
+func (c *xzDictChecker) Read(p []byte) (int, error) {
+	for len(c.pending) == 0 && c.err == nil {
+		c.buf = c.buf[:0]
+		c.err = c.next()
+		c.pending = c.buf
+	}
+	n := copy(p, c.pending)
+	c.pending = c.pending[n:]
+	if n > 0 {
+		return n, nil
+	}
+	return 0, c.err
+}
+
+// take reads the next n bytes of the stream, passing them through to the decoder.
+func (c *xzDictChecker) take(n int) ([]byte, error) {
+	start := len(c.buf)
+	c.buf = append(c.buf, make([]byte, n)...)
+	_, err := io.ReadFull(c.r, c.buf[start:])
+	if err == io.EOF { //nolint:errorlint // io.EOF is never wrapped
+		err = io.ErrUnexpectedEOF
+	}
+	return c.buf[start:], errors.AddStack(err)
+}
+
+// takeVarint reads a multibyte integer as the xz format encodes them.
+func (c *xzDictChecker) takeVarint() (uint64, int, error) {
+	var v uint64
+	for i := range 9 {
+		b, err := c.take(1)
+		if err != nil {
+			return 0, 0, err
+		}
+		v |= uint64(b[0]&0x7f) << (7 * i)
+		if b[0]&0x80 == 0 {
+			return v, i + 1, nil
+		}
+	}
+	return 0, 0, errors.New("xz: integer is too long")
+}
+
+// next passes through the next piece of the stream, checking it on the way.
+func (c *xzDictChecker) next() error {
+	switch c.state {
+	case xzStreamHeader:
+		h, err := c.take(xzStreamHeaderSize)
+		if err != nil {
+			return err
+		}
+		if !bytes.HasPrefix(h, xzMagic) {
+			return errors.New("xz: bad stream header")
+		}
+		// the check's size is 4 << ((id-1)/3) bytes for any id but none's 0
+		if id := h[7] & 0x0f; id != 0 {
+			c.checkSize = 4 << ((int(id) - 1) / 3)
+		} else {
+			c.checkSize = 0
+		}
+		c.state = xzBlockOrIndex
+	case xzBlockOrIndex:
+		b, err := c.r.Peek(1)
+		if err != nil {
+			return errors.Annotate(io.ErrUnexpectedEOF, "xz: reading block header")
+		}
+		if b[0] == 0 {
+			return c.startIndex()
+		}
+		h, err := c.take((int(b[0]) + 1) * 4)
+		if err != nil {
+			return err
+		}
+		err = c.checkBlockHeader(h)
+		if err != nil {
+			return err
+		}
+		c.blockSize = int64(len(h))
+		c.state = xzChunk
+	case xzChunk:
+		return c.nextChunk()
+	case xzBlockEnd:
+		_, err := c.take(int(-c.blockSize&3) + c.checkSize)
+		if err != nil {
+			return err
+		}
+		c.state = xzBlockOrIndex
+	case xzIndexRecords:
+		_, n, err := c.takeVarint()
+		if err != nil {
+			return err
+		}
+		c.indexSize += int64(n)
+		c.records--
+		if c.records == 0 {
+			c.state = xzIndexEnd
+		}
+	case xzIndexEnd:
+		// padding, the index's CRC32, then the stream footer
+		_, err := c.take(int(-c.indexSize&3) + 4 + xzStreamHeaderSize)
+		if err != nil {
+			return err
+		}
+		c.state = xzStreamPadding
+	case xzStreamPadding:
+		b, err := c.r.Peek(1)
+		if err == io.EOF { //nolint:errorlint // io.EOF is never wrapped
+			return io.EOF
+		} else if err != nil {
+			return errors.AddStack(err)
+		}
+		if b[0] != 0 {
+			c.state = xzStreamHeader
+			return nil
+		}
+		_, err = c.take(4)
+		return err
+	}
+	return nil
+}
+
+func (c *xzDictChecker) startIndex() error {
+	_, err := c.take(1)
+	if err != nil {
+		return err
+	}
+	count, n, err := c.takeVarint()
+	if err != nil {
+		return err
+	}
+	c.indexSize = int64(1 + n)
+	// each record is an unpadded size and an uncompressed size
+	c.records = 2 * count
+	if c.records == 0 {
+		c.state = xzIndexEnd
+	} else {
+		c.state = xzIndexRecords
+	}
+	return nil
+}
+
+func (c *xzDictChecker) checkBlockHeader(h []byte) error {
+	// size, flags, then the fields and filters, padding and a CRC32
+	fields := bytes.NewReader(h[2 : len(h)-4])
+	flags := h[1]
+	if flags&0x40 != 0 {
+		_, err := binary.ReadUvarint(fields)
+		if err != nil {
+			return errors.Annotate(err, "xz: reading block header")
+		}
+	}
+	if flags&0x80 != 0 {
+		_, err := binary.ReadUvarint(fields)
+		if err != nil {
+			return errors.Annotate(err, "xz: reading block header")
+		}
+	}
+	for range int(flags&0x03) + 1 {
+		id, err := binary.ReadUvarint(fields)
+		if err != nil {
+			return errors.Annotate(err, "xz: reading block header")
+		}
+		size, err := binary.ReadUvarint(fields)
+		if err != nil {
+			return errors.Annotate(err, "xz: reading block header")
+		}
+		if size > uint64(fields.Len()) {
+			return errors.New("xz: filter properties overrun the block header")
+		}
+		props := make([]byte, size)
+		_, _ = fields.Read(props)
+		if id != xzLZMA2FilterID || size != 1 {
+			// the decoder only knows LZMA2, and will refuse anything else itself
+			continue
+		}
+		dict, err := lzma.DecodeDictCap(props[0])
+		if err != nil {
+			return errors.Annotate(err, "xz: reading block header")
+		}
+		if c.maxDict > 0 && dict > c.maxDict {
+			return errors.Annotatef(ErrLimitExceeded,
+				"xz dictionary is %d bytes, more than the %d allowed", dict, c.maxDict)
+		}
+	}
+	return nil
+}
+
+// nextChunk passes through one LZMA2 chunk; the chunk headers are the only way to find where
+// a block without a compressed size in its header ends.
+func (c *xzDictChecker) nextChunk() error {
+	ctl, err := c.take(1)
+	if err != nil {
+		return err
+	}
+	c.blockSize++
+	var size int
+	switch control := ctl[0]; {
+	case control == 0x00:
+		c.state = xzBlockEnd
+		return nil
+	case control == 0x01 || control == 0x02:
+		// uncompressed, with a 16-bit size
+		h, err := c.take(2)
+		if err != nil {
+			return err
+		}
+		c.blockSize += 2
+		size = int(binary.BigEndian.Uint16(h)) + 1
+	case control >= 0x80:
+		// LZMA, with the rest of the unpacked size and a 16-bit packed size,
+		// and new properties if it resets the state
+		hdrLen := 4
+		if control&0x60 >= 0x40 {
+			hdrLen++
+		}
+		h, err := c.take(hdrLen)
+		if err != nil {
+			return err
+		}
+		c.blockSize += int64(hdrLen)
+		size = int(binary.BigEndian.Uint16(h[2:4])) + 1
+	default:
+		return errors.Errorf("xz: invalid LZMA2 chunk control byte %#x", control)
+	}
+	_, err = c.take(size)
+	if err != nil {
+		return err
+	}
+	c.blockSize += int64(size)
+	return nil
+}
@@ -0,0 +1,94 @@
+// Package kual converts KUAL extensions, as most Kindle homebrew is distributed, into packages.
+package kual
+
+import (
+	"encoding/xml"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/clintharrison/go-kindle-pkg/pkg/repository/manifest"
+	"github.com/pingcap/errors"
+)
+
+// ConfigFileName is the file that makes a directory under extensions/ a KUAL extension.
+const ConfigFileName = "config.xml"
+
+// Config is the <information> from an extension's config.xml, e.g.
+//
+//	<extension>
+//	  <information>
+//	    <name>kterm</name>
+//	    <version>2.6</version>
+//	    <author>bfabiszewski</author>
+//	    <id>kterm</id>
+//	  </information>
+//	  <menus><menu type="json">menu.json</menu></menus>
+//	</extension>
+type Config struct {
+	Name    string `xml:"information>name"`
+	Version string `xml:"information>version"`
+	Author  string `xml:"information>author"`
+	ID      string `xml:"information>id"`
+}
+
+func ParseConfig(r io.Reader) (*Config, error) {
+	c := &Config{Name: "", Version: "", Author: "", ID: ""}
+	err := xml.NewDecoder(r).Decode(c)
+	if err != nil {
+		return nil, errors.Wrap(err, "xml.Decode() to kual.Config")
+	}
+	c.Name = strings.TrimSpace(c.Name)
+	c.Version = strings.TrimSpace(c.Version)
+	c.Author = strings.TrimSpace(c.Author)
+	c.ID = strings.TrimSpace(c.ID)
+	return c, nil
+}
+
+// versionRegexp matches the numeric start of the versions extensions use, like "2.6", "v1.0.3"
+// or "1.2-beta".
+var versionRegexp = regexp.MustCompile(`^[vV]?(\d+)(?:\.(\d+))?(?:\.(\d+))?`) //nolint:gochecknoglobals
+
+// ParseVersion turns an extension's free-form version into a semantic version, ignoring any
+// components past the patch version and any suffix.
+func ParseVersion(v string) (*manifest.SemanticVersion, error) {
+	m := versionRegexp.FindStringSubmatch(v)
+	if m == nil {
+		return nil, errors.Errorf("version %q doesn't start with a number", v)
+	}
+	parts := make([]int, 3)
+	for i, s := range m[1:] {
+		if s == "" {
+			continue
+		}
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			return nil, errors.Errorf("version %q has an invalid component %q", v, s)
+		}
+		parts[i] = n
+	}
+	return &manifest.SemanticVersion{Major: parts[0], Minor: parts[1], Patch: parts[2]}, nil
+}
+
+// invalidIDChars are runs of anything but what package IDs are made of; see manifest.Validate.
+var invalidIDChars = regexp.MustCompile(`[^a-z.-]+`) //nolint:gochecknoglobals
+
+// PackageID derives a package ID from the first of the candidates that has any letters in it: an
+// extension's <id>, its <name>, then its directory name. IDs can only have lowercase letters, "-"
+// and ".", so digits are dropped and anything else becomes "-".
+func PackageID(candidates ...string) string {
+	for _, c := range candidates {
+		id := strings.Map(func(r rune) rune {
+			if r >= '0' && r <= '9' {
+				return -1
+			}
+			return r
+		}, strings.ToLower(c))
+		id = strings.Trim(invalidIDChars.ReplaceAllString(id, "-"), "-.")
+		if id != "" {
+			return id
+		}
+	}
+	return ""
+}
@@ -0,0 +1,349 @@
+package kual
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"maps"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/clintharrison/go-kindle-pkg/pkg/kpkg"
+	"github.com/clintharrison/go-kindle-pkg/pkg/repository/manifest"
+	"github.com/clintharrison/go-kindle-pkg/pkg/version"
+	"github.com/pingcap/errors"
+)
+
+type ExportOption func(*exportOptions)
+
+type exportOptions struct {
+	arch string
+}
+
+// WithArch exports a multi-architecture package's files for arch, as kpmgo would install them on
+// such a device.
+func WithArch(arch string) ExportOption {
+	return func(o *exportOptions) {
+		o.arch = arch
+	}
+}
+
+// ExportExtensionDir is the directory name of the extension generated for a package ID.
+func ExportExtensionDir(id string) string {
+	return "kpm-" + id
+}
+
+// ExportZip writes a zip of k for copying onto a Kindle's userstore by hand, for devices without
+// kpmgo. It holds a KUAL extension, extensions/kpm-<id>/, whose menu runs the package's install.sh,
+// uninstall.sh and launch.sh with the environment kpmgo gives them. The package's files are in the
+// extension's pkg/ until it's installed, when they're moved to kpm/pkgs/<id>/ as kpmgo would have
+// installed them, so kpmgo only sees the package as installed once its install.sh has succeeded.
+func ExportZip(ctx context.Context, k *kpkg.KPKG, w io.Writer, optFuncs ...ExportOption) error {
+	opts := &exportOptions{arch: ""}
+	for _, o := range optFuncs {
+		o(opts)
+	}
+	m := k.Manifest
+	var extractOpts []kpkg.ExtractOption
+	if opts.arch != "" {
+		extractOpts = append(extractOpts, kpkg.WithArch(opts.arch))
+	} else {
+		archs, err := k.Archs()
+		if err != nil {
+			return errors.Wrapf(err, "reading %s", m.ID)
+		}
+		if len(archs) > 0 {
+			return errors.Errorf("%s has files for each of %s; pick an architecture", m.ID, strings.Join(archs, ", "))
+		}
+	}
+	if len(m.Dependencies) > 0 {
+		slog.Warn("dependencies aren't included in the zip, and must be installed separately",
+			"id", m.ID, "dependencies", slices.Sorted(maps.Keys(m.Dependencies)))
+	}
+
+	tmpDir, err := os.MkdirTemp("", "kpkg-export-")
+	if err != nil {
+		return errors.AddStack(err)
+	}
+	defer func() { _ = os.RemoveAll(tmpDir) }()
+	err = k.ExtractAll(ctx, tmpDir, false, nil, extractOpts...)
+	if err != nil {
+		return errors.Wrapf(err, "extracting %s", m.ID)
+	}
+	_, err = os.Stat(filepath.Join(tmpDir, "launch.sh"))
+	hasLaunch := err == nil
+
+	zw := zip.NewWriter(w)
+	extDir := path.Join("extensions", ExportExtensionDir(m.ID))
+	pkgDir := path.Join(extDir, exportPackageDir)
+	// the directories the package is in, which addTree won't add
+	for _, dir := range []string{"extensions", extDir} {
+		err := addFile(zw, dir+"/", nil, fs.ModeDir|0o755)
+		if err != nil {
+			return err
+		}
+	}
+	err = addTree(zw, tmpDir, pkgDir)
+	if err != nil {
+		return err
+	}
+	files, err := extensionFiles(m, hasLaunch)
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		err := addFile(zw, path.Join(extDir, f.name), f.data, f.mode)
+		if err != nil {
+			return err
+		}
+	}
+	err = zw.SetComment(exportInstructions(m, menuName(m)))
+	if err != nil {
+		return errors.AddStack(err)
+	}
+	return errors.AddStack(zw.Close())
+}
+
+// exportPackageDir is where the package's files are in the extension until it's installed.
+const exportPackageDir = "pkg"
+
+// exportBaseDir is kpmgo's base directory relative to the userstore, which is the zip's root.
+func exportBaseDir() string {
+	return strings.TrimPrefix(version.KindleBaseDir, version.KindleUserstoreDir+"/")
+}
+
+// addTree adds the files under dir to the zip under prefix. Symlinks are left out, as the
+// userstore's FAT filesystem can't hold them; install scripts that need them must make them.
+func addTree(zw *zip.Writer, dir, prefix string) error {
+	var skipped []string
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return errors.AddStack(err)
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return errors.AddStack(err)
+		}
+		name := path.Join(prefix, filepath.ToSlash(rel))
+		info, err := d.Info()
+		if err != nil {
+			return errors.AddStack(err)
+		}
+		switch {
+		case d.IsDir():
+			fh, err := zip.FileInfoHeader(info)
+			if err != nil {
+				return errors.AddStack(err)
+			}
+			fh.Name = name + "/"
+			if rel == "." {
+				// rather than the temporary directory's 0700
+				fh.SetMode(fs.ModeDir | 0o755)
+			}
+			_, err = zw.CreateHeader(fh)
+			return errors.AddStack(err)
+		case d.Type().IsRegular():
+			return addRegularFile(zw, p, name, info)
+		default:
+			skipped = append(skipped, rel)
+			return nil
+		}
+	})
+	if err != nil {
+		return errors.Annotatef(err, "adding %q to the zip", dir)
+	}
+	if len(skipped) > 0 {
+		slog.Warn("leaving out symlinks and special files, which the userstore can't hold",
+			"count", len(skipped), "first", skipped[0])
+	}
+	return nil
+}
+
+func addRegularFile(zw *zip.Writer, p, name string, info fs.FileInfo) error {
+	fh, err := zip.FileInfoHeader(info)
+	if err != nil {
+		return errors.AddStack(err)
+	}
+	fh.Name = name
+	fh.Method = zip.Deflate
+	out, err := zw.CreateHeader(fh)
+	if err != nil {
+		return errors.AddStack(err)
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		return errors.AddStack(err)
+	}
+	defer f.Close()
+	_, err = io.Copy(out, f)
+	return errors.Wrapf(err, "adding %q", name)
+}
+
+func addFile(zw *zip.Writer, name string, data []byte, mode os.FileMode) error {
+	fh := &zip.FileHeader{Name: name, Method: zip.Deflate, Modified: time.Now()} //nolint:exhaustruct
+	if mode.IsDir() {
+		fh.Method = zip.Store
+	}
+	fh.SetMode(mode)
+	out, err := zw.CreateHeader(fh)
+	if err != nil {
+		return errors.AddStack(err)
+	}
+	_, err = out.Write(data)
+	return errors.Wrapf(err, "adding %q", name)
+}
+
+type menuItem struct {
+	Name     string      `json:"name"`
+	Action   string      `json:"action,omitempty"`
+	Params   string      `json:"params,omitempty"`
+	ExitMenu bool        `json:"exitmenu"`
+	Internal string      `json:"internal,omitempty"`
+	Items    []*menuItem `json:"items,omitempty"`
+}
+
+type extensionFile struct {
+	name string
+	data []byte
+	mode os.FileMode
+}
+
+// extensionFiles generates the KUAL extension that stands in for kpmgo: a menu with the package's
+// actions, which all go through extension.sh.
+func extensionFiles(m *manifest.Manifest, hasLaunch bool) ([]extensionFile, error) {
+	name := menuName(m)
+	item := func(verb, param string, exit bool) *menuItem {
+		return &menuItem{
+			Name:     verb + " " + name,
+			Action:   "./extension.sh",
+			Params:   param,
+			ExitMenu: exit,
+			Internal: "status " + verb + "ing " + name + "...",
+			Items:    nil,
+		}
+	}
+	root := &menuItem{Name: name, Action: "", Params: "", ExitMenu: false, Internal: "", Items: nil}
+	if hasLaunch {
+		root.Items = append(root.Items, item("Launch", "launch", true))
+	}
+	root.Items = append(root.Items, item("Install", "install", false), item("Uninstall", "uninstall", false))
+	menu, err := json.MarshalIndent(map[string][]*menuItem{"items": {root}}, "", "    ")
+	if err != nil {
+		return nil, errors.AddStack(err)
+	}
+
+	config := fmt.Sprintf(`<?xml version="1.0" encoding="UTF-8"?>
+<extension>
+    <information>
+        <name>%s</name>
+        <version>%s</version>
+        <author>%s</author>
+        <id>%s</id>
+    </information>
+    <menus>
+        <menu type="json" dynamic="false">menu.json</menu>
+    </menus>
+</extension>
+`, xmlEscape(name), m.Version.String(), xmlEscape(m.Author), ExportExtensionDir(m.ID))
+
+	return []extensionFile{
+		{ConfigFileName, []byte(config), 0o644},
+		{"menu.json", append(menu, '\n'), 0o644},
+		{"extension.sh", []byte(extensionScript(m.ID)), 0o755},
+	}, nil
+}
+
+// menuName is what the package is called in KUAL's menu.
+func menuName(m *manifest.Manifest) string {
+	if m.Name != "" {
+		return m.Name
+	}
+	return m.ID
+}
+
+func xmlEscape(s string) string {
+	var b strings.Builder
+	_ = xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+// extensionScript runs the package's scripts as kpmgo's install, uninstall and launch would. The
+// userstore can be overridden with KPM_USERSTORE_DIR, so the script can be tried out off a Kindle.
+// FAT doesn't keep modes, so every script is run with /bin/sh. Installing moves the package into
+// place before running install.sh, as kpmgo does, and back into the extension if it fails.
+func extensionScript(id string) string {
+	return fmt.Sprintf(`#!/bin/sh
+# Generated by kpmgo export-zip.
+set -eu
+
+KPM_USERSTORE_DIR="${KPM_USERSTORE_DIR:-%s}"
+KPM_BASE_DIR="$KPM_USERSTORE_DIR/"%s
+KPM_INSTALL_DIR="$KPM_BASE_DIR/pkgs/"%s
+export KPM_USERSTORE_DIR KPM_BASE_DIR KPM_INSTALL_DIR
+ext_dir="$KPM_USERSTORE_DIR/extensions/"%s
+staged_dir="$ext_dir/"%s
+log="${TMPDIR:-/tmp}/"%s.log
+
+case "${1:-}" in
+install)
+	if [ -d "$staged_dir" ]; then
+		if [ -e "$KPM_INSTALL_DIR" ]; then
+			echo "$KPM_INSTALL_DIR already exists; uninstall it first" >&2
+			exit 1
+		fi
+		mkdir -p "$KPM_BASE_DIR/pkgs"
+		mv "$staged_dir" "$KPM_INSTALL_DIR"
+		cd "$KPM_INSTALL_DIR"
+		if [ -f ./install.sh ] && ! /bin/sh -l ./install.sh >>"$log" 2>&1; then
+			cd /
+			mv "$KPM_INSTALL_DIR" "$staged_dir"
+			exit 1
+		fi
+	else
+		cd "$KPM_INSTALL_DIR"
+		if [ -f ./install.sh ]; then
+			/bin/sh -l ./install.sh >>"$log" 2>&1
+		fi
+	fi
+	;;
+uninstall)
+	if [ -d "$KPM_INSTALL_DIR" ]; then
+		cd "$KPM_INSTALL_DIR"
+		if [ -f ./uninstall.sh ]; then
+			/bin/sh -l ./uninstall.sh >>"$log" 2>&1
+		fi
+	fi
+	cd /
+	rm -rf "$KPM_INSTALL_DIR" "$ext_dir"
+	;;
+launch)
+	cd "$KPM_INSTALL_DIR"
+	nohup /bin/sh -l ./launch.sh >>"$log" 2>&1 &
+	;;
+*)
+	echo "Unknown command: ${1:-}" >&2
+	exit 1
+	;;
+esac
+`, version.KindleUserstoreDir, shellQuote(exportBaseDir()), shellQuote(id), shellQuote(ExportExtensionDir(id)),
+		shellQuote(exportPackageDir), shellQuote(ExportExtensionDir(id)))
+}
+
+// exportInstructions is the zip's comment, which unzip and most archive managers show.
+func exportInstructions(m *manifest.Manifest, name string) string {
+	return fmt.Sprintf(`%s %s, exported by %s.
+
+To install it without kpmgo, connect the Kindle over USB and copy the extensions/
+directory in this zip to the root of the Kindle's drive. Then open KUAL on the
+Kindle, and pick "Install %s" from the %s menu.
+`, m.ID, m.Version.String(), version.FullVersion, name, name)
+}
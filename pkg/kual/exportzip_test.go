@@ -0,0 +1,163 @@
+package kual_test
+
+import (
+	"archive/zip"
+	"bytes"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/clintharrison/go-kindle-pkg/pkg/kpkg"
+	"github.com/clintharrison/go-kindle-pkg/pkg/kual"
+	"github.com/stretchr/testify/require"
+)
+
+func buildPackage(t *testing.T, files map[string]string) *kpkg.KPKG {
+	t.Helper()
+	dir := t.TempDir()
+	for name, content := range files {
+		p := filepath.Join(dir, name)
+		require.NoError(t, os.MkdirAll(filepath.Dir(p), 0o755))
+		require.NoError(t, os.WriteFile(p, []byte(content), 0o644)) //nolint:gosec
+	}
+	p := filepath.Join(t.TempDir(), "tool.kpkg")
+	require.NoError(t, kpkg.Build(t.Context(), dir, p, kpkg.WithSkipArchCheck()))
+	k, err := kpkg.Open(t.Context(), p)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = k.Close() })
+	return k
+}
+
+// unzip extracts the zip into dir, as copying it onto the userstore would.
+func unzip(t *testing.T, data []byte, dir string) []string {
+	t.Helper()
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	require.NoError(t, err)
+	var names []string
+	for _, f := range zr.File {
+		names = append(names, f.Name)
+		p := filepath.Join(dir, filepath.FromSlash(f.Name))
+		if f.FileInfo().IsDir() {
+			require.NoError(t, os.MkdirAll(p, 0o755))
+			continue
+		}
+		r, err := f.Open()
+		require.NoError(t, err)
+		content, err := io.ReadAll(r)
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(p, content, 0o644)) //nolint:gosec // FAT has no modes anyway
+	}
+	require.Contains(t, zr.Comment, `pick "Install Tool" from the Tool menu`)
+	return names
+}
+
+const envScript = `#!/bin/sh
+echo "$KPM_INSTALL_DIR $KPM_BASE_DIR $KPM_USERSTORE_DIR $(pwd)" >"$KPM_USERSTORE_DIR/%s"
+`
+
+func TestExportZip(t *testing.T) {
+	t.Parallel()
+	k := buildPackage(t, map[string]string{
+		"manifest.json": `{"id": "tool", "name": "Tool", "version": [1, 2, 3]}`,
+		"install.sh":    strings.Replace(envScript, "%s", "installed", 1),
+		"uninstall.sh":  strings.Replace(envScript, "%s", "uninstalled", 1),
+		"bin/tool":      "tool",
+	})
+	buf := &bytes.Buffer{}
+	require.NoError(t, kual.ExportZip(t.Context(), k, buf))
+
+	userstore := t.TempDir()
+	names := unzip(t, buf.Bytes(), userstore)
+	require.Contains(t, names, "extensions/kpm-tool/pkg/manifest.json")
+	require.Contains(t, names, "extensions/kpm-tool/pkg/bin/tool")
+	require.Contains(t, names, "extensions/kpm-tool/config.xml")
+	require.Contains(t, names, "extensions/kpm-tool/menu.json")
+	menu, err := os.ReadFile(filepath.Join(userstore, "extensions", "kpm-tool", "menu.json"))
+	require.NoError(t, err)
+	require.Contains(t, string(menu), `"name": "Install Tool"`)
+	require.NotContains(t, string(menu), "Launch")
+
+	// KUAL runs extension.sh from the extension's directory
+	extDir := filepath.Join(userstore, "extensions", "kpm-tool")
+	installDir := filepath.Join(userstore, "kpm", "pkgs", "tool")
+	// kpmgo mustn't see the package as installed until it is
+	require.NoDirExists(t, installDir)
+	run := func(action string) {
+		out, err := runExtension(t, extDir, userstore, action)
+		require.NoError(t, err, "%s: %s", action, out)
+	}
+	want := installDir + " " + filepath.Join(userstore, "kpm") + " " + userstore + " " + installDir + "\n"
+	run("install")
+	data, err := os.ReadFile(filepath.Join(userstore, "installed"))
+	require.NoError(t, err)
+	require.Equal(t, want, string(data))
+	data, err = os.ReadFile(filepath.Join(installDir, "bin", "tool"))
+	require.NoError(t, err)
+	require.Equal(t, "tool", string(data))
+	require.NoDirExists(t, filepath.Join(extDir, "pkg"))
+
+	run("uninstall")
+	data, err = os.ReadFile(filepath.Join(userstore, "uninstalled"))
+	require.NoError(t, err)
+	require.Equal(t, want, string(data))
+	require.NoDirExists(t, installDir)
+	require.NoDirExists(t, extDir)
+}
+
+// runExtension runs the extension's script as KUAL would, from the extension's directory.
+func runExtension(t *testing.T, extDir, userstore, action string) (string, error) {
+	t.Helper()
+	cmd := exec.CommandContext(t.Context(), "/bin/sh", "./extension.sh", action)
+	cmd.Dir = extDir
+	cmd.Env = append(os.Environ(), "KPM_USERSTORE_DIR="+userstore, "TMPDIR="+t.TempDir())
+	out, err := cmd.CombinedOutput()
+	return string(out), err
+}
+
+func TestExportZip_InstallFails(t *testing.T) {
+	t.Parallel()
+	k := buildPackage(t, map[string]string{
+		"manifest.json": `{"id": "tool", "name": "Tool", "version": [1, 2, 3]}`,
+		"install.sh":    "#!/bin/sh\nexit 1\n",
+		"bin/tool":      "tool",
+	})
+	buf := &bytes.Buffer{}
+	require.NoError(t, kual.ExportZip(t.Context(), k, buf))
+	userstore := t.TempDir()
+	unzip(t, buf.Bytes(), userstore)
+
+	// the package is put back in the extension, so kpmgo doesn't take it as installed
+	extDir := filepath.Join(userstore, "extensions", "kpm-tool")
+	_, err := runExtension(t, extDir, userstore, "install")
+	require.Error(t, err)
+	require.NoDirExists(t, filepath.Join(userstore, "kpm", "pkgs", "tool"))
+	require.FileExists(t, filepath.Join(extDir, "pkg", "bin", "tool"))
+}
+
+func TestExportZip_MultiArch(t *testing.T) {
+	t.Parallel()
+	k := buildPackage(t, map[string]string{
+		"manifest.json":       `{"id": "tool", "name": "Tool", "version": [1, 2, 3]}`,
+		"common/launch.sh":    "#!/bin/sh\n",
+		"arch/armhf/bin/tool": "armhf",
+		"arch/armel/bin/tool": "armel",
+	})
+	err := kual.ExportZip(t.Context(), k, io.Discard)
+	require.ErrorContains(t, err, "pick an architecture")
+
+	buf := &bytes.Buffer{}
+	require.NoError(t, kual.ExportZip(t.Context(), k, buf, kual.WithArch(kpkg.ArchArmhf)))
+	userstore := t.TempDir()
+	names := unzip(t, buf.Bytes(), userstore)
+	require.Contains(t, names, "extensions/kpm-tool/pkg/launch.sh")
+	require.NotContains(t, names, "extensions/kpm-tool/pkg/arch/armel/bin/tool")
+	data, err := os.ReadFile(filepath.Join(userstore, "extensions", "kpm-tool", "pkg", "bin", "tool"))
+	require.NoError(t, err)
+	require.Equal(t, "armhf", string(data))
+	menu, err := os.ReadFile(filepath.Join(userstore, "extensions", "kpm-tool", "menu.json"))
+	require.NoError(t, err)
+	require.Contains(t, string(menu), `"name": "Launch Tool"`)
+}
@@ -0,0 +1,317 @@
+package kual
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/clintharrison/go-kindle-pkg/pkg/kpkg"
+	"github.com/clintharrison/go-kindle-pkg/pkg/repository/manifest"
+	"github.com/pingcap/errors"
+)
+
+// ExtensionDir is where an imported package keeps the extension; install.sh copies it from there
+// into the userstore's extensions directory, where KUAL looks for it.
+const ExtensionDir = "extension"
+
+type ImportOption func(*importOptions)
+
+type importOptions struct {
+	id        string
+	version   *manifest.SemanticVersion
+	extension string
+	buildOpts []kpkg.BuildOption
+}
+
+// WithID sets the package ID, instead of deriving it from config.xml.
+func WithID(id string) ImportOption {
+	return func(o *importOptions) {
+		o.id = id
+	}
+}
+
+// WithVersion sets the package version, instead of parsing config.xml's.
+func WithVersion(v manifest.SemanticVersion) ImportOption {
+	return func(o *importOptions) {
+		o.version = &v
+	}
+}
+
+// WithExtension picks which extension to import, by directory name, from a zip with several.
+func WithExtension(name string) ImportOption {
+	return func(o *importOptions) {
+		o.extension = name
+	}
+}
+
+// WithBuildOptions passes options on to kpkg.Build.
+func WithBuildOptions(buildOpts ...kpkg.BuildOption) ImportOption {
+	return func(o *importOptions) {
+		o.buildOpts = append(o.buildOpts, buildOpts...)
+	}
+}
+
+// extension is where an extension is in a zip.
+type extension struct {
+	// dir is the extension's directory name, as it goes under extensions/
+	dir string
+	// prefix is the directory's path in the zip, with a trailing slash
+	prefix string
+}
+
+// ImportZip converts a zip with a KUAL extension, at extensions/<name>/ or just <name>/, into a
+// package at output. The manifest is generated from config.xml, and install.sh and uninstall.sh
+// put the extension in, and remove it from, the userstore's extensions directory. Anything else
+// in the zip is left out.
+func ImportZip(ctx context.Context, zipPath, output string, optFuncs ...ImportOption) (*manifest.Manifest, error) {
+	opts := &importOptions{id: "", version: nil, extension: "", buildOpts: nil}
+	for _, o := range optFuncs {
+		o(opts)
+	}
+
+	zr, err := zip.OpenReader(zipPath)
+	if err != nil {
+		return nil, errors.Wrapf(err, "zip.OpenReader(%q)", zipPath)
+	}
+	defer zr.Close()
+
+	ext, err := findExtension(&zr.Reader, opts.extension)
+	if err != nil {
+		return nil, errors.Annotatef(err, "in %q", zipPath)
+	}
+	m, err := extensionManifest(&zr.Reader, ext, filepath.Base(zipPath), opts)
+	if err != nil {
+		return nil, errors.Annotatef(err, "in %q", zipPath)
+	}
+
+	tmpDir, err := os.MkdirTemp("", "kpkg-import-")
+	if err != nil {
+		return nil, errors.AddStack(err)
+	}
+	defer func() { _ = os.RemoveAll(tmpDir) }()
+
+	err = extractExtension(&zr.Reader, ext, filepath.Join(tmpDir, ExtensionDir, ext.dir))
+	if err != nil {
+		return nil, errors.Annotatef(err, "extracting %q", zipPath)
+	}
+	err = writePackageFiles(tmpDir, m, ext.dir)
+	if err != nil {
+		return nil, err
+	}
+	err = kpkg.Build(ctx, tmpDir, output, opts.buildOpts...)
+	if err != nil {
+		return nil, errors.Wrapf(err, "kpkg.Build() for %q", zipPath)
+	}
+	return m, nil
+}
+
+// findExtension finds the directory with a config.xml, or the one named want if it's set.
+func findExtension(zr *zip.Reader, want string) (*extension, error) {
+	var found []*extension
+	for _, f := range zr.File {
+		name := strings.TrimPrefix(f.Name, "./")
+		dir, file := path.Split(name)
+		if file != ConfigFileName || strings.Contains(name, "__MACOSX/") {
+			continue
+		}
+		parent, extDir := path.Split(strings.TrimSuffix(dir, "/"))
+		if parent == "" || path.Base(parent) == "extensions" {
+			found = append(found, &extension{dir: extDir, prefix: dir})
+		}
+	}
+
+	if want == "" && len(found) == 1 {
+		return found[0], nil
+	}
+	names := make([]string, 0, len(found))
+	for _, e := range found {
+		if e.dir == want {
+			return e, nil
+		}
+		names = append(names, e.dir)
+	}
+	switch {
+	case len(found) == 0:
+		return nil, errors.Errorf("no KUAL extension: no extensions/<name>/%s", ConfigFileName)
+	case want != "":
+		return nil, errors.Errorf("no extension %q, only %s", want, strings.Join(names, ", "))
+	default:
+		return nil, errors.Errorf("more than one extension, pick one of %s", strings.Join(names, ", "))
+	}
+}
+
+// extensionManifest generates the manifest from the extension's config.xml and the options.
+func extensionManifest(
+	zr *zip.Reader, ext *extension, zipName string, opts *importOptions,
+) (*manifest.Manifest, error) {
+	f, err := zr.Open(ext.prefix + ConfigFileName)
+	if err != nil {
+		return nil, errors.AddStack(err)
+	}
+	defer f.Close()
+	cfg, err := ParseConfig(f)
+	if err != nil {
+		return nil, errors.Annotatef(err, "parsing %s%s", ext.prefix, ConfigFileName)
+	}
+
+	m := &manifest.Manifest{
+		ID:            opts.id,
+		Name:          cfg.Name,
+		Author:        cfg.Author,
+		Description:   fmt.Sprintf("KUAL extension %s, imported from %s", ext.dir, zipName),
+		Version:       manifest.SemanticVersion{Major: 0, Minor: 0, Patch: 0},
+		SupportedArch: nil,
+		Dependencies:  nil,
+	}
+	if m.ID == "" {
+		m.ID = PackageID(cfg.ID, cfg.Name, ext.dir)
+	}
+	if m.Name == "" {
+		m.Name = ext.dir
+	}
+	if opts.version != nil {
+		m.Version = *opts.version
+	} else {
+		v, err := ParseVersion(cfg.Version)
+		if err != nil {
+			return nil, errors.Annotate(err, "set the package's version instead")
+		}
+		m.Version = *v
+	}
+	err = m.Validate()
+	if err != nil {
+		return nil, errors.AddStack(err)
+	}
+	return m, nil
+}
+
+// extractExtension writes the extension's files from the zip to dest. Files outside the extension
+// are skipped, along with symlinks, which the userstore's FAT filesystem couldn't hold anyway.
+func extractExtension(zr *zip.Reader, ext *extension, dest string) error {
+	var skipped []string
+	for _, f := range zr.File {
+		name := strings.TrimPrefix(f.Name, "./")
+		rel, ok := strings.CutPrefix(name, ext.prefix)
+		if !ok || f.Mode()&fs.ModeSymlink != 0 {
+			if !strings.HasSuffix(name, "/") {
+				skipped = append(skipped, name)
+			}
+			continue
+		}
+		if rel == "" {
+			continue
+		}
+		if !filepath.IsLocal(rel) {
+			return errors.Errorf("%q is outside the extension directory", f.Name)
+		}
+		target := filepath.Join(dest, filepath.FromSlash(rel))
+		if f.FileInfo().IsDir() {
+			err := os.MkdirAll(target, 0o755) //nolint:gosec
+			if err != nil {
+				return errors.AddStack(err)
+			}
+			continue
+		}
+		err := extractFile(f, target)
+		if err != nil {
+			return err
+		}
+	}
+	if len(skipped) > 0 {
+		slog.Warn("leaving out files that aren't in the extension directory",
+			"extension", ext.prefix, "count", len(skipped), "first", skipped[0])
+	}
+	return nil
+}
+
+func extractFile(f *zip.File, target string) error {
+	err := os.MkdirAll(filepath.Dir(target), 0o755) //nolint:gosec
+	if err != nil {
+		return errors.AddStack(err)
+	}
+	// zips made on Windows have no modes, and Build would pack 0000 as is
+	mode := f.Mode().Perm()
+	if mode == 0 {
+		mode = 0o644
+	}
+	r, err := f.Open()
+	if err != nil {
+		return errors.Wrapf(err, "opening %q", f.Name)
+	}
+	defer r.Close()
+	out, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, mode)
+	if err != nil {
+		return errors.AddStack(err)
+	}
+	_, err = io.Copy(out, r) //nolint:gosec // the zip is the user's own
+	cerr := out.Close()
+	if err == nil {
+		err = cerr
+	}
+	return errors.Wrapf(err, "extracting %q", f.Name)
+}
+
+func writePackageFiles(dir string, m *manifest.Manifest, extDir string) error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return errors.AddStack(err)
+	}
+	data = append(data, '\n')
+	files := []struct {
+		name string
+		data []byte
+		mode os.FileMode
+	}{
+		{"manifest.json", data, 0o644},
+		{"install.sh", []byte(installScript(extDir)), 0o755},
+		{"uninstall.sh", []byte(uninstallScript(extDir)), 0o755},
+	}
+	for _, f := range files {
+		p := filepath.Join(dir, f.name)
+		err := os.WriteFile(p, f.data, f.mode)
+		if err != nil {
+			return errors.Wrapf(err, "os.WriteFile(%q)", p)
+		}
+	}
+	return nil
+}
+
+// The scripts are run by kpmgo with KPM_USERSTORE_DIR set; /mnt/us is the userstore on a Kindle.
+const scriptPreamble = `#!/bin/sh
+# Generated by kpmgo import-zip.
+set -e
+dest="${KPM_USERSTORE_DIR:-/mnt/us}/extensions/"%s
+`
+
+func installScript(extDir string) string {
+	return fmt.Sprintf(scriptPreamble, shellQuote(extDir)) + fmt.Sprintf(`rm -rf "$dest"
+mkdir -p "$(dirname "$dest")"
+cp -R "${KPM_INSTALL_DIR:-.}/%s/"%s "$dest"
+echo "Installed the KUAL extension to $dest"
+`, ExtensionDir, shellQuote(extDir))
+}
+
+func uninstallScript(extDir string) string {
+	return fmt.Sprintf(scriptPreamble, shellQuote(extDir)) + `rm -rf "$dest"
+echo "Removed the KUAL extension from $dest"
+`
+}
+
+// shellQuote quotes s for sh, so extension directories can be named anything.
+func shellQuote(s string) string {
+	if s != "" && !slices.ContainsFunc([]rune(s), func(r rune) bool {
+		return !strings.ContainsRune("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789._-", r)
+	}) {
+		return s
+	}
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
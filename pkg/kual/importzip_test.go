@@ -0,0 +1,167 @@
+package kual_test
+
+import (
+	"archive/zip"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/clintharrison/go-kindle-pkg/pkg/kpkg"
+	"github.com/clintharrison/go-kindle-pkg/pkg/kual"
+	"github.com/clintharrison/go-kindle-pkg/pkg/repository/manifest"
+	"github.com/stretchr/testify/require"
+)
+
+const ktermConfig = `<?xml version="1.0" encoding="UTF-8"?>
+<extension>
+    <information>
+        <name>kterm</name>
+        <version>2.6-beta</version>
+        <author>bfabiszewski</author>
+        <id>kterm64</id>
+    </information>
+    <menus>
+        <menu type="json" dynamic="false">menu.json</menu>
+    </menus>
+</extension>
+`
+
+func writeZip(t *testing.T, files map[string]string) string {
+	t.Helper()
+	p := filepath.Join(t.TempDir(), "kterm-2.6.zip")
+	f, err := os.Create(p)
+	require.NoError(t, err)
+	zw := zip.NewWriter(f)
+	for name, content := range files {
+		fh := &zip.FileHeader{Name: name, Method: zip.Deflate} //nolint:exhaustruct
+		mode := os.FileMode(0o644)
+		if strings.HasSuffix(name, ".sh") {
+			mode = 0o755
+		}
+		fh.SetMode(mode)
+		w, err := zw.CreateHeader(fh)
+		require.NoError(t, err)
+		_, err = w.Write([]byte(content))
+		require.NoError(t, err)
+	}
+	require.NoError(t, zw.Close())
+	require.NoError(t, f.Close())
+	return p
+}
+
+func TestImportZip(t *testing.T) {
+	t.Parallel()
+	zipPath := writeZip(t, map[string]string{
+		"extensions/kterm/config.xml":   ktermConfig,
+		"extensions/kterm/menu.json":    `{"items": []}`,
+		"extensions/kterm/bin/kterm.sh": "#!/bin/sh\necho kterm\n",
+		"README.txt":                    "not part of the extension",
+	})
+	output := filepath.Join(t.TempDir(), "kterm.kpkg")
+
+	m, err := kual.ImportZip(t.Context(), zipPath, output)
+	require.NoError(t, err)
+	require.Equal(t, "kterm", m.ID)
+	require.Equal(t, "kterm", m.Name)
+	require.Equal(t, "bfabiszewski", m.Author)
+	require.Equal(t, manifest.SemanticVersion{Major: 2, Minor: 6, Patch: 0}, m.Version)
+
+	k, err := kpkg.Open(t.Context(), output)
+	require.NoError(t, err)
+	defer func() { _ = k.Close() }()
+	require.Equal(t, m.ID, k.Manifest.ID)
+	installDir := t.TempDir()
+	require.NoError(t, k.ExtractAll(t.Context(), installDir, false, nil))
+	require.FileExists(t, filepath.Join(installDir, "extension", "kterm", "config.xml"))
+	require.NoFileExists(t, filepath.Join(installDir, "README.txt"))
+
+	// the scripts put the extension in the userstore, and take it out again
+	userstore := t.TempDir()
+	run := func(script string) {
+		cmd := exec.CommandContext(t.Context(), "/bin/sh", filepath.Join(installDir, script))
+		cmd.Dir = installDir
+		cmd.Env = append(os.Environ(), "KPM_INSTALL_DIR="+installDir, "KPM_USERSTORE_DIR="+userstore)
+		out, err := cmd.CombinedOutput()
+		require.NoError(t, err, "%s: %s", script, out)
+	}
+	run("install.sh")
+	data, err := os.ReadFile(filepath.Join(userstore, "extensions", "kterm", "bin", "kterm.sh"))
+	require.NoError(t, err)
+	require.Equal(t, "#!/bin/sh\necho kterm\n", string(data))
+	run("install.sh")
+	run("uninstall.sh")
+	require.NoDirExists(t, filepath.Join(userstore, "extensions", "kterm"))
+}
+
+func TestImportZip_Errors(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name  string
+		files map[string]string
+		opts  []kual.ImportOption
+		want  string
+	}{
+		{
+			name:  "no extension",
+			files: map[string]string{"README.txt": ""},
+			opts:  nil,
+			want:  "no KUAL extension",
+		},
+		{
+			name: "several extensions",
+			files: map[string]string{
+				"extensions/a/config.xml": ktermConfig,
+				"extensions/b/config.xml": ktermConfig,
+			},
+			opts: nil,
+			want: "more than one extension",
+		},
+		{
+			name: "unparseable version",
+			files: map[string]string{
+				"extensions/a/config.xml": strings.Replace(ktermConfig, "2.6-beta", "beta", 1),
+			},
+			opts: nil,
+			want: "set the package's version instead",
+		},
+		{
+			name: "escaping path",
+			files: map[string]string{
+				"extensions/a/config.xml":    ktermConfig,
+				"extensions/a/../../evil.sh": "",
+			},
+			opts: nil,
+			want: "outside the extension directory",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			zipPath := writeZip(t, tt.files)
+			_, err := kual.ImportZip(t.Context(), zipPath, filepath.Join(t.TempDir(), "out.kpkg"), tt.opts...)
+			require.ErrorContains(t, err, tt.want)
+		})
+	}
+
+	// --extension picks one of several, and --version stands in for an unparseable one
+	zipPath := writeZip(t, map[string]string{
+		"extensions/a/config.xml": ktermConfig,
+		"extensions/b/config.xml": strings.Replace(ktermConfig, "2.6-beta", "beta", 1),
+	})
+	m, err := kual.ImportZip(t.Context(), zipPath, filepath.Join(t.TempDir(), "out.kpkg"),
+		kual.WithExtension("b"), kual.WithVersion(manifest.SemanticVersion{Major: 1, Minor: 0, Patch: 0}),
+		kual.WithID("b"))
+	require.NoError(t, err)
+	require.Equal(t, "b", m.ID)
+	require.Equal(t, "1.0.0", m.Version.String())
+}
+
+func TestPackageID(t *testing.T) {
+	t.Parallel()
+	require.Equal(t, "net.clint.kpmgo", kual.PackageID("net.clint64.kpmgo"))
+	require.Equal(t, "my-extension", kual.PackageID("", "My Extension"))
+	require.Equal(t, "kterm", kual.PackageID("123", "", "kterm"))
+	require.Empty(t, kual.PackageID("42"))
+}
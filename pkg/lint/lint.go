@@ -0,0 +1,383 @@
+// Package lint checks package directories and .kpkg files for mistakes that only show up once a
+// package is on a device: scripts that /bin/sh can't run, binaries that can't be executed, names
+// that the FAT userstore can't hold, and so on.
+package lint
+
+import (
+	"archive/tar"
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+	"slices"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/clintharrison/go-kindle-pkg/pkg/kpkg"
+	"github.com/clintharrison/go-kindle-pkg/pkg/repository/manifest"
+	"github.com/clintharrison/go-kindle-pkg/pkg/resolver"
+	"github.com/pingcap/errors"
+)
+
+type Severity string
+
+const (
+	// SeverityError is for packages that won't install or work as intended.
+	SeverityError Severity = "error"
+	// SeverityWarning is for packages that probably have a mistake in them.
+	SeverityWarning Severity = "warning"
+)
+
+// Rule IDs, which are stable so that findings can be filtered by them.
+const (
+	RuleManifestMissing        = "manifest-missing"
+	RuleManifestInvalid        = "manifest-invalid"
+	RuleUnaddressableID        = "unaddressable-id"
+	RuleInstallScriptMissing   = "install-script-missing"
+	RuleUninstallScriptMissing = "uninstall-script-missing"
+	RuleScriptNotSh            = "script-not-sh"
+	RuleScriptBashism          = "script-bashism"
+	RuleScriptCRLF             = "script-crlf"
+	RuleUndeclaredDependency   = "undeclared-dependency"
+	RuleBinaryNotExecutable    = "binary-not-executable"
+	RuleFATInvalidName         = "fat-invalid-name"
+	RuleFATCaseCollision       = "fat-case-collision"
+	RuleUnsafePath             = "unsafe-path"
+	RuleSuspiciousPath         = "suspicious-path"
+)
+
+type Rule struct {
+	ID       string   `json:"id"`
+	Severity Severity `json:"severity"`
+	Summary  string   `json:"summary"`
+}
+
+//nolint:gochecknoglobals
+var rules = []Rule{
+	{RuleManifestMissing, SeverityError, "manifest.json is missing"},
+	{RuleManifestInvalid, SeverityError, "manifest.json doesn't parse, or doesn't validate"},
+	{RuleUnaddressableID, SeverityError, "a package or dependency ID can't be named on the command line"},
+	{RuleInstallScriptMissing, SeverityWarning, "install.sh is missing"},
+	{RuleUninstallScriptMissing, SeverityError, "uninstall.sh is missing, so uninstalling will fail"},
+	{RuleScriptNotSh, SeverityError, "a script asks for an interpreter the Kindle doesn't have, or isn't run with"},
+	{RuleScriptBashism, SeverityWarning, "a script run with /bin/sh uses a bash-only feature"},
+	{RuleScriptCRLF, SeverityError, "a script has CRLF line endings"},
+	{RuleUndeclaredDependency, SeverityWarning, "launch.sh uses another package that isn't a dependency"},
+	{RuleBinaryNotExecutable, SeverityError, "an ELF binary isn't executable"},
+	{RuleFATInvalidName, SeverityError, "a name has characters FAT doesn't allow"},
+	{RuleFATCaseCollision, SeverityError, "two names differ only in case, which FAT doesn't distinguish"},
+	{RuleUnsafePath, SeverityError, "an entry would be refused on extraction"},
+	{RuleSuspiciousPath, SeverityWarning, "a file that probably wasn't meant to be packed"},
+}
+
+// Rules returns every rule, in the order they are checked.
+func Rules() []Rule {
+	return slices.Clone(rules)
+}
+
+func severityOf(ruleID string) Severity {
+	for _, r := range rules {
+		if r.ID == ruleID {
+			return r.Severity
+		}
+	}
+	panic("unknown lint rule " + ruleID)
+}
+
+// Finding is one problem in a package. Path is as stored in the package, and Line counts from 1;
+// either is omitted when it doesn't apply.
+type Finding struct {
+	Rule     string   `json:"rule"`
+	Severity Severity `json:"severity"`
+	Path     string   `json:"path,omitempty"`
+	Line     int      `json:"line,omitempty"`
+	Message  string   `json:"message"`
+}
+
+func (f Finding) String() string {
+	loc := f.Path
+	if f.Line > 0 {
+		loc = fmt.Sprintf("%s:%d", f.Path, f.Line)
+	}
+	if loc == "" {
+		return fmt.Sprintf("%s [%s] %s", f.Severity, f.Rule, f.Message)
+	}
+	return fmt.Sprintf("%s [%s] %s: %s", f.Severity, f.Rule, loc, f.Message)
+}
+
+// HasErrors reports whether any of the findings is an error.
+func HasErrors(findings []Finding) bool {
+	return slices.ContainsFunc(findings, func(f Finding) bool { return f.Severity == SeverityError })
+}
+
+// Dir lints the package that kpkg.Build would make from the directory at rootPath.
+func Dir(ctx context.Context, rootPath string) ([]Finding, error) {
+	l := newLinter()
+	err := kpkg.WalkBuildDir(ctx, rootPath, l.add)
+	if err != nil {
+		return nil, errors.Annotatef(err, "reading package directory %q", rootPath)
+	}
+	return l.run(), nil
+}
+
+// Package lints a .kpkg file, every entry as it is stored.
+func Package(ctx context.Context, k *kpkg.KPKG) ([]Finding, error) {
+	l := newLinter()
+	err := k.Walk(ctx, l.add)
+	if err != nil {
+		return nil, errors.Annotate(err, "reading package")
+	}
+	return l.run(), nil
+}
+
+const (
+	// headSize is how much of every file is read, to recognize scripts and binaries
+	headSize = 512
+	// maxScriptSize is how much of a script is read to check it; nobody writes longer ones by hand
+	maxScriptSize = 1 << 20
+)
+
+type entry struct {
+	header *tar.Header
+	// path is the cleaned path in the package, "." for the root
+	path string
+	// data is the whole of manifest.json and scripts, and the start of other files
+	data []byte
+}
+
+func (e *entry) isScript() bool {
+	return e.header.Typeflag == tar.TypeReg &&
+		(strings.HasSuffix(e.path, ".sh") || bytes.HasPrefix(e.data, []byte("#!")))
+}
+
+func (e *entry) isELF() bool {
+	return e.header.Typeflag == tar.TypeReg && bytes.HasPrefix(e.data, []byte("\x7fELF"))
+}
+
+type linter struct {
+	entries  []*entry
+	findings []Finding
+}
+
+func newLinter() *linter {
+	return &linter{entries: nil, findings: nil}
+}
+
+func (l *linter) add(h *tar.Header, r io.Reader) error {
+	e := &entry{header: h, path: path.Clean(strings.TrimPrefix(h.Name, "/")), data: nil}
+	if h.Typeflag == tar.TypeReg {
+		var err error
+		e.data, err = io.ReadAll(io.LimitReader(r, headSize))
+		if err != nil {
+			return errors.Wrapf(err, "reading %q", h.Name)
+		}
+		if e.path == "manifest.json" || e.isScript() {
+			rest, err := io.ReadAll(io.LimitReader(r, maxScriptSize-headSize))
+			if err != nil {
+				return errors.Wrapf(err, "reading %q", h.Name)
+			}
+			e.data = append(e.data, rest...)
+		}
+	}
+	l.entries = append(l.entries, e)
+	return nil
+}
+
+func (l *linter) report(ruleID, p string, line int, format string, args ...any) {
+	l.findings = append(l.findings, Finding{
+		Rule:     ruleID,
+		Severity: severityOf(ruleID),
+		Path:     p,
+		Line:     line,
+		Message:  fmt.Sprintf(format, args...),
+	})
+}
+
+// run checks everything, and returns the findings sorted by path.
+func (l *linter) run() []Finding {
+	m := l.checkManifest()
+	for _, e := range l.entries {
+		l.checkPath(e)
+		if e.isELF() && e.header.Mode&0o111 == 0 {
+			l.report(RuleBinaryNotExecutable, e.path, 0, "ELF binary has mode %04o, so it can't be run", e.header.Mode&0o7777)
+		}
+		if e.isScript() {
+			l.checkScript(e)
+		}
+	}
+	for _, v := range l.views() {
+		l.checkInstalled(v, m)
+	}
+
+	slices.SortFunc(l.findings, func(a, b Finding) int {
+		return cmp.Or(
+			strings.Compare(a.Path, b.Path), cmp.Compare(a.Line, b.Line),
+			strings.Compare(a.Rule, b.Rule), strings.Compare(a.Message, b.Message))
+	})
+	// the same file can be checked for more than one architecture
+	return slices.Compact(l.findings)
+}
+
+// checkManifest reports problems with manifest.json, and returns it if it parses.
+func (l *linter) checkManifest() *manifest.Manifest {
+	i := slices.IndexFunc(l.entries, func(e *entry) bool { return e.path == "manifest.json" })
+	if i < 0 {
+		l.report(RuleManifestMissing, "", 0, "the package has no manifest.json")
+		return nil
+	}
+	e := l.entries[i]
+	if e.header.Typeflag != tar.TypeReg {
+		l.report(RuleManifestInvalid, e.path, 0, "manifest.json must be a regular file")
+		return nil
+	}
+	m := &manifest.Manifest{} //nolint:exhaustruct
+	err := json.Unmarshal(e.data, m)
+	if err != nil {
+		l.report(RuleManifestInvalid, e.path, 0, "%v", err)
+		return nil
+	}
+	for _, p := range m.Problems() {
+		l.report(RuleManifestInvalid, e.path, 0, "%s", p)
+	}
+
+	l.checkAddressable(e.path, "package id", m.ID)
+	for depID := range m.Dependencies {
+		l.checkAddressable(e.path, "dependency id", depID)
+	}
+	return m
+}
+
+// checkAddressable reports an ID that `kpmgo install <id>` wouldn't find.
+func (l *linter) checkAddressable(p, what, id string) {
+	if id == "" {
+		return
+	}
+	c, err := resolver.ParseConstraint(id)
+	if err != nil || string(c.ID) != id || c.Min != nil || c.Max != nil {
+		l.report(RuleUnaddressableID, p, 0, "%s %q can't be named as a constraint on the command line", what, id)
+	}
+}
+
+// fatInvalidChars are the characters FAT doesn't allow in names, besides control characters.
+const fatInvalidChars = `"*:<>?\|`
+
+// junkNames are files and directories left behind by tools, which nothing on a Kindle needs.
+//
+//nolint:gochecknoglobals
+var junkNames = []string{".git", ".svn", ".hg", "__MACOSX", ".DS_Store", "Thumbs.db", "desktop.ini"}
+
+// checkPath checks an entry's name and type, as stored.
+func (l *linter) checkPath(e *entry) {
+	err := kpkg.CheckEntry(e.header)
+	if ue, ok := kpkg.AsUnsafeEntryError(err); ok {
+		l.report(RuleUnsafePath, e.path, 0, "%s, so it won't be extracted", ue.Reason)
+		return
+	}
+	if e.path == "." {
+		return
+	}
+	dirs := strings.Split(path.Dir(e.path), "/")
+	if slices.ContainsFunc(dirs, func(d string) bool { return slices.Contains(junkNames, d) }) {
+		// only the top of a .git/ or the like is reported
+		return
+	}
+
+	switch e.header.Typeflag {
+	case tar.TypeReg, tar.TypeDir, tar.TypeSymlink, tar.TypeLink:
+	default:
+		l.report(RuleSuspiciousPath, e.path, 0, "entry of type %q is neither a file, a directory nor a link",
+			e.header.Typeflag)
+	}
+
+	base := path.Base(e.path)
+	switch {
+	case !utf8.ValidString(base):
+		l.report(RuleSuspiciousPath, e.path, 0, "name isn't valid UTF-8")
+	case base != strings.TrimSpace(base):
+		l.report(RuleSuspiciousPath, e.path, 0, "name starts or ends with whitespace")
+	case slices.Contains(junkNames, base) || strings.HasPrefix(base, "._"):
+		l.report(RuleSuspiciousPath, e.path, 0, "%q is left behind by other tools, and shouldn't be packed", base)
+	case strings.HasSuffix(base, "~") || strings.HasSuffix(base, ".swp") ||
+		strings.HasSuffix(base, ".orig") || strings.HasSuffix(base, ".rej"):
+		l.report(RuleSuspiciousPath, e.path, 0, "looks like a backup or leftover file")
+	}
+
+	if strings.ContainsAny(base, fatInvalidChars) || strings.ContainsFunc(base, func(r rune) bool { return r < 0x20 }) {
+		l.report(RuleFATInvalidName, e.path, 0,
+			"name can't be created on FAT, which doesn't allow control characters or any of %s", fatInvalidChars)
+	} else if strings.HasSuffix(base, ".") || strings.HasSuffix(base, " ") {
+		l.report(RuleFATInvalidName, e.path, 0, "name ends with %q, which FAT drops", base[len(base)-1:])
+	}
+}
+
+// view is the package as installed on one architecture, keyed by installed path.
+type view struct {
+	arch    string
+	entries map[string]*entry
+}
+
+// views returns the package as it is installed on each architecture it has a payload tree for,
+// or just as it is stored if it isn't a multi-architecture package.
+func (l *linter) views() []view {
+	var archs []string
+	for _, e := range l.entries {
+		if dir, arch := path.Split(e.path); dir == kpkg.ArchDir+"/" && e.header.Typeflag == tar.TypeDir {
+			archs = append(archs, arch)
+		}
+	}
+	if archs == nil {
+		v := view{arch: "", entries: map[string]*entry{}}
+		for _, e := range l.entries {
+			v.entries[e.path] = e
+		}
+		return []view{v}
+	}
+	vs := make([]view, 0, len(archs))
+	for _, arch := range archs {
+		v := view{arch: arch, entries: map[string]*entry{}}
+		for _, e := range l.entries {
+			if p, ok := kpkg.InstalledPath(e.path, arch); ok {
+				v.entries[p] = e
+			}
+		}
+		vs = append(vs, v)
+	}
+	return vs
+}
+
+// checkInstalled checks the package as installed: that its scripts are there, and that its
+// files can all be told apart on FAT.
+func (l *linter) checkInstalled(v view, m *manifest.Manifest) {
+	on := ""
+	if v.arch != "" {
+		on = " on " + v.arch
+	}
+	if _, ok := v.entries["install.sh"]; !ok {
+		l.report(RuleInstallScriptMissing, "install.sh", 0,
+			"no install.sh is installed%s; add one, even if it does nothing", on)
+	}
+	if _, ok := v.entries["uninstall.sh"]; !ok {
+		l.report(RuleUninstallScriptMissing, "uninstall.sh", 0,
+			"no uninstall.sh is installed%s, so it can't be uninstalled", on)
+	}
+	if launch, ok := v.entries["launch.sh"]; ok && m != nil && launch.isScript() {
+		l.checkLaunchDependencies(launch, m)
+	}
+
+	// each name is reported as colliding with the first of the names it folds to
+	first := map[string]string{}
+	for p := range v.entries {
+		f, ok := first[strings.ToLower(p)]
+		if !ok || p < f {
+			first[strings.ToLower(p)] = p
+		}
+	}
+	for p, e := range v.entries {
+		if first := first[strings.ToLower(p)]; first != p {
+			l.report(RuleFATCaseCollision, e.path, 0, "is installed%s as %q, which FAT can't tell apart from %q", on, p, first)
+		}
+	}
+}
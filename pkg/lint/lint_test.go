@@ -0,0 +1,151 @@
+package lint_test
+
+import (
+	"archive/tar"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/clintharrison/go-kindle-pkg/pkg/kpkg"
+	"github.com/clintharrison/go-kindle-pkg/pkg/lint"
+	"github.com/stretchr/testify/require"
+)
+
+const testManifest = `{"id": "tool", "name": "Tool", "version": [1, 0, 0], "dependencies": {"kterm": {}}}`
+
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		p := filepath.Join(dir, name)
+		require.NoError(t, os.MkdirAll(filepath.Dir(p), 0o755))
+		require.NoError(t, os.WriteFile(p, []byte(content), 0o644)) //nolint:gosec
+	}
+}
+
+// rulesByPath collects the findings as rule IDs by path, which is all most tests care about.
+func rulesByPath(findings []lint.Finding) map[string][]string {
+	m := map[string][]string{}
+	for _, f := range findings {
+		m[f.Path] = append(m[f.Path], f.Rule)
+	}
+	return m
+}
+
+func TestDir_Clean(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"manifest.json": testManifest,
+		"install.sh":    "#!/bin/sh\necho installing\n",
+		"uninstall.sh":  "#!/bin/sh\necho uninstalling\n",
+		"launch.sh":     "#!/bin/sh\n/mnt/us/extensions/kterm/bin/kterm -e \"$KPM_BASE_DIR/pkgs/tool/run.sh\"\n",
+		"bin/run.sh":    "#!/usr/bin/env sh\nx=${1:-default}\n[ \"$x\" = y ] && echo yes\n",
+	})
+
+	findings, err := lint.Dir(t.Context(), dir)
+	require.NoError(t, err)
+	require.Empty(t, findings)
+}
+
+func TestDir(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"manifest.json": `{"id": "Tool", "version": [1, 0, 0]}`,
+		"install.sh":    "#!/bin/bash\necho installing\n",
+		"launch.sh": "#!/bin/sh\r\n" +
+			"if [[ -n \"$1\" ]]; then source ./env; fi\r\n" +
+			"# [[ in a comment is fine\r\n" +
+			"/mnt/us/extensions/kterm/bin/kterm\r\n",
+		"bin/tool":        "\x7fELF not really",
+		"bin/helper.sh":   "#!/bin/zsh\necho hi\n",
+		"bin/script.py":   "#!/usr/bin/env python3\nprint('fine')\n",
+		"lib/a:b.so":      "",
+		"lib/README":      "",
+		"lib/readme":      "",
+		"notes.txt~":      "",
+		".DS_Store":       "",
+		".git/HEAD":       "ref: refs/heads/main\n",
+		".git/objects/ab": "",
+	})
+
+	findings, err := lint.Dir(t.Context(), dir)
+	require.NoError(t, err)
+	require.Equal(t, map[string][]string{
+		"manifest.json": {lint.RuleManifestInvalid, lint.RuleManifestInvalid, lint.RuleUnaddressableID},
+		"install.sh":    {lint.RuleScriptNotSh},
+		"uninstall.sh":  {lint.RuleUninstallScriptMissing},
+		"launch.sh": {
+			lint.RuleScriptCRLF, lint.RuleScriptBashism, lint.RuleScriptBashism, lint.RuleUndeclaredDependency,
+		},
+		"bin/tool":      {lint.RuleBinaryNotExecutable},
+		"bin/helper.sh": {lint.RuleScriptNotSh},
+		"lib/a:b.so":    {lint.RuleFATInvalidName},
+		"lib/readme":    {lint.RuleFATCaseCollision},
+		"notes.txt~":    {lint.RuleSuspiciousPath},
+		".DS_Store":     {lint.RuleSuspiciousPath},
+		".git":          {lint.RuleSuspiciousPath},
+	}, rulesByPath(findings))
+	require.True(t, lint.HasErrors(findings))
+
+	for _, f := range findings {
+		if f.Rule == lint.RuleUndeclaredDependency {
+			require.Equal(t, 4, f.Line)
+			require.Contains(t, f.Message, `"kterm"`)
+		}
+	}
+}
+
+func TestDir_MultiArch(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"manifest.json":             testManifest,
+		"common/install.sh":         "#!/bin/sh\n",
+		"arch/armhf/uninstall.sh":   "#!/bin/sh\n",
+		"arch/armel/uninstall.bash": "#!/bin/sh\n",
+	})
+
+	findings, err := lint.Dir(t.Context(), dir)
+	require.NoError(t, err)
+	require.Len(t, findings, 1)
+	require.Equal(t, lint.RuleUninstallScriptMissing, findings[0].Rule)
+	require.Contains(t, findings[0].Message, "armel")
+}
+
+func TestPackage(t *testing.T) {
+	t.Parallel()
+	p := filepath.Join(t.TempDir(), "raw.kpkg")
+	f, err := os.Create(p)
+	require.NoError(t, err)
+	tw := tar.NewWriter(f)
+	for _, e := range []struct {
+		h    tar.Header
+		data string
+	}{
+		{tar.Header{Typeflag: tar.TypeReg, Name: "manifest.json", Mode: 0o644}, testManifest}, //nolint:exhaustruct
+		{tar.Header{Typeflag: tar.TypeReg, Name: "install.sh", Mode: 0o755}, "#!/bin/sh\n"},   //nolint:exhaustruct
+		{tar.Header{Typeflag: tar.TypeReg, Name: "uninstall.sh", Mode: 0o755}, "#!/bin/sh\n"}, //nolint:exhaustruct
+		{tar.Header{Typeflag: tar.TypeReg, Name: "../escape", Mode: 0o644}, ""},               //nolint:exhaustruct
+		{tar.Header{Typeflag: tar.TypeSymlink, Name: "passwd", Linkname: "/etc/passwd"}, ""},  //nolint:exhaustruct
+		{tar.Header{Typeflag: tar.TypeFifo, Name: "fifo", Mode: 0o644}, ""},                   //nolint:exhaustruct
+	} {
+		e.h.Size = int64(len(e.data))
+		require.NoError(t, tw.WriteHeader(&e.h))
+		_, err := tw.Write([]byte(e.data))
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Close())
+	require.NoError(t, f.Close())
+
+	k, err := kpkg.Open(t.Context(), p)
+	require.NoError(t, err)
+	defer func() { _ = k.Close() }()
+	findings, err := lint.Package(t.Context(), k)
+	require.NoError(t, err)
+	require.Equal(t, map[string][]string{
+		"../escape": {lint.RuleUnsafePath},
+		"passwd":    {lint.RuleUnsafePath},
+		"fifo":      {lint.RuleSuspiciousPath},
+	}, rulesByPath(findings))
+}
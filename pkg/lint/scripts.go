@@ -0,0 +1,151 @@
+package lint
+
+import (
+	"bytes"
+	"path"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/clintharrison/go-kindle-pkg/pkg/kpkg"
+	"github.com/clintharrison/go-kindle-pkg/pkg/repository/manifest"
+)
+
+// entrypoints are the scripts kpmgo runs itself, always with /bin/sh whatever their #! line says.
+//
+//nolint:gochecknoglobals
+var entrypoints = []string{"install.sh", "uninstall.sh", "launch.sh"}
+
+// isEntrypoint reports whether p is one of the entrypoints, where it would be installed at the
+// package root.
+func isEntrypoint(p string) bool {
+	dir := path.Dir(p)
+	return slices.Contains(entrypoints, path.Base(p)) &&
+		(dir == "." || dir == kpkg.CommonDir || path.Dir(dir) == kpkg.ArchDir)
+}
+
+// posixShells can run POSIX sh scripts, and are on every Kindle: /bin/sh is BusyBox ash.
+//
+//nolint:gochecknoglobals
+var posixShells = []string{"sh", "ash"}
+
+// otherShells are shells a script might ask for that Kindles don't have.
+//
+//nolint:gochecknoglobals
+var otherShells = []string{"bash", "zsh", "ksh", "mksh", "fish", "csh", "tcsh"}
+
+type bashism struct {
+	re   *regexp.Regexp
+	what string
+}
+
+// bashisms are the bash features most often used by mistake in sh scripts. Lines are matched
+// without their comments, so these are heuristics: a match inside a string is still reported.
+//
+//nolint:gochecknoglobals
+var bashisms = []bashism{
+	{regexp.MustCompile(`\[\[`), "[[ ]] tests"},
+	{regexp.MustCompile(`^\s*function\s+\w+`), "the function keyword"},
+	{regexp.MustCompile(`(^|[;&|]|\bthen|\bdo|\belse)\s*source\s`), "source, instead of ."},
+	{regexp.MustCompile(`<<<`), "here-strings"},
+	{regexp.MustCompile(`&>`), "&> redirection, instead of >file 2>&1"},
+	{regexp.MustCompile(`(^|[\s;])\w+=\(`), "arrays"},
+	{regexp.MustCompile(`\$\{\w+:(\d| +-?\d)`), "substring expansion"},
+	{regexp.MustCompile(`\[\s[^]]*\s==\s`), "== in [ ], instead of ="},
+}
+
+// checkScript checks a script's line endings and interpreter, and for scripts run by /bin/sh,
+// that it doesn't use bash features.
+func (l *linter) checkScript(e *entry) {
+	lines := bytes.Split(e.data, []byte("\n"))
+	for i, line := range lines {
+		if bytes.HasSuffix(line, []byte("\r")) {
+			l.report(RuleScriptCRLF, e.path, i+1, "script has CRLF line endings, which sh reads as part of each command")
+			break
+		}
+	}
+
+	interp := interpreter(lines[0])
+	switch {
+	case isEntrypoint(e.path) && interp != "" && !slices.Contains(posixShells, interp):
+		l.report(RuleScriptNotSh, e.path, 1, "asks for %s, but kpmgo runs it with /bin/sh", interp)
+	case slices.Contains(otherShells, interp):
+		l.report(RuleScriptNotSh, e.path, 1, "asks for %s, which Kindles don't have", interp)
+	}
+	if interp != "" && !slices.Contains(posixShells, interp) && !isEntrypoint(e.path) {
+		return
+	}
+
+	for i, line := range lines {
+		code := stripComment(string(bytes.TrimSuffix(line, []byte("\r"))))
+		for _, b := range bashisms {
+			if b.re.MatchString(code) {
+				l.report(RuleScriptBashism, e.path, i+1, "uses %s, which POSIX sh doesn't have", b.what)
+			}
+		}
+	}
+}
+
+// interpreter returns the name of the program a #! line asks for, looking through env, or "" if
+// the line isn't one.
+func interpreter(line []byte) string {
+	rest, ok := bytes.CutPrefix(bytes.TrimSuffix(line, []byte("\r")), []byte("#!"))
+	if !ok {
+		return ""
+	}
+	fields := strings.Fields(string(rest))
+	if len(fields) == 0 {
+		return ""
+	}
+	interp := path.Base(fields[0])
+	if interp == "env" {
+		// skip env's options, like -S
+		for _, f := range fields[1:] {
+			if !strings.HasPrefix(f, "-") {
+				return path.Base(f)
+			}
+		}
+	}
+	return interp
+}
+
+// stripComment removes a comment that starts at a word boundary, roughly as sh would.
+func stripComment(line string) string {
+	if strings.HasPrefix(strings.TrimSpace(line), "#") {
+		return ""
+	}
+	if i := strings.Index(line, " #"); i >= 0 {
+		return line[:i]
+	}
+	return line
+}
+
+// otherPackagePaths match absolute paths into where other packages are installed: KUAL
+// extensions, and kpmgo's own package directory.
+//
+//nolint:gochecknoglobals
+var otherPackagePaths = []*regexp.Regexp{
+	regexp.MustCompile(`/mnt/us/extensions/([^/\s"'$]+)`),
+	regexp.MustCompile(`/mnt/us/kpm/pkgs/([^/\s"'$]+)`),
+	regexp.MustCompile(`\$\{?KPM_BASE_DIR\}?/pkgs/([^/\s"'$]+)`),
+}
+
+// checkLaunchDependencies reports paths in launch.sh into other packages, which won't be there
+// unless the manifest depends on them.
+func (l *linter) checkLaunchDependencies(e *entry, m *manifest.Manifest) {
+	for i, line := range bytes.Split(e.data, []byte("\n")) {
+		code := stripComment(string(line))
+		for _, re := range otherPackagePaths {
+			for _, match := range re.FindAllStringSubmatch(code, -1) {
+				id := match[1]
+				if id == m.ID {
+					continue
+				}
+				if _, ok := m.Dependencies[id]; !ok {
+					l.report(RuleUndeclaredDependency, e.path, i+1,
+						"uses %s, but %q isn't in the manifest's dependencies", match[0], id)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package mtree
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/pingcap/errors"
+)
+
+type DifferenceKind string
+
+const (
+	Missing  DifferenceKind = "missing"
+	Modified DifferenceKind = "modified"
+	Extra    DifferenceKind = "extra"
+)
+
+// Difference is a file that doesn't match its specification.
+type Difference struct {
+	Path   string
+	Kind   DifferenceKind
+	Detail string
+}
+
+func (d Difference) String() string {
+	if d.Detail == "" {
+		return fmt.Sprintf("%s: %s", d.Kind, d.Path)
+	}
+	return fmt.Sprintf("%s: %s (%s)", d.Kind, d.Path, d.Detail)
+}
+
+// Compare checks the actual entries against a specification. Each keyword in the specification
+// is compared if the actual entry has it too, so a specification with uids can still be checked
+// against a directory listed by FromDir. Entries with the "optional" keyword may be missing, and
+// only the topmost of several extra entries in a directory tree is reported.
+func Compare(spec, actual []Entry) []Difference {
+	specByPath := make(map[string]Entry, len(spec))
+	for _, e := range spec {
+		specByPath[e.Path] = e
+	}
+	actualByPath := make(map[string]Entry, len(actual))
+	for _, e := range actual {
+		actualByPath[e.Path] = e
+	}
+
+	var ds []Difference
+	for p, se := range specByPath {
+		ae, ok := actualByPath[p]
+		if !ok {
+			if _, optional := se.Keywords["optional"]; !optional {
+				ds = append(ds, Difference{Path: p, Kind: Missing, Detail: ""})
+			}
+			continue
+		}
+		if detail := compareKeywords(se, ae); detail != "" {
+			ds = append(ds, Difference{Path: p, Kind: Modified, Detail: detail})
+		}
+	}
+	extra := func(p string) bool {
+		_, inSpec := specByPath[p]
+		_, inActual := actualByPath[p]
+		// the root is there whether or not the specification lists it
+		return p != "." && inActual && !inSpec
+	}
+	for p := range actualByPath {
+		if extra(p) && !extra(path.Dir(p)) {
+			ds = append(ds, Difference{Path: p, Kind: Extra, Detail: ""})
+		}
+	}
+
+	slices.SortFunc(ds, func(a, b Difference) int { return strings.Compare(a.Path, b.Path) })
+	return ds
+}
+
+// compareKeywords describes how an entry's keywords differ from its specification. When the
+// types differ nothing else is compared, since it wouldn't mean much.
+func compareKeywords(se, ae Entry) string {
+	if st, at := se.Keywords["type"], ae.Keywords["type"]; st != "" && at != "" && st != at {
+		return fmt.Sprintf("type %s, expected %s", at, st)
+	}
+	var diffs []string
+	for _, k := range sortedKeywords(se.Keywords) {
+		sv := se.Keywords[k]
+		av, ok := ae.Keywords[k]
+		if !ok || sameValue(k, sv, av) {
+			continue
+		}
+		diffs = append(diffs, fmt.Sprintf("%s %s, expected %s", k, av, sv))
+	}
+	return strings.Join(diffs, ", ")
+}
+
+func sameValue(keyword, a, b string) bool {
+	if keyword == "mode" {
+		ma, errA := strconv.ParseUint(a, 8, 32)
+		mb, errB := strconv.ParseUint(b, 8, 32)
+		return errA == nil && errB == nil && ma == mb
+	}
+	if keyword == "sha256digest" {
+		return strings.EqualFold(a, b)
+	}
+	return a == b
+}
+
+func fileSHA256(p string) (string, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return "", errors.Wrapf(err, "os.Open(%q)", p)
+	}
+	defer f.Close()
+	h := sha256.New()
+	_, err = io.Copy(h, f)
+	if err != nil {
+		return "", errors.Wrapf(err, "reading %q", p)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
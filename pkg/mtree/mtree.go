@@ -0,0 +1,344 @@
+// Package mtree reads, writes and compares mtree(5) specifications: a text listing of a file
+// hierarchy with each file's type, mode, size, digest and so on, as written by BSD mtree and
+// libarchive. Only the keywords relevant to packages are generated, but any keyword can be read.
+package mtree
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/pingcap/errors"
+)
+
+// KeywordOrder is the order keywords are written in; any others follow, sorted.
+var KeywordOrder = []string{ //nolint:gochecknoglobals
+	"type", "mode", "size", "uid", "gid", "link", "sha256digest",
+}
+
+// defaults are the /set line the Writer starts with, which matches most entries in a package.
+var defaults = [][2]string{ //nolint:gochecknoglobals
+	{"type", "file"}, {"uid", "0"}, {"gid", "0"}, {"mode", "0644"},
+}
+
+// Entry is one file in a specification, with every keyword that applies to it, including those
+// from /set lines.
+type Entry struct {
+	// Path is relative to the root, without a leading "./"; the root itself is "."
+	Path     string
+	Keywords map[string]string
+}
+
+// Writer writes a specification, one full path per line. The header and /set defaults are
+// written before the first entry or comment, or by Flush.
+type Writer struct {
+	w       io.Writer
+	started bool
+}
+
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w: w, started: false}
+}
+
+func (mw *Writer) start() error {
+	if mw.started {
+		return nil
+	}
+	mw.started = true
+	parts := []string{"/set"}
+	for _, kv := range defaults {
+		parts = append(parts, kv[0]+"="+kv[1])
+	}
+	_, err := fmt.Fprintf(mw.w, "#mtree v2.0\n%s\n", strings.Join(parts, " "))
+	return errors.AddStack(err)
+}
+
+// WriteEntry writes e, leaving out keywords that match the /set defaults.
+func (mw *Writer) WriteEntry(e Entry) error {
+	err := mw.start()
+	if err != nil {
+		return err
+	}
+	name := "."
+	if e.Path != "." {
+		name = "./" + e.Path
+	}
+	parts := []string{Escape(name)}
+	for _, k := range sortedKeywords(e.Keywords) {
+		v := e.Keywords[k]
+		if slices.Contains(defaults, [2]string{k, v}) {
+			continue
+		}
+		if v == "" {
+			parts = append(parts, k)
+		} else {
+			parts = append(parts, k+"="+Escape(v))
+		}
+	}
+	_, err = fmt.Fprintln(mw.w, strings.Join(parts, " "))
+	return errors.AddStack(err)
+}
+
+// WriteComment writes text as a comment line.
+func (mw *Writer) WriteComment(text string) error {
+	err := mw.start()
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(mw.w, "# %s\n", strings.ReplaceAll(text, "\n", " "))
+	return errors.AddStack(err)
+}
+
+// Flush writes the header if nothing else has been, so that an empty hierarchy is still a valid
+// specification.
+func (mw *Writer) Flush() error {
+	return mw.start()
+}
+
+func sortedKeywords(kws map[string]string) []string {
+	var keys, rest []string
+	for _, k := range KeywordOrder {
+		if _, ok := kws[k]; ok {
+			keys = append(keys, k)
+		}
+	}
+	for k := range kws {
+		if !slices.Contains(KeywordOrder, k) {
+			rest = append(rest, k)
+		}
+	}
+	slices.Sort(rest)
+	return append(keys, rest...)
+}
+
+// Escape encodes the bytes mtree(5) can't have in a name or value as a backslash and three
+// octal digits: whitespace and other control characters, non-ASCII bytes, and '#', '=' and '\'.
+func Escape(s string) string {
+	sb := &strings.Builder{}
+	for i := range len(s) {
+		c := s[i]
+		if c <= ' ' || c >= 0x7f || c == '#' || c == '=' || c == '\\' {
+			fmt.Fprintf(sb, "\\%03o", c)
+		} else {
+			sb.WriteByte(c)
+		}
+	}
+	return sb.String()
+}
+
+// Unescape decodes octal escapes, and the C-style ones some mtree implementations write, like
+// "\s" for a space.
+func Unescape(s string) string {
+	if !strings.Contains(s, "\\") {
+		return s
+	}
+	sb := &strings.Builder{}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c != '\\' || i == len(s)-1 {
+			sb.WriteByte(c)
+			continue
+		}
+		if i+3 < len(s) && isOctal(s[i+1]) && isOctal(s[i+2]) && isOctal(s[i+3]) {
+			n, _ := strconv.ParseUint(s[i+1:i+4], 8, 8)
+			sb.WriteByte(byte(n))
+			i += 3
+			continue
+		}
+		i++
+		switch s[i] {
+		case 'a':
+			sb.WriteByte('\a')
+		case 'b':
+			sb.WriteByte('\b')
+		case 'f':
+			sb.WriteByte('\f')
+		case 'n':
+			sb.WriteByte('\n')
+		case 'r':
+			sb.WriteByte('\r')
+		case 's':
+			sb.WriteByte(' ')
+		case 't':
+			sb.WriteByte('\t')
+		case 'v':
+			sb.WriteByte('\v')
+		default:
+			sb.WriteByte(s[i])
+		}
+	}
+	return sb.String()
+}
+
+func isOctal(c byte) bool {
+	return c >= '0' && c <= '7'
+}
+
+// Parse reads a specification in either format mtree(5) describes: full paths, or names
+// relative to the last directory, with ".." to go back up.
+func Parse(r io.Reader) ([]Entry, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1<<20)
+	set := map[string]string{}
+	// dirs are the directories relative names have entered, and ".." leaves; BSD mtree enters "."
+	// too, so its listings end with a ".." for it
+	var dirs []string
+	var entries []Entry
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := scanner.Text()
+		// a trailing backslash continues the line
+		for strings.HasSuffix(line, "\\") && scanner.Scan() {
+			lineNo++
+			line = strings.TrimSuffix(line, "\\") + " " + scanner.Text()
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+
+		switch fields[0] {
+		case "/set":
+			for _, kw := range fields[1:] {
+				k, v := parseKeyword(kw)
+				set[k] = v
+			}
+			continue
+		case "/unset":
+			for _, k := range fields[1:] {
+				if k == "all" {
+					clear(set)
+				}
+				delete(set, k)
+			}
+			continue
+		case "..":
+			if len(dirs) == 0 {
+				return nil, errors.Errorf("line %d: \"..\" above the root", lineNo)
+			}
+			dirs = dirs[:len(dirs)-1]
+			continue
+		}
+
+		name := Unescape(fields[0])
+		kws := make(map[string]string, len(set)+len(fields)-1)
+		for k, v := range set {
+			kws[k] = v
+		}
+		for _, kw := range fields[1:] {
+			k, v := parseKeyword(kw)
+			kws[k] = v
+		}
+		var p string
+		if strings.Contains(name, "/") {
+			p = path.Clean(name)
+		} else {
+			cwd := "."
+			if len(dirs) > 0 {
+				cwd = dirs[len(dirs)-1]
+			}
+			p = path.Join(cwd, name)
+			if kws["type"] == "dir" {
+				dirs = append(dirs, p)
+			}
+		}
+		p = strings.TrimPrefix(path.Clean("/"+p), "/")
+		if p == "" {
+			p = "."
+		}
+		entries = append(entries, Entry{Path: p, Keywords: kws})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.AddStack(err)
+	}
+	return entries, nil
+}
+
+// parseKeyword splits keyword=value, with "sha256" read as its alias "sha256digest".
+func parseKeyword(kw string) (string, string) {
+	k, v, _ := strings.Cut(kw, "=")
+	if k == "sha256" {
+		k = "sha256digest"
+	}
+	return k, Unescape(v)
+}
+
+// FromDir lists a directory as it would be specified, with the keywords in KeywordOrder except
+// for uid and gid, which extracting a package doesn't set, and the root's mode.
+func FromDir(root string) ([]Entry, error) {
+	var entries []Entry
+	err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return errors.AddStack(err)
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return errors.AddStack(err)
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return errors.AddStack(err)
+		}
+		kws := map[string]string{"mode": FormatMode(fi.Mode())}
+		if rel == "." {
+			// the root is wherever the files were put, and its mode is that directory's, not theirs
+			delete(kws, "mode")
+		}
+		switch {
+		case fi.IsDir():
+			kws["type"] = "dir"
+		case fi.Mode()&fs.ModeSymlink != 0:
+			kws["type"] = "link"
+			target, err := os.Readlink(p)
+			if err != nil {
+				return errors.AddStack(err)
+			}
+			kws["link"] = target
+		case fi.Mode().IsRegular():
+			kws["type"] = "file"
+			kws["size"] = strconv.FormatInt(fi.Size(), 10)
+			sum, err := fileSHA256(p)
+			if err != nil {
+				return err
+			}
+			kws["sha256digest"] = sum
+		case fi.Mode()&fs.ModeNamedPipe != 0:
+			kws["type"] = "fifo"
+		case fi.Mode()&fs.ModeCharDevice != 0:
+			kws["type"] = "char"
+		case fi.Mode()&fs.ModeDevice != 0:
+			kws["type"] = "block"
+		case fi.Mode()&fs.ModeSocket != 0:
+			kws["type"] = "socket"
+		}
+		entries = append(entries, Entry{Path: filepath.ToSlash(rel), Keywords: kws})
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "walking %q", root)
+	}
+	return entries, nil
+}
+
+// FormatMode formats a file's permission bits as mtree does, in four octal digits.
+func FormatMode(m fs.FileMode) string {
+	mode := uint32(m.Perm())
+	if m&fs.ModeSetuid != 0 {
+		mode |= 0o4000
+	}
+	if m&fs.ModeSetgid != 0 {
+		mode |= 0o2000
+	}
+	if m&fs.ModeSticky != 0 {
+		mode |= 0o1000
+	}
+	return fmt.Sprintf("%04o", mode)
+}
@@ -0,0 +1,103 @@
+package mtree_test
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/clintharrison/go-kindle-pkg/pkg/mtree"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteAndParse(t *testing.T) {
+	t.Parallel()
+
+	entries := []mtree.Entry{
+		{Path: ".", Keywords: map[string]string{"type": "dir", "mode": "0755", "uid": "0", "gid": "0"}},
+		{Path: "with space#and=equals", Keywords: map[string]string{
+			"type": "file", "mode": "0644", "uid": "0", "gid": "0", "size": "3", "sha256digest": "abc",
+		}},
+		{Path: "dir", Keywords: map[string]string{"type": "dir", "mode": "0755", "uid": "0", "gid": "0"}},
+		{Path: "dir/link", Keywords: map[string]string{
+			"type": "link", "mode": "0777", "uid": "0", "gid": "0", "link": "../with space#and=equals",
+		}},
+	}
+	buf := &bytes.Buffer{}
+	mw := mtree.NewWriter(buf)
+	for _, e := range entries {
+		require.NoError(t, mw.WriteEntry(e))
+	}
+	require.NoError(t, mw.WriteComment("the end"))
+	require.Equal(t, `#mtree v2.0
+/set type=file uid=0 gid=0 mode=0644
+. type=dir mode=0755
+./with\040space\043and\075equals size=3 sha256digest=abc
+./dir type=dir mode=0755
+./dir/link type=link mode=0777 link=../with\040space\043and\075equals
+# the end
+`, buf.String())
+
+	parsed, err := mtree.Parse(buf)
+	require.NoError(t, err)
+	require.Equal(t, entries, parsed)
+}
+
+func TestParse_RelativePaths(t *testing.T) {
+	t.Parallel()
+
+	// as BSD mtree writes it, with C-style escapes, continued lines and /unset
+	parsed, err := mtree.Parse(strings.NewReader(`#	   user: someone
+/set type=file uid=0 gid=0 mode=0644 nlink=1
+.               type=dir mode=0755 nlink=3
+    bin         type=dir mode=0755 nlink=2
+        tool    mode=0755 size=4 \
+                sha256=ABCD
+/unset nlink
+        a\sb    size=0
+    ..
+    etc\
+                type=dir
+    ..
+..
+`))
+	require.NoError(t, err)
+	require.Equal(t, []mtree.Entry{
+		{Path: ".", Keywords: map[string]string{"type": "dir", "uid": "0", "gid": "0", "mode": "0755", "nlink": "3"}},
+		{Path: "bin", Keywords: map[string]string{"type": "dir", "uid": "0", "gid": "0", "mode": "0755", "nlink": "2"}},
+		{Path: "bin/tool", Keywords: map[string]string{
+			"type": "file", "uid": "0", "gid": "0", "mode": "0755", "nlink": "1", "size": "4", "sha256digest": "ABCD",
+		}},
+		{Path: "bin/a b", Keywords: map[string]string{"type": "file", "uid": "0", "gid": "0", "mode": "0644", "size": "0"}},
+		{Path: "etc", Keywords: map[string]string{"type": "dir", "uid": "0", "gid": "0", "mode": "0644"}},
+	}, parsed)
+
+	_, err = mtree.Parse(strings.NewReader("..\n"))
+	require.Error(t, err)
+}
+
+func TestCompare(t *testing.T) {
+	t.Parallel()
+
+	spec := []mtree.Entry{
+		{Path: "a", Keywords: map[string]string{"type": "file", "mode": "0644", "uid": "0", "size": "1"}},
+		{Path: "b", Keywords: map[string]string{"type": "file", "mode": "644", "sha256digest": "ABCD"}},
+		{Path: "c", Keywords: map[string]string{"type": "file"}},
+		{Path: "d", Keywords: map[string]string{"type": "file", "optional": ""}},
+		{Path: "e", Keywords: map[string]string{"type": "dir"}},
+	}
+	actual := []mtree.Entry{
+		{Path: ".", Keywords: map[string]string{"type": "dir"}},
+		// no uid to compare
+		{Path: "a", Keywords: map[string]string{"type": "file", "mode": "0755", "size": "1"}},
+		{Path: "b", Keywords: map[string]string{"type": "file", "mode": "0644", "sha256digest": "abcd"}},
+		{Path: "e", Keywords: map[string]string{"type": "file", "mode": "0644"}},
+		{Path: "f", Keywords: map[string]string{"type": "dir"}},
+		{Path: "f/g", Keywords: map[string]string{"type": "file"}},
+	}
+	require.Equal(t, []mtree.Difference{
+		{Path: "a", Kind: mtree.Modified, Detail: "mode 0755, expected 0644"},
+		{Path: "c", Kind: mtree.Missing, Detail: ""},
+		{Path: "e", Kind: mtree.Modified, Detail: "type file, expected dir"},
+		{Path: "f", Kind: mtree.Extra, Detail: ""},
+	}, mtree.Compare(spec, actual))
+}
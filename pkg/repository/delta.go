@@ -0,0 +1,182 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/clintharrison/go-kindle-pkg/pkg/kpkg"
+	"github.com/clintharrison/go-kindle-pkg/pkg/repository/manifest"
+	"github.com/pingcap/errors"
+)
+
+type HTTPOption func(*HTTPRepository)
+
+// WithDeltaCache makes the repository keep a copy in dir of each package it opens that publishes
+// deltas, instead of streaming it, so that the next version can be downloaded as a delta against
+// that copy. installed returns the installed version of a package: only a delta from that version
+// is used, and the full artifact is downloaded instead if it can't be, or doesn't apply exactly.
+func WithDeltaCache(dir string, installed func(id string) (manifest.SemanticVersion, bool)) HTTPOption {
+	return func(r *HTTPRepository) {
+		r.deltaCache = dir
+		r.installedVersion = installed
+	}
+}
+
+// usesDeltas reports whether any version of a package has deltas, and so whether it is worth
+// keeping a copy of whichever version is installed.
+func (r *HTTPRepository) usesDeltas(id string) bool {
+	if r.deltaCache == "" {
+		return false
+	}
+	for _, art := range r.repoConfig.Packages[id].Artifacts {
+		if len(art.Deltas) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *HTTPRepository) cachePath(id string, v manifest.SemanticVersion) string {
+	return filepath.Join(r.deltaCache, fmt.Sprintf("%s_%s.kpkg", id, v.String()))
+}
+
+// fetchToCache puts the package in the delta cache, from a delta if it can, and returns its path,
+// and whether it was already there.
+func (r *HTTPRepository) fetchToCache(
+	ctx context.Context, pkg *RepoPackage, art *manifest.Artifact,
+) (string, bool, error) {
+	dest := r.cachePath(pkg.ID, pkg.Version)
+	_, err := os.Stat(dest)
+	if err == nil {
+		slog.Debug("using cached package", "package", pkg, "path", dest)
+		return dest, true, nil
+	}
+	err = os.MkdirAll(r.deltaCache, 0o755) //nolint:gosec
+	if err != nil {
+		return "", false, errors.Wrapf(err, "os.MkdirAll(%q)", r.deltaCache)
+	}
+
+	if d, base := r.findDelta(pkg, art); d != nil {
+		fmt.Printf(" - Downloading %s as a delta from version %s\n", pkg, d.From.String())
+		err := applyDeltaFromURL(ctx, base, d, dest)
+		if err == nil {
+			r.pruneCache(pkg.ID, pkg.Version)
+			return dest, false, nil
+		}
+		slog.Warn("delta update failed, downloading the full package", "package", pkg, "delta", d.URL, "error", err)
+		fmt.Printf(" - Delta did not apply (%v), downloading the full package instead\n", errors.Cause(err))
+	}
+
+	err = downloadFile(ctx, art.URL, dest)
+	if err != nil {
+		return "", false, err
+	}
+	r.pruneCache(pkg.ID, pkg.Version)
+	return dest, false, nil
+}
+
+// matchesSignature checks that a cached package is the one sig was made for, so that a copy of a
+// version that has since been republished is fetched again. Whether sig can be trusted is up to
+// whoever extracts the package.
+func matchesSignature(ctx context.Context, k *kpkg.KPKG, sig *kpkg.Signature) error {
+	manifestSum, payloadSum, err := k.Digests(ctx)
+	if err != nil {
+		return errors.Wrap(err, "hashing cached package")
+	}
+	if manifestSum != sig.ManifestSHA256 || payloadSum != sig.PayloadSHA256 {
+		return errors.Annotate(kpkg.ErrBadSignature, "cached package is not the one that was signed")
+	}
+	return nil
+}
+
+// findDelta returns the artifact's delta from the installed version, and the cached copy of that
+// version to apply it to, if there are both.
+func (r *HTTPRepository) findDelta(pkg *RepoPackage, art *manifest.Artifact) (*manifest.Delta, string) {
+	installed, ok := r.installedVersion(pkg.ID)
+	if !ok {
+		return nil, ""
+	}
+	base := r.cachePath(pkg.ID, installed)
+	_, err := os.Stat(base)
+	if err != nil {
+		slog.Debug("no cached copy of the installed version to apply a delta to", "package", pkg, "path", base)
+		return nil, ""
+	}
+	for _, d := range art.Deltas {
+		if d.From != installed {
+			continue
+		}
+		if d.PayloadSHA256 == "" {
+			slog.Debug("delta has no payload digest to check it against, not using it", "package", pkg, "delta", d.URL)
+			return nil, ""
+		}
+		return &d, base
+	}
+	return nil, ""
+}
+
+// applyDeltaFromURL downloads d and applies it to basePath, checking the result against the
+// digest the repository publishes for it.
+func applyDeltaFromURL(ctx context.Context, basePath string, d *manifest.Delta, dest string) error {
+	body, err := httpGet(ctx, d.URL)
+	if err != nil {
+		return err
+	}
+	defer body.Close() //nolint:errcheck
+	return errors.AddStack(kpkg.ApplyDelta(ctx, basePath, body, dest, d.PayloadSHA256))
+}
+
+// downloadFile downloads rawurl to dest, through a temporary file so dest is only ever complete.
+func downloadFile(ctx context.Context, rawurl, dest string) error {
+	body, err := httpGet(ctx, rawurl)
+	if err != nil {
+		return err
+	}
+	defer body.Close() //nolint:errcheck
+
+	partPath := dest + ".part"
+	f, err := os.Create(partPath)
+	if err != nil {
+		return errors.Wrapf(err, "os.Create(%q)", partPath)
+	}
+	_, err = io.Copy(f, body)
+	cerr := f.Close()
+	if err == nil {
+		err = cerr
+	}
+	if err != nil {
+		_ = os.Remove(partPath)
+		return errors.Wrapf(err, "downloading %q to %q", rawurl, partPath)
+	}
+	return errors.AddStack(os.Rename(partPath, dest))
+}
+
+// pruneCache removes the cached copies of other versions of a package, which no delta will be
+// applied to now that keep has replaced them. The installed version's copy stays until keep is
+// installed, as the delta to the next version will be from it if installing keep fails.
+func (r *HTTPRepository) pruneCache(id string, keep manifest.SemanticVersion) {
+	keepPaths := []string{r.cachePath(id, keep)}
+	if installed, ok := r.installedVersion(id); ok {
+		keepPaths = append(keepPaths, r.cachePath(id, installed))
+	}
+	matches, err := filepath.Glob(filepath.Join(r.deltaCache, id+"_*.kpkg"))
+	if err != nil {
+		return
+	}
+	for _, p := range matches {
+		v := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(p), id+"_"), ".kpkg")
+		var major, minor, patch int
+		_, err := fmt.Sscanf(v, "%d.%d.%d", &major, &minor, &patch)
+		if err != nil || slices.Contains(keepPaths, p) {
+			continue
+		}
+		slog.Debug("removing cached package", "path", p)
+		_ = os.Remove(p)
+	}
+}
@@ -0,0 +1,221 @@
+package repository
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/clintharrison/go-kindle-pkg/pkg/kpkg"
+	"github.com/clintharrison/go-kindle-pkg/pkg/repository/manifest"
+	"github.com/stretchr/testify/require"
+)
+
+// deltaServer serves a repository with versions 1.0.0 and 1.0.1 of dummy-package, and a delta
+// between them published with payloadSHA256, counting the requests for each file.
+type deltaServer struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	requests map[string]int
+}
+
+func newDeltaServer(t *testing.T, files map[string][]byte, payloadSHA256 string) *deltaServer {
+	t.Helper()
+	s := &deltaServer{Server: nil, mu: sync.Mutex{}, requests: map[string]int{}}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		s.requests[r.URL.Path]++
+		s.mu.Unlock()
+		data, ok := files[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		_, _ = w.Write(data)
+	}))
+	t.Cleanup(s.Close)
+
+	v100 := manifest.SemanticVersion{Major: 1, Minor: 0, Patch: 0}
+	v101 := manifest.SemanticVersion{Major: 1, Minor: 0, Patch: 1}
+	repoConfig := manifest.RepositoryConfig{ //nolint:exhaustruct
+		Version: 1,
+		ID:      "test-repo",
+		Packages: map[string]manifest.Package{
+			"dummy-package": { //nolint:exhaustruct
+				Artifacts: []manifest.Artifact{
+					{URL: s.URL + "/v1.0.0.kpkg", Version: v100}, //nolint:exhaustruct
+					{ //nolint:exhaustruct
+						URL:     s.URL + "/v1.0.1.kpkg",
+						Version: v101,
+						Deltas: []manifest.Delta{
+							{From: v100, URL: s.URL + "/v1.0.1_from_1.0.0.kdelta", PayloadSHA256: payloadSHA256},
+						},
+					},
+				},
+			},
+		},
+	}
+	data, err := json.Marshal(repoConfig)
+	require.NoError(t, err)
+	files["/repository.json"] = data
+	return s
+}
+
+func (s *deltaServer) count(p string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests[p]
+}
+
+func TestHTTPRepository_Delta(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	v1Path := filepath.Join(dir, "v1.kpkg")
+	v2Path := filepath.Join(dir, "v2.kpkg")
+	require.NoError(t, createDummyKPKGFile(t, v1Path, 0))
+	require.NoError(t, createDummyKPKGFile(t, v2Path, 1))
+	v1, err := os.ReadFile(v1Path)
+	require.NoError(t, err)
+	v2, err := os.ReadFile(v2Path)
+	require.NoError(t, err)
+	var delta bytes.Buffer
+	require.NoError(t, kpkg.CreateDelta(t.Context(), v1Path, v2Path, &delta))
+	k, err := kpkg.Open(t.Context(), v2Path)
+	require.NoError(t, err)
+	_, v2Sum, err := k.Digests(t.Context())
+	require.NoError(t, err)
+	require.NoError(t, k.Close())
+
+	// a delta to some other package has a header that's consistent with what it rebuilds, but not
+	// with the repository
+	otherPath := filepath.Join(dir, "other.kpkg")
+	require.NoError(t, createDummyKPKGFile(t, otherPath, 2))
+	var lying bytes.Buffer
+	require.NoError(t, kpkg.CreateDelta(t.Context(), v1Path, otherPath, &lying))
+
+	installed := func(id string) (manifest.SemanticVersion, bool) {
+		return manifest.SemanticVersion{Major: 1, Minor: 0, Patch: 0}, id == "dummy-package"
+	}
+
+	tests := []struct {
+		name      string
+		delta     []byte
+		sum       string
+		wantDelta int
+		wantFull  int
+	}{
+		{name: "delta applies", delta: delta.Bytes(), sum: v2Sum, wantDelta: 1, wantFull: 0},
+		{
+			name: "corrupt delta falls back to the full package", delta: []byte("not a delta"), sum: v2Sum,
+			wantDelta: 1, wantFull: 1,
+		},
+		{
+			name: "delta whose header lies falls back to the full package", delta: lying.Bytes(), sum: v2Sum,
+			wantDelta: 1, wantFull: 1,
+		},
+		{
+			name: "delta without a published digest isn't used", delta: delta.Bytes(), sum: "",
+			wantDelta: 0, wantFull: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			s := newDeltaServer(t, map[string][]byte{
+				"/v1.0.0.kpkg":              v1,
+				"/v1.0.1.kpkg":              v2,
+				"/v1.0.1_from_1.0.0.kdelta": tt.delta,
+			}, tt.sum)
+
+			cache := t.TempDir()
+			require.NoError(t, os.WriteFile(filepath.Join(cache, "dummy-package_1.0.0.kpkg"), v1, 0o644)) //nolint:gosec
+			// left behind by some earlier install
+			require.NoError(t, os.WriteFile(filepath.Join(cache, "dummy-package_0.9.0.kpkg"), v1, 0o644)) //nolint:gosec
+
+			r, err := NewHTTPRepository(s.URL+"/repository.json", WithDeltaCache(cache, installed))
+			require.NoError(t, err)
+			pkgs, err := r.FetchPackages(t.Context())
+			require.NoError(t, err)
+			var target *RepoPackage
+			for _, p := range pkgs {
+				if p.Version.Patch == 1 {
+					target = p
+				}
+			}
+			require.NotNil(t, target)
+
+			k, err := r.OpenPackage(t.Context(), target)
+			require.NoError(t, err)
+			require.Equal(t, 1, k.Manifest.Version.Patch)
+			require.NoError(t, k.Close())
+
+			require.Equal(t, tt.wantDelta, s.count("/v1.0.1_from_1.0.0.kdelta"))
+			require.Equal(t, tt.wantFull, s.count("/v1.0.1.kpkg"))
+			_, err = os.Stat(filepath.Join(cache, "dummy-package_1.0.1.kpkg"))
+			require.NoError(t, err, "the new version should be cached for the next delta")
+			_, err = os.Stat(filepath.Join(cache, "dummy-package_1.0.0.kpkg"))
+			require.NoError(t, err, "the installed version should be kept in case installing the new one fails")
+			_, err = os.Stat(filepath.Join(cache, "dummy-package_0.9.0.kpkg"))
+			require.ErrorIs(t, err, os.ErrNotExist, "other versions should be pruned")
+		})
+	}
+}
+
+func TestHTTPRepository_DeltaCacheRepublished(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	stalePath := filepath.Join(dir, "stale.kpkg")
+	v2Path := filepath.Join(dir, "v2.kpkg")
+	require.NoError(t, createDummyKPKGFile(t, stalePath, 2))
+	require.NoError(t, createDummyKPKGFile(t, v2Path, 1))
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	_, err = kpkg.SignFile(t.Context(), v2Path, priv)
+	require.NoError(t, err)
+	v2, err := os.ReadFile(v2Path)
+	require.NoError(t, err)
+	v2Sig, err := os.ReadFile(v2Path + kpkg.SignatureSuffix)
+	require.NoError(t, err)
+	stale, err := os.ReadFile(stalePath)
+	require.NoError(t, err)
+
+	s := newDeltaServer(t, map[string][]byte{
+		"/v1.0.1.kpkg":                        v2,
+		"/v1.0.1.kpkg" + kpkg.SignatureSuffix: v2Sig,
+	}, "")
+	// cached before 1.0.1 was republished, so it isn't what's signed now
+	cache := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(cache, "dummy-package_1.0.1.kpkg"), stale, 0o644)) //nolint:gosec
+
+	installed := func(string) (manifest.SemanticVersion, bool) {
+		return manifest.SemanticVersion{Major: 0, Minor: 0, Patch: 0}, false
+	}
+	r, err := NewHTTPRepository(s.URL+"/repository.json", WithDeltaCache(cache, installed))
+	require.NoError(t, err)
+	pkgs, err := r.FetchPackages(t.Context())
+	require.NoError(t, err)
+	var target *RepoPackage
+	for _, p := range pkgs {
+		if p.Version.Patch == 1 {
+			target = p
+		}
+	}
+	require.NotNil(t, target)
+
+	k, err := r.OpenPackage(t.Context(), target)
+	require.NoError(t, err)
+	defer k.Close()
+	require.Equal(t, 1, s.count("/v1.0.1.kpkg"), "the stale copy should be fetched again")
+	cached, err := os.ReadFile(filepath.Join(cache, "dummy-package_1.0.1.kpkg"))
+	require.NoError(t, err)
+	require.Equal(t, v2, cached)
+}
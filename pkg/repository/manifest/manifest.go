@@ -16,6 +16,19 @@ type Artifact struct {
 	Version       SemanticVersion `json:"version"`
 	Dependencies  []Dependency    `json:"dependencies,omitempty"`
 	SupportedArch []string        `json:"supported_arch,omitempty"`
+	// Deltas are optional smaller downloads that reconstruct this artifact from an earlier version
+	Deltas []Delta `json:"deltas,omitempty"`
+}
+
+// Delta is a binary delta from an earlier version of an artifact, as written by `create-delta`.
+type Delta struct {
+	// From is the version the delta applies to
+	From SemanticVersion `json:"from"`
+	URL  string          `json:"url"`
+	// PayloadSHA256 is the digest of the decompressed payload of the artifact the delta rebuilds.
+	// The rebuilt package is checked against it, rather than against the delta's own header, and
+	// a delta without it isn't used.
+	PayloadSHA256 string `json:"payload_sha256,omitempty"`
 }
 
 type Package struct {
@@ -0,0 +1,64 @@
+package manifest
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/pingcap/errors"
+)
+
+// idRegexp matches the package IDs that can be named on the command line (see resolver.ParseConstraint).
+var idRegexp = regexp.MustCompile(`^[a-z][a-z-.]*$`)
+
+// Validate checks the manifest for everything a package needs to be installable, and reports
+// every problem at once.
+func (m *Manifest) Validate() error {
+	problems := m.Problems()
+	if len(problems) > 0 {
+		return errors.Errorf("invalid manifest: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// Problems lists what Validate would report, one problem per string.
+func (m *Manifest) Problems() []string {
+	var problems []string
+	problem := func(format string, args ...any) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	switch {
+	case m.ID == "":
+		problem("id is required")
+	case !idRegexp.MatchString(m.ID):
+		problem("id %q must be lowercase letters, '-' and '.'", m.ID)
+	}
+	if m.Name == "" {
+		problem("name is required")
+	}
+	if m.Version.Major < 0 || m.Version.Minor < 0 || m.Version.Patch < 0 {
+		problem("version %s must not be negative", m.Version.String())
+	}
+	seenArch := map[string]bool{}
+	for _, arch := range m.SupportedArch {
+		if arch == "" {
+			problem("supported_arch must not contain empty values")
+		} else if seenArch[arch] {
+			problem("supported_arch lists %q more than once", arch)
+		}
+		seenArch[arch] = true
+	}
+	for depID, dep := range m.Dependencies {
+		if !idRegexp.MatchString(depID) {
+			problem("dependency id %q must be lowercase letters, '-' and '.'", depID)
+		}
+		if dep.ID != "" && dep.ID != depID {
+			problem("dependency %q has a mismatched id %q", depID, dep.ID)
+		}
+		if dep.Min != nil && dep.Max != nil && dep.Min.Compare(*dep.Max) >= 0 {
+			problem("dependency %q allows no versions: >=%s,<%s", depID, dep.Min.String(), dep.Max.String())
+		}
+	}
+	return problems
+}
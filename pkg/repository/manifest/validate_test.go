@@ -0,0 +1,44 @@
+package manifest_test
+
+import (
+	"testing"
+
+	"github.com/clintharrison/go-kindle-pkg/pkg/repository/manifest"
+	"github.com/stretchr/testify/require"
+)
+
+//nolint:exhaustruct
+func TestManifestValidate(t *testing.T) {
+	t.Parallel()
+
+	valid := manifest.Manifest{
+		ID:            "kterm",
+		Name:          "kterm",
+		Version:       manifest.SemanticVersion{Major: 2, Minor: 6, Patch: 0},
+		SupportedArch: []string{"armhf"},
+		Dependencies: map[string]manifest.Dependency{
+			"koreader": {Min: &manifest.SemanticVersion{Major: 1}, Max: &manifest.SemanticVersion{Major: 2}},
+		},
+	}
+	require.NoError(t, valid.Validate())
+
+	for name, mutate := range map[string]func(m *manifest.Manifest){
+		"no id":            func(m *manifest.Manifest) { m.ID = "" },
+		"uppercase id":     func(m *manifest.Manifest) { m.ID = "KTerm" },
+		"no name":          func(m *manifest.Manifest) { m.Name = "" },
+		"negative version": func(m *manifest.Manifest) { m.Version.Minor = -1 },
+		"duplicate arch":   func(m *manifest.Manifest) { m.SupportedArch = []string{"armhf", "armhf"} },
+		"empty dependency range": func(m *manifest.Manifest) {
+			m.Dependencies = map[string]manifest.Dependency{
+				"koreader": {Min: &manifest.SemanticVersion{Major: 2}, Max: &manifest.SemanticVersion{Major: 1}},
+			}
+		},
+		"mismatched dependency id": func(m *manifest.Manifest) {
+			m.Dependencies = map[string]manifest.Dependency{"koreader": {ID: "kterm"}}
+		},
+	} {
+		m := valid
+		mutate(&m)
+		require.Error(t, m.Validate(), name)
+	}
+}
@@ -71,6 +71,9 @@ type Repository interface {
 	ID() string
 	FetchPackages(ctx context.Context) ([]*RepoPackage, error)
 	DownloadPackage(ctx context.Context, repoPackage *RepoPackage, destFile string, dryRun bool) error
+	// OpenPackage opens a package for extraction without necessarily keeping a copy of it on disk.
+	// The options are passed to kpkg.Open or kpkg.OpenStream, along with the package's signature.
+	OpenPackage(ctx context.Context, repoPackage *RepoPackage, opts ...kpkg.OpenOption) (*kpkg.KPKG, error)
 }
 
 const LocalFileRepoID = "$kpkgfile"
@@ -128,9 +131,36 @@ func (r *LocalFileRepository) DownloadPackage(
 	if err != nil {
 		return errors.Wrapf(err, "io.Copy() to %q", destPath)
 	}
+
+	// bring the detached signature along, if there is one
+	sigData, err := os.ReadFile(srcPath + kpkg.SignatureSuffix)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return errors.Wrapf(err, "os.ReadFile(%q)", srcPath+kpkg.SignatureSuffix)
+	}
+	err = os.WriteFile(destPath+kpkg.SignatureSuffix, sigData, 0o644) //nolint:gosec
+	if err != nil {
+		return errors.Wrapf(err, "os.WriteFile(%q)", destPath+kpkg.SignatureSuffix)
+	}
 	return nil
 }
 
+func (r *LocalFileRepository) OpenPackage(
+	ctx context.Context, pkg *RepoPackage, opts ...kpkg.OpenOption,
+) (*kpkg.KPKG, error) {
+	srcPath, ok := r.pathForPackage[pkg.ID]
+	if !ok {
+		return nil, fmt.Errorf("package %s not found in local file repository", pkg.ID)
+	}
+	k, err := kpkg.Open(ctx, srcPath, opts...)
+	if err != nil {
+		return nil, errors.Wrapf(err, "kpkg.Open(%q)", srcPath)
+	}
+	return k, nil
+}
+
 func (r *LocalFileRepository) FetchPackages(ctx context.Context) ([]*RepoPackage, error) {
 	for _, p := range r.paths {
 		fi, err := os.Stat(p)
@@ -180,6 +210,7 @@ func (r *LocalFileRepository) FetchPackages(ctx context.Context) ([]*RepoPackage
 			},
 			SupportedArch: manif.SupportedArch,
 			Dependencies:  deps,
+			Deltas:        nil,
 		}
 		r.pkgs = append(r.pkgs, NewRepoPackage(manif.ID, LocalFileRepoID, artifact))
 		r.pathForPackage[manif.ID] = p
@@ -192,16 +223,24 @@ type HTTPRepository struct {
 	url        *url.URL
 	pas        []*RepoPackage
 	repoConfig *manifest.RepositoryConfig
+
+	// deltaCache is where packages are kept to apply deltas to, if anywhere
+	deltaCache       string
+	installedVersion func(id string) (manifest.SemanticVersion, bool)
 }
 
-func NewHTTPRepository(rawurl string) (*HTTPRepository, error) {
+func NewHTTPRepository(rawurl string, opts ...HTTPOption) (*HTTPRepository, error) {
 	parsed, err := url.Parse(rawurl)
 	if err != nil {
 		return nil, fmt.Errorf("invalid URL %q: %w", rawurl, err)
 	}
 	switch parsed.Scheme {
 	case "http", "https", "file":
-		return &HTTPRepository{url: parsed, pas: nil, repoConfig: nil}, nil
+		r := &HTTPRepository{url: parsed, pas: nil, repoConfig: nil, deltaCache: "", installedVersion: nil}
+		for _, o := range opts {
+			o(r)
+		}
+		return r, nil
 	default:
 		return nil, fmt.Errorf("invalid URL scheme %q in repo %q", parsed.Scheme, rawurl)
 	}
@@ -252,26 +291,152 @@ func (r *HTTPRepository) DownloadPackage(
 		return nil
 	}
 
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, art.URL, nil)
+	body, err := httpGet(ctx, art.URL)
+	if err != nil {
+		return err
+	}
+	defer body.Close() //nolint:errcheck
+
+	outFile, err := os.Create(destPath)
+	if err != nil {
+		return errors.Wrapf(err, "os.Create(%q)", destPath)
+	}
+	defer outFile.Close()
+
+	_, err = io.Copy(outFile, body)
+	if err != nil {
+		return errors.Wrapf(err, "io.Copy() to %q", destPath)
+	}
+
+	err = downloadSignature(ctx, art.URL+kpkg.SignatureSuffix, destPath+kpkg.SignatureSuffix)
+	if err != nil {
+		return errors.Wrapf(err, "downloading signature for %s", pkg)
+	}
+	return nil
+}
+
+// OpenPackage streams the artifact straight from the repository into kpkg.OpenStream,
+// so nothing has to be written to the Kindle's small /tmp. With WithDeltaCache, packages that
+// publish deltas are reconstructed or downloaded into the cache instead, and opened from there.
+func (r *HTTPRepository) OpenPackage(
+	ctx context.Context, pkg *RepoPackage, opts ...kpkg.OpenOption,
+) (*kpkg.KPKG, error) {
+	if pkg.RepositoryID != r.repoConfig.ID {
+		return nil, fmt.Errorf("package %s does not belong to repository %s", pkg.ID, r.repoConfig.ID)
+	}
+	art := r.findArtifact(pkg.ID, pkg.Version)
+	if art == nil {
+		return nil, fmt.Errorf("no artifact for %s in repository %s", pkg, r.repoConfig.ID)
+	}
+
+	sigData, err := fetchSignature(ctx, art.URL+kpkg.SignatureSuffix)
+	if err != nil {
+		return nil, errors.Wrapf(err, "fetching signature for %s", pkg)
+	}
+	var sig *kpkg.Signature
+	if sigData != nil {
+		sig, err = kpkg.ParseSignature(sigData)
+		if err != nil {
+			return nil, errors.Wrapf(err, "parsing signature for %s", pkg)
+		}
+		opts = append(opts, kpkg.WithSignature(sig))
+	}
+
+	if r.usesDeltas(pkg.ID) {
+		p, cached, err := r.fetchToCache(ctx, pkg, art)
+		if err != nil {
+			return nil, errors.Wrapf(err, "fetching %s", pkg)
+		}
+		k, err := kpkg.Open(ctx, p, opts...)
+		if err == nil && cached && sig != nil {
+			// the signature is only checked as the package is extracted, too late to fetch it again
+			err = matchesSignature(ctx, k, sig)
+			if err != nil {
+				_ = k.Close()
+			}
+		}
+		if err != nil {
+			// a cached copy could be damaged, or from a republished version; the artifact has the last word
+			slog.Warn("cached package did not open, downloading it again", "path", p, "error", err)
+			_ = os.Remove(p)
+			err = downloadFile(ctx, art.URL, p)
+			if err != nil {
+				return nil, errors.Wrapf(err, "fetching %s", pkg)
+			}
+			k, err = kpkg.Open(ctx, p, opts...)
+			if err != nil {
+				return nil, errors.Wrapf(err, "kpkg.Open(%q)", p)
+			}
+		}
+		return k, nil
+	}
+
+	body, err := httpGet(ctx, art.URL)
+	if err != nil {
+		return nil, err
+	}
+	k, err := kpkg.OpenStream(ctx, body, opts...)
+	if err != nil {
+		_ = body.Close()
+		return nil, errors.Wrapf(err, "kpkg.OpenStream(%q)", art.URL)
+	}
+	k.RegisterCloser(body.Close)
+	return k, nil
+}
+
+func httpGet(ctx context.Context, rawurl string) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawurl, nil)
+	if err != nil {
+		return nil, errors.Wrapf(err, "http.NewRequestWithContext(%q)", rawurl)
+	}
+	req.Header.Set("User-Agent", version.FullVersion)
+	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
-		return errors.Wrapf(err, "http.NewRequestWithContext(%q)", art.URL)
+		return nil, errors.Wrapf(err, "http.Get(%q)", rawurl)
+	}
+	if resp.StatusCode != http.StatusOK {
+		_ = resp.Body.Close()
+		return nil, fmt.Errorf("unexpected status %q for %q", resp.Status, rawurl)
+	}
+	return resp.Body, nil
+}
+
+// fetchSignature fetches the detached signature for an artifact. Signatures are optional
+// in a repository, so a 404 is not an error: the package is just treated as unsigned, and nil is returned.
+func fetchSignature(ctx context.Context, sigURL string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, sigURL, nil)
+	if err != nil {
+		return nil, errors.Wrapf(err, "http.NewRequestWithContext(%q)", sigURL)
 	}
 	req.Header.Set("User-Agent", version.FullVersion)
 	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
-		return errors.Wrapf(err, "http.Get(%q)", art.URL)
+		return nil, errors.Wrapf(err, "http.Get(%q)", sigURL)
 	}
 	defer resp.Body.Close() //nolint:errcheck
 
-	outFile, err := os.Create(destPath)
+	if resp.StatusCode == http.StatusNotFound {
+		slog.Debug("no signature for artifact", "url", sigURL)
+		return nil, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %q for %q", resp.Status, sigURL)
+	}
+	data, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return errors.Wrapf(err, "os.Create(%q)", destPath)
+		return nil, errors.Wrapf(err, "reading %q", sigURL)
 	}
-	defer outFile.Close()
+	return data, nil
+}
 
-	_, err = io.Copy(outFile, resp.Body)
+func downloadSignature(ctx context.Context, sigURL, destPath string) error {
+	data, err := fetchSignature(ctx, sigURL)
+	if err != nil || data == nil {
+		return err
+	}
+	err = os.WriteFile(destPath, data, 0o644) //nolint:gosec
 	if err != nil {
-		return errors.Wrapf(err, "io.Copy() to %q", destPath)
+		return errors.Wrapf(err, "os.WriteFile(%q)", destPath)
 	}
 	return nil
 }
@@ -336,6 +501,20 @@ func (r *MultiRepository) DownloadPackage(
 	return fmt.Errorf("package %s not found in any repository", pkg.ID)
 }
 
+func (r *MultiRepository) OpenPackage(
+	ctx context.Context, pkg *RepoPackage, opts ...kpkg.OpenOption,
+) (*kpkg.KPKG, error) {
+	for _, r := range r.repos {
+		if r.ID() != pkg.RepositoryID {
+			continue
+		}
+		slog.Debug("MultiRepository.OpenPackage() trying repo", "repo", r.ID(), "for package", pkg.ID)
+		k, err := r.OpenPackage(ctx, pkg, opts...)
+		return k, errors.AddStack(err)
+	}
+	return nil, fmt.Errorf("package %s not found in any repository", pkg.ID)
+}
+
 // FetchPackages fetches each repository and adds their packages to the collection of PackageArtifacts.
 func (r *MultiRepository) FetchPackages(ctx context.Context) ([]*RepoPackage, error) {
 	slog.Debug("fetching packages", "repos", r.repos)
@@ -0,0 +1,82 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/clintharrison/go-kindle-pkg/pkg/kpkg"
+	"github.com/clintharrison/go-kindle-pkg/pkg/repository/manifest"
+)
+
+const StreamRepoID = "$kpkgstream"
+
+// StreamRepository offers a single package that has already been opened with kpkg.OpenStream,
+// such as one piped to `kpmgo install -`. The stream can only be read once, so the package can't be
+// downloaded, and OpenPackage ignores its options: they must be given to kpkg.OpenStream instead.
+type StreamRepository struct {
+	kpkg   *kpkg.KPKG
+	pkg    *RepoPackage
+	opened bool
+}
+
+var _ Repository = (*StreamRepository)(nil)
+
+func NewStreamRepository(k *kpkg.KPKG) *StreamRepository {
+	m := k.Manifest
+	deps := make([]manifest.Dependency, 0, len(m.Dependencies))
+	for dID, d := range m.Dependencies {
+		deps = append(deps, manifest.Dependency{
+			ID:           dID,
+			Min:          d.Min,
+			Max:          d.Max,
+			RepositoryID: d.RepositoryID,
+		})
+	}
+	artifact := &manifest.Artifact{
+		URL:           "-",
+		Version:       m.Version,
+		SupportedArch: m.SupportedArch,
+		Dependencies:  deps,
+		Deltas:        nil,
+	}
+	return &StreamRepository{
+		kpkg:   k,
+		pkg:    NewRepoPackage(m.ID, StreamRepoID, artifact),
+		opened: false,
+	}
+}
+
+func (r *StreamRepository) String() string {
+	return fmt.Sprintf("StreamRepository(%s)", r.pkg)
+}
+
+func (r *StreamRepository) ID() string {
+	return StreamRepoID
+}
+
+func (r *StreamRepository) FetchPackages(_ context.Context) ([]*RepoPackage, error) {
+	return []*RepoPackage{r.pkg}, nil
+}
+
+func (r *StreamRepository) DownloadPackage(
+	_ context.Context, pkg *RepoPackage, destPath string, dryRun bool,
+) error {
+	if dryRun {
+		fmt.Printf("  [dry run] Reading package %s version %s from stream\n", pkg.ID, pkg.Version.String())
+		return nil
+	}
+	return fmt.Errorf("package %s was streamed and cannot be downloaded to %q", pkg.ID, destPath)
+}
+
+func (r *StreamRepository) OpenPackage(
+	_ context.Context, pkg *RepoPackage, _ ...kpkg.OpenOption,
+) (*kpkg.KPKG, error) {
+	if pkg.ID != r.pkg.ID || pkg.Version != r.pkg.Version {
+		return nil, fmt.Errorf("package %s not found in stream repository", pkg)
+	}
+	if r.opened {
+		return nil, fmt.Errorf("package %s has already been read from the stream", pkg)
+	}
+	r.opened = true
+	return r.kpkg, nil
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"log/slog"
 	"slices"
+	"strings"
 
 	"github.com/clintharrison/go-kindle-pkg/pkg/repository"
 	"github.com/clintharrison/go-kindle-pkg/pkg/repository/manifest"
@@ -121,6 +122,8 @@ func NewResolver(universe []*VersionedPackage) *Resolver {
 
 type options struct {
 	existingArtifacts []*VersionedPackage
+	preferredVersions map[ArtifactID]manifest.SemanticVersion
+	arch              string
 }
 
 type OptionFunc func(*options)
@@ -131,9 +134,57 @@ func WithArtifacts(artifacts []*VersionedPackage) OptionFunc {
 	}
 }
 
+// WithPreferredVersions tries the given version of each package before any other, instead of the
+// highest. If the preferred one can't satisfy the constraints, the versions above it are tried
+// next, lowest first, so a package is upgraded only as far as it has to be; lower versions are
+// tried last.
+func WithPreferredVersions(versions map[ArtifactID]manifest.SemanticVersion) OptionFunc {
+	return func(o *options) {
+		o.preferredVersions = versions
+	}
+}
+
+// WithArch leaves out the versions of packages that don't support arch, the architecture they're
+// being installed for, so a dependency resolves to a version the device can run. Packages that
+// don't list their architectures are taken to support them all, and an empty arch allows every
+// version.
+func WithArch(arch string) OptionFunc {
+	return func(o *options) {
+		o.arch = arch
+	}
+}
+
+// RetainInstalled returns constraints that keep every installed package installed, alongside the
+// requested ones, and the preferred versions that keep them at their installed versions unless
+// the request needs them upgraded. Packages that are requested themselves are left to the request.
+func RetainInstalled(
+	installed map[ArtifactID][]*VersionedPackage, requested []*Constraint,
+) ([]*Constraint, map[ArtifactID]manifest.SemanticVersion) {
+	constraints := make([]*Constraint, 0, len(requested)+len(installed))
+	constraints = append(constraints, requested...)
+	preferred := make(map[ArtifactID]manifest.SemanticVersion, len(installed))
+	for id, arts := range installed {
+		if len(arts) == 0 || slices.ContainsFunc(requested, func(c *Constraint) bool { return c.ID == id }) {
+			continue
+		}
+		// there should only be one installed version, but keep the newest if there are more
+		newest := slices.MaxFunc(arts, func(a, b *VersionedPackage) int { return a.Version.Compare(b.Version) })
+		v := newest.Version
+		constraints = append(constraints, &Constraint{ID: id, Min: &v, Max: nil, RepositoryID: nil})
+		preferred[id] = v
+	}
+	// map order is random, and the order constraints are tried in changes which solution is found
+	slices.SortStableFunc(constraints[len(requested):], func(a, b *Constraint) int {
+		return strings.Compare(string(a.ID), string(b.ID))
+	})
+	return constraints, preferred
+}
+
 func (r *Resolver) Resolve(constraints []*Constraint, opts ...OptionFunc) (map[ArtifactID]*VersionedPackage, error) {
 	options := &options{
 		existingArtifacts: []*VersionedPackage{},
+		preferredVersions: nil,
+		arch:              "",
 	}
 	for _, opt := range opts {
 		opt(options)
@@ -147,17 +198,31 @@ func (r *Resolver) Resolve(constraints []*Constraint, opts ...OptionFunc) (map[A
 		r.packages[a.ID] = append(r.packages[a.ID], a)
 	}
 
-	res, success := r.resolveRecursive(constraints, resolved)
+	res, success := r.resolveRecursive(constraints, resolved, options)
 	if !success {
 		return nil, errors.Errorf("unable to resolve desired packages")
 	}
 	return res, nil
 }
 
+// preferenceRank groups versions by how they compare to the preferred version pv: pv itself, then
+// upgrades, then downgrades.
+func preferenceRank(v, pv manifest.SemanticVersion) int {
+	switch c := v.Compare(pv); {
+	case c == 0:
+		return 0
+	case c > 0:
+		return 1
+	default:
+		return 2
+	}
+}
+
 // resolvedRecursive takes the remaining unresolved constraints and the current resolved map,
 // and attempts to resolve all constraints recursively, returning the final resolved map or an error.
 func (r *Resolver) resolveRecursive(
 	constraints []*Constraint, resolved map[ArtifactID]*VersionedPackage,
+	opts *options,
 ) (map[ArtifactID]*VersionedPackage, bool) {
 	slog.Debug("resolveRecursive called", "constraints", constraints, "resolved", resolved)
 	if len(constraints) == 0 {
@@ -178,17 +243,30 @@ func (r *Resolver) resolveRecursive(
 	if currVer, ok := resolved[cid]; ok {
 		if constraint.Allows(currVer) {
 			// "drop" this constraint and continue resolving the rest
-			return r.resolveRecursive(constraintsRemaining, resolved)
+			return r.resolveRecursive(constraintsRemaining, resolved, opts)
 		}
 		// conflict! we'll need to backtrack
 		return nil, false
 	}
 
-	// candidate list is ordered descending by version (by default)
+	// candidate list is ordered descending by version (by default), or outward from any preferred
+	// version: it first, then upgrades ascending, then downgrades descending
 	// TODO: consider repository order -- which must always be descending priority?
 	candidates := make([]*VersionedPackage, len(r.packages[cid]))
 	copy(candidates, r.packages[cid])
+	pv, hasPreferred := opts.preferredVersions[cid]
 	slices.SortFunc(candidates, func(a, b *VersionedPackage) int {
+		if hasPreferred {
+			ar, br := preferenceRank(a.Version, pv), preferenceRank(b.Version, pv)
+			switch {
+			case ar != br:
+				return ar - br
+			case ar == 1:
+				return a.Version.Compare(b.Version)
+			default:
+				return b.Version.Compare(a.Version)
+			}
+		}
 		if r.preferMaxVersion {
 			return b.Version.Compare(a.Version)
 		}
@@ -200,6 +278,10 @@ func (r *Resolver) resolveRecursive(
 			slog.Debug("skipping candidate that does not satisfy constraint", "constraint", constraint, "candidate", candidate)
 			continue
 		}
+		if opts.arch != "" && len(candidate.SupportedArch) > 0 && !slices.Contains(candidate.SupportedArch, opts.arch) {
+			slog.Debug("skipping candidate that does not support the architecture", "arch", opts.arch, "candidate", candidate)
+			continue
+		}
 
 		// tentatively select this candidate: this may be backtracked
 		resolved[cid] = candidate
@@ -208,7 +290,7 @@ func (r *Resolver) resolveRecursive(
 		newConstraints := make([]*Constraint, 0, len(constraintsRemaining)+len(candidate.Dependencies))
 		newConstraints = append(newConstraints, constraintsRemaining...)
 		newConstraints = append(newConstraints, candidate.Dependencies...)
-		res, success := r.resolveRecursive(newConstraints, resolved)
+		res, success := r.resolveRecursive(newConstraints, resolved, opts)
 		if success {
 			return res, true
 		}
@@ -255,6 +337,14 @@ func DiffInstallations(
 	return add, rm
 }
 
+// RemovalOrder orders packages to be removed so that each comes before the packages it depends
+// on, which DiffInstallations' order of installing doesn't do.
+func RemovalOrder(rm []*VersionedPackage) []*VersionedPackage {
+	ordered := sortedChangeOrder(rm)
+	slices.Reverse(ordered)
+	return ordered
+}
+
 func sortedChangeOrder(changes []*VersionedPackage) []*VersionedPackage {
 	type node struct {
 		art      *VersionedPackage
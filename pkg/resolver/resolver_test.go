@@ -390,3 +390,121 @@ func TestDiffInstallations_InstallsInDependencyOrder(t *testing.T) {
 		})
 	}
 }
+
+func TestRetainInstalled(t *testing.T) {
+	t.Parallel()
+	universe := []*VersionedPackage{
+		mkPkgA("koreader", 1, 0, 0, mkMinC("fbink", 1, 0, 0)),
+		mkPkgA("koreader", 2, 0, 0, mkMinC("fbink", 1, 0, 0)),
+		mkPkgA("fbink", 1, 0, 0),
+		mkPkgA("fbink", 1, 1, 0),
+		mkPkgA("fbink", 2, 0, 0),
+		mkPkgA("pfetch", 1, 0, 0),
+		mkPkgA("kterm", 1, 0, 0, mkMinC("fbink", 1, 1, 0)),
+	}
+	current := map[ArtifactID][]*VersionedPackage{
+		"koreader": {mkPkgA("koreader", 1, 0, 0, mkMinC("fbink", 1, 0, 0))},
+		"fbink":    {mkPkgA("fbink", 1, 0, 0)},
+	}
+
+	tests := []struct {
+		name        string
+		requested   []*Constraint
+		expectedAdd []string
+		expectedRm  []string
+	}{
+		{
+			name:        "unrelated package leaves the installed ones alone",
+			requested:   []*Constraint{mkC("pfetch")},
+			expectedAdd: []string{"pfetch-1.0.0"},
+			expectedRm:  nil,
+		},
+		{
+			name:        "dependency is upgraded only as far as the new package needs",
+			requested:   []*Constraint{mkC("kterm")},
+			expectedAdd: []string{"fbink-1.1.0", "kterm-1.0.0"},
+			expectedRm:  []string{"fbink-1.0.0"},
+		},
+		{
+			name:        "requested package that's installed is upgraded",
+			requested:   []*Constraint{mkC("koreader")},
+			expectedAdd: []string{"koreader-2.0.0"},
+			expectedRm:  []string{"koreader-1.0.0"},
+		},
+		{
+			name:        "nothing requested changes nothing",
+			requested:   nil,
+			expectedAdd: nil,
+			expectedRm:  nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			constraints, preferred := RetainInstalled(current, tt.requested)
+			result, err := NewResolver(universe).Resolve(constraints, WithPreferredVersions(preferred))
+			require.NoError(t, err)
+			add, rm := DiffInstallations(current, result)
+
+			var addIDs, rmIDs []string
+			for _, a := range add {
+				addIDs = append(addIDs, a.String())
+			}
+			for _, a := range rm {
+				rmIDs = append(rmIDs, a.String())
+			}
+			require.ElementsMatch(t, tt.expectedAdd, addIDs)
+			require.ElementsMatch(t, tt.expectedRm, rmIDs)
+		})
+	}
+
+	// without a preference, the highest allowed version is picked as usual
+	result, err := NewResolver(universe).Resolve([]*Constraint{mkMinC("fbink", 1, 0, 0)})
+	require.NoError(t, err)
+	require.Equal(t, mkSV(2, 0, 0), result["fbink"].Version)
+}
+
+func TestResolver_WithArch(t *testing.T) {
+	t.Parallel()
+	armel := mkPkgA("fbink", 1, 0, 0)
+	armel.SupportedArch = []string{"armel"}
+	armhf := mkPkgA("fbink", 2, 0, 0)
+	armhf.SupportedArch = []string{"armhf"}
+	universe := []*VersionedPackage{
+		mkPkgA("koreader", 1, 0, 0, mkC("fbink")),
+		armel,
+		armhf,
+	}
+
+	// the newest version is only picked if the device can run it; koreader doesn't list its
+	// architectures, so it supports them all
+	result, err := NewResolver(universe).Resolve([]*Constraint{mkC("koreader")}, WithArch("armel"))
+	require.NoError(t, err)
+	require.Equal(t, mkSV(1, 0, 0), result["fbink"].Version)
+	result, err = NewResolver(universe).Resolve([]*Constraint{mkC("koreader")}, WithArch("armhf"))
+	require.NoError(t, err)
+	require.Equal(t, mkSV(2, 0, 0), result["fbink"].Version)
+
+	_, err = NewResolver(universe).Resolve([]*Constraint{mkMinC("fbink", 2, 0, 0)}, WithArch("armel"))
+	require.Error(t, err)
+	_, err = NewResolver(universe).Resolve([]*Constraint{mkC("koreader")}, WithArch("arm64"))
+	require.Error(t, err)
+	// without an architecture, nothing is left out
+	result, err = NewResolver(universe).Resolve([]*Constraint{mkC("koreader")})
+	require.NoError(t, err)
+	require.Equal(t, mkSV(2, 0, 0), result["fbink"].Version)
+}
+
+func TestRemovalOrder(t *testing.T) {
+	t.Parallel()
+	rm := []*VersionedPackage{
+		mkPkgA("fbink", 1, 0, 0),
+		mkPkgA("pfetch", 1, 0, 0, mkMinC("kterm", 1, 0, 0)),
+		mkPkgA("kterm", 1, 0, 0, mkMinC("fbink", 1, 0, 0)),
+	}
+	var ids []string
+	for _, a := range RemovalOrder(rm) {
+		ids = append(ids, a.String())
+	}
+	require.Equal(t, []string{"pfetch-1.0.0", "kterm-1.0.0", "fbink-1.0.0"}, ids)
+}
@@ -0,0 +1,284 @@
+package state
+
+import (
+	"encoding/json"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/clintharrison/go-kindle-pkg/pkg/repository/manifest"
+	"github.com/clintharrison/go-kindle-pkg/pkg/version"
+	"github.com/pingcap/errors"
+)
+
+const (
+	// DBFile is the installed-package database's name in the base directory.
+	DBFile = "installed.json"
+	// DBVersion is the version of the database format this version of kpmgo writes. Version 1
+	// had no world set.
+	DBVersion = 2
+	// UnknownRepositoryID is the origin of packages that weren't installed by a version of kpmgo
+	// that kept the database, such as ones copied onto the Kindle by hand.
+	UnknownRepositoryID = "<installed>"
+)
+
+// Origin is where an installed package came from.
+type Origin struct {
+	RepositoryID string `json:"repository_id"`
+	// SHA256 is the digest of the package's decompressed payload, which is what signatures cover,
+	// so it's the same however the package was compressed or delivered.
+	SHA256 string `json:"sha256,omitempty"`
+}
+
+// InstalledPackage is the database's record of a package in pkgs/.
+type InstalledPackage struct {
+	Origin
+
+	Manifest    *manifest.Manifest `json:"manifest"`
+	InstalledAt time.Time          `json:"installed_at"`
+	// Explicit is set if the package is in the world set, rather than installed as a dependency.
+	Explicit bool `json:"explicit"`
+	// Files are the package's files, relative to its directory, as it was installed. Files its
+	// scripts create aren't included.
+	Files []string `json:"files"`
+}
+
+// Constraint is a package that was asked for, and the versions it was asked for at.
+type Constraint struct {
+	ID string `json:"id"`
+	// Min is inclusive and Max exclusive, as for the resolver.
+	Min *manifest.SemanticVersion `json:"min,omitempty"`
+	Max *manifest.SemanticVersion `json:"max,omitempty"`
+}
+
+// DB is the installed-package database, which install and uninstall keep up to date.
+type DB struct {
+	Version  int                          `json:"version"`
+	Packages map[string]*InstalledPackage `json:"packages"`
+	// World is the set of packages that were asked for, sorted by ID. Everything else that's
+	// installed is only there as their dependencies, and can be autoremoved once it isn't.
+	World []Constraint `json:"world"`
+}
+
+// DBPath is where the database is kept for the base directory.
+func DBPath(baseDir string) string {
+	return filepath.Join(baseDir, DBFile)
+}
+
+// LoadDB reads the database for the base directory, and reconciles it with pkgs/: packages that
+// are there but have no record, because they were installed before there was a database or were
+// copied in by hand, are imported from their manifests, and records of packages that are gone are
+// dropped. The reconciled database is only written when packages are next changed.
+func LoadDB(baseDir string) (*DB, error) {
+	p := DBPath(baseDir)
+	db, err := ReadDB(p)
+	if os.IsNotExist(errors.Cause(err)) {
+		slog.Debug("no installed-package database yet, importing pkgs/", "path", p)
+		db = &DB{Version: DBVersion, Packages: map[string]*InstalledPackage{}, World: nil}
+	} else if err != nil {
+		return nil, err
+	}
+	err = db.reconcile(baseDir)
+	if err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+// ReadDB reads the database at p, as it is.
+func ReadDB(p string) (*DB, error) {
+	data, err := os.ReadFile(p)
+	if err != nil {
+		return nil, errors.AddStack(err)
+	}
+	var db DB
+	err = json.Unmarshal(data, &db)
+	if err != nil {
+		return nil, errors.Annotatef(err, "reading %s", p)
+	}
+	if db.Version > DBVersion || db.Version < 1 {
+		return nil, errors.Errorf("%s has version %d, but %s %s only reads versions up to %d",
+			p, db.Version, version.CLIName, version.FullVersion, DBVersion)
+	}
+	if db.Packages == nil {
+		db.Packages = map[string]*InstalledPackage{}
+	}
+	// older versions are upgraded as they're read, and written back when packages next change
+	if db.Version == 1 {
+		for id, ip := range db.Packages {
+			if ip.Explicit {
+				db.Request(Constraint{ID: id, Min: nil, Max: nil})
+			}
+		}
+		db.Version = DBVersion
+	}
+	return &db, nil
+}
+
+// Save writes the database to p, replacing it all at once.
+func (db *DB) Save(p string) error {
+	data, err := json.MarshalIndent(db, "", "  ")
+	if err != nil {
+		return errors.AddStack(err)
+	}
+	tmp := p + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return errors.AddStack(err)
+	}
+	_, err = f.Write(append(data, '\n'))
+	if err == nil {
+		err = f.Sync()
+	}
+	cerr := f.Close()
+	if err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, p)
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+		return errors.Annotatef(err, "writing %s", p)
+	}
+	return nil
+}
+
+// Install records p, replacing any record of an older version. It's explicit if it's in the
+// world set, so a package that was asked for stays explicit when it's upgraded as a dependency.
+func (db *DB) Install(p *InstalledPackage) {
+	p.Explicit = db.Requested(p.Manifest.ID)
+	db.Packages[p.Manifest.ID] = p
+}
+
+// Remove drops the record of package id. It stays in the world set, as it's removed to be
+// replaced as often as it's uninstalled; see Forget.
+func (db *DB) Remove(id string) {
+	delete(db.Packages, id)
+}
+
+// Request adds c to the world set, replacing any constraint on the same package.
+func (db *DB) Request(c Constraint) {
+	db.World = slices.DeleteFunc(db.World, func(w Constraint) bool { return w.ID == c.ID })
+	db.World = append(db.World, c)
+	slices.SortFunc(db.World, func(a, b Constraint) int { return strings.Compare(a.ID, b.ID) })
+	if p, ok := db.Packages[c.ID]; ok {
+		p.Explicit = true
+	}
+}
+
+// Forget takes package id out of the world set, so it's only kept as a dependency.
+func (db *DB) Forget(id string) {
+	db.World = slices.DeleteFunc(db.World, func(w Constraint) bool { return w.ID == id })
+	if p, ok := db.Packages[id]; ok {
+		p.Explicit = false
+	}
+}
+
+// Requested reports whether package id is in the world set.
+func (db *DB) Requested(id string) bool {
+	return slices.ContainsFunc(db.World, func(w Constraint) bool { return w.ID == id })
+}
+
+func (db *DB) reconcile(baseDir string) error {
+	pkgsDir := filepath.Join(baseDir, "pkgs")
+	entries, err := os.ReadDir(pkgsDir)
+	if err != nil && !os.IsNotExist(err) {
+		return errors.AddStack(err)
+	}
+	var found, imported []string
+	for _, e := range entries {
+		_, err := os.Stat(filepath.Join(pkgsDir, e.Name(), "manifest.json"))
+		if !e.IsDir() || err != nil {
+			continue
+		}
+		found = append(found, e.Name())
+		if _, ok := db.Packages[e.Name()]; ok {
+			continue
+		}
+		p, err := ScanPackage(filepath.Join(pkgsDir, e.Name()))
+		if err != nil {
+			return err
+		}
+		slog.Debug("importing package into the installed-package database", "id", e.Name())
+		db.Packages[e.Name()] = p
+		imported = append(imported, e.Name())
+	}
+	// there's no telling whether a package was asked for, so it's taken to have been unless
+	// another installed package depends on it, in which case it's taken to be that one's dependency
+	for _, id := range imported {
+		if !db.isDependency(id) {
+			db.Request(Constraint{ID: id, Min: nil, Max: nil})
+		}
+	}
+	for id := range db.Packages {
+		if !slices.Contains(found, id) {
+			slog.Warn("package is in the installed-package database but not in pkgs/, forgetting it", "id", id)
+			db.Remove(id)
+			db.Forget(id)
+		}
+	}
+	return nil
+}
+
+// isDependency reports whether any other installed package depends on package id.
+func (db *DB) isDependency(id string) bool {
+	for other, p := range db.Packages {
+		if _, ok := p.Manifest.Dependencies[id]; ok && other != id {
+			return true
+		}
+	}
+	return false
+}
+
+// ScanPackage makes a record for the package in dir from its files, with an unknown origin. Its
+// install time is when its manifest was written.
+func ScanPackage(dir string) (*InstalledPackage, error) {
+	mp := filepath.Join(dir, "manifest.json")
+	data, err := os.ReadFile(mp)
+	if err != nil {
+		return nil, errors.AddStack(err)
+	}
+	var m manifest.Manifest
+	err = json.Unmarshal(data, &m)
+	if err != nil {
+		return nil, errors.Annotatef(err, "reading %s", mp)
+	}
+	info, err := os.Stat(mp)
+	if err != nil {
+		return nil, errors.AddStack(err)
+	}
+	files, err := ListFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+	return &InstalledPackage{
+		Origin:      Origin{RepositoryID: UnknownRepositoryID, SHA256: ""},
+		Manifest:    &m,
+		InstalledAt: info.ModTime().UTC(),
+		Explicit:    false,
+		Files:       files,
+	}, nil
+}
+
+// ListFiles lists the files under dir, relative to it and with forward slashes.
+func ListFiles(dir string) ([]string, error) {
+	var files []string
+	err := fs.WalkDir(os.DirFS(dir), ".", func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return errors.AddStack(err)
+		}
+		if !d.IsDir() {
+			files = append(files, p)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Annotatef(err, "listing %s", dir)
+	}
+	return files, nil
+}
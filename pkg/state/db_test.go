@@ -0,0 +1,144 @@
+package state_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/clintharrison/go-kindle-pkg/pkg/repository/manifest"
+	"github.com/clintharrison/go-kindle-pkg/pkg/state"
+	"github.com/stretchr/testify/require"
+)
+
+func writePackage(t *testing.T, baseDir, id string) {
+	t.Helper()
+	dir := filepath.Join(baseDir, "pkgs", id)
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "bin"), 0o755))
+	data := `{"id": "` + id + `", "version": [1, 2, 3], "dependencies": {"dep": {"id": "dep"}}}`
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "manifest.json"), []byte(data), 0o644))    //nolint:gosec
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "bin", id), []byte("#!/bin/sh\n"), 0o644)) //nolint:gosec
+}
+
+func TestLoadDB_Migrate(t *testing.T) {
+	t.Parallel()
+	baseDir := t.TempDir()
+	writePackage(t, baseDir, "a")
+	// not a package without a manifest
+	require.NoError(t, os.MkdirAll(filepath.Join(baseDir, "pkgs", "junk"), 0o755))
+
+	db, err := state.LoadDB(baseDir)
+	require.NoError(t, err)
+	require.Len(t, db.Packages, 1)
+	a := db.Packages["a"]
+	require.Equal(t, state.Origin{RepositoryID: state.UnknownRepositoryID, SHA256: ""}, a.Origin)
+	// there's no telling whether it was asked for, so it's taken to have been, as nothing
+	// depends on it
+	require.True(t, a.Explicit)
+	require.Equal(t, []state.Constraint{{ID: "a", Min: nil, Max: nil}}, db.World)
+	require.Equal(t, manifest.SemanticVersion{Major: 1, Minor: 2, Patch: 3}, a.Manifest.Version)
+	require.Equal(t, []string{"bin/a", "manifest.json"}, a.Files)
+	require.False(t, a.InstalledAt.IsZero())
+	// importing doesn't write the database; the next change to the packages does
+	require.NoFileExists(t, state.DBPath(baseDir))
+}
+
+func TestLoadDB_MigrateDependencies(t *testing.T) {
+	t.Parallel()
+	baseDir := t.TempDir()
+	writePackage(t, baseDir, "a")
+	writePackage(t, baseDir, "b")
+	writePackage(t, baseDir, "dep")
+
+	// dep is installed because a and b depend on it, so it's imported as their dependency, and
+	// can be autoremoved once they're gone
+	db, err := state.LoadDB(baseDir)
+	require.NoError(t, err)
+	require.Len(t, db.Packages, 3)
+	require.True(t, db.Requested("a"))
+	require.True(t, db.Requested("b"))
+	require.False(t, db.Requested("dep"))
+	require.False(t, db.Packages["dep"].Explicit)
+	rm, err := db.Unneeded([]string{"a", "b"}, []string{"a", "b"})
+	require.NoError(t, err)
+	require.Len(t, rm, 1)
+	require.Equal(t, "dep", string(rm[0].ID))
+}
+
+func TestLoadDB_Reconcile(t *testing.T) {
+	t.Parallel()
+	baseDir := t.TempDir()
+	writePackage(t, baseDir, "a")
+	writePackage(t, baseDir, "b")
+	db, err := state.LoadDB(baseDir)
+	require.NoError(t, err)
+	installedAt := time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC)
+	db.Packages["a"].Origin = state.Origin{RepositoryID: "repo", SHA256: "abc"}
+	db.Packages["a"].InstalledAt = installedAt
+	require.NoError(t, db.Save(state.DBPath(baseDir)))
+
+	// b is removed and c copied in by hand, behind kpmgo's back
+	require.NoError(t, os.RemoveAll(filepath.Join(baseDir, "pkgs", "b")))
+	writePackage(t, baseDir, "c")
+
+	db, err = state.LoadDB(baseDir)
+	require.NoError(t, err)
+	require.Len(t, db.Packages, 2)
+	require.Equal(t, state.Origin{RepositoryID: "repo", SHA256: "abc"}, db.Packages["a"].Origin)
+	require.Equal(t, installedAt, db.Packages["a"].InstalledAt)
+	require.Equal(t, state.UnknownRepositoryID, db.Packages["c"].RepositoryID)
+	require.False(t, db.Requested("b"))
+	require.True(t, db.Requested("c"))
+}
+
+func TestDB_Install(t *testing.T) {
+	t.Parallel()
+	baseDir := t.TempDir()
+	writePackage(t, baseDir, "a")
+	db, err := state.LoadDB(baseDir)
+	require.NoError(t, err)
+
+	// a package in the world set stays explicit when it's upgraded as a dependency
+	upgrade := &state.InstalledPackage{
+		Origin:      state.Origin{RepositoryID: "repo", SHA256: "def"},
+		Manifest:    &manifest.Manifest{ID: "a", Version: manifest.SemanticVersion{Major: 2}}, //nolint:exhaustruct
+		InstalledAt: time.Now(),
+		Explicit:    false,
+		Files:       []string{"manifest.json"},
+	}
+	db.Remove("a")
+	db.Install(upgrade)
+	require.True(t, db.Packages["a"].Explicit)
+	require.Equal(t, "repo", db.Packages["a"].RepositoryID)
+
+	db.Forget("a")
+	require.False(t, db.Packages["a"].Explicit)
+	require.Empty(t, db.World)
+	minV := manifest.SemanticVersion{Major: 2, Minor: 0, Patch: 0}
+	db.Request(state.Constraint{ID: "a", Min: &minV, Max: nil})
+	require.True(t, db.Packages["a"].Explicit)
+	require.Equal(t, []state.Constraint{{ID: "a", Min: &minV, Max: nil}}, db.World)
+}
+
+func TestReadDB_Upgrade(t *testing.T) {
+	t.Parallel()
+	p := filepath.Join(t.TempDir(), state.DBFile)
+	// version 1 had no world set, only which packages were explicit
+	v1 := `{"version": 1, "packages": {
+		"a": {"repository_id": "repo", "manifest": {"id": "a", "version": [1, 0, 0]}, "explicit": true},
+		"b": {"repository_id": "repo", "manifest": {"id": "b", "version": [1, 0, 0]}, "explicit": false}
+	}}`
+	require.NoError(t, os.WriteFile(p, []byte(v1), 0o644)) //nolint:gosec
+	db, err := state.ReadDB(p)
+	require.NoError(t, err)
+	require.Equal(t, state.DBVersion, db.Version)
+	require.Equal(t, []state.Constraint{{ID: "a", Min: nil, Max: nil}}, db.World)
+}
+
+func TestReadDB_Version(t *testing.T) {
+	t.Parallel()
+	p := filepath.Join(t.TempDir(), state.DBFile)
+	require.NoError(t, os.WriteFile(p, []byte(`{"version": 99, "packages": {}}`), 0o644)) //nolint:gosec
+	_, err := state.ReadDB(p)
+	require.ErrorContains(t, err, "version 99")
+}
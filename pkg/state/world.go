@@ -0,0 +1,61 @@
+package state
+
+import (
+	"slices"
+
+	"github.com/clintharrison/go-kindle-pkg/pkg/resolver"
+	"github.com/pingcap/errors"
+)
+
+// Unneeded returns the installed packages outside the world set's dependency closure, once the
+// packages in removing are gone and the IDs in forgetting are out of the world set. They're in
+// the order to remove them, each before the packages it depends on.
+func (db *DB) Unneeded(removing, forgetting []string) ([]*resolver.VersionedPackage, error) {
+	// the closure is resolved among the installed packages alone, at the versions they're
+	// installed at
+	installed := map[resolver.ArtifactID][]*resolver.VersionedPackage{}
+	var universe []*resolver.VersionedPackage
+	for id, p := range db.Packages {
+		if slices.Contains(removing, id) {
+			continue
+		}
+		rp := p.RepoPackage()
+		var ds []*resolver.Constraint
+		for _, d := range rp.Dependencies {
+			// a dependency is met by the installed package, wherever it came from
+			ds = append(ds, &resolver.Constraint{ID: resolver.ArtifactID(d.ID), Min: d.Min, Max: d.Max, RepositoryID: nil})
+		}
+		vp := &resolver.VersionedPackage{
+			ID:            resolver.ArtifactID(id),
+			RepositoryID:  resolver.RepositoryID(rp.RepositoryID),
+			Version:       rp.Version,
+			Dependencies:  ds,
+			SupportedArch: rp.SupportedArch,
+		}
+		installed[vp.ID] = []*resolver.VersionedPackage{vp}
+		universe = append(universe, vp)
+	}
+
+	world := db.WorldConstraints(slices.Concat(removing, forgetting))
+	needed, err := resolver.NewResolver(universe).Resolve(world)
+	if err != nil {
+		return nil, errors.Annotate(err,
+			"the installed packages don't meet the world set's dependencies, so it's unclear which are unneeded")
+	}
+	_, rm := resolver.DiffInstallations(installed, needed)
+	return resolver.RemovalOrder(rm), nil
+}
+
+// WorldConstraints returns the world set's constraints on the installed packages, other than the
+// IDs in except, so that installing other packages doesn't move the ones asked for out of the
+// versions they were asked for at.
+func (db *DB) WorldConstraints(except []string) []*resolver.Constraint {
+	var cs []*resolver.Constraint
+	for _, c := range db.World {
+		if _, ok := db.Packages[c.ID]; !ok || slices.Contains(except, c.ID) {
+			continue
+		}
+		cs = append(cs, &resolver.Constraint{ID: resolver.ArtifactID(c.ID), Min: c.Min, Max: c.Max, RepositoryID: nil})
+	}
+	return cs
+}
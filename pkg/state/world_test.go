@@ -0,0 +1,95 @@
+package state_test
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/clintharrison/go-kindle-pkg/pkg/repository/manifest"
+	"github.com/clintharrison/go-kindle-pkg/pkg/state"
+	"github.com/stretchr/testify/require"
+)
+
+func mkInstalled(id string, deps ...string) *state.InstalledPackage {
+	ds := map[string]manifest.Dependency{}
+	for _, d := range deps {
+		ds[d] = manifest.Dependency{ID: d, RepositoryID: nil, Min: nil, Max: nil}
+	}
+	//nolint:exhaustruct
+	return &state.InstalledPackage{
+		Origin:   state.Origin{RepositoryID: "repo", SHA256: ""},
+		Manifest: &manifest.Manifest{ID: id, Version: manifest.SemanticVersion{Major: 1}, Dependencies: ds},
+	}
+}
+
+func TestDB_Unneeded(t *testing.T) {
+	t.Parallel()
+	// pfetch and koreader were asked for; the rest came along as dependencies, apart from old,
+	// whose dependent is long gone
+	newDB := func() *state.DB {
+		db := &state.DB{Version: state.DBVersion, Packages: map[string]*state.InstalledPackage{}, World: nil}
+		for _, p := range []*state.InstalledPackage{
+			mkInstalled("pfetch", "kterm"),
+			mkInstalled("kterm", "fbink", "libx"),
+			mkInstalled("libx"),
+			mkInstalled("koreader", "fbink"),
+			mkInstalled("fbink"),
+			mkInstalled("old"),
+		} {
+			db.Install(p)
+		}
+		db.Request(state.Constraint{ID: "pfetch", Min: nil, Max: nil})
+		db.Request(state.Constraint{ID: "koreader", Min: &manifest.SemanticVersion{Major: 1}, Max: nil}) //nolint:exhaustruct
+		return db
+	}
+	ids := func(db *state.DB, removing, forgetting []string) []string {
+		rm, err := db.Unneeded(removing, forgetting)
+		require.NoError(t, err)
+		var ids []string
+		for _, vp := range rm {
+			ids = append(ids, string(vp.ID))
+		}
+		return ids
+	}
+
+	require.Equal(t, []string{"old"}, ids(newDB(), nil, nil))
+
+	// uninstalling pfetch leaves its dependencies unneeded, kterm before the libx it needs, but
+	// koreader still needs fbink
+	rm := ids(newDB(), []string{"pfetch"}, []string{"pfetch"})
+	require.ElementsMatch(t, []string{"kterm", "libx", "old"}, rm)
+	require.Less(t, slices.Index(rm, "kterm"), slices.Index(rm, "libx"))
+
+	// forgetting a package only makes it a dependency
+	require.ElementsMatch(t, []string{"old", "pfetch", "kterm", "libx"}, ids(newDB(), nil, []string{"pfetch"}))
+
+	// a world set the installed packages don't satisfy can't be worked from
+	db := newDB()
+	db.Remove("fbink")
+	_, err := db.Unneeded(nil, nil)
+	require.ErrorContains(t, err, "world set")
+}
+
+func TestDB_WorldConstraints(t *testing.T) {
+	t.Parallel()
+	v1 := manifest.SemanticVersion{Major: 1} //nolint:exhaustruct
+	v2 := manifest.SemanticVersion{Major: 2} //nolint:exhaustruct
+	db := &state.DB{Version: state.DBVersion, Packages: map[string]*state.InstalledPackage{}, World: nil}
+	db.Install(mkInstalled("koreader"))
+	db.Install(mkInstalled("pfetch"))
+	db.Request(state.Constraint{ID: "koreader", Min: &v1, Max: &v2})
+	db.Request(state.Constraint{ID: "pfetch", Min: nil, Max: nil})
+	// asked for, but since deleted by hand
+	db.Request(state.Constraint{ID: "gone", Min: nil, Max: nil})
+
+	cs := db.WorldConstraints(nil)
+	require.Len(t, cs, 2)
+	require.Equal(t, "koreader", string(cs[0].ID))
+	require.Equal(t, &v1, cs[0].Min)
+	require.Equal(t, &v2, cs[0].Max)
+	require.Equal(t, "pfetch", string(cs[1].ID))
+
+	// a package asked for again is left to the new request
+	cs = db.WorldConstraints([]string{"koreader"})
+	require.Len(t, cs, 1)
+	require.Equal(t, "pfetch", string(cs[0].ID))
+}
@@ -0,0 +1,61 @@
+package textdiff_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/clintharrison/go-kindle-pkg/pkg/textdiff"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUnified(t *testing.T) {
+	t.Parallel()
+
+	lines := func(n int) []string {
+		var ls []string
+		for i := 1; i <= n; i++ {
+			ls = append(ls, strings.Repeat("x", i))
+		}
+		return ls
+	}
+	a := strings.Join(lines(20), "\n") + "\n"
+	bLines := lines(20)
+	bLines[1] = "changed"
+	bLines = append(bLines[:15], append([]string{"inserted"}, bLines[15:]...)...)
+	b := strings.Join(bLines, "\n")
+
+	for _, tc := range []struct {
+		name, a, b, want string
+	}{
+		{"same", a, a, ""},
+		{"empty to one line", "", "one\n", "--- a\n+++ b\n@@ -0,0 +1 @@\n+one\n"},
+		{"one line to empty", "one\n", "", "--- a\n+++ b\n@@ -1 +0,0 @@\n-one\n"},
+		{"two hunks and no trailing newline", a, b, `--- a
++++ b
+@@ -1,5 +1,5 @@
+ x
+-xx
++changed
+ xxx
+ xxxx
+ xxxxx
+@@ -13,8 +13,9 @@
+ xxxxxxxxxxxxx
+ xxxxxxxxxxxxxx
+ xxxxxxxxxxxxxxx
++inserted
+ xxxxxxxxxxxxxxxx
+ xxxxxxxxxxxxxxxxx
+ xxxxxxxxxxxxxxxxxx
+ xxxxxxxxxxxxxxxxxxx
+-xxxxxxxxxxxxxxxxxxxx
++xxxxxxxxxxxxxxxxxxxx
+\ No newline at end of file
+`},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			require.Equal(t, tc.want, textdiff.Unified("a", "b", tc.a, tc.b, 3))
+		})
+	}
+}
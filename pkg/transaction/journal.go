@@ -0,0 +1,164 @@
+package transaction
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"github.com/pingcap/errors"
+)
+
+// JournalFile is the journal's name in the transaction's directory.
+const JournalFile = "journal"
+
+// Op is a kind of step in a transaction.
+type Op string
+
+const (
+	// OpStage downloads and extracts a package into staging/: the two are one step, as packages
+	// are extracted as they're downloaded.
+	OpStage Op = "stage"
+	// OpCommit starts changing pkgs/, with the packages to add and remove; it's done once they've
+	// all been changed.
+	OpCommit Op = "commit"
+	// OpUninstall runs a removed package's uninstall.sh.
+	OpUninstall Op = "uninstall"
+	// OpBackup moves a removed package's directory from pkgs/ into backup/.
+	OpBackup Op = "backup"
+	// OpMoveIn moves a new package's directory from staging/ into pkgs/.
+	OpMoveIn Op = "move-in"
+	// OpInstall runs a new package's install.sh.
+	OpInstall Op = "install"
+	// OpDatabase writes the installed-package database, once the packages have been changed.
+	OpDatabase Op = "database"
+	// OpMenu regenerates the KUAL menu, once the packages have been changed.
+	OpMenu Op = "menu"
+	// OpRollback starts undoing the steps that were done; it's done once they've all been undone.
+	OpRollback Op = "rollback"
+)
+
+// Entry is a line in the journal. Each step is written before it starts, and again with Done set
+// once it has finished, so a step that was interrupted has only the first.
+type Entry struct {
+	Op Op     `json:"op"`
+	ID string `json:"id,omitempty"`
+	// Undo marks a step being undone while rolling back, rather than done.
+	Undo bool `json:"undo,omitempty"`
+	Done bool `json:"done,omitempty"`
+	// Add and Remove are the packages an OpCommit changes, in order.
+	Add    []string `json:"add,omitempty"`
+	Remove []string `json:"remove,omitempty"`
+}
+
+// journal is the append-only log of a transaction's steps. Every entry is synced to disk before
+// the step goes ahead, so it survives the Kindle losing power.
+type journal struct {
+	f       *os.File
+	entries []Entry
+	hook    func(Entry)
+}
+
+func openJournal(dir string, hook func(Entry)) (*journal, error) {
+	p := filepath.Join(dir, JournalFile)
+	entries, size, err := readJournal(p)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(p, os.O_WRONLY|os.O_CREATE, 0o644) //nolint:gosec
+	if err != nil {
+		return nil, errors.AddStack(err)
+	}
+	// drop a line that was cut off, so the next entry starts on a line of its own
+	err = f.Truncate(size)
+	if err == nil {
+		_, err = f.Seek(size, io.SeekStart)
+	}
+	if err != nil {
+		_ = f.Close()
+		return nil, errors.AddStack(err)
+	}
+	return &journal{f: f, entries: entries, hook: hook}, nil
+}
+
+// readJournal reads the entries in the journal at p, and the size of the part they're in. A last
+// line that's cut off, from a crash while it was written, is ignored: its step hadn't started.
+func readJournal(p string) ([]Entry, int64, error) {
+	data, err := os.ReadFile(p)
+	if os.IsNotExist(err) {
+		return nil, 0, nil
+	}
+	if err != nil {
+		return nil, 0, errors.AddStack(err)
+	}
+	var entries []Entry
+	var size int64
+	for {
+		line, rest, ok := bytes.Cut(data, []byte("\n"))
+		if !ok {
+			break
+		}
+		var e Entry
+		err := json.Unmarshal(line, &e)
+		if err != nil {
+			break
+		}
+		entries = append(entries, e)
+		size += int64(len(line)) + 1
+		data = rest
+	}
+	if len(data) > 0 {
+		slog.Warn("ignoring the end of the journal, which was cut off", "path", p, "size", size)
+	}
+	return entries, size, nil
+}
+
+func (j *journal) write(e Entry) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return errors.AddStack(err)
+	}
+	_, err = j.f.Write(append(data, '\n'))
+	if err != nil {
+		return errors.Annotate(err, "writing to the journal")
+	}
+	err = j.f.Sync()
+	if err != nil {
+		return errors.Annotate(err, "syncing the journal")
+	}
+	j.entries = append(j.entries, e)
+	if j.hook != nil {
+		j.hook(e)
+	}
+	return nil
+}
+
+func (j *journal) Close() error {
+	return errors.AddStack(j.f.Close())
+}
+
+// has reports whether the journal has an entry for s, undoing it if undo is set, and finished
+// if done is set.
+func (j *journal) has(s step, undo, done bool) bool {
+	return slices.ContainsFunc(j.entries, func(e Entry) bool {
+		return e.Op == s.op && e.ID == s.id && e.Undo == undo && e.Done == done
+	})
+}
+
+// started returns the steps of committing that were started, in order.
+func (j *journal) started() []step {
+	var steps []step
+	for _, e := range j.entries {
+		if e.Undo || e.Done || !slices.Contains([]Op{OpUninstall, OpBackup, OpMoveIn, OpInstall, OpDatabase}, e.Op) {
+			continue
+		}
+		s := step{e.Op, e.ID}
+		if !slices.Contains(steps, s) {
+			steps = append(steps, s)
+		}
+	}
+	return steps
+}
@@ -0,0 +1,9 @@
+package transaction
+
+import (
+	"github.com/pingcap/errors"
+)
+
+// ErrRunning is returned by Interrupted and Recover while a transaction is running in another
+// process, which looks the same on disk as one that was interrupted.
+var ErrRunning = errors.New("a transaction is running in another process") //nolint:gochecknoglobals
@@ -0,0 +1,41 @@
+//go:build !unix
+
+package transaction
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/pingcap/errors"
+)
+
+// lockFile is the lock's name in the base directory, where flock(2) isn't available.
+const lockFile = "transaction.lock"
+
+// lock is a lock file in the base directory, which a transaction holds from New or Recover until
+// it's closed. Transactions only run on a Kindle, which has flock(2); this is for hosts without
+// it, where a lock file left by a crash has to be removed by hand.
+type lock struct {
+	f *os.File
+}
+
+// tryLock takes the lock in dir, failing with ErrRunning rather than waiting if it's held.
+func tryLock(dir string) (*lock, error) {
+	p := filepath.Join(dir, lockFile)
+	f, err := os.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644) //nolint:gosec
+	if os.IsExist(err) {
+		return nil, errors.Annotatef(ErrRunning, "remove %s if it isn't", p)
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "locking %q", dir)
+	}
+	return &lock{f: f}, nil
+}
+
+func (l *lock) unlock() error {
+	err := l.f.Close()
+	if err != nil {
+		return errors.AddStack(err)
+	}
+	return errors.AddStack(os.Remove(l.f.Name()))
+}
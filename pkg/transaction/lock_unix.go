@@ -0,0 +1,40 @@
+//go:build unix
+
+package transaction
+
+import (
+	"os"
+	"syscall"
+
+	"github.com/pingcap/errors"
+)
+
+// lock is an exclusive flock(2) on the base directory, which a transaction holds from New or
+// Recover until it's closed. It's on the base directory rather than the transaction's, as that's
+// there before the transaction's directory is made and after it's removed, so there's no moment
+// a running transaction's directory isn't locked. The kernel drops the lock when the process
+// exits, so an interrupted transaction's directory never is.
+type lock struct {
+	f *os.File
+}
+
+// tryLock takes the lock on dir, failing with ErrRunning rather than waiting if it's held.
+func tryLock(dir string) (*lock, error) {
+	f, err := os.Open(dir)
+	if err != nil {
+		return nil, errors.AddStack(err)
+	}
+	err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err != nil {
+		_ = f.Close()
+		if err == syscall.EWOULDBLOCK { //nolint:errorlint // returned unwrapped
+			return nil, errors.AddStack(ErrRunning)
+		}
+		return nil, errors.Wrapf(err, "locking %q", dir)
+	}
+	return &lock{f: f}, nil
+}
+
+func (l *lock) unlock() error {
+	return errors.AddStack(l.f.Close())
+}
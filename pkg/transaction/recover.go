@@ -0,0 +1,151 @@
+package transaction
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/pingcap/errors"
+)
+
+// Status describes an interrupted transaction, from its journal.
+type Status struct {
+	// Add and Remove are the packages being changed, once committing had started.
+	Add    []string
+	Remove []string
+	// Committing is set once pkgs/ had started changing. Before that, only staging was done, and
+	// there's nothing to recover but removing it.
+	Committing bool
+	// Committed is set once all the packages had been changed, so only the menu might be left.
+	Committed bool
+	// RollingBack is set if the changes were being undone, which can only be finished.
+	RollingBack bool
+	// Last is the last entry in the journal, if there is one.
+	Last *Entry
+}
+
+// CanRollForward reports whether the transaction can be finished, rather than undone.
+func (s *Status) CanRollForward() bool {
+	return s.Committing && !s.RollingBack
+}
+
+// Interrupted returns the status of the transaction in the base directory, or nil if there isn't
+// one. It fails with ErrRunning if the transaction is still running in another process.
+func Interrupted(optFuncs ...Option) (*Status, error) {
+	t := newTransaction(optFuncs)
+	ok, err := t.exists()
+	if !ok || err != nil {
+		return nil, err
+	}
+	l, err := tryLock(t.baseDir)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = l.unlock() }()
+	return t.status()
+}
+
+func (t *Transaction) exists() (bool, error) {
+	_, err := os.Stat(t.dir)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil, errors.AddStack(err)
+}
+
+// status reads the interrupted transaction's status from its journal, with the lock held.
+func (t *Transaction) status() (*Status, error) {
+	// it may have finished in the time it took to take the lock
+	ok, err := t.exists()
+	if !ok || err != nil {
+		return nil, err
+	}
+	entries, _, err := readJournal(filepath.Join(t.dir, JournalFile))
+	if err != nil {
+		return nil, err
+	}
+	s := &Status{Add: nil, Remove: nil, Committing: false, Committed: false, RollingBack: false, Last: nil}
+	for i, e := range entries {
+		switch {
+		case e.Op == OpCommit && !e.Done:
+			s.Committing = true
+			s.Add = e.Add
+			s.Remove = e.Remove
+		case e.Op == OpCommit && e.Done:
+			s.Committed = true
+		case e.Op == OpRollback:
+			s.RollingBack = !e.Done
+		}
+		s.Last = &entries[i]
+	}
+	return s, nil
+}
+
+// Recover finishes an interrupted transaction, rolling it forward to complete the changes, or
+// back to undo them, and then removes it. A transaction that hadn't started committing can only
+// be rolled back, and one that was rolling back already can only carry on. If rolling forward
+// fails, the changes are rolled back, as Commit would. Like Interrupted, it fails with ErrRunning
+// if the transaction is still running in another process.
+func Recover(ctx context.Context, forward bool, optFuncs ...Option) error {
+	t := newTransaction(optFuncs)
+	ok, err := t.exists()
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errors.New("there is no interrupted transaction")
+	}
+	t.lock, err = tryLock(t.baseDir)
+	if err != nil {
+		return err
+	}
+	s, err := t.reopen(forward)
+	if err != nil {
+		_ = t.lock.unlock()
+		return err
+	}
+	defer t.Close() //nolint:errcheck
+
+	switch {
+	case !s.Committing:
+		fmt.Fprintln(t.out, "Removing packages that were staged but not installed") //nolint:errcheck
+		return nil
+	case forward:
+		fmt.Fprintln(t.out, "\033[1mRolling forward changes\033[0m") //nolint:errcheck
+		err = t.forward(ctx)
+		if err != nil {
+			return t.failed(ctx, err)
+		}
+		return nil
+	default:
+		fmt.Fprintln(t.out, "\033[1mRolling back changes\033[0m") //nolint:errcheck
+		err = t.backward(ctx)
+		if err != nil {
+			t.keep = true
+			return err
+		}
+		return nil
+	}
+}
+
+// reopen picks up the interrupted transaction from its journal, with the lock held.
+func (t *Transaction) reopen(forward bool) (*Status, error) {
+	s, err := t.status()
+	if err != nil {
+		return nil, err
+	}
+	if s == nil {
+		return nil, errors.New("there is no interrupted transaction")
+	}
+	if forward && !s.CanRollForward() {
+		return nil, errors.New("the transaction can't be rolled forward, only back")
+	}
+	t.journal, err = openJournal(t.dir, t.hook)
+	if err != nil {
+		return nil, err
+	}
+	t.add = s.Add
+	t.rm = s.Remove
+	return s, nil
+}
@@ -0,0 +1,529 @@
+// Package transaction applies package changes to the installed packages all at once: new packages
+// are staged first, replaced ones are backed up, and if any step fails, pkgs/ is put back as it was.
+// Each step is journaled, so a transaction interrupted by a crash can be recovered later.
+package transaction
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/clintharrison/go-kindle-pkg/pkg/state"
+	"github.com/clintharrison/go-kindle-pkg/pkg/version"
+	"github.com/pingcap/errors"
+)
+
+const (
+	// Dir is the transaction's working directory in the base directory. It's on the same
+	// filesystem as pkgs/, so packages can be moved in and out of it by renaming.
+	Dir        = "transaction"
+	stagingDir = "staging"
+	backupDir  = "backup"
+	// the installed-package database as it'll be once committed, and as it was before
+	newDBFile = "installed.json"
+	oldDBFile = "installed.old.json"
+)
+
+// ErrInProgress is returned by New when another transaction's directory is still there: either
+// one is running, or one was interrupted.
+var ErrInProgress = errors.New("another transaction is in progress, or was interrupted") //nolint:gochecknoglobals
+
+// step is one of the steps of committing, which are journaled.
+type step struct {
+	op Op
+	id string
+}
+
+// Transaction is a set of packages to add and remove from pkgs/. Packages are added with Add,
+// which stages their files, and removed with Remove; nothing in pkgs/ changes until Commit.
+type Transaction struct {
+	baseDir        string
+	userstoreDir   string
+	out            io.Writer
+	regenerateMenu func() error
+	hook           func(Entry)
+
+	dir     string
+	lock    *lock
+	journal *journal
+	add     []string
+	rm      []string
+	// staged are the database records of the added packages
+	staged map[string]*state.InstalledPackage
+	// request and forget are the changes to the world set
+	request []state.Constraint
+	forget  []string
+	// keep is set if the transaction was interrupted or rolling back failed, so its directory is
+	// left for recovery
+	keep bool
+}
+
+type Option func(*Transaction)
+
+// WithBaseDir uses dir as the base directory, with the packages in dir/pkgs, instead of
+// version.BaseDir().
+func WithBaseDir(dir string) Option {
+	return func(t *Transaction) {
+		t.baseDir = dir
+	}
+}
+
+// WithUserstoreDir sets KPM_USERSTORE_DIR for scripts, instead of version.UserstoreDir().
+func WithUserstoreDir(dir string) Option {
+	return func(t *Transaction) {
+		t.userstoreDir = dir
+	}
+}
+
+// WithOutput sends progress messages and scripts' output to w, instead of stdout.
+func WithOutput(w io.Writer) Option {
+	return func(t *Transaction) {
+		t.out = w
+	}
+}
+
+// WithMenu regenerates the KUAL menu with regenerate once the packages have changed.
+func WithMenu(regenerate func() error) Option {
+	return func(t *Transaction) {
+		t.regenerateMenu = regenerate
+	}
+}
+
+// WithJournalHook calls hook with each entry after it's written to the journal.
+func WithJournalHook(hook func(Entry)) Option {
+	return func(t *Transaction) {
+		t.hook = hook
+	}
+}
+
+func newTransaction(optFuncs []Option) *Transaction {
+	t := &Transaction{
+		baseDir:        "",
+		userstoreDir:   "",
+		out:            os.Stdout,
+		regenerateMenu: nil,
+		hook:           nil,
+		dir:            "",
+		lock:           nil,
+		journal:        nil,
+		add:            nil,
+		rm:             nil,
+		staged:         map[string]*state.InstalledPackage{},
+		request:        nil,
+		forget:         nil,
+		keep:           false,
+	}
+	for _, o := range optFuncs {
+		o(t)
+	}
+	if t.baseDir == "" {
+		t.baseDir = version.BaseDir()
+	}
+	if t.userstoreDir == "" {
+		t.userstoreDir = version.UserstoreDir()
+	}
+	t.dir = filepath.Join(t.baseDir, Dir)
+	return t
+}
+
+// New starts a transaction, creating its working directory. Only one transaction can run at a
+// time, so New fails with ErrInProgress if another process holds the lock, or the directory
+// exists. The transaction must be closed.
+func New(optFuncs ...Option) (*Transaction, error) {
+	t := newTransaction(optFuncs)
+	err := os.MkdirAll(t.baseDir, 0o755) //nolint:gosec
+	if err != nil {
+		return nil, errors.AddStack(err)
+	}
+	t.lock, err = tryLock(t.baseDir)
+	if errors.Cause(err) == ErrRunning { //nolint:errorlint // pingcap/errors has no Is()
+		return nil, errors.Annotate(ErrInProgress, ErrRunning.Error())
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = t.create()
+	if err != nil {
+		_ = t.lock.unlock()
+		return nil, err
+	}
+	return t, nil
+}
+
+func (t *Transaction) create() error {
+	err := os.Mkdir(t.dir, 0o755) //nolint:gosec
+	if os.IsExist(err) {
+		return errors.Annotatef(ErrInProgress, "%s exists", t.dir)
+	}
+	if err != nil {
+		return errors.AddStack(err)
+	}
+	for _, d := range []string{stagingDir, backupDir} {
+		err := os.Mkdir(filepath.Join(t.dir, d), 0o755) //nolint:gosec
+		if err != nil {
+			_ = os.RemoveAll(t.dir)
+			return errors.AddStack(err)
+		}
+	}
+	t.journal, err = openJournal(t.dir, t.hook)
+	if err != nil {
+		_ = os.RemoveAll(t.dir)
+		return err
+	}
+	return nil
+}
+
+// PackageDir is where package id is installed.
+func (t *Transaction) PackageDir(id string) string {
+	return filepath.Join(t.baseDir, "pkgs", id)
+}
+
+// Add stages package id to be installed: fill is given an empty directory to put its files in,
+// and returns where the package came from, for the installed-package database, or nil if that's
+// unknown. Packages are installed in the order they're added, so dependencies should come first.
+func (t *Transaction) Add(id string, fill func(dir string) (*state.Origin, error)) error {
+	if slices.Contains(t.add, id) {
+		return errors.Errorf("%s is already being installed", id)
+	}
+	err := t.journal.write(Entry{Op: OpStage, ID: id}) //nolint:exhaustruct
+	if err != nil {
+		return err
+	}
+	dir := filepath.Join(t.dir, stagingDir, id)
+	err = os.Mkdir(dir, 0o755) //nolint:gosec
+	if err != nil {
+		return errors.AddStack(err)
+	}
+	origin, err := fill(dir)
+	if err != nil {
+		return errors.Annotatef(err, "staging %s", id)
+	}
+	p, err := state.ScanPackage(dir)
+	if err != nil {
+		return errors.Annotatef(err, "staging %s", id)
+	}
+	if p.Manifest.ID != id {
+		return errors.Errorf("staging %s: its manifest has ID %q", id, p.Manifest.ID)
+	}
+	if origin != nil {
+		p.Origin = *origin
+	}
+	err = t.journal.write(Entry{Op: OpStage, ID: id, Done: true}) //nolint:exhaustruct
+	if err != nil {
+		return err
+	}
+	t.add = append(t.add, id)
+	t.staged[id] = p
+	return nil
+}
+
+// Remove marks installed package id to be uninstalled. Packages are uninstalled in the order
+// they're removed, before any are installed; replacing a package means removing and adding it.
+func (t *Transaction) Remove(id string) error {
+	if slices.Contains(t.rm, id) {
+		return errors.Errorf("%s is already being removed", id)
+	}
+	_, err := os.Stat(t.PackageDir(id))
+	if err != nil {
+		return errors.Annotatef(err, "%s is not installed", id)
+	}
+	t.rm = append(t.rm, id)
+	return nil
+}
+
+// Request adds c to the world set, the packages that were asked for, when the transaction commits.
+func (t *Transaction) Request(c state.Constraint) {
+	t.request = append(t.request, c)
+}
+
+// Forget takes package id out of the world set when the transaction commits, so it's kept only
+// while other packages depend on it.
+func (t *Transaction) Forget(id string) {
+	t.forget = append(t.forget, id)
+}
+
+// Commit uninstalls the removed packages, then installs the added ones, and records them in the
+// installed-package database. If anything fails, the changes made so far are rolled back, and the
+// error is returned. If ctx is canceled, Commit stops as if the device had crashed, and the
+// transaction is left for Recover.
+func (t *Transaction) Commit(ctx context.Context) error {
+	err := os.MkdirAll(filepath.Join(t.baseDir, "pkgs"), 0o755) //nolint:gosec
+	if err == nil {
+		err = t.prepareDB()
+	}
+	if err == nil {
+		err = t.journal.write(Entry{Op: OpCommit, ID: "", Undo: false, Done: false, Add: t.add, Remove: t.rm})
+	}
+	if err == nil {
+		err = t.forward(ctx)
+	}
+	if err != nil {
+		return t.failed(ctx, err)
+	}
+	return nil
+}
+
+// plan is the steps of committing, in order.
+func (t *Transaction) plan() []step {
+	var steps []step
+	for _, id := range t.rm {
+		steps = append(steps, step{OpUninstall, id}, step{OpBackup, id})
+	}
+	for _, id := range t.add {
+		steps = append(steps, step{OpMoveIn, id}, step{OpInstall, id})
+	}
+	return append(steps, step{OpDatabase, ""})
+}
+
+// prepareDB writes the database as it is before committing and as it will be after, so either
+// can be put in place by rolling forward or back, even after a crash.
+func (t *Transaction) prepareDB() error {
+	db, err := state.LoadDB(t.baseDir)
+	if err != nil {
+		return err
+	}
+	err = db.Save(filepath.Join(t.dir, oldDBFile))
+	if err != nil {
+		return err
+	}
+	now := time.Now().UTC()
+	for _, id := range t.rm {
+		db.Remove(id)
+	}
+	for _, id := range t.add {
+		p := t.staged[id]
+		p.InstalledAt = now
+		db.Install(p)
+	}
+	for _, c := range t.request {
+		db.Request(c)
+	}
+	for _, id := range t.forget {
+		db.Forget(id)
+	}
+	return db.Save(filepath.Join(t.dir, newDBFile))
+}
+
+// putDB replaces the installed-package database with one prepared by prepareDB.
+func (t *Transaction) putDB(name string) error {
+	db, err := state.ReadDB(filepath.Join(t.dir, name))
+	if err != nil {
+		return err
+	}
+	return db.Save(state.DBPath(t.baseDir))
+}
+
+// forward does the steps of committing that haven't been done yet, then regenerates the menu. A
+// step that was started but not finished is done again.
+func (t *Transaction) forward(ctx context.Context) error {
+	for _, s := range t.plan() {
+		if t.journal.has(s, false, true) {
+			continue
+		}
+		err := t.do(ctx, s)
+		if err != nil {
+			return err
+		}
+	}
+	err := t.journal.write(Entry{Op: OpCommit, ID: "", Undo: false, Done: true, Add: nil, Remove: nil})
+	if err != nil {
+		return err
+	}
+	// the packages are changed by now, so this can only be warned about
+	err = t.updateMenu()
+	if err != nil {
+		slog.Warn("failed to regenerate the KUAL menu", "err", err)
+	}
+	return nil
+}
+
+func (t *Transaction) do(ctx context.Context, s step) error {
+	err := ctx.Err()
+	if err != nil {
+		return errors.AddStack(err)
+	}
+	err = t.journal.write(Entry{Op: s.op, ID: s.id}) //nolint:exhaustruct
+	if err != nil {
+		return err
+	}
+	switch s.op { //nolint:exhaustive
+	case OpUninstall:
+		err = t.runScript(ctx, s.id, "uninstall.sh", true)
+	case OpBackup:
+		err = move(t.PackageDir(s.id), filepath.Join(t.dir, backupDir, s.id))
+	case OpMoveIn:
+		err = move(filepath.Join(t.dir, stagingDir, s.id), t.PackageDir(s.id))
+	case OpInstall:
+		err = t.runScript(ctx, s.id, "install.sh", false)
+	case OpDatabase:
+		err = t.putDB(newDBFile)
+	default:
+		err = errors.Errorf("unexpected step %s", s.op)
+	}
+	if err != nil {
+		return errors.Annotatef(err, "%s %s", s.op, s.id)
+	}
+	return t.journal.write(Entry{Op: s.op, ID: s.id, Done: true}) //nolint:exhaustruct
+}
+
+// move renames src to dst, unless that was already done before the transaction was interrupted.
+func move(src, dst string) error {
+	_, srcErr := os.Lstat(src)
+	_, dstErr := os.Lstat(dst)
+	if os.IsNotExist(srcErr) && dstErr == nil {
+		return nil
+	}
+	return errors.AddStack(os.Rename(src, dst))
+}
+
+func (t *Transaction) updateMenu() error {
+	if t.regenerateMenu == nil {
+		return nil
+	}
+	err := t.journal.write(Entry{Op: OpMenu}) //nolint:exhaustruct
+	if err != nil {
+		return err
+	}
+	err = t.regenerateMenu()
+	if err != nil {
+		return err
+	}
+	return t.journal.write(Entry{Op: OpMenu, Done: true}) //nolint:exhaustruct
+}
+
+// failed handles err from committing or rolling forward: the changes are rolled back, unless ctx
+// was canceled, in which case everything is left for Recover.
+func (t *Transaction) failed(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		t.keep = true
+		return errors.Annotatef(err, "interrupted; run `%s recover` to finish or undo the changes", version.CLIName)
+	}
+	fmt.Fprintf(t.out, "\033[1mRolling back changes:\033[0m %v\n", err) //nolint:errcheck
+	rerr := t.backward(context.WithoutCancel(ctx))
+	if rerr != nil {
+		t.keep = true
+		return errors.Annotatef(err, "rolling back also failed, backups are in %s: %v", t.dir, rerr)
+	}
+	return err
+}
+
+// backward undoes the steps that were started, most recent first, and that haven't been undone
+// yet. Scripts are run to undo what their counterparts did, but their failures are only logged,
+// as there's nothing else to try.
+func (t *Transaction) backward(ctx context.Context) error {
+	if !t.journal.has(step{OpRollback, ""}, false, false) {
+		err := t.journal.write(Entry{Op: OpRollback}) //nolint:exhaustruct
+		if err != nil {
+			return err
+		}
+	}
+	var errs []string
+	for _, s := range slices.Backward(t.journal.started()) {
+		if t.journal.has(s, true, true) {
+			continue
+		}
+		// scripts that didn't run because of ctx mustn't be taken as undone
+		if ctx.Err() != nil {
+			return errors.AddStack(ctx.Err())
+		}
+		err := t.undo(ctx, s)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("undoing %s %s: %v", s.op, s.id, err))
+			continue
+		}
+		err = t.journal.write(Entry{Op: s.op, ID: s.id, Undo: true, Done: true}) //nolint:exhaustruct
+		if err != nil {
+			return err
+		}
+	}
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	err := t.journal.write(Entry{Op: OpRollback, Done: true}) //nolint:exhaustruct
+	if err != nil {
+		return err
+	}
+	// the menu only needs putting back if it was changed
+	if t.journal.has(step{OpMenu, ""}, false, false) {
+		err := t.updateMenu()
+		if err != nil {
+			slog.Warn("failed to regenerate the KUAL menu", "err", err)
+		}
+	}
+	return nil
+}
+
+func (t *Transaction) undo(ctx context.Context, s step) error {
+	switch s.op { //nolint:exhaustive
+	case OpDatabase:
+		return t.putDB(oldDBFile)
+	case OpInstall:
+		err := t.runScript(ctx, s.id, "uninstall.sh", false)
+		if err != nil {
+			slog.Warn("uninstall script failed while rolling back", "id", s.id, "err", err)
+		}
+	case OpMoveIn:
+		// only if it was moved in; otherwise, it's still in staging/ and there's nothing to undo
+		_, err := os.Lstat(filepath.Join(t.dir, stagingDir, s.id))
+		if os.IsNotExist(err) {
+			return errors.AddStack(os.RemoveAll(t.PackageDir(s.id)))
+		}
+	case OpBackup:
+		return move(filepath.Join(t.dir, backupDir, s.id), t.PackageDir(s.id))
+	case OpUninstall:
+		err := t.runScript(ctx, s.id, "install.sh", false)
+		if err != nil {
+			slog.Warn("install script failed while rolling back", "id", s.id, "err", err)
+		}
+	}
+	return nil
+}
+
+// runScript runs one of package id's scripts in its directory, with /bin/sh as the scripts may
+// not be executable on the userstore. A missing script is an error only if it's required.
+func (t *Transaction) runScript(ctx context.Context, id, name string, required bool) error {
+	dir := t.PackageDir(id)
+	script := filepath.Join(dir, name)
+	_, err := os.Stat(script)
+	if os.IsNotExist(err) && !required {
+		slog.Debug("no script for package", "id", id, "script", name)
+		return nil
+	}
+
+	fmt.Fprintf(t.out, "Running %s for %s\n", name, id) //nolint:errcheck
+	cmd := exec.CommandContext(ctx, "/bin/sh", "-l", script)
+	cmd.Env = append(cmd.Env, os.Environ()...)
+	cmd.Env = append(cmd.Env, "KPM_INSTALL_DIR="+dir)
+	cmd.Env = append(cmd.Env, "KPM_BASE_DIR="+t.baseDir)
+	cmd.Env = append(cmd.Env, "KPM_USERSTORE_DIR="+t.userstoreDir)
+	cmd.Dir = dir
+	cmd.Stdout = t.out
+	cmd.Stderr = t.out
+	err = cmd.Run()
+	if err != nil {
+		return errors.Annotatef(err, "%s for %s", name, id)
+	}
+	return nil
+}
+
+// Close removes the transaction's working directory, with anything staged that wasn't committed.
+// If the transaction was interrupted or rolling back failed, it's left for Recover.
+func (t *Transaction) Close() error {
+	// the lock is only released once the directory is gone, or left for Recover
+	defer func() { _ = t.lock.unlock() }()
+	err := t.journal.Close()
+	if err != nil {
+		return err
+	}
+	if t.keep {
+		return nil
+	}
+	return errors.AddStack(os.RemoveAll(t.dir))
+}
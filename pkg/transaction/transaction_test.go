@@ -0,0 +1,323 @@
+package transaction_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/fs"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/clintharrison/go-kindle-pkg/pkg/state"
+	"github.com/clintharrison/go-kindle-pkg/pkg/transaction"
+	"github.com/pingcap/errors"
+	"github.com/stretchr/testify/require"
+)
+
+// writePackage writes a package whose scripts log to the userstore, and whose install.sh fails
+// if failInstall is set.
+func writePackage(t *testing.T, dir, id, ver string, failInstall bool) {
+	t.Helper()
+	install := "#!/bin/sh\necho install " + id + " " + ver + " >>\"$KPM_USERSTORE_DIR/log\"\n"
+	if failInstall {
+		install += "exit 1\n"
+	}
+	files := map[string]string{
+		"manifest.json": `{"id": "` + id + `", "version": [` + strings.ReplaceAll(ver, ".", ", ") + `]}`,
+		"install.sh":    install,
+		"uninstall.sh":  "#!/bin/sh\necho uninstall " + id + " " + ver + " >>\"$KPM_USERSTORE_DIR/log\"\n",
+	}
+	for name, content := range files {
+		require.NoError(t, os.MkdirAll(dir, 0o755))
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644)) //nolint:gosec
+	}
+}
+
+// snapshot reads every file under dir.
+func snapshot(t *testing.T, dir string) map[string]string {
+	t.Helper()
+	files := map[string]string{}
+	require.NoError(t, filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		data, err := os.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		files[rel] = string(data)
+		return err
+	}))
+	return files
+}
+
+// stage returns a fill function for Transaction.Add that writes a package from the test repository.
+func stage(t *testing.T, id, ver string, failInstall bool) func(string) (*state.Origin, error) {
+	t.Helper()
+	return func(dir string) (*state.Origin, error) {
+		writePackage(t, dir, id, ver, failInstall)
+		return &state.Origin{RepositoryID: "test", SHA256: "sum-" + id}, nil
+	}
+}
+
+// installedVersions reads the installed-package database.
+func installedVersions(t *testing.T, baseDir string) map[string]string {
+	t.Helper()
+	db, err := state.LoadDB(baseDir)
+	require.NoError(t, err)
+	versions := map[string]string{}
+	for id, p := range db.Packages {
+		versions[id] = p.Manifest.Version.String()
+	}
+	return versions
+}
+
+func setup(t *testing.T, installed ...string) (string, string) {
+	t.Helper()
+	baseDir := t.TempDir()
+	userstore := t.TempDir()
+	for _, id := range installed {
+		writePackage(t, filepath.Join(baseDir, "pkgs", id), id, "1.0.0", false)
+	}
+	return baseDir, userstore
+}
+
+func readLog(t *testing.T, userstore string) []string {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join(userstore, "log"))
+	require.NoError(t, err)
+	return strings.Split(strings.TrimSpace(string(data)), "\n")
+}
+
+func TestCommit(t *testing.T) {
+	t.Parallel()
+	baseDir, userstore := setup(t, "a", "b")
+
+	tx, err := transaction.New(transaction.WithBaseDir(baseDir), transaction.WithUserstoreDir(userstore),
+		transaction.WithOutput(&bytes.Buffer{}))
+	require.NoError(t, err)
+	require.NoError(t, tx.Remove("a"))
+	for _, id := range []string{"a", "c"} {
+		require.NoError(t, tx.Add(id, stage(t, id, "2.0.0", false)))
+	}
+	tx.Request(state.Constraint{ID: "a", Min: nil, Max: nil})
+	require.NoError(t, tx.Commit(t.Context()))
+	require.NoError(t, tx.Close())
+
+	require.Equal(t, []string{"uninstall a 1.0.0", "install a 2.0.0", "install c 2.0.0"}, readLog(t, userstore))
+	require.Contains(t, snapshot(t, baseDir)["pkgs/a/install.sh"], "2.0.0")
+	require.Contains(t, snapshot(t, baseDir)["pkgs/b/install.sh"], "1.0.0")
+	require.FileExists(t, filepath.Join(baseDir, "pkgs", "c", "manifest.json"))
+	require.NoDirExists(t, filepath.Join(baseDir, transaction.Dir))
+
+	// b was installed before there was a database, so it's imported with an unknown origin, and
+	// taken to have been asked for
+	db, err := state.ReadDB(state.DBPath(baseDir))
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"a": "2.0.0", "b": "1.0.0", "c": "2.0.0"}, installedVersions(t, baseDir))
+	require.Equal(t, state.Origin{RepositoryID: "test", SHA256: "sum-a"}, db.Packages["a"].Origin)
+	require.Equal(t, state.Origin{RepositoryID: "test", SHA256: "sum-c"}, db.Packages["c"].Origin)
+	require.Equal(t, state.UnknownRepositoryID, db.Packages["b"].RepositoryID)
+	require.True(t, db.Packages["a"].Explicit)
+	require.True(t, db.Packages["b"].Explicit)
+	require.False(t, db.Packages["c"].Explicit)
+	require.Equal(t, []state.Constraint{{ID: "a", Min: nil, Max: nil}, {ID: "b", Min: nil, Max: nil}}, db.World)
+	require.Equal(t, []string{"install.sh", "manifest.json", "uninstall.sh"}, db.Packages["c"].Files)
+}
+
+func TestCommit_Rollback(t *testing.T) {
+	t.Parallel()
+	baseDir, userstore := setup(t, "a", "b", "untouched")
+	before := snapshot(t, filepath.Join(baseDir, "pkgs"))
+
+	tx, err := transaction.New(transaction.WithBaseDir(baseDir), transaction.WithUserstoreDir(userstore),
+		transaction.WithOutput(&bytes.Buffer{}))
+	require.NoError(t, err)
+	require.NoError(t, tx.Remove("a"))
+	require.NoError(t, tx.Remove("b"))
+	for _, id := range []string{"a", "b", "c"} {
+		require.NoError(t, tx.Add(id, stage(t, id, "2.0.0", id == "b")))
+	}
+	err = tx.Commit(t.Context())
+	require.ErrorContains(t, err, "install.sh for b")
+	require.NoError(t, tx.Close())
+
+	// the new packages' scripts are undone, and the old ones' install scripts re-run
+	require.Equal(t, []string{
+		"uninstall a 1.0.0",
+		"uninstall b 1.0.0",
+		"install a 2.0.0",
+		"install b 2.0.0",
+		"uninstall b 2.0.0",
+		"uninstall a 2.0.0",
+		"install b 1.0.0",
+		"install a 1.0.0",
+	}, readLog(t, userstore))
+	require.Equal(t, before, snapshot(t, filepath.Join(baseDir, "pkgs")))
+	require.NoDirExists(t, filepath.Join(baseDir, transaction.Dir))
+	require.Equal(t, map[string]string{"a": "1.0.0", "b": "1.0.0", "untouched": "1.0.0"}, installedVersions(t, baseDir))
+}
+
+func TestNew_InProgress(t *testing.T) {
+	t.Parallel()
+	baseDir, userstore := setup(t, "a")
+	before := snapshot(t, baseDir)
+
+	tx, err := transaction.New(transaction.WithBaseDir(baseDir), transaction.WithUserstoreDir(userstore))
+	require.NoError(t, err)
+	_, err = transaction.New(transaction.WithBaseDir(baseDir), transaction.WithUserstoreDir(userstore))
+	require.Equal(t, transaction.ErrInProgress, errors.Cause(err))
+
+	// a package that fails to stage leaves nothing behind once the transaction is closed
+	err = tx.Add("b", func(dir string) (*state.Origin, error) {
+		writePackage(t, dir, "b", "1.0.0", false)
+		return nil, errors.New("download failed")
+	})
+	require.ErrorContains(t, err, "download failed")
+	require.Error(t, tx.Remove("missing"))
+	require.NoError(t, tx.Close())
+	require.Equal(t, before, snapshot(t, baseDir))
+}
+
+func TestRecover_Running(t *testing.T) {
+	t.Parallel()
+	baseDir, userstore := setup(t, "a")
+	opts := []transaction.Option{
+		transaction.WithBaseDir(baseDir), transaction.WithUserstoreDir(userstore), transaction.WithOutput(&bytes.Buffer{}),
+	}
+	tx, err := transaction.New(opts...)
+	require.NoError(t, err)
+	require.NoError(t, tx.Add("b", stage(t, "b", "1.0.0", false)))
+
+	// a running transaction's directory looks just like an interrupted one's, but is locked
+	_, err = transaction.Interrupted(opts...)
+	require.Equal(t, transaction.ErrRunning, errors.Cause(err))
+	require.Equal(t, transaction.ErrRunning, errors.Cause(transaction.Recover(t.Context(), false, opts...)))
+	require.DirExists(t, filepath.Join(baseDir, transaction.Dir, "staging", "b"))
+
+	require.NoError(t, tx.Commit(t.Context()))
+	require.NoError(t, tx.Close())
+	s, err := transaction.Interrupted(opts...)
+	require.NoError(t, err)
+	require.Nil(t, s)
+	require.Equal(t, map[string]string{"a": "1.0.0", "b": "1.0.0"}, installedVersions(t, baseDir))
+}
+
+// listMenu stands in for regenerating the KUAL menu: it lists the installed packages.
+func listMenu(baseDir, userstore string) func() error {
+	return func() error {
+		entries, err := os.ReadDir(filepath.Join(baseDir, "pkgs"))
+		if err != nil {
+			return err
+		}
+		var ids []string
+		for _, e := range entries {
+			ids = append(ids, e.Name())
+		}
+		return os.WriteFile(filepath.Join(userstore, "menu"), []byte(strings.Join(ids, " ")), 0o644) //nolint:gosec
+	}
+}
+
+// interruptedCommit replaces a with a new version and adds c, as in TestCommit, but cancels the
+// context once the journal has n entries, as if the device crashed then.
+func interruptedCommit(t *testing.T, baseDir, userstore string, n int) int {
+	t.Helper()
+	ctx, cancel := context.WithCancel(t.Context())
+	defer cancel()
+	written := 0
+	opts := []transaction.Option{
+		transaction.WithBaseDir(baseDir), transaction.WithUserstoreDir(userstore),
+		transaction.WithOutput(&bytes.Buffer{}), transaction.WithMenu(listMenu(baseDir, userstore)),
+		transaction.WithJournalHook(func(transaction.Entry) {
+			written++
+			if written == n {
+				cancel()
+			}
+		}),
+	}
+	tx, err := transaction.New(opts...)
+	require.NoError(t, err)
+	require.NoError(t, tx.Remove("a"))
+	for _, id := range []string{"a", "c"} {
+		require.NoError(t, tx.Add(id, stage(t, id, "2.0.0", false)))
+	}
+	err = tx.Commit(ctx)
+	if err != nil {
+		require.ErrorContains(t, err, "recover")
+	}
+	require.NoError(t, tx.Close())
+	return written
+}
+
+func TestRecover(t *testing.T) {
+	t.Parallel()
+	baseDir, userstore := setup(t, "a", "b")
+	before := snapshot(t, filepath.Join(baseDir, "pkgs"))
+	total := interruptedCommit(t, baseDir, userstore, 0)
+	after := snapshot(t, filepath.Join(baseDir, "pkgs"))
+	require.NotEqual(t, before, after)
+
+	for n := 1; n <= total; n++ {
+		for _, forward := range []bool{false, true} {
+			t.Run(fmt.Sprintf("entry %d forward %t", n, forward), func(t *testing.T) {
+				t.Parallel()
+				baseDir, userstore := setup(t, "a", "b")
+				interruptedCommit(t, baseDir, userstore, n)
+				opts := []transaction.Option{
+					transaction.WithBaseDir(baseDir), transaction.WithUserstoreDir(userstore),
+					transaction.WithOutput(&bytes.Buffer{}), transaction.WithMenu(listMenu(baseDir, userstore)),
+				}
+				s, err := transaction.Interrupted(opts...)
+				require.NoError(t, err)
+				want := before
+				switch {
+				case s == nil:
+					// the crash was after the commit was finished
+					want = after
+				case forward && !s.CanRollForward():
+					require.Error(t, transaction.Recover(t.Context(), forward, opts...))
+					require.NoError(t, transaction.Recover(t.Context(), false, opts...))
+				default:
+					require.NoError(t, transaction.Recover(t.Context(), forward, opts...))
+					if forward {
+						want = after
+					}
+				}
+
+				require.Equal(t, want, snapshot(t, filepath.Join(baseDir, "pkgs")))
+				require.NoDirExists(t, filepath.Join(baseDir, transaction.Dir))
+				// the database matches pkgs/, if it was written at all
+				db, err := state.ReadDB(state.DBPath(baseDir))
+				if !os.IsNotExist(errors.Cause(err)) {
+					require.NoError(t, err)
+					ids := map[string]bool{}
+					for id := range db.Packages {
+						ids[id] = true
+					}
+					require.Equal(t, packageIDs(want), ids)
+				}
+				// the menu is regenerated if the packages were changed, and only then
+				menu, err := os.ReadFile(filepath.Join(userstore, "menu"))
+				if os.IsNotExist(err) {
+					require.Equal(t, before, want)
+				} else {
+					require.NoError(t, err)
+					require.Equal(t, strings.Join(slices.Sorted(maps.Keys(packageIDs(want))), " "), string(menu))
+				}
+			})
+		}
+	}
+}
+
+func packageIDs(files map[string]string) map[string]bool {
+	ids := map[string]bool{}
+	for p := range files {
+		ids[strings.Split(filepath.ToSlash(p), "/")[0]] = true
+	}
+	return ids
+}
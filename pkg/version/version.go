@@ -7,17 +7,23 @@ import (
 
 const (
 	CLIName     = "kpmgo"
-	baseDir     = "/mnt/us/kpm"
 	FullVersion = CLIName + " v" + Version
 	Version     = "0.0.1"
 )
 
+// On a Kindle, the userstore is the FAT partition that's exported over USB, and kpmgo keeps its
+// packages in a directory on it.
+const (
+	KindleUserstoreDir = "/mnt/us"
+	KindleBaseDir      = KindleUserstoreDir + "/kpm"
+)
+
 var logged = false //nolint:gochecknoglobals
 
 func BaseDir() string {
 	hostname, err := os.Hostname()
 	if err == nil && hostname == "kindle" {
-		return baseDir
+		return KindleBaseDir
 	}
 	// for non-Kindle testing, use a temp directory
 	tmpDir := os.TempDir()
@@ -32,10 +38,24 @@ func BaseDir() string {
 func UserstoreDir() string {
 	hostname, err := os.Hostname()
 	if err == nil && hostname == "kindle" {
-		return "/mnt/us"
+		return KindleUserstoreDir
 	}
 	// for non-Kindle testing, use a temp directory
 	dir := BaseDir() + "/userstore"
 	os.MkdirAll(dir, 0o755) //nolint:errcheck,gosec // If this fails, :shrug: we'll find out when writing to it
 	return dir
 }
+
+// DeviceArch returns the architecture packages are installed for: "armhf" on Kindles with the
+// hard-float loader (firmware 5.16.3 and later), "armel" on older ones, and "" anywhere else.
+func DeviceArch() string {
+	hostname, err := os.Hostname()
+	if err != nil || hostname != "kindle" {
+		return ""
+	}
+	_, err = os.Stat("/lib/ld-linux-armhf.so.3")
+	if err == nil {
+		return "armhf"
+	}
+	return "armel"
+}